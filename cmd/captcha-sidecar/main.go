@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"flow2api/internal/browser"
+	"flow2api/internal/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tokenSource is implemented by the browser captcha services
+type tokenSource interface {
+	Initialize() error
+	GetToken(projectID string) (string, error)
+	Close() error
+}
+
+func main() {
+	addr := flag.String("addr", ":8001", "listen address")
+	configPath := flag.String("config", "", "path to setting.toml")
+	mode := flag.String("mode", "browser", "browser or personal")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	authToken := os.Getenv("SIDECAR_TOKEN")
+	if authToken == "" {
+		authToken = cfg.Captcha.SidecarToken
+	}
+
+	var source tokenSource
+	switch *mode {
+	case "browser":
+		source = browser.GetCaptchaService()
+	case "personal":
+		source = browser.GetPersonalCaptchaService()
+	default:
+		log.Fatalf("Unknown mode: %s", *mode)
+	}
+
+	if err := source.Initialize(); err != nil {
+		log.Fatalf("Failed to initialize %s captcha: %v", *mode, err)
+	}
+	defer source.Close()
+
+	app := fiber.New(fiber.Config{
+		AppName:               "Flow2API Captcha Sidecar",
+		DisableStartupMessage: true,
+	})
+
+	app.Get("/health", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+
+	app.Post("/solve", func(c *fiber.Ctx) error {
+		if authToken != "" && c.Get("Authorization") != "Bearer "+authToken {
+			return c.Status(401).JSON(browser.SidecarSolveResponse{Error: "Unauthorized"})
+		}
+
+		var req browser.SidecarSolveRequest
+		if err := c.BodyParser(&req); err != nil || req.ProjectID == "" {
+			return c.Status(400).JSON(browser.SidecarSolveResponse{Error: "project_id is required"})
+		}
+
+		token, err := source.GetToken(req.ProjectID)
+		if err != nil {
+			return c.Status(502).JSON(browser.SidecarSolveResponse{Error: err.Error()})
+		}
+		if token == "" {
+			return c.Status(502).JSON(browser.SidecarSolveResponse{Error: "failed to obtain token"})
+		}
+		return c.JSON(browser.SidecarSolveResponse{Token: token})
+	})
+
+	// Graceful shutdown
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		app.Shutdown()
+	}()
+
+	fmt.Printf("✓ Captcha sidecar (%s) listening on %s\n", *mode, *addr)
+	if err := app.Listen(*addr); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,60 +18,70 @@ import (
 	"flow2api/internal/client"
 	"flow2api/internal/config"
 	"flow2api/internal/database"
+	"flow2api/internal/lifecycle"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
 	"flow2api/internal/services"
+	"flow2api/internal/storage"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 )
 
 func main() {
+	configPath := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "path to setting.toml (env FLOW2API_CONFIG)")
+	dbPath := flag.String("db", "", "path to the SQLite database, overrides database.path")
+	host := flag.String("host", "", "listen host, overrides server.host")
+	port := flag.Int("port", 0, "listen port, overrides server.port")
+	logLevel := flag.String("log-level", "", "debug, info, warn or error, overrides debug.log_level")
+	flag.Parse()
+	config.SetCommandLine(config.CommandLine{Host: *host, Port: *port, DBPath: *dbPath, LogLevel: *logLevel})
+
 	fmt.Println("============================================================")
 	fmt.Println("Flow2API (Go Version) Starting...")
 	fmt.Println("============================================================")
 
 	// Load configuration
-	cfg, err := config.Load("")
+	cfg, err := config.Load(*configPath)
 	if err != nil {
-		log.Printf("Warning: Failed to load config: %v (using defaults)", err)
+		log.Fatalf("Failed to load config: %v", err)
 	}
 
 	// Initialize database
 	db := database.GetInstance()
-	if err := db.Init(""); err != nil {
+	if err := db.Init(cfg.Database.Path); err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
 	// Load configurations from database
-	if adminConfig, err := db.GetAdminConfig(); err == nil {
-		cfg.SetAdminCredentials(adminConfig.Username, adminConfig.Password)
-		cfg.SetAPIKey(adminConfig.APIKey)
-	}
+	applyDatabaseConfig(cfg, db)
 
-	if cacheConfig, err := db.GetCacheConfig(); err == nil {
-		cfg.SetCacheEnabled(cacheConfig.CacheEnabled)
-		cfg.SetCacheTimeout(cacheConfig.CacheTimeout)
-		cfg.SetCacheBaseURL(cacheConfig.CacheBaseURL)
-	}
-
-	if generationConfig, err := db.GetGenerationConfig(); err == nil {
-		cfg.SetImageTimeout(generationConfig.ImageTimeout)
-		cfg.SetVideoTimeout(generationConfig.VideoTimeout)
+	// Environment variables take precedence over settings stored in the database
+	envOverrides, err := cfg.ApplyEnv()
+	if err != nil {
+		log.Fatalf("Failed to apply environment overrides: %v", err)
 	}
-
-	if debugConfig, err := db.GetDebugConfig(); err == nil {
-		cfg.SetDebugEnabled(debugConfig.Enabled)
+	if len(envOverrides) > 0 {
+		log.Printf("Config overridden from environment and flags: %s", strings.Join(envOverrides, ", "))
 	}
+	// The settings above were published as a new configuration
+	cfg = config.Get()
 
-	if captchaConfig, err := db.GetCaptchaConfig(); err == nil {
-		cfg.SetCaptchaMethod(captchaConfig.CaptchaMethod)
+	// Fail fast on bad values, including those overridden from the database
+	if err := cfg.Validate(browser.ValidateBrowserProxyURL); err != nil {
+		log.Fatal(err)
 	}
+	logging.Setup(cfg.Debug, os.Stderr)
 
 	// Get proxy configuration
-	proxyURL := ""
-	if proxyConfig, err := db.GetProxyConfig(); err == nil && proxyConfig.Enabled {
-		proxyURL = proxyConfig.ProxyURL
+	proxyURL := cfg.Proxy.URL
+	if proxyURL == "" {
+		if proxyConfig, err := db.GetProxyConfig(); err == nil && proxyConfig.Enabled {
+			proxyURL = proxyConfig.ProxyURL
+		}
 	}
 
 	// Initialize browser captcha service based on method
@@ -90,30 +105,68 @@ func main() {
 
 	// Initialize services
 	flowClient := client.NewFlowClient(proxyURL)
-	tokenManager := services.NewTokenManager(db, flowClient)
+	events := services.NewEventBus()
+	tokenManager := services.NewTokenManager(db, flowClient, events)
 	concurrencyManager := services.NewConcurrencyManager()
 	loadBalancer := services.NewLoadBalancer(tokenManager, concurrencyManager)
-	generationHandler := services.NewGenerationHandler(flowClient, tokenManager, loadBalancer, db, concurrencyManager)
+	canaryRouter := services.NewCanaryRouter(db)
+	rateLimiter := services.NewRateLimiter(db)
+	ipFilter := services.NewIPFilter(db)
+	generationHandler := services.NewGenerationHandler(flowClient, tokenManager, loadBalancer, db, concurrencyManager, canaryRouter, events)
+	services.RegisterHTTPHooks(generationHandler.Hooks(), cfg.Hooks)
+	workerPool := services.NewWorkerPool(generationHandler, cfg.Generation.ImageWorkers, cfg.Generation.VideoWorkers, cfg.Generation.QueueSize)
+	modelDiscovery := services.NewModelDiscovery(db, flowClient, tokenManager)
+	uploads := services.NewUploadStore(filepath.Join(filepath.Dir(cfg.Database.Path), "uploads"))
+	cacheJanitor := services.NewCacheJanitor(db, services.CacheDir, uploads)
+
+	// Load the model registry and the upstream models enabled by operators
+	if err := modelDiscovery.LoadModels(); err != nil {
+		log.Printf("Warning: Failed to load the model registry: %v", err)
+	}
 
-	// Initialize concurrency limits
+	// Initialize concurrency limits, following token and group edits
 	tokens, _ := tokenManager.GetAllTokens()
 	concurrencyManager.Initialize(tokens)
+	concurrencyManager.WatchTokens(context.Background(), tokenManager, events)
+	concurrencyManager.StartReconciler(time.Minute, generationHandler.TaskFinished)
+	generationHandler.StartTaskWatchdog(time.Minute)
 
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		AppName:      "Flow2API",
 		ServerHeader: "Flow2API",
-		BodyLimit:    50 * 1024 * 1024, // 50MB
+		BodyLimit:    50 * 1024 * 1024,                                       // 50MB
+		ReadTimeout:  time.Duration(cfg.Server.Timeouts.Admin) * time.Second, // request headers
+		IdleTimeout:  time.Duration(cfg.Server.Timeouts.Idle) * time.Second,
+
+		ReadBufferSize:  cfg.Server.ReadBufferSize,
+		WriteBufferSize: cfg.Server.WriteBufferSize,
+
+		// Behind a reverse proxy the IP filters see the client, not the proxy
+		ProxyHeader:             cfg.Server.ProxyHeader,
+		EnableTrustedProxyCheck: cfg.Server.ProxyHeader != "",
+		TrustedProxies:          cfg.Server.TrustedProxies,
+		EnableIPValidation:      true,
 	})
+	// Body read and response write timeouts depend on the route class
+	app.Server().HeaderReceived = api.RouteTimeouts(cfg.Server.Timeouts)
 
-	// Middleware
-	app.Use(logger.New())
+	// Middleware; the request ID is returned as X-Request-ID and carried by
+	// the generation logs of the request
+	app.Use(requestid.New())
+	app.Use(logger.New(logger.Config{
+		Format: "[${time}] ${status} - ${latency} ${method} ${path} ${locals:requestid}\n",
+	}))
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
 		AllowMethods: "GET,POST,PUT,DELETE,OPTIONS",
 		AllowHeaders: "*",
 	}))
 
+	// Client and admin APIs only serve the addresses the security config admits
+	app.Use("/v1", api.IPGuard(ipFilter))
+	app.Use("/api", api.IPGuard(ipFilter))
+
 	// Static files
 	app.Static("/tmp", "./tmp")
 	app.Static("/static", "./static")
@@ -130,45 +183,207 @@ func main() {
 	})
 
 	// API routes
-	apiHandler := api.NewHandler(generationHandler, tokenManager, cfg)
+	federation := services.NewFederation()
+	apiHandler := api.NewHandler(generationHandler, workerPool, tokenManager, federation, rateLimiter, uploads, events, db, cfg)
 	apiHandler.SetupRoutes(app)
 
 	// Admin routes
-	adminHandler := api.NewAdminHandler(tokenManager, db, cfg)
+	adminHandler := api.NewAdminHandler(tokenManager, generationHandler, modelDiscovery, canaryRouter, rateLimiter, ipFilter, cacheJanitor, events, db, cfg)
 	adminHandler.SetupAdminRoutes(app)
 
 	// Start auto-unban task
-	go func() {
-		ticker := time.NewTicker(1 * time.Hour)
-		defer ticker.Stop()
-		for range ticker.C {
-			if err := tokenManager.AutoUnban429Tokens(); err != nil {
-				log.Printf("Auto-unban task error: %v", err)
-			}
-		}
-	}()
+	tokenManager.StartAutoUnban()
+
+	// Start refreshing ATs ahead of expiry
+	tokenManager.StartATRefresh()
+
+	// Start cache cleanup
+	cacheJanitor.Start(5 * time.Minute)
+
+	// Start scheduled self-tests; the setting only takes effect at startup
+	if cfg.SelfTest.Enabled {
+		generationHandler.StartSelfTests(time.Duration(cfg.SelfTest.Interval) * time.Minute)
+	}
+
+	// Start upstream model discovery
+	modelDiscovery.Start(time.Duration(cfg.Flow.ModelDiscoveryInterval) * time.Minute)
+
+	// Start pulling tokens from the primary instance
+	adminHandler.StartTokenSync()
 
 	// Print startup info
 	fmt.Printf("✓ Database initialized\n")
 	fmt.Printf("✓ Total tokens: %d\n", len(tokens))
 	fmt.Printf("✓ Cache: %s (timeout: %ds)\n", map[bool]string{true: "Enabled", false: "Disabled"}[cfg.Cache.Enabled], cfg.Cache.Timeout)
 	fmt.Printf("✓ Captcha method: %s\n", cfg.Captcha.CaptchaMethod)
+	if cfg.Chaos.Enabled {
+		fmt.Printf("⚠ Chaos injection enabled: upstream latency, errors and captcha failures are simulated\n")
+	}
 	fmt.Printf("✓ Server running on http://%s:%d\n", cfg.Server.Host, cfg.Server.Port)
 	fmt.Println("============================================================")
 
-	// Graceful shutdown
-	c := make(chan os.Signal, 1)
+	// Reload setting.toml and the model registry on SIGHUP without dropping
+	// the browser or running generations
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			pending, err := cfg.Reload(func(next *config.Config) { applyDatabaseConfig(next, db) }, browser.ValidateBrowserProxyURL)
+			if err != nil {
+				log.Printf("[CONFIG] Reload failed, keeping current settings: %v", err)
+				continue
+			}
+			logging.Apply(config.Get().Debug)
+			log.Println("[CONFIG] Configuration reloaded")
+			if len(pending) > 0 {
+				log.Printf("[CONFIG] Restart required to apply: %s", strings.Join(pending, ", "))
+			}
+			if err := modelDiscovery.LoadModels(); err != nil {
+				log.Printf("[CONFIG] Model registry reload failed: %v", err)
+			} else {
+				log.Printf("[CONFIG] Model registry reloaded (%d models)", len(models.ListModelConfigs()))
+			}
+		}
+	}()
+
+	// Dump queues, running generations and goroutine stacks on SIGUSR1
+	dump := make(chan os.Signal, 1)
+	notifyDump(dump)
+	go func() {
+		for range dump {
+			workerPool.LogState()
+		}
+	}()
+
+	// Report readiness, then drain running generations on SIGINT/SIGTERM
+	// before stopping the server. A second signal stops immediately.
+	status := lifecycle.NewReporter(cfg.Server.StatusFile)
+	report := func(state string, deadline time.Time) {
+		running, queued := workerPool.Load()
+		if err := status.Update(state, running, queued, deadline); err != nil {
+			log.Printf("[LIFECYCLE] Status update failed: %v", err)
+		}
+	}
+	report(lifecycle.StateStarting, time.Time{})
+	app.Hooks().OnListen(func(fiber.ListenData) error {
+		report(lifecycle.StateReady, time.Time{})
+		return nil
+	})
+
+	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		<-c
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+	ready:
+		for {
+			select {
+			case <-ticker.C:
+				report(lifecycle.StateReady, time.Time{})
+			case <-c:
+				break ready
+			}
+		}
+
 		fmt.Println("\nFlow2API Shutting down...")
+		workerPool.Drain()
+		deadline := time.Now().Add(time.Duration(cfg.Server.DrainTimeout) * time.Second)
+		poll := time.NewTicker(time.Second)
+		defer poll.Stop()
+	drain:
+		for {
+			report(lifecycle.StateDraining, deadline)
+			running, queued := workerPool.Load()
+			if running+queued == 0 {
+				break
+			}
+			if !time.Now().Before(deadline) {
+				log.Printf("[LIFECYCLE] Drain timeout reached, abandoning %d running and %d queued generations", running, queued)
+				break
+			}
+			select {
+			case <-poll.C:
+			case <-c:
+				log.Printf("[LIFECYCLE] Second signal, abandoning %d running and %d queued generations", running, queued)
+				break drain
+			}
+		}
 		app.Shutdown()
 	}()
 
 	// Start server
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
-	if err := app.Listen(addr); err != nil {
+	if err := serve(app, addr, cfg.Server.Listeners); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+	report(lifecycle.StateStopped, time.Time{})
+}
+
+// serve runs the app on addr until it is shut down. With several listeners,
+// each is an SO_REUSEPORT socket on the same address and the kernel spreads
+// new connections across them; they all feed the same server.
+func serve(app *fiber.App, addr string, listeners int) error {
+	if listeners <= 1 {
+		return app.Listen(addr)
+	}
+
+	lns := make([]net.Listener, 0, listeners)
+	for i := 0; i < listeners; i++ {
+		ln, err := listenReusePort(addr)
+		if err != nil {
+			for _, open := range lns {
+				open.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+	log.Printf("[SERVER] Accepting on %d SO_REUSEPORT listeners", listeners)
+
+	// Shutdown closes every listener the server is serving
+	for _, ln := range lns[1:] {
+		go app.Server().Serve(ln)
+	}
+	return app.Listener(lns[0])
+}
+
+// applyDatabaseConfig layers the settings saved in the admin panel over cfg
+func applyDatabaseConfig(cfg *config.Config, db *database.Database) {
+	if adminConfig, err := db.GetAdminConfig(); err == nil {
+		cfg.SetAdminCredentials(adminConfig.Username, adminConfig.Password)
+		cfg.SetAPIKey(adminConfig.APIKey)
+		if adminConfig.PreviousAPIKeyExpires != nil {
+			cfg.SetPreviousAPIKey(adminConfig.PreviousAPIKey, *adminConfig.PreviousAPIKeyExpires)
+		}
+	}
+
+	if cacheConfig, err := db.GetCacheConfig(); err == nil {
+		cfg.SetCacheEnabled(cacheConfig.CacheEnabled)
+		cfg.SetCacheTimeout(cacheConfig.CacheTimeout)
+		cfg.SetCacheBaseURL(cacheConfig.CacheBaseURL)
+		if cacheConfig.StorageBackend != "" {
+			cfg.SetCacheStorage(cacheConfig.StorageBackend, storage.S3ConfigFromDB(cacheConfig))
+		}
+	}
+
+	if generationConfig, err := db.GetGenerationConfig(); err == nil {
+		cfg.SetImageTimeout(generationConfig.ImageTimeout)
+		cfg.SetVideoTimeout(generationConfig.VideoTimeout)
+	}
+	if announcement, err := db.GetAnnouncement(); err == nil && announcement != "" {
+		cfg.SetAnnouncement(announcement)
+	}
+
+	if debugConfig, err := db.GetDebugConfig(); err == nil {
+		cfg.SetDebugEnabled(debugConfig.Enabled)
+		cfg.SetDebugLogging(debugConfig.LogRequests, debugConfig.LogResponses, debugConfig.MaskToken)
+	}
+
+	if captchaConfig, err := db.GetCaptchaConfig(); err == nil {
+		cfg.SetCaptchaMethod(captchaConfig.CaptchaMethod)
+		if captchaConfig.SidecarURL != "" {
+			cfg.SetCaptchaSidecar(captchaConfig.SidecarURL, captchaConfig.SidecarToken)
+		}
+	}
 }
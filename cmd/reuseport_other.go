@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func listenReusePort(addr string) (net.Listener, error) {
+	return nil, fmt.Errorf("server.listeners > 1 needs SO_REUSEPORT, which %s does not support", runtime.GOOS)
+}
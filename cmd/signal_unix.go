@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDump relays SIGUSR1, which asks for a runtime state dump
+func notifyDump(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyDump does nothing: Windows has no SIGUSR1
+func notifyDump(c chan<- os.Signal) {}
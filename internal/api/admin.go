@@ -1,31 +1,70 @@
 package api
 
 import (
+	"bufio"
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"flow2api/internal/config"
 	"flow2api/internal/database"
+	"flow2api/internal/logging"
+	"flow2api/internal/metrics"
+	"flow2api/internal/models"
 	"flow2api/internal/services"
+	"flow2api/internal/storage"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 // AdminHandler handles admin API routes
 type AdminHandler struct {
-	tokenManager *services.TokenManager
-	db           *database.Database
-	cfg          *config.Config
-	adminTokens  sync.Map
+	tokenManager   *services.TokenManager
+	generator      services.Generator
+	modelDiscovery *services.ModelDiscovery
+	canaryRouter   *services.CanaryRouter
+	rateLimiter    *services.RateLimiter
+	ipFilter       *services.IPFilter
+	cacheJanitor   *services.CacheJanitor
+	events         *services.EventBus
+	db             *database.Database
+	cfg            *config.Config
+	sessions       *services.AdminSessions
+	syncMu         sync.Mutex // one token sync at a time
+	importJobs     sync.Map   // job ID -> *tokenImportJob
+	twoFactorMu    sync.Mutex // one TOTP or recovery code check at a time, so none is used twice
+	configMu       sync.Mutex // one config save at a time, so version checks hold
+
+	twoFactorFails map[string]*secondFactorFailures // wrong codes by username; guarded by twoFactorMu
 }
 
 // NewAdminHandler creates a new admin handler
-func NewAdminHandler(tm *services.TokenManager, db *database.Database, cfg *config.Config) *AdminHandler {
+func NewAdminHandler(tm *services.TokenManager, gen services.Generator, md *services.ModelDiscovery, cr *services.CanaryRouter, rl *services.RateLimiter, ipf *services.IPFilter, cj *services.CacheJanitor, events *services.EventBus, db *database.Database, cfg *config.Config) *AdminHandler {
 	return &AdminHandler{
-		tokenManager: tm,
-		db:           db,
-		cfg:          cfg,
+		tokenManager:   tm,
+		generator:      gen,
+		modelDiscovery: md,
+		canaryRouter:   cr,
+		rateLimiter:    rl,
+		ipFilter:       ipf,
+		cacheJanitor:   cj,
+		events:         events,
+		db:             db,
+		cfg:            cfg,
+		sessions:       services.NewAdminSessions(db),
 	}
 }
 
@@ -34,10 +73,21 @@ func (h *AdminHandler) SetupAdminRoutes(app *fiber.App) {
 	// Auth (frontend uses /api/login)
 	app.Post("/api/login", h.Login)
 	app.Post("/api/logout", h.adminAuthMiddleware, h.Logout)
+	app.Post("/api/session/refresh", h.adminAuthMiddleware, h.RefreshSession)
+	app.Get("/api/sessions", h.adminAuthMiddleware, h.GetSessions)
+	app.Delete("/api/sessions/:id", h.adminAuthMiddleware, h.RevokeSession)
+	app.Get("/api/2fa", h.adminAuthMiddleware, h.GetTwoFactor)
+	app.Post("/api/2fa/enroll", h.adminAuthMiddleware, h.EnrollTwoFactor)
+	app.Post("/api/2fa/confirm", h.adminAuthMiddleware, h.ConfirmTwoFactor)
+	app.Post("/api/2fa/disable", h.adminAuthMiddleware, h.DisableTwoFactor)
+	app.Post("/api/2fa/recovery-codes", h.adminAuthMiddleware, h.RegenerateRecoveryCodes)
 
 	// Stats
 	app.Get("/api/stats", h.adminAuthMiddleware, h.GetStats)
 
+	// Live updates (EventSource cannot set headers, so ?token= is accepted too)
+	app.Get("/api/events", h.StreamEvents)
+
 	// Tokens
 	app.Get("/api/tokens", h.adminAuthMiddleware, h.GetTokens)
 	app.Post("/api/tokens", h.adminAuthMiddleware, h.AddToken)
@@ -47,60 +97,207 @@ func (h *AdminHandler) SetupAdminRoutes(app *fiber.App) {
 	app.Post("/api/tokens/:id/disable", h.adminAuthMiddleware, h.DisableToken)
 	app.Post("/api/tokens/:id/refresh-credits", h.adminAuthMiddleware, h.RefreshCredits)
 	app.Post("/api/tokens/:id/refresh-at", h.adminAuthMiddleware, h.RefreshAT)
+	app.Post("/api/tokens/refresh-at-all", h.adminAuthMiddleware, h.RefreshAllAT)
 	app.Post("/api/tokens/import", h.adminAuthMiddleware, h.ImportTokens)
+	app.Get("/api/tokens/import/:id", h.adminAuthMiddleware, h.GetImportJob)
+	app.Get("/api/tokens/export", h.adminAuthMiddleware, h.ExportTokens)
+	app.Post("/api/tokens/sync", h.adminAuthMiddleware, h.SyncTokens)
+
+	// Upstream projects
+	app.Post("/api/projects/cleanup", h.adminAuthMiddleware, h.CleanupProjects)
+	app.Get("/api/tokens/:id/projects", h.adminAuthMiddleware, h.GetTokenProjects)
+	app.Post("/api/tokens/:id/projects", h.adminAuthMiddleware, h.CreateTokenProject)
+	app.Post("/api/tokens/:id/projects/rotate", h.adminAuthMiddleware, h.RotateTokenProject)
+	app.Delete("/api/tokens/:id/projects/:project_id", h.adminAuthMiddleware, h.DeleteTokenProject)
 
 	// Admin config
-	app.Get("/api/admin/config", h.adminAuthMiddleware, h.GetAdminConfig)
-	app.Post("/api/admin/config", h.adminAuthMiddleware, h.UpdateAdminConfig)
+	// Config sections are versioned: reads answer an ETag and saves sending an
+	// outdated If-Match get 409 with the current values
+	adminVersion := h.versionedConfig("admin", h.GetAdminConfig)
+	app.Get("/api/admin/config", h.adminAuthMiddleware, adminVersion, h.GetAdminConfig)
+	app.Post("/api/admin/config", h.adminAuthMiddleware, adminVersion, h.UpdateAdminConfig)
 	app.Post("/api/admin/password", h.adminAuthMiddleware, h.ChangePassword)
 	app.Post("/api/admin/apikey", h.adminAuthMiddleware, h.UpdateAPIKey)
-	app.Post("/api/admin/debug", h.adminAuthMiddleware, h.UpdateDebugConfig)
+	debugVersion := h.versionedConfig("debug", h.GetDebugConfig)
+	app.Get("/api/admin/debug", h.adminAuthMiddleware, debugVersion, h.GetDebugConfig)
+	app.Post("/api/admin/debug", h.adminAuthMiddleware, debugVersion, h.UpdateDebugConfig)
 
 	// Proxy config
-	app.Get("/api/proxy/config", h.adminAuthMiddleware, h.GetProxyConfig)
-	app.Post("/api/proxy/config", h.adminAuthMiddleware, h.UpdateProxyConfig)
+	proxyVersion := h.versionedConfig("proxy", h.GetProxyConfig)
+	app.Get("/api/proxy/config", h.adminAuthMiddleware, proxyVersion, h.GetProxyConfig)
+	app.Post("/api/proxy/config", h.adminAuthMiddleware, proxyVersion, h.UpdateProxyConfig)
 
 	// Cache config
-	app.Get("/api/cache/config", h.adminAuthMiddleware, h.GetCacheConfig)
-	app.Post("/api/cache/config", h.adminAuthMiddleware, h.UpdateCacheConfig)
-	app.Post("/api/cache/enabled", h.adminAuthMiddleware, h.UpdateCacheEnabled)
-	app.Post("/api/cache/base-url", h.adminAuthMiddleware, h.UpdateCacheBaseURL)
+	cacheVersion := h.versionedConfig("cache", h.GetCacheConfig)
+	app.Get("/api/cache/config", h.adminAuthMiddleware, cacheVersion, h.GetCacheConfig)
+	app.Post("/api/cache/config", h.adminAuthMiddleware, cacheVersion, h.UpdateCacheConfig)
+	app.Post("/api/cache/enabled", h.adminAuthMiddleware, cacheVersion, h.UpdateCacheEnabled)
+	app.Post("/api/cache/base-url", h.adminAuthMiddleware, cacheVersion, h.UpdateCacheBaseURL)
+	app.Post("/api/cache/storage", h.adminAuthMiddleware, cacheVersion, h.UpdateCacheStorage)
+	app.Get("/api/cache/stats", h.adminAuthMiddleware, h.GetCacheStats)
+	app.Post("/api/cache/purge", h.adminAuthMiddleware, h.PurgeCache)
+
+	// Share links for cached media; /share/:token is public
+	app.Post("/api/media/:id/share", h.adminAuthMiddleware, h.ShareMedia)
+	app.Get("/share/:token", h.ServeShare)
+	app.Post("/share/:token", h.ServeShare)
+
+	// ZIP of task results by ID or creation date
+	app.Get("/api/media/archive", h.adminAuthMiddleware, h.DownloadArchive)
+	app.Post("/api/media/archive", h.adminAuthMiddleware, h.DownloadArchive)
 
 	// Captcha config
-	app.Get("/api/captcha/config", h.adminAuthMiddleware, h.GetCaptchaConfig)
-	app.Post("/api/captcha/config", h.adminAuthMiddleware, h.UpdateCaptchaConfig)
+	captchaVersion := h.versionedConfig("captcha", h.GetCaptchaConfig)
+	app.Get("/api/captcha/config", h.adminAuthMiddleware, captchaVersion, h.GetCaptchaConfig)
+	app.Post("/api/captcha/config", h.adminAuthMiddleware, captchaVersion, h.UpdateCaptchaConfig)
 
 	// Generation timeout config
-	app.Get("/api/generation/timeout", h.adminAuthMiddleware, h.GetGenerationConfig)
-	app.Post("/api/generation/timeout", h.adminAuthMiddleware, h.UpdateGenerationConfig)
+	generationVersion := h.versionedConfig("generation", h.GetGenerationConfig)
+	app.Get("/api/generation/timeout", h.adminAuthMiddleware, generationVersion, h.GetGenerationConfig)
+	app.Post("/api/generation/timeout", h.adminAuthMiddleware, generationVersion, h.UpdateGenerationConfig)
+	announcementVersion := h.versionedConfig("announcement", h.GetAnnouncement)
+	app.Get("/api/announcement", h.adminAuthMiddleware, announcementVersion, h.GetAnnouncement)
+	app.Put("/api/announcement", h.adminAuthMiddleware, announcementVersion, h.SetAnnouncement)
 
 	// Token auto-refresh config
-	app.Get("/api/token-refresh/config", h.adminAuthMiddleware, h.GetTokenRefreshConfig)
-	app.Post("/api/token-refresh/config", h.adminAuthMiddleware, h.UpdateTokenRefreshConfig)
+	refreshVersion := h.versionedConfig("token_refresh", h.GetTokenRefreshConfig)
+	app.Get("/api/token-refresh/config", h.adminAuthMiddleware, refreshVersion, h.GetTokenRefreshConfig)
+	app.Post("/api/token-refresh/config", h.adminAuthMiddleware, refreshVersion, h.UpdateTokenRefreshConfig)
+	app.Post("/api/token-refresh/enabled", h.adminAuthMiddleware, refreshVersion, h.UpdateTokenRefreshEnabled)
+	banVersion := h.versionedConfig("token_bans", h.GetBanConfig)
+	app.Get("/api/token-bans/config", h.adminAuthMiddleware, banVersion, h.GetBanConfig)
+	app.Post("/api/token-bans/config", h.adminAuthMiddleware, banVersion, h.UpdateBanConfig)
+
+	// Model registry
+	app.Get("/api/models/registry", h.adminAuthMiddleware, h.GetRegistryModels)
+	app.Post("/api/models/registry", h.adminAuthMiddleware, h.AddRegistryModel)
+	app.Put("/api/models/registry/:name", h.adminAuthMiddleware, h.UpdateRegistryModel)
+	app.Delete("/api/models/registry/:name", h.adminAuthMiddleware, h.DeleteRegistryModel)
+	app.Get("/api/models/aliases", h.adminAuthMiddleware, h.GetModelAliases)
+	app.Post("/api/models/aliases", h.adminAuthMiddleware, h.SaveModelAlias)
+	app.Delete("/api/models/aliases/:alias", h.adminAuthMiddleware, h.DeleteModelAlias)
+	app.Put("/api/models/default", h.adminAuthMiddleware, h.SetDefaultModel)
+
+	// Upstream model discovery
+	app.Get("/api/models/discovered", h.adminAuthMiddleware, h.GetDiscoveredModels)
+	app.Post("/api/models/discover", h.adminAuthMiddleware, h.DiscoverModels)
+	app.Post("/api/models/discovered/:key/enable", h.adminAuthMiddleware, h.EnableDiscoveredModel)
+	app.Post("/api/models/discovered/:key/ignore", h.adminAuthMiddleware, h.IgnoreDiscoveredModel)
+
+	// Canary routing
+	app.Get("/api/canary", h.adminAuthMiddleware, h.GetCanaryRules)
+	app.Post("/api/canary", h.adminAuthMiddleware, h.AddCanaryRule)
+	app.Put("/api/canary/:id", h.adminAuthMiddleware, h.UpdateCanaryRule)
+	app.Delete("/api/canary/:id", h.adminAuthMiddleware, h.DeleteCanaryRule)
+
+	// Additional API keys with model allowlists
+	app.Get("/api/keys", h.adminAuthMiddleware, h.GetKeys)
+	app.Get("/api/keys/usage", h.adminAuthMiddleware, h.GetKeyUsage)
+
+	// Usage reports for billing and capacity planning
+	app.Get("/api/usage", h.adminAuthMiddleware, h.GetUsageReport)
+	app.Get("/api/tokens/fairness", h.adminAuthMiddleware, h.GetFairness)
+	app.Post("/api/keys", h.adminAuthMiddleware, h.AddKey)
+	app.Put("/api/keys/:id", h.adminAuthMiddleware, h.UpdateKey)
+	app.Delete("/api/keys/:id", h.adminAuthMiddleware, h.DeleteKey)
+
+	// Token groups reserving tokens for bound keys and models
+	app.Get("/api/token-groups", h.adminAuthMiddleware, h.GetTokenGroups)
+	app.Post("/api/token-groups", h.adminAuthMiddleware, h.AddTokenGroup)
+	app.Put("/api/token-groups/:id", h.adminAuthMiddleware, h.UpdateTokenGroup)
+	app.Delete("/api/token-groups/:id", h.adminAuthMiddleware, h.DeleteTokenGroup)
+
+	// Rate limits
+	app.Get("/api/rate-limits", h.adminAuthMiddleware, h.GetRateLimits)
+	app.Post("/api/rate-limits", h.adminAuthMiddleware, h.SetRateLimit)
+	app.Delete("/api/rate-limits/:model", h.adminAuthMiddleware, h.DeleteRateLimit)
+
+	// IP allowlist, denylist and per-IP rate limit
+	securityVersion := h.versionedConfig("security", h.GetSecurityConfig)
+	app.Get("/api/security", h.adminAuthMiddleware, securityVersion, h.GetSecurityConfig)
+	app.Put("/api/security", h.adminAuthMiddleware, securityVersion, h.UpdateSecurityConfig)
+
+	// Tasks
+	app.Get("/api/tasks/:task_id", h.adminAuthMiddleware, h.GetTask)
 
 	// Logs
 	app.Get("/api/logs", h.adminAuthMiddleware, h.GetLogs)
+
+	// End-to-end generation self-test
+	app.Get("/api/selftest/generation", h.adminAuthMiddleware, h.GetSelfTest)
+	app.Post("/api/selftest/generation", h.adminAuthMiddleware, h.RunSelfTest)
 }
 
 func (h *AdminHandler) adminAuthMiddleware(c *fiber.Ctx) error {
 	auth := c.Get("Authorization")
 	if auth == "" || len(auth) < 8 {
-		return c.Status(401).JSON(fiber.Map{"error": "Missing authorization"})
+		return fail(c, 401, "Missing authorization")
 	}
 
 	token := auth[7:] // Remove "Bearer "
-	if _, ok := h.adminTokens.Load(token); !ok {
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired admin token"})
+	session := h.sessions.Validate(token)
+	if session == nil {
+		return fail(c, 401, "Invalid or expired admin token")
 	}
 
-	c.Locals("adminToken", token)
+	c.Locals("adminSession", session)
 	return c.Next()
 }
 
-func (h *AdminHandler) generateToken() string {
-	bytes := make([]byte, 32)
-	rand.Read(bytes)
-	return "admin-" + hex.EncodeToString(bytes)
+// StreamEvents pushes token and generation events to the dashboard over SSE
+func (h *AdminHandler) StreamEvents(c *fiber.Ctx) error {
+	token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = c.Query("token")
+	}
+	if h.sessions.Validate(token) == nil {
+		return fail(c, 401, "Invalid or expired admin token")
+	}
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	events, unsubscribe := h.events.Subscribe()
+	meter := metrics.StartStream(c.Route().Path, "")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+		defer meter.Done()
+
+		keepalive := time.NewTicker(15 * time.Second)
+		defer keepalive.Stop()
+
+		w.WriteString(": connected\n\n")
+		if w.Flush() != nil {
+			return
+		}
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				meter.Chunk()
+			case <-keepalive.C:
+				// Revoked or expired sessions stop receiving events
+				if !h.sessions.Active(token) {
+					return
+				}
+				w.WriteString(": ping\n\n")
+			}
+			// A failed flush means the dashboard went away
+			if w.Flush() != nil {
+				return
+			}
+		}
+	})
+
+	return nil
 }
 
 // Login handles admin login
@@ -108,35 +305,78 @@ func (h *AdminHandler) Login(c *fiber.Ctx) error {
 	var req struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
+		Code     string `json:"code"` // TOTP or recovery code, when two-factor login is on
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 
 	adminConfig, err := h.db.GetAdminConfig()
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to get admin config"})
+		return fail(c, 500, "Failed to get admin config")
 	}
 
 	if req.Username != adminConfig.Username || req.Password != adminConfig.Password {
-		return c.Status(401).JSON(fiber.Map{"error": "Invalid credentials"})
+		return fail(c, 401, "Invalid credentials")
+	}
+	if status, message, details := h.loginSecondFactor(c, adminConfig, req.Code); status != 0 {
+		return failWith(c, status, message, details)
 	}
 
-	token := h.generateToken()
-	h.adminTokens.Store(token, true)
+	token, session, err := h.sessions.Create(adminConfig.Username, c.IP(), c.Get("User-Agent"))
+	if err != nil {
+		return fail(c, 500, "Failed to create session")
+	}
 
-	return c.JSON(fiber.Map{
-		"success":  true,
-		"token":    token,
-		"username": adminConfig.Username,
-	})
+	return respond(c, SessionToken{Token: token, Username: adminConfig.Username, ExpiresAt: session.ExpiresAt})
 }
 
 // Logout handles admin logout
 func (h *AdminHandler) Logout(c *fiber.Ctx) error {
-	token := c.Locals("adminToken").(string)
-	h.adminTokens.Delete(token)
-	return c.JSON(fiber.Map{"success": true, "message": "Logged out"})
+	session := c.Locals("adminSession").(*models.AdminSession)
+	h.sessions.Revoke(session.ID)
+	return respond(c, Message{Message: "Logged out"})
+}
+
+// RefreshSession replaces the calling session's token with a new one; the
+// old token stops working
+func (h *AdminHandler) RefreshSession(c *fiber.Ctx) error {
+	current := c.Locals("adminSession").(*models.AdminSession)
+	token, session, err := h.sessions.Create(current.Username, c.IP(), c.Get("User-Agent"))
+	if err != nil {
+		return fail(c, 500, "Failed to create session")
+	}
+	h.sessions.Revoke(current.ID)
+
+	return respond(c, SessionToken{Token: token, Username: session.Username, ExpiresAt: session.ExpiresAt})
+}
+
+// GetSessions lists the signed-in admin sessions, marking the caller's
+func (h *AdminHandler) GetSessions(c *fiber.Ctx) error {
+	sessions, err := h.sessions.List()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	current := c.Locals("adminSession").(*models.AdminSession)
+	for _, session := range sessions {
+		session.Current = session.ID == current.ID
+	}
+	return respond(c, SessionList{Sessions: sessions})
+}
+
+// RevokeSession signs out one session, the caller's included
+func (h *AdminHandler) RevokeSession(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fail(c, 400, "Invalid session ID")
+	}
+	if err := h.sessions.Revoke(int64(id)); err != nil {
+		if err == sql.ErrNoRows {
+			return fail(c, 404, "Session not found")
+		}
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, Ack{})
 }
 
 // ChangePassword changes admin password
@@ -147,12 +387,12 @@ func (h *AdminHandler) ChangePassword(c *fiber.Ctx) error {
 		NewPassword string `json:"new_password"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 
 	adminConfig, _ := h.db.GetAdminConfig()
 	if req.OldPassword != adminConfig.Password {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid old password"})
+		return fail(c, 400, "Invalid old password")
 	}
 
 	updates := map[string]interface{}{"password": req.NewPassword}
@@ -161,80 +401,83 @@ func (h *AdminHandler) ChangePassword(c *fiber.Ctx) error {
 	}
 
 	if err := h.db.UpdateAdminConfig(updates); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update password"})
+		return fail(c, 500, "Failed to update password")
 	}
 
-	// Clear all admin tokens
-	h.adminTokens.Range(func(key, _ interface{}) bool {
-		h.adminTokens.Delete(key)
-		return true
-	})
+	// Sign out every session
+	h.sessions.RevokeAll()
 
-	return c.JSON(fiber.Map{"success": true, "message": "Password changed, please re-login"})
+	return respond(c, Message{Message: "Password changed, please re-login"})
 }
 
 // GetTokens returns all tokens
 func (h *AdminHandler) GetTokens(c *fiber.Ctx) error {
-	tokens, err := h.tokenManager.GetAllTokens()
+	tokens, err := h.tokenManager.GetTokensWithStats()
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 
-	var result []fiber.Map
-	for _, t := range tokens {
-		stats, _ := h.tokenManager.GetTokenStats(t.ID)
-
-		item := fiber.Map{
-			"id":                   t.ID,
-			"st":                   t.ST,
-			"at":                   t.AT,
-			"token":                t.AT,
-			"email":                t.Email,
-			"name":                 t.Name,
-			"remark":               t.Remark,
-			"is_active":            t.IsActive,
-			"credits":              t.Credits,
-			"user_paygate_tier":    t.UserPaygateTier,
-			"current_project_id":   t.CurrentProjectID,
-			"current_project_name": t.CurrentProjectName,
-			"image_enabled":        t.ImageEnabled,
-			"video_enabled":        t.VideoEnabled,
-			"image_concurrency":    t.ImageConcurrency,
-			"video_concurrency":    t.VideoConcurrency,
-			"use_count":            t.UseCount,
-			"ban_reason":           t.BanReason,
-		}
-
-		if t.ATExpires != nil {
-			item["at_expires"] = t.ATExpires.Format("2006-01-02T15:04:05Z")
-		}
-		if t.CreatedAt != nil {
-			item["created_at"] = t.CreatedAt.Format("2006-01-02T15:04:05Z")
-		}
-		if t.LastUsedAt != nil {
-			item["last_used_at"] = t.LastUsedAt.Format("2006-01-02T15:04:05Z")
-		}
-		if t.BannedAt != nil {
-			item["banned_at"] = t.BannedAt.Format("2006-01-02T15:04:05Z")
-		}
-
-		if stats != nil {
-			item["stats"] = fiber.Map{
-				"image_count":             stats.ImageCount,
-				"video_count":             stats.VideoCount,
-				"success_count":           stats.SuccessCount,
-				"error_count":             stats.ErrorCount,
-				"today_image_count":       stats.TodayImageCount,
-				"today_video_count":       stats.TodayVideoCount,
-				"today_error_count":       stats.TodayErrorCount,
-				"consecutive_error_count": stats.ConsecutiveErrorCount,
-			}
-		}
-
-		result = append(result, item)
+	var result []*TokenItem
+	for _, ts := range tokens {
+		result = append(result, tokenItem(ts.Token, ts.Stats))
 	}
 
-	return c.JSON(fiber.Map{"tokens": result})
+	return respond(c, TokenList{Tokens: result})
+}
+
+// tokenItem renders a token as the token list shows it
+func tokenItem(t *models.Token, stats *models.TokenStats) *TokenItem {
+	item := &TokenItem{
+		ID:                 t.ID,
+		ST:                 t.ST,
+		AT:                 t.AT,
+		Token:              t.AT,
+		Email:              t.Email,
+		Name:               t.Name,
+		Remark:             t.Remark,
+		IsActive:           t.IsActive,
+		Credits:            t.Credits,
+		UserPaygateTier:    t.UserPaygateTier,
+		CurrentProjectID:   t.CurrentProjectID,
+		CurrentProjectName: t.CurrentProjectName,
+		ImageEnabled:       t.ImageEnabled,
+		VideoEnabled:       t.VideoEnabled,
+		ImageConcurrency:   t.ImageConcurrency,
+		VideoConcurrency:   t.VideoConcurrency,
+		UseCount:           t.UseCount,
+		BanReason:          t.BanReason,
+		GroupID:            t.GroupID,
+		DailyImageLimit:    t.DailyImageLimit,
+		DailyVideoLimit:    t.DailyVideoLimit,
+		Version:            t.Version,
+	}
+
+	if t.ATExpires != nil {
+		item.ATExpires = t.ATExpires.Format("2006-01-02T15:04:05Z")
+	}
+	if t.CreatedAt != nil {
+		item.CreatedAt = t.CreatedAt.Format("2006-01-02T15:04:05Z")
+	}
+	if t.LastUsedAt != nil {
+		item.LastUsedAt = t.LastUsedAt.Format("2006-01-02T15:04:05Z")
+	}
+	if t.BannedAt != nil {
+		item.BannedAt = t.BannedAt.Format("2006-01-02T15:04:05Z")
+	}
+
+	if stats != nil {
+		item.Stats = &TokenItemStats{
+			ImageCount:            stats.ImageCount,
+			VideoCount:            stats.VideoCount,
+			SuccessCount:          stats.SuccessCount,
+			ErrorCount:            stats.ErrorCount,
+			TodayImageCount:       stats.TodayImageCount,
+			TodayVideoCount:       stats.TodayVideoCount,
+			TodayErrorCount:       stats.TodayErrorCount,
+			ConsecutiveErrorCount: stats.ConsecutiveErrorCount,
+		}
+	}
+	return item
 }
 
 // AddToken adds a new token
@@ -248,6 +491,9 @@ func (h *AdminHandler) AddToken(c *fiber.Ctx) error {
 		VideoEnabled     bool   `json:"video_enabled"`
 		ImageConcurrency int    `json:"image_concurrency"`
 		VideoConcurrency int    `json:"video_concurrency"`
+		GroupID          int64  `json:"group_id"`
+		DailyImageLimit  int    `json:"daily_image_limit"`
+		DailyVideoLimit  int    `json:"daily_video_limit"`
 	}
 	req.ImageEnabled = true
 	req.VideoEnabled = true
@@ -255,11 +501,17 @@ func (h *AdminHandler) AddToken(c *fiber.Ctx) error {
 	req.VideoConcurrency = -1
 
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 
 	if req.ST == "" {
-		return c.Status(400).JSON(fiber.Map{"error": "ST is required"})
+		return fail(c, 400, "ST is required")
+	}
+	if err := h.checkTokenGroup(req.GroupID); err != nil {
+		return fail(c, 400, err.Error())
+	}
+	if req.DailyImageLimit < 0 || req.DailyVideoLimit < 0 {
+		return fail(c, 400, "daily limits must not be negative")
 	}
 
 	token, err := h.tokenManager.AddToken(
@@ -267,22 +519,47 @@ func (h *AdminHandler) AddToken(c *fiber.Ctx) error {
 		req.ImageEnabled, req.VideoEnabled, req.ImageConcurrency, req.VideoConcurrency,
 	)
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 400, err.Error())
+	}
+	if req.GroupID != 0 || req.DailyImageLimit != 0 || req.DailyVideoLimit != 0 {
+		if err := h.tokenManager.UpdateToken(token.ID, map[string]interface{}{
+			"group_id":          req.GroupID,
+			"daily_image_limit": req.DailyImageLimit,
+			"daily_video_limit": req.DailyVideoLimit,
+		}); err != nil {
+			return fail(c, 500, err.Error())
+		}
+		token.GroupID = req.GroupID
+		token.DailyImageLimit = req.DailyImageLimit
+		token.DailyVideoLimit = req.DailyVideoLimit
 	}
 
-	return c.JSON(fiber.Map{"success": true, "token": token})
+	return respond(c, TokenResult{Token: token})
 }
 
-// UpdateToken updates a token
+// UpdateToken updates a token. A client that sends the version it loaded,
+// in the body or as If-Match, gets 409 and the current token when another
+// session edited it in between.
 func (h *AdminHandler) UpdateToken(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid token ID"})
+		return fail(c, 400, "Invalid token ID")
 	}
 
 	var req map[string]interface{}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
+	}
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		return fail(c, 400, err.Error())
+	}
+	if v, ok := req["version"]; ok && v != nil {
+		n, ok := v.(float64)
+		if !ok || n < 0 {
+			return fail(c, 400, "version must be a non-negative number")
+		}
+		version = int64(n)
 	}
 
 	updates := make(map[string]interface{})
@@ -310,75 +587,111 @@ func (h *AdminHandler) UpdateToken(c *fiber.Ctx) error {
 	if v, ok := req["video_concurrency"]; ok {
 		updates["video_concurrency"] = v
 	}
+	if v, ok := req["group_id"]; ok {
+		groupID, ok := v.(float64)
+		if !ok && v != nil {
+			return fail(c, 400, "group_id must be a number")
+		}
+		if err := h.checkTokenGroup(int64(groupID)); err != nil {
+			return fail(c, 400, err.Error())
+		}
+		updates["group_id"] = int64(groupID)
+	}
+	for _, field := range []string{"daily_image_limit", "daily_video_limit"} {
+		if v, ok := req[field]; ok {
+			limit, ok := v.(float64)
+			if !ok || limit < 0 {
+				return fail(c, 400, field+" must be a non-negative number")
+			}
+			updates[field] = int(limit)
+		}
+	}
 
-	if err := h.tokenManager.UpdateToken(int64(id), updates); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	newVersion, err := h.tokenManager.EditToken(int64(id), version, updates)
+	if err != nil {
+		if errors.Is(err, services.ErrTokenConflict) {
+			return h.tokenConflict(c, int64(id))
+		}
+		return fail(c, 500, err.Error())
 	}
 
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, VersionResult{Version: newVersion})
+}
+
+// tokenConflict answers 409 with the token as another session left it
+func (h *AdminHandler) tokenConflict(c *fiber.Ctx, id int64) error {
+	token, err := h.db.GetToken(id)
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	stats, _ := h.tokenManager.GetTokenStats(id)
+	return failWith(c, 409, "Token was changed by another session; review the current values and save again", fiber.Map{
+		"version": token.Version,
+		"current": tokenItem(token, stats),
+	})
 }
 
 // DeleteToken deletes a token
 func (h *AdminHandler) DeleteToken(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid token ID"})
+		return fail(c, 400, "Invalid token ID")
 	}
 
 	if err := h.tokenManager.DeleteToken(int64(id)); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
 }
 
 // EnableToken enables a token
 func (h *AdminHandler) EnableToken(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid token ID"})
+		return fail(c, 400, "Invalid token ID")
 	}
 
 	if err := h.tokenManager.EnableToken(int64(id)); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
 }
 
 // DisableToken disables a token
 func (h *AdminHandler) DisableToken(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid token ID"})
+		return fail(c, 400, "Invalid token ID")
 	}
 
 	if err := h.tokenManager.DisableToken(int64(id)); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
 }
 
 // RefreshCredits refreshes token credits
 func (h *AdminHandler) RefreshCredits(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid token ID"})
+		return fail(c, 400, "Invalid token ID")
 	}
 
 	credits, err := h.tokenManager.RefreshCredits(int64(id))
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 
-	return c.JSON(fiber.Map{"success": true, "credits": credits})
+	return respond(c, CreditsResult{Credits: credits})
 }
 
 // Config endpoints
 func (h *AdminHandler) GetProxyConfig(c *fiber.Ctx) error {
 	cfg, _ := h.db.GetProxyConfig()
-	return c.JSON(cfg)
+	return respond(c, cfg)
 }
 
 func (h *AdminHandler) UpdateProxyConfig(c *fiber.Ctx) error {
@@ -387,17 +700,24 @@ func (h *AdminHandler) UpdateProxyConfig(c *fiber.Ctx) error {
 		ProxyURL string `json:"proxy_url"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 	if err := h.db.UpdateProxyConfig(req.Enabled, req.ProxyURL); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
 }
 
 func (h *AdminHandler) GetCacheConfig(c *fiber.Ctx) error {
-	cfg, _ := h.db.GetCacheConfig()
-	return c.JSON(cfg)
+	cfg, err := h.db.GetCacheConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if cfg.StorageBackend == "" {
+		cfg.StorageBackend = config.Get().Cache.Backend
+	}
+	cfg.S3SecretKey = ""
+	return respond(c, cfg)
 }
 
 func (h *AdminHandler) UpdateCacheConfig(c *fiber.Ctx) error {
@@ -407,58 +727,80 @@ func (h *AdminHandler) UpdateCacheConfig(c *fiber.Ctx) error {
 		BaseURL string `json:"cache_base_url"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 	if err := h.db.UpdateCacheConfig(req.Enabled, req.Timeout, req.BaseURL); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 	h.cfg.SetCacheEnabled(req.Enabled)
 	h.cfg.SetCacheTimeout(req.Timeout)
 	h.cfg.SetCacheBaseURL(req.BaseURL)
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
 }
 
 func (h *AdminHandler) GetDebugConfig(c *fiber.Ctx) error {
 	cfg, _ := h.db.GetDebugConfig()
-	return c.JSON(cfg)
+	return respond(c, cfg)
 }
 
+// UpdateDebugConfig switches debug mode; log_requests, log_responses and
+// mask_token keep their stored values when omitted
 func (h *AdminHandler) UpdateDebugConfig(c *fiber.Ctx) error {
 	var req struct {
-		Enabled bool `json:"enabled"`
+		Enabled      bool  `json:"enabled"`
+		LogRequests  *bool `json:"log_requests"`
+		LogResponses *bool `json:"log_responses"`
+		MaskToken    *bool `json:"mask_token"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
-	}
-	if err := h.db.UpdateDebugConfig(req.Enabled); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 400, "Invalid request")
 	}
-	h.cfg.SetDebugEnabled(req.Enabled)
-	return c.JSON(fiber.Map{"success": true})
+	debugConfig, err := h.db.GetDebugConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	debugConfig.Enabled = req.Enabled
+	debugConfig.LogRequests = boolOr(req.LogRequests, debugConfig.LogRequests)
+	debugConfig.LogResponses = boolOr(req.LogResponses, debugConfig.LogResponses)
+	debugConfig.MaskToken = boolOr(req.MaskToken, debugConfig.MaskToken)
+	if err := h.db.UpdateDebugConfig(debugConfig); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.cfg.SetDebugEnabled(debugConfig.Enabled)
+	h.cfg.SetDebugLogging(debugConfig.LogRequests, debugConfig.LogResponses, debugConfig.MaskToken)
+	logging.Apply(config.Get().Debug)
+	return respond(c, Ack{})
 }
 
 func (h *AdminHandler) GetCaptchaConfig(c *fiber.Ctx) error {
 	cfg, _ := h.db.GetCaptchaConfig()
-	return c.JSON(cfg)
+	return respond(c, cfg)
 }
 
 func (h *AdminHandler) UpdateCaptchaConfig(c *fiber.Ctx) error {
 	var req map[string]interface{}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 	if err := h.db.UpdateCaptchaConfig(req); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 	if method, ok := req["captcha_method"].(string); ok {
 		h.cfg.SetCaptchaMethod(method)
 	}
-	return c.JSON(fiber.Map{"success": true})
+	if url, ok := req["sidecar_url"].(string); ok {
+		token := config.Get().Captcha.SidecarToken
+		if t, ok := req["sidecar_token"].(string); ok {
+			token = t
+		}
+		h.cfg.SetCaptchaSidecar(url, token)
+	}
+	return respond(c, Ack{})
 }
 
 func (h *AdminHandler) GetGenerationConfig(c *fiber.Ctx) error {
 	cfg, _ := h.db.GetGenerationConfig()
-	return c.JSON(cfg)
+	return respond(c, cfg)
 }
 
 func (h *AdminHandler) UpdateGenerationConfig(c *fiber.Ctx) error {
@@ -467,23 +809,53 @@ func (h *AdminHandler) UpdateGenerationConfig(c *fiber.Ctx) error {
 		VideoTimeout int `json:"video_timeout"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 	if err := h.db.UpdateGenerationConfig(req.ImageTimeout, req.VideoTimeout); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 	h.cfg.SetImageTimeout(req.ImageTimeout)
 	h.cfg.SetVideoTimeout(req.VideoTimeout)
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
+}
+
+// GetAnnouncement returns the notice currently shown to clients
+func (h *AdminHandler) GetAnnouncement(c *fiber.Ctx) error {
+	return respond(c, Message{Message: h.cfg.GetAnnouncement()})
+}
+
+// SetAnnouncement sets the notice sent at the start of generation streams and
+// in generation errors; an empty message removes it
+func (h *AdminHandler) SetAnnouncement(c *fiber.Ctx) error {
+	var req struct {
+		Message string `json:"message"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if utf8.RuneCountInString(req.Message) > 500 {
+		return fail(c, 400, "message must be at most 500 characters")
+	}
+
+	if err := h.db.SetAnnouncement(req.Message); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.cfg.SetAnnouncement(req.Message)
+	return respond(c, Message{Message: req.Message})
 }
 
 func (h *AdminHandler) GetAdminConfig(c *fiber.Ctx) error {
 	cfg, _ := h.db.GetAdminConfig()
-	return c.JSON(fiber.Map{
-		"username":            cfg.Username,
-		"api_key":             cfg.APIKey,
-		"error_ban_threshold": cfg.ErrorBanThreshold,
-	})
+	resp := AdminConfigView{
+		Username:          cfg.Username,
+		APIKey:            cfg.APIKey,
+		ErrorBanThreshold: cfg.ErrorBanThreshold,
+	}
+	if expires := cfg.PreviousAPIKeyExpires; cfg.PreviousAPIKey != "" && expires != nil && time.Now().Before(*expires) {
+		resp.PreviousAPIKeyExpiresAt = expires
+	}
+	return respond(c, resp)
 }
 
 func (h *AdminHandler) UpdateAdminConfig(c *fiber.Ctx) error {
@@ -491,43 +863,76 @@ func (h *AdminHandler) UpdateAdminConfig(c *fiber.Ctx) error {
 		ErrorBanThreshold int `json:"error_ban_threshold"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 	if err := h.db.UpdateAdminConfig(map[string]interface{}{"error_ban_threshold": req.ErrorBanThreshold}); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
 }
 
 func (h *AdminHandler) UpdateAPIKey(c *fiber.Ctx) error {
 	var req struct {
-		NewAPIKey string `json:"new_api_key"`
+		NewAPIKey   string `json:"new_api_key"`
+		GracePeriod *int   `json:"grace_period"` // seconds; defaults to global.api_key_grace
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
+	}
+	req.NewAPIKey = strings.TrimSpace(req.NewAPIKey)
+	if len(req.NewAPIKey) < 6 {
+		return fail(c, 400, "new_api_key must be at least 6 characters")
+	}
+	grace := config.Get().Global.APIKeyGrace
+	if req.GracePeriod != nil {
+		grace = *req.GracePeriod
+	}
+	if grace < 0 {
+		return fail(c, 400, "grace_period must not be negative")
+	}
+	if existing, err := h.db.GetAPIKeyByKey(req.NewAPIKey); err != nil {
+		return fail(c, 500, err.Error())
+	} else if existing != nil {
+		return fail(c, 400, "new_api_key is already used by an additional key")
+	}
+
+	// The old key stays valid for the grace period so clients can switch
+	// over without an outage
+	previous, expires := h.cfg.RotateAPIKey(req.NewAPIKey, time.Duration(grace)*time.Second)
+	updates := map[string]interface{}{
+		"api_key":                     req.NewAPIKey,
+		"previous_api_key":            previous,
+		"previous_api_key_expires_at": nil,
 	}
-	if err := h.db.UpdateAdminConfig(map[string]interface{}{"api_key": req.NewAPIKey}); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	if !expires.IsZero() {
+		updates["previous_api_key_expires_at"] = expires
 	}
-	h.cfg.SetAPIKey(req.NewAPIKey)
-	return c.JSON(fiber.Map{"success": true})
+	if err := h.db.UpdateAdminConfig(updates); err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	var resp APIKeyRotation
+	if !expires.IsZero() {
+		resp.PreviousAPIKeyExpiresAt = &expires
+	}
+	return respond(c, resp)
 }
 
 // GetStats returns statistics
 func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
-	tokens, _ := h.tokenManager.GetAllTokens()
+	tokens, _ := h.tokenManager.GetTokensWithStats()
+	canaryStats, _ := h.canaryRouter.Stats()
 
 	var totalTokens, activeTokens int
 	var totalImages, totalVideos, totalErrors int
 	var todayImages, todayVideos, todayErrors int
 
 	totalTokens = len(tokens)
-	for _, t := range tokens {
-		if t.IsActive {
+	for _, ts := range tokens {
+		if ts.Token.IsActive {
 			activeTokens++
 		}
-		stats, _ := h.tokenManager.GetTokenStats(t.ID)
-		if stats != nil {
+		if stats := ts.Stats; stats != nil {
 			totalImages += stats.ImageCount
 			totalVideos += stats.VideoCount
 			totalErrors += stats.ErrorCount
@@ -537,15 +942,16 @@ func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
 		}
 	}
 
-	return c.JSON(fiber.Map{
-		"total_tokens":  totalTokens,
-		"active_tokens": activeTokens,
-		"total_images":  totalImages,
-		"total_videos":  totalVideos,
-		"total_errors":  totalErrors,
-		"today_images":  todayImages,
-		"today_videos":  todayVideos,
-		"today_errors":  todayErrors,
+	return respond(c, Stats{
+		TotalTokens:  totalTokens,
+		ActiveTokens: activeTokens,
+		TotalImages:  totalImages,
+		TotalVideos:  totalVideos,
+		TotalErrors:  totalErrors,
+		TodayImages:  todayImages,
+		TodayVideos:  todayVideos,
+		TodayErrors:  todayErrors,
+		Canary:       canaryStats,
 	})
 }
 
@@ -553,61 +959,59 @@ func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
 func (h *AdminHandler) RefreshAT(c *fiber.Ctx) error {
 	id, err := c.ParamsInt("id")
 	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid token ID"})
+		return fail(c, 400, "Invalid token ID")
 	}
 
 	token, err := h.tokenManager.RefreshAT(int64(id))
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"success": false, "detail": err.Error()})
+		return failWith(c, 500, err.Error(), fiber.Map{"detail": err.Error()})
 	}
 
-	result := fiber.Map{
-		"id":    token.ID,
-		"email": token.Email,
-	}
+	result := RefreshedATToken{ID: token.ID, Email: token.Email}
 	if token.ATExpires != nil {
-		result["at_expires"] = token.ATExpires.Format("2006-01-02T15:04:05Z")
+		result.ATExpires = token.ATExpires.Format("2006-01-02T15:04:05Z")
 	}
 
-	return c.JSON(fiber.Map{"success": true, "token": result})
+	return respond(c, RefreshedAT{Token: result})
 }
 
-// ImportTokens imports tokens from JSON
-func (h *AdminHandler) ImportTokens(c *fiber.Ctx) error {
-	var req struct {
-		Tokens []struct {
-			ST               string `json:"session_token"`
-			AT               string `json:"access_token"`
-			Email            string `json:"email"`
-			IsActive         bool   `json:"is_active"`
-			ImageEnabled     bool   `json:"image_enabled"`
-			VideoEnabled     bool   `json:"video_enabled"`
-			ImageConcurrency int    `json:"image_concurrency"`
-			VideoConcurrency int    `json:"video_concurrency"`
-		} `json:"tokens"`
+// RefreshAllAT eagerly refreshes the ATs of all active tokens, or of the
+// given IDs, and reports how each went
+func (h *AdminHandler) RefreshAllAT(c *fiber.Ctx) error {
+	req := struct {
+		IDs             []int64 `json:"ids"`
+		IncludeDisabled bool    `json:"include_disabled"`
+		Parallelism     int     `json:"parallelism"`
+		DelayMs         int     `json:"delay_ms"` // between the start of two refreshes
+	}{Parallelism: 4, DelayMs: 200}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fail(c, 400, "Invalid request")
+		}
 	}
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	if req.Parallelism < 1 || req.Parallelism > 32 {
+		return fail(c, 400, "parallelism must be between 1 and 32")
+	}
+	if req.DelayMs < 0 || req.DelayMs > 60000 {
+		return fail(c, 400, "delay_ms must be between 0 and 60000")
 	}
 
-	var added, updated int
-	for _, t := range req.Tokens {
-		if t.ST == "" && t.AT == "" {
+	all, err := h.tokenManager.GetAllTokens()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	var tokens []*models.Token
+	for _, token := range all {
+		if len(req.IDs) > 0 && !slices.Contains(req.IDs, token.ID) {
 			continue
 		}
-		st := t.ST
-		if st == "" {
-			st = t.AT
-		}
-		_, err := h.tokenManager.AddToken(st, "", "", "", t.ImageEnabled, t.VideoEnabled, t.ImageConcurrency, t.VideoConcurrency)
-		if err != nil {
-			updated++
-		} else {
-			added++
+		if (token.IsActive || req.IncludeDisabled || len(req.IDs) > 0) && token.ST != "" {
+			tokens = append(tokens, token)
 		}
 	}
 
-	return c.JSON(fiber.Map{"success": true, "added": added, "updated": updated})
+	summary := h.tokenManager.RefreshAllAT(tokens, req.Parallelism, time.Duration(req.DelayMs)*time.Millisecond)
+	return respond(c, RefreshAllResult{Success: summary.Failed == 0, Summary: summary})
 }
 
 // UpdateCacheEnabled updates cache enabled status
@@ -616,15 +1020,15 @@ func (h *AdminHandler) UpdateCacheEnabled(c *fiber.Ctx) error {
 		Enabled bool `json:"enabled"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 
 	cfg, _ := h.db.GetCacheConfig()
 	if err := h.db.UpdateCacheConfig(req.Enabled, cfg.CacheTimeout, cfg.CacheBaseURL); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 	h.cfg.SetCacheEnabled(req.Enabled)
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
 }
 
 // UpdateCacheBaseURL updates cache base URL
@@ -633,38 +1037,950 @@ func (h *AdminHandler) UpdateCacheBaseURL(c *fiber.Ctx) error {
 		BaseURL string `json:"base_url"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
 	}
 
 	cfg, _ := h.db.GetCacheConfig()
 	if err := h.db.UpdateCacheConfig(cfg.CacheEnabled, cfg.CacheTimeout, req.BaseURL); err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return fail(c, 500, err.Error())
 	}
 	h.cfg.SetCacheBaseURL(req.BaseURL)
-	return c.JSON(fiber.Map{"success": true})
+	return respond(c, Ack{})
+}
+
+// UpdateCacheStorage switches the backend used for cached media
+func (h *AdminHandler) UpdateCacheStorage(c *fiber.Ctx) error {
+	var req models.CacheConfigDB
+	req.S3PathStyle = true
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+
+	current, err := h.db.GetCacheConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if req.S3SecretKey == "" {
+		req.S3SecretKey = current.S3SecretKey
+	}
+	if req.StorageBackend == "" {
+		req.StorageBackend = "local"
+	}
+
+	// Validate by building the backend before persisting
+	candidate := &config.Config{Cache: config.CacheConfig{Backend: req.StorageBackend, S3: storage.S3ConfigFromDB(&req)}}
+	if _, err := storage.New(os.TempDir(), candidate); err != nil {
+		return fail(c, 400, err.Error())
+	}
+
+	if err := h.db.UpdateCacheStorageConfig(&req); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.cfg.SetCacheStorage(req.StorageBackend, storage.S3ConfigFromDB(&req))
+	return respond(c, Ack{})
+}
+
+// GetCacheStats returns cache size and file counts
+func (h *AdminHandler) GetCacheStats(c *fiber.Ctx) error {
+	stats, err := h.cacheJanitor.Stats()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, CacheStatsResult{Stats: stats})
+}
+
+// PurgeCache deletes cached files; ?expired=true only removes files past cache_timeout
+func (h *AdminHandler) PurgeCache(c *fiber.Ctx) error {
+	var removed int
+	var err error
+	if c.QueryBool("expired") {
+		removed, err = h.cacheJanitor.Sweep(time.Duration(config.Get().Cache.Timeout) * time.Second)
+	} else {
+		removed, err = h.cacheJanitor.Purge()
+	}
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, PurgeResult{Removed: removed})
+}
+
+// CleanupProjects removes orphaned flow2api projects on all accounts; dry_run defaults to true
+func (h *AdminHandler) CleanupProjects(c *fiber.Ctx) error {
+	result, err := h.tokenManager.CleanupOrphanProjects(c.QueryBool("dry_run", true))
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, CleanupResult{Result: result})
+}
+
+// projectToken resolves the :id token of a project route, answering 400 or
+// 404 itself when it returns false
+func (h *AdminHandler) projectToken(c *fiber.Ctx) (int64, bool, error) {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return 0, false, fail(c, 400, "Invalid token ID")
+	}
+	token, err := h.db.GetToken(int64(id))
+	if err == sql.ErrNoRows || (err == nil && token == nil) {
+		return 0, false, fail(c, 404, "Token not found")
+	}
+	if err != nil {
+		return 0, false, fail(c, 500, err.Error())
+	}
+	return token.ID, true, nil
+}
+
+// GetTokenProjects lists a token's projects; ?upstream=true also lists the
+// account's projects on Flow
+func (h *AdminHandler) GetTokenProjects(c *fiber.Ctx) error {
+	id, ok, err := h.projectToken(c)
+	if !ok {
+		return err
+	}
+	projects, err := h.tokenManager.ListProjects(id, c.QueryBool("upstream", false))
+	if err != nil {
+		return fail(c, 502, err.Error())
+	}
+	return respond(c, ProjectList{Projects: projects})
+}
+
+// CreateTokenProject creates a project on a token's account; make_current
+// switches the token to it
+func (h *AdminHandler) CreateTokenProject(c *fiber.Ctx) error {
+	id, ok, err := h.projectToken(c)
+	if !ok {
+		return err
+	}
+	var req struct {
+		MakeCurrent bool `json:"make_current"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fail(c, 400, "Invalid request")
+		}
+	}
+	project, err := h.tokenManager.CreateProject(id, req.MakeCurrent)
+	if err != nil {
+		return fail(c, 502, err.Error())
+	}
+	return respond(c, ProjectResult{Project: project})
+}
+
+// RotateTokenProject moves a token to a new project; delete_old also deletes
+// the previous one upstream
+func (h *AdminHandler) RotateTokenProject(c *fiber.Ctx) error {
+	id, ok, err := h.projectToken(c)
+	if !ok {
+		return err
+	}
+	var req struct {
+		DeleteOld bool `json:"delete_old"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fail(c, 400, "Invalid request")
+		}
+	}
+	project, err := h.tokenManager.RotateProject(id, req.DeleteOld)
+	if project == nil {
+		return fail(c, 502, err.Error())
+	}
+	resp := ProjectResult{Project: project}
+	if err != nil {
+		resp.Warning = err.Error()
+	}
+	return respond(c, resp)
+}
+
+// DeleteTokenProject deletes a project that is not the token's current one
+func (h *AdminHandler) DeleteTokenProject(c *fiber.Ctx) error {
+	id, ok, err := h.projectToken(c)
+	if !ok {
+		return err
+	}
+	token, _ := h.db.GetToken(id)
+	if projectID := c.Params("project_id"); token != nil && projectID == token.CurrentProjectID {
+		return fail(c, 409, "Cannot delete the token's current project; rotate it first")
+	}
+	if err := h.tokenManager.DeleteProject(id, c.Params("project_id")); err != nil {
+		return fail(c, 502, err.Error())
+	}
+	return respond(c, Ack{})
 }
 
 // GetTokenRefreshConfig returns token auto-refresh configuration
 func (h *AdminHandler) GetTokenRefreshConfig(c *fiber.Ctx) error {
-	return c.JSON(fiber.Map{
-		"success":      true,
-		"auto_refresh": true,
-	})
+	cfg, err := h.db.GetTokenRefreshConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, ConfigData[*models.TokenRefreshConfig]{Config: cfg})
 }
 
-// UpdateTokenRefreshConfig updates token auto-refresh configuration
+// UpdateTokenRefreshConfig updates token auto-refresh configuration; fields
+// left out keep their value
 func (h *AdminHandler) UpdateTokenRefreshConfig(c *fiber.Ctx) error {
 	var req struct {
-		AutoRefresh bool `json:"auto_refresh"`
+		Enabled             *bool `json:"at_auto_refresh_enabled"`
+		IntervalMinutes     *int  `json:"interval_minutes"`
+		BeforeExpiryMinutes *int  `json:"before_expiry_minutes"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		return fail(c, 400, "Invalid request")
+	}
+
+	cfg, err := h.db.GetTokenRefreshConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if req.Enabled != nil {
+		cfg.Enabled = *req.Enabled
+	}
+	if req.IntervalMinutes != nil {
+		cfg.IntervalMinutes = *req.IntervalMinutes
+	}
+	if req.BeforeExpiryMinutes != nil {
+		cfg.BeforeExpiryMinutes = *req.BeforeExpiryMinutes
+	}
+	return h.saveTokenRefreshConfig(c, cfg)
+}
+
+// UpdateTokenRefreshEnabled turns scheduled AT refresh on or off
+func (h *AdminHandler) UpdateTokenRefreshEnabled(c *fiber.Ctx) error {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+
+	cfg, err := h.db.GetTokenRefreshConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	cfg.Enabled = req.Enabled
+	return h.saveTokenRefreshConfig(c, cfg)
+}
+
+func (h *AdminHandler) saveTokenRefreshConfig(c *fiber.Ctx, cfg *models.TokenRefreshConfig) error {
+	if cfg.IntervalMinutes < 1 || cfg.IntervalMinutes > 1440 {
+		return fail(c, 400, "interval_minutes must be between 1 and 1440")
+	}
+	if cfg.BeforeExpiryMinutes < cfg.IntervalMinutes || cfg.BeforeExpiryMinutes > 1440 {
+		return fail(c, 400, "before_expiry_minutes must be between interval_minutes and 1440, or an AT can expire between two runs")
+	}
+	if err := h.db.UpdateTokenRefreshConfig(cfg); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.tokenManager.ReloadATRefresh()
+	if saved, err := h.db.GetTokenRefreshConfig(); err == nil {
+		cfg = saved
+	}
+	return respond(c, ConfigData[*models.TokenRefreshConfig]{Config: cfg})
+}
+
+// GetBanConfig returns how tokens are banned and when bans are lifted
+func (h *AdminHandler) GetBanConfig(c *fiber.Ctx) error {
+	cfg, err := h.db.GetBanConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, ConfigData[*models.BanConfig]{Config: cfg})
+}
+
+// UpdateBanConfig updates the ban policies; fields left out keep their value
+func (h *AdminHandler) UpdateBanConfig(c *fiber.Ctx) error {
+	var req struct {
+		RateLimitBan        *bool   `json:"rate_limit_ban"`
+		RateLimitBanMinutes *int    `json:"rate_limit_ban_minutes"`
+		ErrorBan            *bool   `json:"error_ban"`
+		ErrorBanMinutes     *int    `json:"error_ban_minutes"`
+		UnbanCheckMinutes   *int    `json:"unban_check_minutes"`
+		QuotaResetHour      *int    `json:"quota_reset_hour"`
+		QuotaResetTimezone  *string `json:"quota_reset_timezone"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+
+	cfg, err := h.db.GetBanConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if req.RateLimitBan != nil {
+		cfg.RateLimitBan = *req.RateLimitBan
+	}
+	if req.RateLimitBanMinutes != nil {
+		cfg.RateLimitBanMinutes = *req.RateLimitBanMinutes
+	}
+	if req.ErrorBan != nil {
+		cfg.ErrorBan = *req.ErrorBan
+	}
+	if req.ErrorBanMinutes != nil {
+		cfg.ErrorBanMinutes = *req.ErrorBanMinutes
+	}
+	if req.UnbanCheckMinutes != nil {
+		cfg.UnbanCheckMinutes = *req.UnbanCheckMinutes
+	}
+	if req.QuotaResetHour != nil {
+		cfg.QuotaResetHour = *req.QuotaResetHour
+	}
+	if req.QuotaResetTimezone != nil {
+		cfg.QuotaResetTimezone = *req.QuotaResetTimezone
+	}
+
+	const week = 7 * 24 * 60
+	if cfg.RateLimitBanMinutes < 1 || cfg.RateLimitBanMinutes > week {
+		return fail(c, 400, fmt.Sprintf("rate_limit_ban_minutes must be between 1 and %d", week))
+	}
+	if cfg.ErrorBanMinutes < 0 || cfg.ErrorBanMinutes > week {
+		return fail(c, 400, fmt.Sprintf("error_ban_minutes must be between 0 (until enabled) and %d", week))
+	}
+	if cfg.UnbanCheckMinutes < 1 || cfg.UnbanCheckMinutes > 1440 {
+		return fail(c, 400, "unban_check_minutes must be between 1 and 1440")
+	}
+	if cfg.QuotaResetHour < 0 || cfg.QuotaResetHour > 23 {
+		return fail(c, 400, "quota_reset_hour must be between 0 and 23")
+	}
+	if _, err := time.LoadLocation(cfg.QuotaResetTimezone); err != nil || cfg.QuotaResetTimezone == "" {
+		return fail(c, 400, fmt.Sprintf("unknown quota_reset_timezone %q", cfg.QuotaResetTimezone))
+	}
+
+	if err := h.db.UpdateBanConfig(cfg); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.tokenManager.ReloadAutoUnban()
+	if saved, err := h.db.GetBanConfig(); err == nil {
+		cfg = saved
+	}
+	return respond(c, ConfigData[*models.BanConfig]{Config: cfg})
+}
+
+// GetDiscoveredModels returns upstream models, flagging ones missing from the registry
+func (h *AdminHandler) GetDiscoveredModels(c *fiber.Ctx) error {
+	upstreamModels, err := h.db.GetUpstreamModels()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	newCount := 0
+	for _, m := range upstreamModels {
+		if m.Status == "new" {
+			newCount++
+		}
+	}
+
+	return respond(c, DiscoveredModels{Models: upstreamModels, NewCount: newCount})
+}
+
+// DiscoverModels runs upstream model discovery immediately
+func (h *AdminHandler) DiscoverModels(c *fiber.Ctx) error {
+	upstreamModels, err := h.modelDiscovery.Discover()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, UpstreamModels{Models: upstreamModels})
+}
+
+// EnableDiscoveredModel registers a discovered model so clients can use it
+func (h *AdminHandler) EnableDiscoveredModel(c *fiber.Ctx) error {
+	var req struct {
+		VideoType string `json:"video_type"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fail(c, 400, "Invalid request")
+		}
+	}
+
+	names, err := h.modelDiscovery.EnableModel(c.Params("key"), req.VideoType)
+	if err != nil {
+		return fail(c, 400, err.Error())
+	}
+	return respond(c, EnabledModels{Models: names})
+}
+
+// IgnoreDiscoveredModel hides a discovered model from the new-model list
+func (h *AdminHandler) IgnoreDiscoveredModel(c *fiber.Ctx) error {
+	if err := h.modelDiscovery.IgnoreModel(c.Params("key")); err != nil {
+		return fail(c, 404, "Upstream model not found")
+	}
+	return respond(c, Ack{})
+}
+
+// GetCanaryRules returns canary rules with control/canary arm statistics
+func (h *AdminHandler) GetCanaryRules(c *fiber.Ctx) error {
+	stats, err := h.canaryRouter.Stats()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, CanaryRules{Rules: stats})
+}
+
+// AddCanaryRule creates a canary rule
+func (h *AdminHandler) AddCanaryRule(c *fiber.Ctx) error {
+	rule := &models.CanaryRule{Enabled: true}
+	if err := c.BodyParser(rule); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	if err := validateCanaryRule(rule); err != nil {
+		return fail(c, 400, err.Error())
+	}
+
+	id, err := h.db.AddCanaryRule(rule)
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.canaryRouter.Reload()
+
+	return respond(c, Created{ID: id})
+}
+
+// UpdateCanaryRule replaces a canary rule and resets its statistics
+func (h *AdminHandler) UpdateCanaryRule(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fail(c, 400, "Invalid rule ID")
+	}
+
+	rule := &models.CanaryRule{Enabled: true}
+	if err := c.BodyParser(rule); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	rule.ID = int64(id)
+	if err := validateCanaryRule(rule); err != nil {
+		return fail(c, 400, err.Error())
+	}
+
+	if err := h.db.UpdateCanaryRule(rule); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.canaryRouter.ResetStats(rule.ID)
+	h.canaryRouter.Reload()
+
+	return respond(c, Ack{})
+}
+
+// DeleteCanaryRule removes a canary rule
+func (h *AdminHandler) DeleteCanaryRule(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fail(c, 400, "Invalid rule ID")
+	}
+
+	if err := h.db.DeleteCanaryRule(int64(id)); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.canaryRouter.ResetStats(int64(id))
+	h.canaryRouter.Reload()
+
+	return respond(c, Ack{})
+}
+
+// GetKeys returns the additional API keys
+func (h *AdminHandler) GetKeys(c *fiber.Ctx) error {
+	keys, err := h.db.GetAPIKeys()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, KeyList{Keys: keys})
+}
+
+// GetKeyUsage returns per-key daily usage for the last ?days= days (default
+// 30) with totals per key; the global key is reported as "default"
+func (h *AdminHandler) GetKeyUsage(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 30)
+	if days < 1 || days > 366 {
+		return fail(c, 400, "days must be between 1 and 366")
+	}
+	since := time.Now().AddDate(0, 0, 1-days).Format("2006-01-02")
+
+	daily, err := h.db.GetKeyUsage(since)
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if daily == nil {
+		daily = []*models.KeyUsage{}
+	}
+	totals := make(map[string]*models.KeyUsage)
+	for _, u := range daily {
+		total, ok := totals[u.KeyID]
+		if !ok {
+			total = &models.KeyUsage{KeyID: u.KeyID}
+			totals[u.KeyID] = total
+		}
+		total.Requests += u.Requests
+		total.PromptCharacters += u.PromptCharacters
+		total.MediaCount += u.MediaCount
+		total.Credits += u.Credits
+	}
+	return respond(c, KeyUsageReport{Since: since, Totals: totals, Daily: daily})
+}
+
+// GetUsageReport aggregates generations, errors, credits and cached bytes
+// between ?from= and ?to= (YYYY-MM-DD, inclusive, default the last 30 days),
+// grouped by ?group_by=day|token|api_key|model
+func (h *AdminHandler) GetUsageReport(c *fiber.Ctx) error {
+	groupBy := c.Query("group_by", "day")
+	if !database.IsUsageGroup(groupBy) {
+		return fail(c, 400, "group_by must be one of day, token, api_key, model")
+	}
+
+	to := time.Now()
+	if v := c.Query("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return fail(c, 400, "to must be a date like 2006-01-02")
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -29)
+	if v := c.Query("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return fail(c, 400, "from must be a date like 2006-01-02")
+		}
+		from = t
+	}
+	if from.After(to) {
+		return fail(c, 400, "from must not be after to")
+	}
+
+	fromDay, toDay := from.Format("2006-01-02"), to.Format("2006-01-02")
+	rows, err := h.db.GetUsageReport(fromDay, toDay, groupBy)
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if rows == nil {
+		rows = []*models.UsageReportRow{}
+	}
+	total := &models.UsageReportRow{Group: "total"}
+	for _, r := range rows {
+		total.Generations += r.Generations
+		total.Errors += r.Errors
+		total.Credits += r.Credits
+		total.CacheBytes += r.CacheBytes
+	}
+
+	return respond(c, UsageReport{From: fromDay, To: toDay, GroupBy: groupBy, Rows: rows, Total: total})
+}
+
+// GetFairness reports each token's share of the tasks created in the last
+// ?hours= (default 24) and how evenly each token group split its traffic.
+// Active tokens are listed even without traffic; disabled ones only when
+// they had some. The overall score weighs each group's by its requests.
+func (h *AdminHandler) GetFairness(c *fiber.Ctx) error {
+	hours := c.QueryInt("hours", 24)
+	if hours < 1 || hours > 720 {
+		return fail(c, 400, "hours must be between 1 and 720")
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	counts, err := h.db.GetTaskCountsByToken(since)
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	tokens, err := h.tokenManager.GetAllTokens()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	shares := []*models.TokenShare{}
+	groups := map[int64]*models.GroupFairness{}
+	members := map[int64][]int{}
+	total := 0
+	for _, t := range tokens {
+		n := counts[t.ID]
+		if !t.IsActive && n == 0 {
+			continue
+		}
+		shares = append(shares, &models.TokenShare{TokenID: t.ID, Email: t.Email, GroupID: t.GroupID, Active: t.IsActive, Requests: n})
+		g := groups[t.GroupID]
+		if g == nil {
+			g = &models.GroupFairness{GroupID: t.GroupID}
+			groups[t.GroupID] = g
+		}
+		g.Tokens++
+		g.Requests += n
+		members[t.GroupID] = append(members[t.GroupID], n)
+		total += n
+	}
+
+	var weighted float64
+	groupList := make([]*models.GroupFairness, 0, len(groups))
+	for id, g := range groups {
+		g.Fairness = jainIndex(members[id])
+		if g.Fairness != nil {
+			weighted += *g.Fairness * float64(g.Requests)
+		}
+		groupList = append(groupList, g)
+	}
+	sort.Slice(groupList, func(i, j int) bool { return groupList[i].GroupID < groupList[j].GroupID })
+	for _, s := range shares {
+		g := groups[s.GroupID]
+		if total > 0 {
+			s.Share = float64(s.Requests) / float64(total)
+		}
+		if g.Requests > 0 {
+			s.GroupShare = float64(s.Requests) / float64(g.Requests)
+		}
+		s.ExpectedShare = 1 / float64(g.Tokens)
+	}
+
+	var overall *float64
+	if total > 0 {
+		score := weighted / float64(total)
+		overall = &score
+	}
+	return respond(c, FairnessReport{
+		Hours:    hours,
+		Since:    since.UTC(),
+		Requests: total,
+		Fairness: overall,
+		Groups:   groupList,
+		Tokens:   shares,
+	})
+}
+
+// jainIndex is (Σx)² / (n·Σx²): 1 when every token got the same traffic,
+// 1/n when one got all of it; nil without traffic
+func jainIndex(values []int) *float64 {
+	var sum, squares float64
+	for _, v := range values {
+		sum += float64(v)
+		squares += float64(v) * float64(v)
+	}
+	if squares == 0 {
+		return nil
+	}
+	index := sum * sum / (float64(len(values)) * squares)
+	return &index
+}
+
+// AddKey creates an API key, generating the secret when none is given
+func (h *AdminHandler) AddKey(c *fiber.Ctx) error {
+	key := &models.APIKey{Enabled: true}
+	if err := c.BodyParser(key); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	if err := validateAPIKey(key); err != nil {
+		return fail(c, 400, err.Error())
+	}
+	if err := h.checkTokenGroup(key.TokenGroupID); err != nil {
+		return fail(c, 400, err.Error())
+	}
+	if key.Key == "" {
+		bytes := make([]byte, 24)
+		rand.Read(bytes)
+		key.Key = "sk-" + hex.EncodeToString(bytes)
+	}
+	if h.cfg.MatchAPIKey(key.Key) {
+		return fail(c, 400, "key must differ from the global API key")
+	}
+
+	id, err := h.db.AddAPIKey(key)
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	return respond(c, CreatedKey{ID: id, Key: key.Key})
+}
+
+// UpdateKey replaces a key's name, allowlist and enabled state; the secret is kept
+func (h *AdminHandler) UpdateKey(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fail(c, 400, "Invalid key ID")
+	}
+
+	key := &models.APIKey{Enabled: true}
+	if err := c.BodyParser(key); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	key.ID = int64(id)
+	if err := validateAPIKey(key); err != nil {
+		return fail(c, 400, err.Error())
+	}
+	if err := h.checkTokenGroup(key.TokenGroupID); err != nil {
+		return fail(c, 400, err.Error())
+	}
+
+	if err := h.db.UpdateAPIKey(key); err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	return respond(c, Ack{})
+}
+
+// DeleteKey removes an API key
+func (h *AdminHandler) DeleteKey(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fail(c, 400, "Invalid key ID")
+	}
+
+	if err := h.db.DeleteAPIKey(int64(id)); err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	return respond(c, Ack{})
+}
+
+func validateAPIKey(key *models.APIKey) error {
+	key.Name = strings.TrimSpace(key.Name)
+	if key.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	patterns, err := modelPatterns(key.AllowedModels)
+	if err != nil {
+		return err
+	}
+	key.AllowedModels = patterns
+
+	key.PrivacyMode = strings.TrimSpace(key.PrivacyMode)
+	if key.PrivacyMode != "" && !slices.Contains(models.PrivacyModes, key.PrivacyMode) {
+		return fmt.Errorf("privacy_mode must be one of %s", strings.Join(models.PrivacyModes, ", "))
+	}
+	return nil
+}
+
+// modelPatterns trims model globs, drops empty ones and rejects any that are
+// malformed or cannot be stored comma-separated
+func modelPatterns(raw []string) ([]string, error) {
+	patterns := make([]string, 0, len(raw))
+	for _, pattern := range raw {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.Contains(pattern, ",") {
+			return nil, fmt.Errorf("invalid model pattern: %s", pattern)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid model pattern: %s", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// checkTokenGroup rejects references to groups that do not exist; 0 means none
+func (h *AdminHandler) checkTokenGroup(id int64) error {
+	if id == 0 {
+		return nil
+	}
+	group, err := h.db.GetTokenGroup(id)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return fmt.Errorf("token group %d does not exist", id)
+	}
+	return nil
+}
+
+// GetTokenGroups lists token groups
+func (h *AdminHandler) GetTokenGroups(c *fiber.Ctx) error {
+	groups, err := h.db.GetTokenGroups()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, TokenGroupList{Groups: groups})
+}
+
+// AddTokenGroup creates a token group; its concurrency is unlimited unless set
+func (h *AdminHandler) AddTokenGroup(c *fiber.Ctx) error {
+	group := &models.TokenGroup{ImageConcurrency: -1, VideoConcurrency: -1}
+	if err := c.BodyParser(group); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	if err := validateTokenGroup(group); err != nil {
+		return fail(c, 400, err.Error())
+	}
+
+	id, err := h.db.AddTokenGroup(group)
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.events.Publish(services.EventTokenGroupUpdated, map[string]interface{}{"group_id": id, "change": "added"})
+	return respond(c, Created{ID: id})
+}
+
+// UpdateTokenGroup replaces a group's name, description and model patterns;
+// limits left out keep their value
+func (h *AdminHandler) UpdateTokenGroup(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fail(c, 400, "Invalid group ID")
+	}
+
+	existing, err := h.db.GetTokenGroup(int64(id))
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if existing == nil {
+		return fail(c, 404, "Token group not found")
+	}
+	group := &models.TokenGroup{
+		ImageConcurrency: existing.ImageConcurrency,
+		VideoConcurrency: existing.VideoConcurrency,
+		DailyImageLimit:  existing.DailyImageLimit,
+		DailyVideoLimit:  existing.DailyVideoLimit,
+	}
+	if err := c.BodyParser(group); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	group.ID = int64(id)
+	if err := validateTokenGroup(group); err != nil {
+		return fail(c, 400, err.Error())
 	}
-	return c.JSON(fiber.Map{"success": true})
+
+	if err := h.db.UpdateTokenGroup(group); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.events.Publish(services.EventTokenGroupUpdated, map[string]interface{}{"group_id": group.ID, "change": "updated"})
+	return respond(c, Ack{})
+}
+
+// DeleteTokenGroup removes a group; its tokens and keys return to the shared pool
+func (h *AdminHandler) DeleteTokenGroup(c *fiber.Ctx) error {
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return fail(c, 400, "Invalid group ID")
+	}
+
+	if err := h.db.DeleteTokenGroup(int64(id)); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.events.Publish(services.EventTokenGroupUpdated, map[string]interface{}{"group_id": id, "change": "deleted"})
+	return respond(c, Ack{})
+}
+
+func validateTokenGroup(group *models.TokenGroup) error {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	patterns, err := modelPatterns(group.Models)
+	if err != nil {
+		return err
+	}
+	group.Models = patterns
+	if group.ImageConcurrency < -1 || group.VideoConcurrency < -1 {
+		return fmt.Errorf("image_concurrency and video_concurrency must be -1 (unlimited) or more")
+	}
+	if group.DailyImageLimit < 0 || group.DailyVideoLimit < 0 {
+		return fmt.Errorf("daily_image_limit and daily_video_limit must be 0 (unlimited) or more")
+	}
+	return nil
+}
+
+// GetRateLimits returns the configured rate limits
+func (h *AdminHandler) GetRateLimits(c *fiber.Ctx) error {
+	limits, err := h.db.GetRateLimits()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, RateLimitList{Limits: limits})
+}
+
+// SetRateLimit creates or replaces the limit of a model, or the global limit for model "*"
+func (h *AdminHandler) SetRateLimit(c *fiber.Ctx) error {
+	limit := &models.RateLimit{}
+	if err := c.BodyParser(limit); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	if limit.Model != models.RateLimitGlobal {
+		if _, _, err := models.ResolveModel(limit.Model, ""); err != nil {
+			return fail(c, 400, fmt.Sprintf("unknown model: %s", limit.Model))
+		}
+		limit.Model = models.BaseModelName(limit.Model)
+	}
+	if limit.RequestsPerMinute <= 0 {
+		return fail(c, 400, "requests_per_minute must be positive")
+	}
+	if limit.Burst <= 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.RequestsPerMinute/60)))
+	}
+
+	if err := h.db.SetRateLimit(limit); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.rateLimiter.Reload()
+
+	return respond(c, Ack{})
 }
 
-// GetLogs returns request logs
+// DeleteRateLimit removes the limit of a model
+func (h *AdminHandler) DeleteRateLimit(c *fiber.Ctx) error {
+	model, err := url.PathUnescape(c.Params("model"))
+	if err != nil {
+		return fail(c, 400, "Invalid model")
+	}
+	if model != models.RateLimitGlobal {
+		model = models.BaseModelName(model)
+	}
+
+	if err := h.db.DeleteRateLimit(model); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	h.rateLimiter.Reload()
+
+	return respond(c, Ack{})
+}
+
+func validateCanaryRule(rule *models.CanaryRule) error {
+	_, sourceConfig, err := models.ResolveModel(rule.Model, "")
+	if err != nil {
+		return fmt.Errorf("unknown model: %s", rule.Model)
+	}
+	if rule.TargetModel == "" && rule.Strategy == "" {
+		return fmt.Errorf("target_model or strategy is required")
+	}
+	if rule.TargetModel != "" {
+		_, targetConfig, err := models.ResolveModel(rule.TargetModel, "")
+		if err != nil {
+			return fmt.Errorf("unknown target_model: %s", rule.TargetModel)
+		}
+		if targetConfig.Type != sourceConfig.Type {
+			return fmt.Errorf("target_model must be the same type as model")
+		}
+	}
+	if rule.Strategy != "" && !services.IsValidStrategy(rule.Strategy) {
+		return fmt.Errorf("unknown strategy: %s", rule.Strategy)
+	}
+	if rule.Percent < 0 || rule.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// GetTask returns a task including its stored request parameters
+func (h *AdminHandler) GetTask(c *fiber.Ctx) error {
+	task, err := h.db.GetTask(c.Params("task_id"))
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if task == nil {
+		return fail(c, 404, "Task not found")
+	}
+	task.ResultURLs = storage.SignURLs(task.ResultURLs)
+
+	return respond(c, TaskResult{Task: task})
+}
+
+// GetLogs returns request logs, each with the token that served it and why;
+// ?token_id= narrows to one token
 func (h *AdminHandler) GetLogs(c *fiber.Ctx) error {
-	// Return empty logs for now - can be enhanced with actual logging
-	return c.JSON([]fiber.Map{})
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	// traced=true narrows to slow or explicitly traced requests for postmortems
+	logs, err := h.db.GetRequestLogs(limit, c.QueryBool("traced"), int64(c.QueryInt("token_id")))
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, logs)
 }
@@ -0,0 +1,383 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"flow2api/internal/models"
+	"flow2api/internal/services"
+)
+
+// Data types of the admin API responses. Enveloped clients get them as data
+// of a Response; the legacy shape is their fields next to "success".
+
+// Ack is the data of a request that has nothing to report
+type Ack struct{}
+
+// Message carries a human-readable message
+type Message struct {
+	Message string `json:"message"`
+}
+
+// SessionToken is a new admin session
+type SessionToken struct {
+	Token     string    `json:"token"`
+	Username  string    `json:"username"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SessionList lists the signed-in admin sessions
+type SessionList struct {
+	Sessions []*models.AdminSession `json:"sessions"`
+}
+
+// AdminConfigView is the admin config without the password
+type AdminConfigView struct {
+	Username                string     `json:"username"`
+	APIKey                  string     `json:"api_key"`
+	ErrorBanThreshold       int        `json:"error_ban_threshold"`
+	PreviousAPIKeyExpiresAt *time.Time `json:"previous_api_key_expires_at,omitempty"`
+}
+
+// APIKeyRotation reports until when the replaced API key keeps working
+type APIKeyRotation struct {
+	PreviousAPIKeyExpiresAt *time.Time `json:"previous_api_key_expires_at,omitempty"`
+}
+
+// TokenList lists tokens as the token list shows them
+type TokenList struct {
+	Tokens []*TokenItem `json:"tokens"`
+}
+
+// TokenItem is a token as the token list shows it
+type TokenItem struct {
+	ID                 int64           `json:"id"`
+	ST                 string          `json:"st"`
+	AT                 string          `json:"at"`
+	Token              string          `json:"token"`
+	Email              string          `json:"email"`
+	Name               string          `json:"name"`
+	Remark             string          `json:"remark"`
+	IsActive           bool            `json:"is_active"`
+	Credits            int             `json:"credits"`
+	UserPaygateTier    string          `json:"user_paygate_tier"`
+	CurrentProjectID   string          `json:"current_project_id"`
+	CurrentProjectName string          `json:"current_project_name"`
+	ImageEnabled       bool            `json:"image_enabled"`
+	VideoEnabled       bool            `json:"video_enabled"`
+	ImageConcurrency   int             `json:"image_concurrency"`
+	VideoConcurrency   int             `json:"video_concurrency"`
+	UseCount           int             `json:"use_count"`
+	BanReason          string          `json:"ban_reason"`
+	GroupID            int64           `json:"group_id"`
+	DailyImageLimit    int             `json:"daily_image_limit"`
+	DailyVideoLimit    int             `json:"daily_video_limit"`
+	Version            int64           `json:"version"`
+	ATExpires          string          `json:"at_expires,omitempty"`
+	CreatedAt          string          `json:"created_at,omitempty"`
+	LastUsedAt         string          `json:"last_used_at,omitempty"`
+	BannedAt           string          `json:"banned_at,omitempty"`
+	Stats              *TokenItemStats `json:"stats,omitempty"`
+}
+
+// TokenItemStats is the usage shown with a token
+type TokenItemStats struct {
+	ImageCount            int `json:"image_count"`
+	VideoCount            int `json:"video_count"`
+	SuccessCount          int `json:"success_count"`
+	ErrorCount            int `json:"error_count"`
+	TodayImageCount       int `json:"today_image_count"`
+	TodayVideoCount       int `json:"today_video_count"`
+	TodayErrorCount       int `json:"today_error_count"`
+	ConsecutiveErrorCount int `json:"consecutive_error_count"`
+}
+
+// TokenResult is a token that was added
+type TokenResult struct {
+	Token *models.Token `json:"token"`
+}
+
+// VersionResult is the version an edit saved
+type VersionResult struct {
+	Version int64 `json:"version"`
+}
+
+// CreditsResult is a token's refreshed credits
+type CreditsResult struct {
+	Credits int `json:"credits"`
+}
+
+// Stats sums the usage of all tokens
+type Stats struct {
+	TotalTokens  int                         `json:"total_tokens"`
+	ActiveTokens int                         `json:"active_tokens"`
+	TotalImages  int                         `json:"total_images"`
+	TotalVideos  int                         `json:"total_videos"`
+	TotalErrors  int                         `json:"total_errors"`
+	TodayImages  int                         `json:"today_images"`
+	TodayVideos  int                         `json:"today_videos"`
+	TodayErrors  int                         `json:"today_errors"`
+	Canary       []*services.CanaryRuleStats `json:"canary"`
+}
+
+// RefreshedAT is a token whose AT was refreshed
+type RefreshedAT struct {
+	Token RefreshedATToken `json:"token"`
+}
+
+// RefreshedATToken identifies the token and its new AT expiry
+type RefreshedATToken struct {
+	ID        int64  `json:"id"`
+	Email     string `json:"email"`
+	ATExpires string `json:"at_expires,omitempty"`
+}
+
+// RefreshAllResult reports a bulk AT refresh; it fails when any token failed
+type RefreshAllResult struct {
+	Success bool                       `json:"success"`
+	Summary *services.ATRefreshSummary `json:"summary"`
+}
+
+func (r RefreshAllResult) failure() string {
+	if r.Success {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d AT refreshes failed", r.Summary.Failed, r.Summary.Total)
+}
+
+// CacheStatsResult is the cache's size and file counts
+type CacheStatsResult struct {
+	Stats *services.CacheStats `json:"stats"`
+}
+
+// PurgeResult counts the cached files removed
+type PurgeResult struct {
+	Removed int `json:"removed"`
+}
+
+// CleanupResult reports an orphaned project cleanup
+type CleanupResult struct {
+	Result *services.ProjectCleanupResult `json:"result"`
+}
+
+// ProjectList lists a token's projects
+type ProjectList struct {
+	Projects []*services.ProjectInfo `json:"projects"`
+}
+
+// ProjectResult is a created or rotated project; Warning says what went
+// wrong after the project was made
+type ProjectResult struct {
+	Project *models.Project `json:"project"`
+	Warning string          `json:"warning,omitempty"`
+}
+
+// ConfigData carries a config section
+type ConfigData[T any] struct {
+	Config T `json:"config"`
+}
+
+// SecurityConfigView is the security config and the caller's address as the
+// filters see it
+type SecurityConfigView struct {
+	Config *models.SecurityConfig `json:"config"`
+	YourIP string                 `json:"your_ip,omitempty"`
+}
+
+// DiscoveredModels lists upstream models; NewCount are missing from the registry
+type DiscoveredModels struct {
+	Models   []*models.UpstreamModel `json:"models"`
+	NewCount int                     `json:"new_count"`
+}
+
+// UpstreamModels lists upstream models
+type UpstreamModels struct {
+	Models []*models.UpstreamModel `json:"models"`
+}
+
+// EnabledModels lists the model names a discovered model was registered as
+type EnabledModels struct {
+	Models []string `json:"models"`
+}
+
+// CanaryRules lists canary rules with their statistics
+type CanaryRules struct {
+	Rules []*services.CanaryRuleStats `json:"rules"`
+}
+
+// Created is the ID of a created record
+type Created struct {
+	ID int64 `json:"id"`
+}
+
+// RegistryModelList lists the models table
+type RegistryModelList struct {
+	Models []*models.RegistryModel `json:"models"`
+}
+
+// ModelCount is the number of models clients can use
+type ModelCount struct {
+	Count int `json:"count"`
+}
+
+// ModelAliases lists the model aliases and the default model
+type ModelAliases struct {
+	Aliases      []*models.ModelAlias `json:"aliases"`
+	DefaultModel string               `json:"default_model"`
+}
+
+// KeyList lists the additional API keys
+type KeyList struct {
+	Keys []*models.APIKey `json:"keys"`
+}
+
+// KeyUsageReport is per-key daily usage and totals since a day
+type KeyUsageReport struct {
+	Since  string                      `json:"since"`
+	Totals map[string]*models.KeyUsage `json:"totals"`
+	Daily  []*models.KeyUsage          `json:"daily"`
+}
+
+// UsageReport is usage between two days, grouped
+type UsageReport struct {
+	From    string                   `json:"from"`
+	To      string                   `json:"to"`
+	GroupBy string                   `json:"group_by"`
+	Rows    []*models.UsageReportRow `json:"rows"`
+	Total   *models.UsageReportRow   `json:"total"`
+}
+
+// FairnessReport is how evenly tokens shared the recent traffic
+type FairnessReport struct {
+	Hours    int                     `json:"hours"`
+	Since    time.Time               `json:"since"`
+	Requests int                     `json:"requests"`
+	Fairness *float64                `json:"fairness"`
+	Groups   []*models.GroupFairness `json:"groups"`
+	Tokens   []*models.TokenShare    `json:"tokens"`
+}
+
+// CreatedKey is a created API key and its secret
+type CreatedKey struct {
+	ID  int64  `json:"id"`
+	Key string `json:"key"`
+}
+
+// TokenGroupList lists token groups
+type TokenGroupList struct {
+	Groups []*models.TokenGroup `json:"groups"`
+}
+
+// RateLimitList lists the configured rate limits
+type RateLimitList struct {
+	Limits []*models.RateLimit `json:"limits"`
+}
+
+// TaskResult is a task with its request parameters
+type TaskResult struct {
+	Task *models.Task `json:"task"`
+}
+
+// TwoFactorStatus reports whether two-factor login is on
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	Pending           bool `json:"pending"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// TwoFactorEnrollment is the secret to confirm two-factor login with
+type TwoFactorEnrollment struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+// RecoveryCodes are new recovery codes; they are only ever shown once
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// ImportJobStarted is a token import moved to the background
+type ImportJobStarted struct {
+	JobID  string `json:"job_id"`
+	Total  int    `json:"total"`
+	Adding int    `json:"adding"`
+}
+
+// TokenImportReport is what an import did, or would do in a dry run
+type TokenImportReport struct {
+	DryRun  bool                `json:"dry_run"`
+	Format  string              `json:"format"`
+	Added   int                 `json:"added"`
+	Updated int                 `json:"updated"`
+	Skipped int                 `json:"skipped"`
+	Invalid int                 `json:"invalid"`
+	Failed  int                 `json:"failed"`
+	Results []TokenImportResult `json:"results"`
+}
+
+// ImportJobStatus is the progress of a background import
+type ImportJobStatus struct {
+	Job *ImportJob `json:"job"`
+}
+
+// ImportJob is a background import; results are listed once it finished
+type ImportJob struct {
+	JobID      string              `json:"job_id"`
+	Status     string              `json:"status"`
+	Format     string              `json:"format"`
+	Total      int                 `json:"total"`
+	Done       int                 `json:"done"`
+	Added      int                 `json:"added"`
+	Updated    int                 `json:"updated"`
+	Skipped    int                 `json:"skipped"`
+	Invalid    int                 `json:"invalid"`
+	Failed     int                 `json:"failed"`
+	StartedAt  time.Time           `json:"started_at"`
+	FinishedAt *time.Time          `json:"finished_at,omitempty"`
+	Results    []TokenImportResult `json:"results,omitempty"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// TokenSyncReport is what a sync from the primary did, or would do
+type TokenSyncReport struct {
+	DryRun    bool                `json:"dry_run"`
+	Source    string              `json:"source"`
+	Added     int                 `json:"added"`
+	Updated   int                 `json:"updated"`
+	Skipped   int                 `json:"skipped"`
+	Invalid   int                 `json:"invalid"`
+	Failed    int                 `json:"failed"`
+	Conflicts int                 `json:"conflicts"`
+	Results   []TokenImportResult `json:"results"`
+	LocalOnly []TokenImportResult `json:"local_only"`
+}
+
+// SelfTestRun is a self-test that ran; it fails when the test did
+type SelfTestRun struct {
+	Success bool                     `json:"success"`
+	Result  *services.SelfTestResult `json:"result"`
+}
+
+func (r SelfTestRun) failure() string {
+	if r.Success {
+		return ""
+	}
+	if r.Result.Error != "" {
+		return r.Result.Error
+	}
+	return "Self-test failed"
+}
+
+// SelfTestStatus is the last self-test's result, nil before the first
+type SelfTestStatus struct {
+	Enabled bool                     `json:"enabled"`
+	Result  *services.SelfTestResult `json:"result"`
+}
+
+// MediaShareLink is a link that shares cached media
+type MediaShareLink struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Protected bool      `json:"protected"`
+}
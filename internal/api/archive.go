@@ -0,0 +1,248 @@
+package api
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+	"flow2api/internal/services"
+	"flow2api/internal/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxArchiveTasks caps how many tasks one archive may contain
+const maxArchiveTasks = 500
+
+// archiveRequest selects tasks either by ID or by creation time. From and To
+// accept RFC 3339 timestamps or dates; a date-only To includes that whole day.
+type archiveRequest struct {
+	TaskIDs []string `json:"task_ids"`
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+}
+
+// archiveEntry describes one result in the archive's manifest.json
+type archiveEntry struct {
+	TaskID    string     `json:"task_id"`
+	Model     string     `json:"model"`
+	Prompt    string     `json:"prompt"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	File      string     `json:"file,omitempty"`
+	URL       string     `json:"url"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// parseArchiveTime reads an RFC 3339 timestamp or a YYYY-MM-DD date (UTC).
+// endOfDay moves a bare date to the start of the following day.
+func parseArchiveTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (use YYYY-MM-DD or RFC 3339)", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// archiveTasks resolves the request to completed tasks
+func (h *AdminHandler) archiveTasks(req *archiveRequest) ([]*models.Task, error) {
+	if len(req.TaskIDs) > 0 {
+		if len(req.TaskIDs) > maxArchiveTasks {
+			return nil, fiber.NewError(400, fmt.Sprintf("at most %d tasks per archive", maxArchiveTasks))
+		}
+		var tasks []*models.Task
+		for _, id := range req.TaskIDs {
+			task, err := h.db.GetTask(strings.TrimSpace(id))
+			if err != nil {
+				return nil, err
+			}
+			if task == nil {
+				return nil, fiber.NewError(404, "Task not found: "+id)
+			}
+			if task.Status == "completed" {
+				tasks = append(tasks, task)
+			}
+		}
+		return tasks, nil
+	}
+
+	if req.From == "" {
+		return nil, fiber.NewError(400, "task_ids or from is required")
+	}
+	from, err := parseArchiveTime(req.From, false)
+	if err != nil {
+		return nil, fiber.NewError(400, err.Error())
+	}
+	to := time.Now()
+	if req.To != "" {
+		if to, err = parseArchiveTime(req.To, true); err != nil {
+			return nil, fiber.NewError(400, err.Error())
+		}
+	}
+	if !to.After(from) {
+		return nil, fiber.NewError(400, "to must be after from")
+	}
+	return h.db.GetCompletedTasksBetween(from, to, maxArchiveTasks)
+}
+
+// DownloadArchive streams a ZIP of the results of the selected tasks, read
+// from the cache backend (or upstream when a result was never cached), with a
+// manifest.json describing each file. Selection comes from the JSON body or
+// from ?task_ids=a,b&from=&to= on GET.
+func (h *AdminHandler) DownloadArchive(c *fiber.Ctx) error {
+	var req archiveRequest
+	if c.Method() == fiber.MethodPost {
+		if err := c.BodyParser(&req); err != nil {
+			return fail(c, 400, "Invalid request")
+		}
+	} else {
+		if ids := c.Query("task_ids"); ids != "" {
+			req.TaskIDs = strings.Split(ids, ",")
+		}
+		req.From, req.To = c.Query("from"), c.Query("to")
+	}
+
+	tasks, err := h.archiveTasks(&req)
+	if err != nil {
+		status := 500
+		if fe, ok := err.(*fiber.Error); ok {
+			status = fe.Code
+		}
+		return fail(c, status, err.Error())
+	}
+	if len(tasks) == 0 {
+		return fail(c, 404, "No completed tasks match the selection")
+	}
+
+	name := "flow2api-" + time.Now().UTC().Format("20060102-150405") + ".zip"
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, name))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := h.writeArchive(w, tasks); err != nil {
+			logging.Component("archive").Error("Archive aborted", "name", name, "error", err)
+		}
+	})
+	return nil
+}
+
+// writeArchive adds every result of tasks to a ZIP written to w. Results that
+// cannot be read are listed in the manifest with their error instead.
+func (h *AdminHandler) writeArchive(w io.Writer, tasks []*models.Task) error {
+	zw := zip.NewWriter(w)
+	var manifest []archiveEntry
+
+	for _, task := range tasks {
+		stamp := "unknown"
+		if task.CreatedAt != nil {
+			stamp = task.CreatedAt.UTC().Format("20060102-150405")
+		}
+		for i, url := range task.ResultURLs {
+			entry := archiveEntry{TaskID: task.TaskID, Model: task.Model, Prompt: task.Prompt, CreatedAt: task.CreatedAt, URL: url}
+			entry.File = fmt.Sprintf("%s_%s_%d", stamp, task.TaskID, i+1)
+			if err := h.addArchiveFile(zw, &entry); err != nil {
+				entry.File, entry.Error = "", err.Error()
+			}
+			manifest = append(manifest, entry)
+		}
+	}
+
+	fw, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(fw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// addArchiveFile copies one result into the archive, completing entry.File
+// with an extension. Media is stored uncompressed since it is compressed
+// already.
+func (h *AdminHandler) addArchiveFile(zw *zip.Writer, entry *archiveEntry) error {
+	body, contentType, err := h.openResult(entry.URL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	ext := path.Ext(strings.SplitN(path.Base(entry.URL), "?", 2)[0])
+	if ext == "" {
+		ext = mediaExtension(contentType)
+	}
+	entry.File += ext
+
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: entry.File, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, body)
+	return err
+}
+
+// mediaExtension picks a file extension for results fetched from URLs
+// without one
+func mediaExtension(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	case "video/mp4":
+		return ".mp4"
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// openResult opens a task result, preferring the local cache directory over a
+// network fetch when the URL points at a locally cached file
+func (h *AdminHandler) openResult(url string) (io.ReadCloser, string, error) {
+	key := path.Base(strings.SplitN(url, "?", 2)[0])
+	file, err := h.db.GetCachedFileByKey(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if file != nil && file.Backend == "local" {
+		f, err := os.Open(filepath.Join(services.CacheDir, filepath.Base(file.Key)))
+		if err == nil {
+			return f, mime.TypeByExtension(filepath.Ext(file.Key)), nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, "", err
+		}
+	}
+
+	resp, err := mediaClient.Get(storage.SignURL(url))
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, "", fmt.Errorf("download failed: HTTP %d", resp.StatusCode)
+	}
+	return resp.Body, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"flow2api/internal/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var versionLog = logging.Component("edit_versions")
+
+// versionTag formats a version as an ETag
+func versionTag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatchVersion reads the version a client edited from If-Match. It returns
+// -1 when the header is missing or "*", so clients that do not send it keep
+// last-write-wins.
+func ifMatchVersion(c *fiber.Ctx) (int64, error) {
+	tag := strings.TrimSpace(c.Get(fiber.HeaderIfMatch))
+	if tag == "" || tag == "*" {
+		return -1, nil
+	}
+	tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil || version < 0 {
+		return 0, errors.New(`If-Match must be a version tag like "3"`)
+	}
+	return version, nil
+}
+
+// versionedConfig guards the routes of one config section. Reads answer the
+// section's version as an ETag; a save sending If-Match with an older version
+// is refused with 409 and the current state instead of overwriting the edit
+// another session saved in between. current is the section's read handler.
+func (h *AdminHandler) versionedConfig(section string, current fiber.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() == fiber.MethodGet {
+			if err := c.Next(); err != nil {
+				return err
+			}
+			version, err := h.db.GetConfigVersion(section)
+			if err == nil {
+				c.Set(fiber.HeaderETag, versionTag(version))
+			}
+			return nil
+		}
+
+		expected, err := ifMatchVersion(c)
+		if err != nil {
+			return fail(c, 400, err.Error())
+		}
+
+		// Saves of config are rare; one at a time keeps check and save atomic
+		h.configMu.Lock()
+		defer h.configMu.Unlock()
+
+		version, err := h.db.GetConfigVersion(section)
+		if err != nil {
+			return fail(c, 500, err.Error())
+		}
+		if expected >= 0 && expected != version {
+			return h.configConflict(c, version, current)
+		}
+
+		if err := c.Next(); err != nil {
+			return err
+		}
+		if c.Response().StatusCode() >= 300 {
+			return nil
+		}
+		if version, err = h.db.BumpConfigVersion(section); err != nil {
+			versionLog.Error("Failed to record config version", "section", section, "error", err)
+			return nil
+		}
+		c.Set(fiber.HeaderETag, versionTag(version))
+		return nil
+	}
+}
+
+// configConflict answers 409 with the section as current renders it
+func (h *AdminHandler) configConflict(c *fiber.Ctx, version int64, current fiber.Handler) error {
+	if err := current(c); err != nil {
+		return err
+	}
+	state := json.RawMessage(append([]byte(nil), c.Response().Body()...))
+	if enveloped(c) {
+		var body Response[json.RawMessage]
+		if err := json.Unmarshal(state, &body); err == nil && body.Data != nil {
+			state = *body.Data
+		}
+	}
+	c.Set(fiber.HeaderETag, versionTag(version))
+	return failWith(c, 409, "Config was changed by another session; review the current values and save again", fiber.Map{
+		"version": version,
+		"current": state,
+	})
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// EnvelopeHeader opts a request into enveloped admin responses. The panel and
+// older integrations keep the legacy shape: the data's fields next to
+// "success": true, or {"error": message} and the error's details.
+const EnvelopeHeader = "X-Flow2API-Envelope"
+
+// Error codes of enveloped responses; they follow the HTTP status, except
+// ErrCodeFailed for a request that answered 2xx but did not succeed
+const (
+	ErrCodeBadRequest   = "bad_request"
+	ErrCodeUnauthorized = "unauthorized"
+	ErrCodeForbidden    = "forbidden"
+	ErrCodeNotFound     = "not_found"
+	ErrCodeConflict     = "conflict"
+	ErrCodeTooLarge     = "payload_too_large"
+	ErrCodeRateLimited  = "rate_limited"
+	ErrCodeInternal     = "internal_error"
+	ErrCodeUpstream     = "upstream_error"
+	ErrCodeUnavailable  = "unavailable"
+	ErrCodeTimeout      = "timeout"
+	ErrCodeFailed       = "failed"
+)
+
+// Response is the envelope of an admin API response: data on success, error
+// otherwise. T is the handler's response type, so clients can be generated
+// from the types in admin_responses.go.
+type Response[T any] struct {
+	Success bool       `json:"success"`
+	Data    *T         `json:"data,omitempty"`
+	Error   *ErrorBody `json:"error,omitempty"`
+}
+
+// ErrorBody describes why a request failed. Details carries the rest of the
+// error, such as two_factor_required or the current state of a conflicting
+// edit.
+type ErrorBody struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// errorCode maps an HTTP status to its error code
+func errorCode(status int) string {
+	switch status {
+	case fiber.StatusBadRequest, fiber.StatusUnprocessableEntity:
+		return ErrCodeBadRequest
+	case fiber.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case fiber.StatusForbidden:
+		return ErrCodeForbidden
+	case fiber.StatusNotFound, fiber.StatusMethodNotAllowed:
+		return ErrCodeNotFound
+	case fiber.StatusConflict:
+		return ErrCodeConflict
+	case fiber.StatusRequestEntityTooLarge:
+		return ErrCodeTooLarge
+	case fiber.StatusTooManyRequests:
+		return ErrCodeRateLimited
+	case fiber.StatusBadGateway:
+		return ErrCodeUpstream
+	case fiber.StatusServiceUnavailable:
+		return ErrCodeUnavailable
+	case fiber.StatusGatewayTimeout, fiber.StatusRequestTimeout:
+		return ErrCodeTimeout
+	}
+	if status >= 500 {
+		return ErrCodeInternal
+	}
+	return ErrCodeFailed
+}
+
+// enveloped reports whether the client asked for enveloped responses
+func enveloped(c *fiber.Ctx) bool {
+	return c.Get(EnvelopeHeader) != ""
+}
+
+// respond answers 200 with data
+func respond[T any](c *fiber.Ctx, data T) error {
+	return respondStatus(c, fiber.StatusOK, data)
+}
+
+// outcome is implemented by data that can report a failure with a 2xx
+// status, such as a bulk refresh where some tokens failed
+type outcome interface {
+	failure() string
+}
+
+// respondStatus answers status with data, enveloped when the client asked
+func respondStatus[T any](c *fiber.Ctx, status int, data T) error {
+	c.Status(status)
+	if !enveloped(c) {
+		return c.JSON(legacyBody(data))
+	}
+	body := Response[T]{Success: true, Data: &data}
+	if o, ok := any(data).(outcome); ok {
+		if message := o.failure(); message != "" {
+			body.Success = false
+			body.Error = &ErrorBody{Code: ErrCodeFailed, Message: message}
+		}
+	}
+	return c.JSON(body)
+}
+
+// legacyBody is data's fields next to "success": true, unless data reports
+// success itself. Data that is not a JSON object is sent as it is.
+func legacyBody(data interface{}) interface{} {
+	raw, err := json.Marshal(data)
+	if err != nil || !bytes.HasPrefix(raw, []byte("{")) {
+		return data
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) != nil {
+		return data
+	}
+	if _, ok := fields["success"]; !ok {
+		fields["success"] = json.RawMessage("true")
+	}
+	return fields
+}
+
+// fail answers status with an error message
+func fail(c *fiber.Ctx, status int, message string) error {
+	return failWith(c, status, message, nil)
+}
+
+// failWith answers status with an error message and details
+func failWith(c *fiber.Ctx, status int, message string, details fiber.Map) error {
+	c.Status(status)
+	if enveloped(c) {
+		return c.JSON(Response[struct{}]{Error: &ErrorBody{Code: errorCode(status), Message: message, Details: details}})
+	}
+	body := fiber.Map{"error": message}
+	for name, value := range details {
+		body[name] = value
+	}
+	return c.JSON(body)
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"flow2api/internal/browser"
+	"flow2api/internal/config"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// sidecarProbeTimeout bounds the sidecar health check of a readiness probe
+const sidecarProbeTimeout = 3 * time.Second
+
+var processStart = time.Now()
+
+// probeCheck is one condition of the readiness probe
+type probeCheck struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Method string `json:"method,omitempty"` // captcha method
+	Active *int   `json:"active,omitempty"` // active tokens
+}
+
+func failedCheck(err error) probeCheck {
+	return probeCheck{Error: err.Error()}
+}
+
+// Healthz answers as long as the process serves requests, for liveness probes
+func (h *Handler) Healthz(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":         "ok",
+		"started_at":     processStart.UTC(),
+		"uptime_seconds": int64(time.Since(processStart).Seconds()),
+	})
+}
+
+// Readyz answers 200 when the instance can serve generations: the database
+// answers, a token is active, the captcha method is usable and the instance
+// is not draining. Otherwise it answers 503 naming the failing checks.
+func (h *Handler) Readyz(c *fiber.Ctx) error {
+	checks := map[string]probeCheck{
+		"database": h.checkDatabase(),
+		"tokens":   h.checkTokens(),
+		"captcha":  checkCaptcha(config.Get()),
+		"draining": {OK: !h.workerPool.Draining()},
+	}
+
+	ready := true
+	for _, check := range checks {
+		ready = ready && check.OK
+	}
+	status, code := "ready", fiber.StatusOK
+	if !ready {
+		status, code = "not_ready", fiber.StatusServiceUnavailable
+	}
+	return c.Status(code).JSON(fiber.Map{"status": status, "checks": checks})
+}
+
+func (h *Handler) checkDatabase() probeCheck {
+	if err := h.db.Ping(); err != nil {
+		return failedCheck(err)
+	}
+	return probeCheck{OK: true}
+}
+
+func (h *Handler) checkTokens() probeCheck {
+	active, err := h.db.CountActiveTokens()
+	if err != nil {
+		return failedCheck(err)
+	}
+	check := probeCheck{OK: active > 0, Active: &active}
+	if active == 0 {
+		check.Error = "no active tokens"
+	}
+	return check
+}
+
+// checkCaptcha reports whether the configured captcha method can solve
+func checkCaptcha(cfg *config.Config) probeCheck {
+	method := cfg.Captcha.CaptchaMethod
+	check := probeCheck{OK: true, Method: method}
+	switch method {
+	case "browser":
+		if !browser.GetCaptchaService().Ready() {
+			check.OK, check.Error = false, "browser is not running"
+		}
+	case "personal":
+		if !browser.GetPersonalCaptchaService().Ready() {
+			check.OK, check.Error = false, "browser is not running"
+		}
+	case "sidecar":
+		timeout := min(time.Duration(cfg.Captcha.SidecarTimeout)*time.Second, sidecarProbeTimeout)
+		if err := browser.NewSidecarClient(cfg.Captcha.SidecarURL, cfg.Captcha.SidecarToken, timeout).Health(); err != nil {
+			check.OK, check.Error = false, err.Error()
+		}
+	default:
+		if cfg.Captcha.YesCaptchaAPIKey == "" {
+			check.OK, check.Error = false, fmt.Sprintf("%s API key is not configured", method)
+		}
+	}
+	return check
+}
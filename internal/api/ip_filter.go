@@ -0,0 +1,87 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+	"flow2api/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// IPGuard rejects requests from addresses the security config does not
+// admit, and requests over the per-address rate limit. Behind a reverse
+// proxy the address comes from server.proxy_header of server.trusted_proxies.
+func IPGuard(filter *services.IPFilter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ok, retryAfter := filter.Check(c.IP())
+		if ok {
+			return c.Next()
+		}
+		if retryAfter > 0 {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			c.Set("Retry-After", strconv.Itoa(seconds))
+			return fail(c, 429, fmt.Sprintf("Rate limit exceeded for your address, retry in %ds", seconds))
+		}
+		logging.Component("ip_filter").Warn("Rejected request", "request_id", requestID(c), "ip", c.IP(), "path", c.Path())
+		return fail(c, 403, "Access denied")
+	}
+}
+
+// GetSecurityConfig returns the IP allowlist, denylist and per-IP rate limit
+func (h *AdminHandler) GetSecurityConfig(c *fiber.Ctx) error {
+	cfg, err := h.db.GetSecurityConfig()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, SecurityConfigView{Config: cfg, YourIP: c.IP()})
+}
+
+// UpdateSecurityConfig replaces the IP filters. A config that would lock out
+// the calling admin is refused.
+func (h *AdminHandler) UpdateSecurityConfig(c *fiber.Ctx) error {
+	req := &models.SecurityConfig{}
+	if err := c.BodyParser(req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	if req.RequestsPerMinute < 0 {
+		return fail(c, 400, "requests_per_minute must not be negative")
+	}
+	if req.RequestsPerMinute > 0 && req.Burst <= 0 {
+		req.Burst = int(math.Max(1, math.Ceil(req.RequestsPerMinute/60)))
+	}
+
+	// Store the entries as parsed, so single addresses and ranges read the same
+	for _, list := range []*[]string{&req.IPAllowlist, &req.IPDenylist} {
+		prefixes, err := services.ParseIPList(*list)
+		if err != nil {
+			return fail(c, 400, err.Error())
+		}
+		entries := make([]string, 0, len(prefixes))
+		for _, prefix := range prefixes {
+			if prefix.IsSingleIP() {
+				entries = append(entries, prefix.Addr().String())
+			} else {
+				entries = append(entries, prefix.String())
+			}
+		}
+		*list = entries
+	}
+	if ok, _ := services.Admits(req, c.IP()); !ok {
+		return fail(c, 400, fmt.Sprintf("These lists would block your own address (%s)", c.IP()))
+	}
+
+	if err := h.db.UpdateSecurityConfig(req); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if err := h.ipFilter.Reload(); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	logging.Component("ip_filter").Info("Security config updated", "allowlist", strings.Join(req.IPAllowlist, ","),
+		"denylist", strings.Join(req.IPDenylist, ","), "requests_per_minute", req.RequestsPerMinute)
+	return respond(c, SecurityConfigView{Config: req})
+}
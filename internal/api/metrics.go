@@ -0,0 +1,27 @@
+package api
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"strings"
+
+	"flow2api/internal/config"
+	"flow2api/internal/metrics"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Metrics serves the Prometheus metrics, behind server.metrics_token when set
+func (h *Handler) Metrics(c *fiber.Ctx) error {
+	if token := config.Get().Server.MetricsToken; token != "" {
+		given := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return c.Status(401).JSON(fiber.Map{"error": "Invalid metrics token"})
+		}
+	}
+
+	var buf bytes.Buffer
+	metrics.Write(&buf)
+	c.Set("Content-Type", metrics.ContentType)
+	return c.Send(buf.Bytes())
+}
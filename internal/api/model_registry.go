@@ -0,0 +1,157 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"flow2api/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetRegistryModels lists the models table, including disabled models
+func (h *AdminHandler) GetRegistryModels(c *fiber.Ctx) error {
+	registry, err := h.db.GetRegistryModels()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if registry == nil {
+		registry = []*models.RegistryModel{}
+	}
+	return respond(c, RegistryModelList{Models: registry})
+}
+
+// AddRegistryModel adds a model to the registry
+func (h *AdminHandler) AddRegistryModel(c *fiber.Ctx) error {
+	model := &models.RegistryModel{Enabled: true}
+	if err := c.BodyParser(model); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	model.Name = strings.TrimSpace(model.Name)
+	if model.Name == "" || strings.ContainsAny(model.Name, " \t/") {
+		return fail(c, 400, "name is required and must not contain spaces or slashes")
+	}
+	if _, err := h.db.GetRegistryModel(model.Name); err == nil {
+		return fail(c, 409, "Model already exists")
+	}
+	return h.saveRegistryModel(c, model)
+}
+
+// UpdateRegistryModel replaces the settings of a model, built-in ones
+// included
+func (h *AdminHandler) UpdateRegistryModel(c *fiber.Ctx) error {
+	existing, err := h.db.GetRegistryModel(c.Params("name"))
+	if err != nil {
+		return fail(c, 404, "Model not found")
+	}
+
+	model := &models.RegistryModel{ModelConfig: existing.ModelConfig, Enabled: existing.Enabled}
+	if err := c.BodyParser(model); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	model.Name = existing.Name
+	return h.saveRegistryModel(c, model)
+}
+
+func (h *AdminHandler) saveRegistryModel(c *fiber.Ctx, model *models.RegistryModel) error {
+	if err := model.Validate(); err != nil {
+		return fail(c, 400, err.Error())
+	}
+	if err := h.db.SaveRegistryModel(model); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return h.reloadModels(c)
+}
+
+// DeleteRegistryModel removes a model added in the admin panel. Built-in
+// models are seeded again at startup, so they can only be disabled.
+func (h *AdminHandler) DeleteRegistryModel(c *fiber.Ctx) error {
+	model, err := h.db.GetRegistryModel(c.Params("name"))
+	if err != nil {
+		return fail(c, 404, "Model not found")
+	}
+	if model.Builtin {
+		return fail(c, 400, "Built-in models cannot be deleted; disable it instead")
+	}
+
+	if err := h.db.DeleteRegistryModel(model.Name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fail(c, 404, "Model not found")
+		}
+		return fail(c, 500, err.Error())
+	}
+	return h.reloadModels(c)
+}
+
+// reloadModels applies a registry change to the models clients can use
+func (h *AdminHandler) reloadModels(c *fiber.Ctx) error {
+	if err := h.modelDiscovery.LoadModels(); err != nil {
+		return fail(c, 500, "Saved, but reloading the model registry failed: "+err.Error())
+	}
+	return respond(c, ModelCount{Count: len(models.ListModelConfigs())})
+}
+
+// GetModelAliases returns the model aliases and the default model
+func (h *AdminHandler) GetModelAliases(c *fiber.Ctx) error {
+	aliases, err := h.db.GetModelAliases()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if aliases == nil {
+		aliases = []*models.ModelAlias{}
+	}
+	defaultModel, _ := h.db.GetDefaultModel()
+	return respond(c, ModelAliases{Aliases: aliases, DefaultModel: defaultModel})
+}
+
+// SaveModelAlias adds an alias, or points an existing one at another model
+func (h *AdminHandler) SaveModelAlias(c *fiber.Ctx) error {
+	var req models.ModelAlias
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	req.Alias = strings.TrimSpace(req.Alias)
+	if req.Alias == "" || strings.ContainsAny(req.Alias, " \t/") {
+		return fail(c, 400, "alias is required and must not contain spaces or slashes")
+	}
+	if _, _, err := models.ResolveModel(req.Model, ""); err != nil {
+		return fail(c, 400, err.Error())
+	}
+
+	if err := h.db.SaveModelAlias(req.Alias, req.Model); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return h.reloadModels(c)
+}
+
+func (h *AdminHandler) DeleteModelAlias(c *fiber.Ctx) error {
+	if err := h.db.DeleteModelAlias(c.Params("alias")); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fail(c, 404, "Alias not found")
+		}
+		return fail(c, 500, err.Error())
+	}
+	return h.reloadModels(c)
+}
+
+// SetDefaultModel sets the model used when a client asks for an unknown
+// model; an empty model rejects unknown names again
+func (h *AdminHandler) SetDefaultModel(c *fiber.Ctx) error {
+	var req struct {
+		Model string `json:"model"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	if req.Model != "" {
+		if _, _, err := models.ResolveModel(req.Model, ""); err != nil {
+			return fail(c, 400, err.Error())
+		}
+	}
+
+	if err := h.db.SetDefaultModel(req.Model); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return h.reloadModels(c)
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"flow2api/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// uploadRefPrefix names a finished resumable upload wherever a reference
+// image URL is accepted, as upload:<id>
+const uploadRefPrefix = "upload:"
+
+// setUploadHeaders reports progress the way tus clients read it
+func setUploadHeaders(c *fiber.Ctx, upload *services.Upload) {
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+}
+
+// CreateUpload starts a resumable upload. The size comes as "size" in a JSON
+// body or as an Upload-Length header.
+func (h *Handler) CreateUpload(c *fiber.Ctx) error {
+	var req struct {
+		Size     int64  `json:"size"`
+		Filename string `json:"filename"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+	if length := c.Get("Upload-Length"); req.Size == 0 && length != "" {
+		req.Size, _ = strconv.ParseInt(length, 10, 64)
+	}
+	if limit := services.MaxUploadBytes(); req.Size <= 0 || req.Size > limit {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("size must be between 1 byte and %d MB", limit>>20)})
+	}
+
+	upload, err := h.uploads.Create(requestKeyID(c), req.Filename, req.Size)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to start upload"})
+	}
+	c.Set(fiber.HeaderLocation, "/v1/uploads/"+upload.ID)
+	setUploadHeaders(c, upload)
+	return c.Status(201).JSON(upload)
+}
+
+// GetUpload reports how much of an upload arrived; HEAD answers the headers only
+func (h *Handler) GetUpload(c *fiber.Ctx) error {
+	upload, err := h.uploads.Get(c.Params("id"), requestKeyID(c))
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	setUploadHeaders(c, upload)
+	return c.JSON(upload)
+}
+
+// AppendUpload writes the request body at the Upload-Offset header. A chunk
+// that does not start where the upload stands gets 409 with the offset to
+// resume from.
+func (h *Handler) AppendUpload(c *fiber.Ctx) error {
+	offset, err := strconv.ParseInt(strings.TrimSpace(c.Get("Upload-Offset")), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Upload-Offset header is required"})
+	}
+
+	upload, err := h.uploads.Append(c.Params("id"), requestKeyID(c), offset, c.Body())
+	switch {
+	case errors.Is(err, services.ErrUploadNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrUploadOffset):
+		setUploadHeaders(c, upload)
+		return c.Status(409).JSON(fiber.Map{"error": err.Error(), "offset": upload.Offset})
+	case errors.Is(err, services.ErrUploadTooLarge):
+		setUploadHeaders(c, upload)
+		return c.Status(413).JSON(fiber.Map{"error": err.Error(), "offset": upload.Offset})
+	case err != nil:
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to store chunk"})
+	}
+	setUploadHeaders(c, upload)
+	return c.JSON(upload)
+}
+
+// DeleteUpload discards an upload
+func (h *Handler) DeleteUpload(c *fiber.Ctx) error {
+	if err := h.uploads.Delete(c.Params("id"), requestKeyID(c)); err != nil {
+		if errors.Is(err, services.ErrUploadNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete upload"})
+	}
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// uploadedImage returns the content of a finished upload of keyID named as a
+// reference
+func (h *Handler) uploadedImage(ref, keyID string) ([]byte, error) {
+	id := strings.TrimPrefix(ref, uploadRefPrefix)
+	data, err := h.uploads.Data(id, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ref, err)
+	}
+	if err := checkReferenceImage(data, "upload "+id); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -2,39 +2,110 @@ package api
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"flow2api/internal/config"
+	"flow2api/internal/database"
+	"flow2api/internal/logging"
+	"flow2api/internal/metrics"
 	"flow2api/internal/models"
 	"flow2api/internal/services"
+	"flow2api/internal/storage"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
 // Handler holds API handlers
 type Handler struct {
-	generationHandler *services.GenerationHandler
+	generationHandler services.Generator
+	workerPool        *services.WorkerPool
 	tokenManager      *services.TokenManager
+	federation        *services.Federation
+	rateLimiter       *services.RateLimiter
+	webhooks          *services.WebhookVerifier
+	uploads           *services.UploadStore
+	events            *services.EventBus
+	db                *database.Database
 	cfg               *config.Config
+
+	publicStatus publicStatusCache
 }
 
 // NewHandler creates a new API handler
-func NewHandler(gh *services.GenerationHandler, tm *services.TokenManager, cfg *config.Config) *Handler {
+func NewHandler(gh services.Generator, wp *services.WorkerPool, tm *services.TokenManager, fed *services.Federation, rl *services.RateLimiter, uploads *services.UploadStore, events *services.EventBus, db *database.Database, cfg *config.Config) *Handler {
 	return &Handler{
 		generationHandler: gh,
+		workerPool:        wp,
 		tokenManager:      tm,
+		federation:        fed,
+		rateLimiter:       rl,
+		webhooks:          services.NewWebhookVerifier(),
+		uploads:           uploads,
+		events:            events,
+		db:                db,
 		cfg:               cfg,
 	}
 }
 
 // SetupRoutes configures all API routes
 func (h *Handler) SetupRoutes(app *fiber.App) {
+	app.Use("/v1", h.watchGenerations)
+
 	// OpenAI-compatible routes
 	app.Get("/v1/models", h.authMiddleware, h.ListModels)
+	app.Get("/v1/status", h.authMiddleware, h.Status)
+	app.Post("/v1/estimate", h.authMiddleware, h.Estimate)
 	app.Post("/v1/chat/completions", h.authMiddleware, h.ChatCompletions)
+	app.Post("/v1/images/generations", h.authMiddleware, h.GenerateImages)
+	app.Post("/v1/images/upscale", h.authMiddleware, h.UpscaleImage)
+	app.Get("/v1/tasks/:id/wait", h.authMiddleware, h.WaitTask)
+
+	// Resumable uploads of reference media, sent in chunks
+	app.Post("/v1/uploads", h.authMiddleware, h.CreateUpload)
+	app.Get("/v1/uploads/:id", h.authMiddleware, h.GetUpload)
+	app.Patch("/v1/uploads/:id", h.authMiddleware, h.AppendUpload)
+	app.Delete("/v1/uploads/:id", h.authMiddleware, h.DeleteUpload)
+
+	// Completion callbacks registered by the calling key
+	app.Get("/v1/webhooks", h.authMiddleware, h.GetWebhook)
+	app.Put("/v1/webhooks", h.authMiddleware, h.SetWebhook)
+	app.Delete("/v1/webhooks", h.authMiddleware, h.DeleteWebhook)
+
+	// Signed automation webhooks authenticate with an HMAC instead of the API key
+	app.Post("/v1/webhooks/generate", h.WebhookGenerate)
+
+	// Status page for downstream users
+	switch config.Get().Server.StatusPage {
+	case "public":
+		app.Get("/status", h.statusPage, h.PublicStatus)
+	case "key":
+		app.Get("/status", h.statusPage, h.authMiddleware, h.PublicStatus)
+	}
+
+	if config.Get().Server.Metrics {
+		app.Get("/metrics", h.Metrics)
+	}
+
+	// Liveness and readiness probes for orchestrators and load balancers
+	app.Get("/healthz", h.Healthz)
+	app.Get("/readyz", h.Readyz)
+	app.Get("/healthz/generation", h.GenerationHealth)
 }
 
 // authMiddleware verifies API key
@@ -45,39 +116,224 @@ func (h *Handler) authMiddleware(c *fiber.Ctx) error {
 	}
 
 	apiKey := strings.TrimPrefix(auth, "Bearer ")
-	if apiKey != h.cfg.GetAPIKey() {
+	if h.cfg.MatchAPIKey(apiKey) {
+		return c.Next()
+	}
+
+	// Additional keys carry their own model allowlist
+	key, err := h.db.GetAPIKeyByKey(apiKey)
+	if err != nil || key == nil || !key.Enabled {
 		return c.Status(401).JSON(fiber.Map{"error": "Invalid API key"})
 	}
+	c.Locals("api_key", key)
 
 	return c.Next()
 }
 
-// ListModels returns available models
+// requestKey returns the additional API key of the request, nil for the global key
+func requestKey(c *fiber.Ctx) *models.APIKey {
+	key, _ := c.Locals("api_key").(*models.APIKey)
+	return key
+}
+
+// requestKeyID identifies the calling key in task records by its ID, which
+// unlike the name is unique and never changes; "default" is the global key
+func requestKeyID(c *fiber.Ctx) string {
+	if key := requestKey(c); key != nil {
+		return models.APIKeyID(key.ID)
+	}
+	return "default"
+}
+
+// taskOwned reports whether the calling key may use a task: its own tasks,
+// or any task for the global key
+func (h *Handler) taskOwned(c *fiber.Ctx, taskID string) (bool, error) {
+	if requestKey(c) == nil {
+		return true, nil
+	}
+	task, err := h.db.GetTask(taskID)
+	if err != nil {
+		return false, err
+	}
+	return task != nil && task.Params != nil && task.Params.KeyID == requestKeyID(c), nil
+}
+
+// requestPrivacy returns the calling key's privacy mode and caching opt-out
+func requestPrivacy(c *fiber.Ctx) (string, bool) {
+	if key := requestKey(c); key != nil {
+		return key.PrivacyMode, key.SkipCache
+	}
+	return "", false
+}
+
+// requestTokenGroup returns the token group bound to the calling key, 0 when
+// requests should be routed by model
+func requestTokenGroup(c *fiber.Ctx) int64 {
+	if key := requestKey(c); key != nil {
+		return key.TokenGroupID
+	}
+	return 0
+}
+
+// requestID returns the ID assigned to the HTTP request for log correlation
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("requestid").(string)
+	return id
+}
+
+// requestBatch reports whether the client marked the request as batch work
+func requestBatch(c *fiber.Ctx) bool {
+	return strings.EqualFold(c.Get(services.PriorityHeader), "batch")
+}
+
+// generationError is the body of a failed generation request, carrying the
+// announcement when one is set
+func (h *Handler) generationError(message string) fiber.Map {
+	body := fiber.Map{"error": message}
+	if announcement := h.cfg.GetAnnouncement(); announcement != "" {
+		body["announcement"] = announcement
+	}
+	return body
+}
+
+// rateLimited takes a request from the model's rate limit buckets and writes a
+// 429 with Retry-After when they are empty
+func (h *Handler) rateLimited(c *fiber.Ctx, model string) (bool, error) {
+	ok, retryAfter := h.rateLimiter.Allow(model)
+	if ok {
+		return false, nil
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Set("Retry-After", strconv.Itoa(seconds))
+	return true, c.Status(429).JSON(h.generationError(fmt.Sprintf("Rate limit exceeded for %s, retry in %ds", model, seconds)))
+}
+
+// modelAllowance returns a check for models a generation switches to after it
+// left the route: the key's allowlist, then the model's rate limit. It keeps
+// the key rather than c, which is reused once the handler returns.
+func (h *Handler) modelAllowance(c *fiber.Ctx) func(model string) bool {
+	key := requestKey(c)
+	return func(model string) bool {
+		if !key.AllowsModel(model, models.BaseModelName(model)) {
+			return false
+		}
+		ok, _ := h.rateLimiter.Allow(model)
+		return ok
+	}
+}
+
+// checkModelAllowed enforces the key's model allowlist against the requested,
+// base and resolved model names
+func checkModelAllowed(c *fiber.Ctx, model, aspectRatio string) error {
+	key := requestKey(c)
+	if key == nil {
+		return nil
+	}
+	names := []string{model, models.BaseModelName(model)}
+	if resolved, _, err := models.ResolveModel(model, aspectRatio); err == nil {
+		names = append(names, resolved)
+	}
+	if !key.AllowsModel(names...) {
+		return fmt.Errorf("API key %s is not allowed to use model %s", key.Name, model)
+	}
+	return nil
+}
+
+// ListModels returns available models, one entry per base model with its supported aspect ratios
 func (h *Handler) ListModels(c *fiber.Ctx) error {
 	var modelList []fiber.Map
 
-	for modelID, cfg := range models.ModelConfigs {
+	key := requestKey(c)
+	seen := make(map[string]bool)
+	for modelID, cfg := range models.ListModelConfigs() {
+		baseID := models.BaseModelName(modelID)
+		if seen[baseID] || !key.AllowsModel(modelID, baseID) {
+			continue
+		}
+		seen[baseID] = true
+
 		description := cfg.Type + " generation"
 		if cfg.Type == "image" {
 			description += " - " + cfg.ModelName
 		} else {
-			description += " - " + cfg.ModelKey
+			description += " - " + strings.TrimSuffix(cfg.ModelKey, "_portrait")
 		}
 
 		modelList = append(modelList, fiber.Map{
-			"id":          modelID,
-			"object":      "model",
-			"owned_by":    "flow2api",
-			"description": description,
+			"id":            baseID,
+			"object":        "model",
+			"owned_by":      "flow2api",
+			"description":   description,
+			"aspect_ratios": models.SupportedAspectRatios(cfg.Type),
 		})
 	}
 
+	// Aliases are listed for clients that check the name they were built for
+	for alias, target := range models.ListAliases() {
+		resolved, cfg, err := models.ResolveModel(target, "")
+		if err != nil || seen[alias] || !key.AllowsModel(target, models.BaseModelName(target), resolved) {
+			continue
+		}
+		seen[alias] = true
+		modelList = append(modelList, fiber.Map{
+			"id":            alias,
+			"object":        "model",
+			"owned_by":      "flow2api",
+			"description":   "alias of " + target,
+			"aspect_ratios": models.SupportedAspectRatios(cfg.Type),
+		})
+	}
+
+	sort.Slice(modelList, func(i, j int) bool {
+		return modelList[i]["id"].(string) < modelList[j]["id"].(string)
+	})
+
 	return c.JSON(fiber.Map{
 		"object": "list",
 		"data":   modelList,
 	})
 }
 
+// Status returns model availability, pool load and recent completion times for schedulers
+func (h *Handler) Status(c *fiber.Ctx) error {
+	status, err := h.generationHandler.Status()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	status.Queues = h.workerPool.Stats()
+	status.Draining = h.workerPool.Draining()
+	return c.JSON(status)
+}
+
+// Estimate returns the expected cost and wait of a request without running it
+func (h *Handler) Estimate(c *fiber.Ctx) error {
+	var req models.EstimateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	req.Model = models.CanonicalModel(req.Model)
+	if req.Model == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "model is required"})
+	}
+	if req.N < 0 || req.N > services.MaxImagesPerRequest {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("n must be between 1 and %d", services.MaxImagesPerRequest)})
+	}
+
+	aspectRatio, err := models.ParseAspectRatio(req.AspectRatio, req.Size)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := checkModelAllowed(c, req.Model, aspectRatio); err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	estimate, err := h.generationHandler.Estimate(req.Model, aspectRatio, req.N, req.ImageCount, requestTokenGroup(c))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(estimate)
+}
+
 // ChatCompletions handles chat completion requests
 func (h *Handler) ChatCompletions(c *fiber.Ctx) error {
 	var req models.ChatCompletionRequest
@@ -85,25 +341,155 @@ func (h *Handler) ChatCompletions(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
+	// Multipart requests carry reference images and video frames as files
+	// next to the fields
+	var uploaded, frames [][]byte
+	if isMultipart(c) {
+		if err := chatForm(c, &req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		var err error
+		if uploaded, err = formImages(c); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if frames, err = formFrames(c); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
 	if len(req.Messages) == 0 {
 		return c.Status(400).JSON(fiber.Map{"error": "Messages cannot be empty"})
 	}
+	req.Model = models.CanonicalModel(req.Model)
+
+	applyExtraBody(&req)
+	if req.Seed != nil && *req.Seed < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "seed must be a non-negative integer"})
+	}
+	if req.N < 0 || req.N > services.MaxImagesPerRequest {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("n must be between 1 and %d", services.MaxImagesPerRequest)})
+	}
+
+	aspectRatio, err := models.ParseAspectRatio(req.AspectRatio, req.Size)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Check the key before reference images are fetched from remote hosts
+	if err := checkModelAllowed(c, req.Model, aspectRatio); err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Availability checks do not reach Flow and are not rate limited
+	if req.Stream {
+		if limited, err := h.rateLimited(c, req.Model); limited {
+			return err
+		}
+	}
 
 	// Extract prompt and images
 	lastMessage := req.Messages[len(req.Messages)-1]
-	prompt, images := h.extractContent(lastMessage)
+	prompt, images, err := h.extractContent(lastMessage, requestKeyID(c))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 
 	// Fallback to deprecated image parameter
 	if req.Image != "" && len(images) == 0 {
-		if imgBytes := h.parseBase64Image(req.Image); imgBytes != nil {
+		imgBytes, err := h.resolveImage(req.Image, requestKeyID(c))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if imgBytes != nil {
 			images = append(images, imgBytes)
 		}
 	}
+	images = append(images, uploaded...)
+	if len(frames) > 0 {
+		// Frames are positional, so they cannot be mixed with other references
+		if len(images) > 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "send start_frame and end_frame without other reference images"})
+		}
+		images = frames
+	}
 
 	if prompt == "" {
 		return c.Status(400).JSON(fiber.Map{"error": "Prompt cannot be empty"})
 	}
 
+	// Keys other than the global one only extend their own videos
+	if req.TaskID != "" {
+		if owned, err := h.taskOwned(c, req.TaskID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		} else if !owned {
+			return c.Status(404).JSON(fiber.Map{"error": "Task not found"})
+		}
+	}
+
+	// Reject unusable reference counts, frames and prompts before anything is uploaded
+	if model, modelConfig, err := models.ResolveModel(req.Model, aspectRatio); err == nil {
+		if err := modelConfig.CheckImageCount(model, len(images)); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if images, err = services.FitFrames(model, modelConfig, images); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error(), "code": models.FrameOrientationErrorCode})
+		}
+		if _, _, err := services.FitPrompt(model, modelConfig, prompt); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error(), "code": models.PromptTooLongErrorCode})
+		}
+	}
+
+	// Federation: hand the request to a peer when no local token can take it.
+	// Extensions stay local because the prior task only exists here, and
+	// multipart uploads because peers are sent JSON.
+	if h.federation.Enabled() && c.Get(services.ForwardedHeader) == "" && req.TaskID == "" && !isMultipart(c) &&
+		!bytes.Contains(c.Body(), []byte(uploadRefPrefix)) &&
+		!h.generationHandler.CanServe(req.Model, aspectRatio) {
+		if peer, ok := h.federation.PickPeer(req.Model); ok {
+			return h.relayToPeer(c, peer, req.Model, req.Stream)
+		}
+	}
+
+	genReq := &services.GenerationRequest{
+		RequestID:      requestID(c),
+		Model:          req.Model,
+		Prompt:         prompt,
+		Images:         images,
+		Stream:         req.Stream,
+		KeyID:          requestKeyID(c),
+		PriorTaskID:    req.TaskID,
+		AspectRatio:    aspectRatio,
+		Seed:           req.Seed,
+		NegativePrompt: strings.TrimSpace(req.NegativePrompt),
+		N:              req.N,
+		Trace:          c.Get(services.TraceHeader) != "",
+		ImageFallback:  req.ImageFallback,
+	}
+	genReq.PrivacyMode, genReq.SkipCache = requestPrivacy(c)
+	genReq.TokenGroupID = requestTokenGroup(c)
+	genReq.Batch = requestBatch(c)
+	if genReq.ImageFallback {
+		genReq.AllowModel = h.modelAllowance(c)
+	}
+
+	if req.ResponseFormat != nil && (req.ResponseFormat.Type == "json" || req.ResponseFormat.Type == "json_object") {
+		genReq.ResponseFormat = services.ResponseFormatJSON
+	}
+
+	// A streaming client that goes away cancels the generation; the stream
+	// notices when a write to it fails
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if req.Stream {
+		genReq.Context = ctx
+	}
+
+	// Queue before responding so a full queue can still be reported as an HTTP error
+	chunkChan := make(chan string, 100)
+	if err := h.workerPool.Submit(genReq, chunkChan); err != nil {
+		cancel(nil)
+		return c.Status(503).JSON(h.generationError(err.Error()))
+	}
+
 	if req.Stream {
 		// Streaming response
 		c.Set("Content-Type", "text/event-stream")
@@ -111,16 +497,24 @@ func (h *Handler) ChatCompletions(c *fiber.Ctx) error {
 		c.Set("Connection", "keep-alive")
 		c.Set("X-Accel-Buffering", "no")
 
+		watch := generationWatchOf(c)
+		meter := metrics.StartStream(c.Route().Path, metricModel(req.Model, aspectRatio))
 		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
-			chunkChan := make(chan string, 100)
-
-			go func() {
-				h.generationHandler.HandleGeneration(req.Model, prompt, images, true, chunkChan)
-			}()
-
+			defer watch.done()
+			defer meter.Done()
+			defer cancel(nil)
 			for chunk := range chunkChan {
+				// Drain what the cancelled generation still sends
+				if ctx.Err() != nil {
+					continue
+				}
 				w.WriteString(chunk)
-				w.Flush()
+				if err := w.Flush(); err != nil {
+					logging.Component("generation").Info("Client disconnected, cancelling generation", "request_id", genReq.RequestID)
+					cancel(services.ErrClientDisconnected)
+					continue
+				}
+				meter.Chunk()
 			}
 
 			w.WriteString("data: [DONE]\n\n")
@@ -130,13 +524,8 @@ func (h *Handler) ChatCompletions(c *fiber.Ctx) error {
 		return nil
 	}
 
-	// Non-streaming response
-	chunkChan := make(chan string, 100)
-
-	go func() {
-		h.generationHandler.HandleGeneration(req.Model, prompt, images, false, chunkChan)
-	}()
-
+	// Non-streaming response; only streams notice a client leaving
+	cancel(nil)
 	var result string
 	for chunk := range chunkChan {
 		result = chunk
@@ -150,11 +539,497 @@ func (h *Handler) ChatCompletions(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{"result": result})
 	}
 
-	return c.Status(500).JSON(fiber.Map{"error": "Generation failed: No response"})
+	return c.Status(500).JSON(h.generationError("Generation failed: No response"))
 }
 
-// extractContent extracts prompt and images from message
-func (h *Handler) extractContent(msg models.ChatMessage) (string, [][]byte) {
+// applyExtraBody fills unset generation options from extra_body
+func applyExtraBody(req *models.ChatCompletionRequest) {
+	extra := req.ExtraBody
+	if extra == nil {
+		return
+	}
+	if req.Seed == nil {
+		req.Seed = extra.Seed
+	}
+	if req.NegativePrompt == "" {
+		req.NegativePrompt = extra.NegativePrompt
+	}
+	if req.AspectRatio == "" {
+		req.AspectRatio = extra.AspectRatio
+	}
+	if req.TaskID == "" {
+		req.TaskID = extra.TaskID
+	}
+	if !req.ImageFallback {
+		req.ImageFallback = extra.ImageFallback
+	}
+}
+
+// metricModel is the registry model a request resolves to, "unknown" when it
+// does not; clients cannot add metric series by sending made-up names
+func metricModel(model, aspectRatio string) string {
+	resolved, _, err := models.ResolveModel(model, aspectRatio)
+	if err != nil {
+		return "unknown"
+	}
+	return resolved
+}
+
+// relayToPeer forwards the raw request body to a peer instance and relays its response
+func (h *Handler) relayToPeer(c *fiber.Ctx, peer config.PeerConfig, model string, stream bool) error {
+	logging.Component("federation").Info("No local token, forwarding to peer", "request_id", requestID(c), "model", model, "peer", peer.URL)
+
+	resp, err := h.federation.Forward(peer, c.Body())
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	c.Status(resp.StatusCode)
+	c.Set("Content-Type", resp.Header.Get("Content-Type"))
+
+	if !stream || resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return c.Status(502).JSON(fiber.Map{"error": "Failed to read peer response"})
+		}
+		return c.Send(body)
+	}
+
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	watch := generationWatchOf(c)
+	meter := metrics.StartStream(c.Route().Path, metricModel(model, ""))
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer watch.done()
+		defer meter.Done()
+		defer resp.Body.Close()
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				w.Write(buf[:n])
+				if w.Flush() != nil {
+					return
+				}
+				meter.Chunk()
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// GenerateImages handles OpenAI-compatible image generation requests
+func (h *Handler) GenerateImages(c *fiber.Ctx) error {
+	var req models.ImageGenerationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	req.Model = models.CanonicalModel(req.Model)
+	if req.Model == "" || strings.TrimSpace(req.Prompt) == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "model and prompt are required"})
+	}
+	if req.ResponseFormat != "" && req.ResponseFormat != "url" {
+		return c.Status(400).JSON(fiber.Map{"error": "Only response_format url is supported"})
+	}
+	if req.N < 0 || req.N > services.MaxImagesPerRequest {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("n must be between 1 and %d", services.MaxImagesPerRequest)})
+	}
+	if req.Seed != nil && *req.Seed < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "seed must be a non-negative integer"})
+	}
+
+	aspectRatio, err := models.ParseAspectRatio(req.AspectRatio, req.Size)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	model, modelConfig, err := models.ResolveModel(req.Model, aspectRatio)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	} else if modelConfig.Type != "image" {
+		return c.Status(400).JSON(fiber.Map{"error": "model must be an image model"})
+	}
+	if err := checkModelAllowed(c, req.Model, aspectRatio); err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+	if limited, err := h.rateLimited(c, req.Model); limited {
+		return err
+	}
+
+	// Reference images come as URLs in JSON or as files (and URL fields) in
+	// multipart bodies
+	if isMultipart(c) {
+		req.Images = append(req.Images, formImageRefs(c)...)
+	}
+	var images [][]byte
+	for _, ref := range req.Images {
+		imgBytes, err := h.resolveImage(ref, requestKeyID(c))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if imgBytes == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "images must be data, http(s) or upload: URLs"})
+		}
+		images = append(images, imgBytes)
+	}
+	if isMultipart(c) {
+		uploaded, err := formImages(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		form, err := c.MultipartForm()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid multipart body"})
+		}
+		if len(form.File["start_frame"])+len(form.File["end_frame"]) > 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "start_frame and end_frame are for video models"})
+		}
+		images = append(images, uploaded...)
+	}
+	if err := modelConfig.CheckImageCount(model, len(images)); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	privacyMode, skipCache := requestPrivacy(c)
+	result, err := h.workerPool.Generate(&services.GenerationRequest{
+		RequestID:      requestID(c),
+		Model:          req.Model,
+		Prompt:         req.Prompt,
+		Images:         images,
+		KeyID:          requestKeyID(c),
+		AspectRatio:    aspectRatio,
+		Seed:           req.Seed,
+		NegativePrompt: strings.TrimSpace(req.NegativePrompt),
+		N:              req.N,
+		Trace:          c.Get(services.TraceHeader) != "",
+		PrivacyMode:    privacyMode,
+		SkipCache:      skipCache,
+		TokenGroupID:   requestTokenGroup(c),
+		Batch:          requestBatch(c),
+	})
+	if errors.Is(err, services.ErrQueueFull) || errors.Is(err, services.ErrDraining) {
+		return c.Status(503).JSON(h.generationError(err.Error()))
+	} else if err != nil {
+		return c.Status(500).JSON(h.generationError(err.Error()))
+	}
+
+	data := make([]fiber.Map, 0, len(result.URLs))
+	for _, url := range result.URLs {
+		data = append(data, fiber.Map{"url": url})
+	}
+
+	return c.JSON(fiber.Map{
+		"created": time.Now().Unix(),
+		"task_id": result.TaskID,
+		"data":    data,
+		"usage":   result.Usage,
+	})
+}
+
+// WebhookGenerate starts a generation from a signed webhook and returns its task ID
+// without waiting; progress is published on the admin event stream
+func (h *Handler) WebhookGenerate(c *fiber.Ctx) error {
+	body := c.Body()
+	if err := h.webhooks.Verify(c.Get(services.WebhookTimestampHeader), c.Get(services.WebhookNonceHeader),
+		c.Get(services.WebhookSignatureHeader), body); err != nil {
+		logging.Component("webhook").Warn("Rejected request", "request_id", requestID(c), "ip", c.IP(), "error", err)
+		return c.Status(401).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var req models.ImageGenerationRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	req.Model = models.CanonicalModel(req.Model)
+	if req.Model == "" || strings.TrimSpace(req.Prompt) == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "model and prompt are required"})
+	}
+	if req.N < 0 || req.N > services.MaxImagesPerRequest {
+		return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("n must be between 1 and %d", services.MaxImagesPerRequest)})
+	}
+	if req.Seed != nil && *req.Seed < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "seed must be a non-negative integer"})
+	}
+
+	aspectRatio, err := models.ParseAspectRatio(req.AspectRatio, req.Size)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if _, _, err := models.ResolveModel(req.Model, aspectRatio); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if limited, err := h.rateLimited(c, req.Model); limited {
+		return err
+	}
+
+	genReq := &services.GenerationRequest{
+		RequestID:      requestID(c),
+		Model:          req.Model,
+		Prompt:         req.Prompt,
+		KeyID:          "webhook",
+		AspectRatio:    aspectRatio,
+		Seed:           req.Seed,
+		NegativePrompt: strings.TrimSpace(req.NegativePrompt),
+		N:              req.N,
+		Stream:         true,
+		TaskID:         uuid.New().String(),
+		Batch:          true,
+	}
+	chunkChan := make(chan string, 100)
+	if err := h.workerPool.Submit(genReq, chunkChan); err != nil {
+		return c.Status(503).JSON(h.generationError(err.Error()))
+	}
+	go func() {
+		for range chunkChan {
+		}
+	}()
+
+	return c.Status(202).JSON(fiber.Map{"success": true, "task_id": genReq.TaskID})
+}
+
+// GetWebhook returns the calling key's completion callback, without its secret
+func (h *Handler) GetWebhook(c *fiber.Ctx) error {
+	hook, err := h.db.GetKeyWebhook(requestKeyID(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"success": true, "webhook": hook})
+}
+
+// SetWebhook registers the calling key's completion callback. The secret is
+// returned once so the receiver can verify signatures.
+func (h *Handler) SetWebhook(c *fiber.Ctx) error {
+	var req models.KeyWebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "url must be an absolute http(s) URL"})
+	}
+	if err := services.CheckPublicHost(u.Hostname()); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "url must point at a public address: " + err.Error()})
+	}
+	if req.Secret == "" {
+		bytes := make([]byte, 24)
+		rand.Read(bytes)
+		req.Secret = "whsec_" + hex.EncodeToString(bytes)
+	} else if len(req.Secret) < 16 {
+		return c.Status(400).JSON(fiber.Map{"error": "secret must be at least 16 characters"})
+	}
+
+	hook := &models.KeyWebhook{KeyID: requestKeyID(c), URL: req.URL, Secret: req.Secret}
+	if err := h.db.SetKeyWebhook(hook); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"success": true, "webhook": hook, "secret": hook.Secret})
+}
+
+// DeleteWebhook removes the calling key's completion callback
+func (h *Handler) DeleteWebhook(c *fiber.Ctx) error {
+	if err := h.db.DeleteKeyWebhook(requestKeyID(c)); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"success": true})
+}
+
+// maxTaskWait caps how long WaitTask holds a request open
+const maxTaskWait = 5 * time.Minute
+
+// taskWaitRecheck is how often WaitTask rereads a task between events, for
+// finishes it missed because the event bus dropped them
+const taskWaitRecheck = 15 * time.Second
+
+// WaitTask long-polls a task: it returns as soon as the task completes or
+// fails, or with done=false and the current state once the timeout elapses
+func (h *Handler) WaitTask(c *fiber.Ctx) error {
+	timeout := 60 * time.Second
+	if raw := c.Query("timeout"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			seconds, convErr := strconv.Atoi(raw)
+			if convErr != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "timeout must be a duration such as 60s"})
+			}
+			d = time.Duration(seconds) * time.Second
+		}
+		if d < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "timeout must not be negative"})
+		}
+		timeout = min(d, maxTaskWait)
+	}
+
+	taskID := c.Params("id")
+	// Subscribe before the first read so a finish in between is not missed
+	events, unsubscribe := h.events.Subscribe()
+	defer unsubscribe()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	recheck := time.NewTicker(taskWaitRecheck)
+	defer recheck.Stop()
+
+	expired := false
+	for {
+		task, err := h.db.GetTask(taskID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var owner string
+		if task != nil {
+			if task.Params != nil {
+				owner = task.Params.KeyID
+			}
+		} else {
+			var pending bool
+			if owner, pending = h.workerPool.Pending(taskID); !pending {
+				return c.Status(404).JSON(fiber.Map{"error": "Task not found"})
+			}
+		}
+		// Keys other than the global one only see their own tasks
+		if requestKey(c) != nil && owner != requestKeyID(c) {
+			return c.Status(404).JSON(fiber.Map{"error": "Task not found"})
+		}
+
+		done := task != nil && task.Status != "processing"
+		if done || expired {
+			if task != nil {
+				task.UpstreamStatus = nil // admin-only diagnostics
+				task.ResultURLs = storage.SignURLs(task.ResultURLs)
+			}
+			return c.JSON(fiber.Map{"success": true, "done": done, "task": task})
+		}
+
+		// Wait for the task's own finish, the recheck or the deadline
+	wait:
+		for {
+			select {
+			case event := <-events:
+				if taskEventFor(event, taskID) {
+					break wait
+				}
+			case <-recheck.C:
+				break wait
+			case <-deadline.C:
+				expired = true
+				break wait
+			case <-c.Context().Done():
+				// The server is shutting down
+				return nil
+			}
+		}
+	}
+}
+
+// taskEventFor reports whether event is taskID finishing
+func taskEventFor(event services.Event, taskID string) bool {
+	if event.Type != services.EventGenerationCompleted && event.Type != services.EventGenerationFailed {
+		return false
+	}
+	data, _ := event.Data.(map[string]interface{})
+	id, _ := data["task_id"].(string)
+	return id == taskID
+}
+
+// UpscaleImage upscales an uploaded image or a prior generation result
+func (h *Handler) UpscaleImage(c *fiber.Ctx) error {
+	var req models.UpscaleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	var uploaded [][]byte
+	if isMultipart(c) {
+		var err error
+		if uploaded, err = formImages(c); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if len(uploaded) > 1 {
+			return c.Status(400).JSON(fiber.Map{"error": "upload one image to upscale"})
+		}
+	}
+	if req.Image == "" && len(uploaded) == 0 && req.MediaID == "" && req.TaskID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "image, media_id or task_id is required"})
+	}
+
+	if err := checkModelAllowed(c, services.UpscaleModel, ""); err != nil {
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Keys other than the global one only upscale their own results
+	if req.TaskID != "" {
+		if owned, err := h.taskOwned(c, req.TaskID); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		} else if !owned {
+			return c.Status(404).JSON(fiber.Map{"error": "Task not found"})
+		}
+	}
+
+	aspectRatio, err := models.ParseAspectRatio(req.AspectRatio, req.Size)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if _, ok := models.FlowAspectRatio("image", aspectRatio); aspectRatio != "" && !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "aspect ratio " + aspectRatio + " is not supported for image models"})
+	}
+
+	upscaleReq := &services.UpscaleRequest{
+		RequestID:    requestID(c),
+		MediaID:      req.MediaID,
+		TaskID:       req.TaskID,
+		Resolution:   strings.ToLower(req.Resolution),
+		AspectRatio:  aspectRatio,
+		KeyID:        requestKeyID(c),
+		TokenGroupID: requestTokenGroup(c),
+	}
+	if len(uploaded) == 1 {
+		upscaleReq.Image = uploaded[0]
+	} else if req.Image != "" {
+		imgBytes, err := h.resolveImage(req.Image, requestKeyID(c))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if imgBytes == nil {
+			imgBytes, _ = base64.StdEncoding.DecodeString(req.Image)
+		}
+		if len(imgBytes) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid image data"})
+		}
+		if limit := maxReferenceImageBytes(); int64(len(imgBytes)) > limit {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("image is larger than %d MB", limit>>20)})
+		}
+		upscaleReq.Image = imgBytes
+	}
+
+	if limited, err := h.rateLimited(c, services.UpscaleModel); limited {
+		return err
+	}
+
+	result, err := h.generationHandler.HandleUpscale(upscaleReq)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	item := fiber.Map{"url": result.URL}
+	if req.ResponseFormat == "b64_json" {
+		item = fiber.Map{"b64_json": base64.StdEncoding.EncodeToString(result.Image)}
+	}
+
+	return c.JSON(fiber.Map{
+		"created": time.Now().Unix(),
+		"task_id": result.TaskID,
+		"data":    []fiber.Map{item},
+	})
+}
+
+// extractContent extracts prompt and images from message; image URLs are
+// fetched, and uploads are looked up among keyID's
+func (h *Handler) extractContent(msg models.ChatMessage, keyID string) (string, [][]byte, error) {
 	var prompt string
 	var images [][]byte
 
@@ -174,7 +1049,11 @@ func (h *Handler) extractContent(msg models.ChatMessage) (string, [][]byte) {
 			} else if itemType == "image_url" {
 				if imageURL, ok := itemMap["image_url"].(map[string]interface{}); ok {
 					if url, ok := imageURL["url"].(string); ok {
-						if imgBytes := h.parseBase64Image(url); imgBytes != nil {
+						imgBytes, err := h.resolveImage(url, keyID)
+						if err != nil {
+							return "", nil, err
+						}
+						if imgBytes != nil {
 							images = append(images, imgBytes)
 						}
 					}
@@ -183,7 +1062,7 @@ func (h *Handler) extractContent(msg models.ChatMessage) (string, [][]byte) {
 		}
 	}
 
-	return prompt, images
+	return prompt, images, nil
 }
 
 // parseBase64Image parses base64 image data
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RunSelfTest runs an end-to-end generation self-test and returns its result
+func (h *AdminHandler) RunSelfTest(c *fiber.Ctx) error {
+	result, err := h.generator.RunSelfTest()
+	switch {
+	case errors.Is(err, services.ErrSelfTestDisabled):
+		return fail(c, 400, "Self-test is not enabled; set [selftest] in setting.toml")
+	case errors.Is(err, services.ErrSelfTestRunning):
+		return fail(c, 409, err.Error())
+	case err != nil:
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, SelfTestRun{Success: result.OK, Result: result})
+}
+
+// GetSelfTest returns the result of the last self-test
+func (h *AdminHandler) GetSelfTest(c *fiber.Ctx) error {
+	return respond(c, SelfTestStatus{Enabled: config.Get().SelfTest.Enabled, Result: h.generator.LastSelfTest()})
+}
+
+// GenerationHealth answers 200 while the last self-test passed within
+// selftest.max_age, for external monitors; otherwise 503. It needs no key, so
+// only the status is given; the admin API has the details.
+func (h *Handler) GenerationHealth(c *fiber.Ctx) error {
+	cfg := config.Get().SelfTest
+	if !cfg.Enabled {
+		return c.Status(404).JSON(fiber.Map{"error": "Self-test is not enabled"})
+	}
+
+	result := h.generationHandler.LastSelfTest()
+	status := "ok"
+	switch {
+	case result == nil:
+		status = "unknown"
+	case !result.OK:
+		status = "failing"
+	case time.Since(result.StartedAt) > time.Duration(cfg.MaxAge)*time.Second:
+		status = "stale"
+	}
+
+	code := fiber.StatusOK
+	if status != "ok" {
+		code = fiber.StatusServiceUnavailable
+	}
+	return c.Status(code).JSON(fiber.Map{"status": status})
+}
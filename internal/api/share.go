@@ -0,0 +1,187 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/models"
+	"flow2api/internal/services"
+	"flow2api/internal/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultShareTTL = 24 * time.Hour
+	maxShareTTL     = 30 * 24 * time.Hour
+)
+
+// mediaClient fetches cached media from remote storage; the timeout covers
+// the whole transfer, so a stalled store cannot hold a request forever
+var mediaClient = &http.Client{Timeout: 10 * time.Minute}
+
+// hashSharePassword returns "salt$hex(sha256(salt + password))"
+func hashSharePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	saltHex := hex.EncodeToString(salt)
+	sum := sha256.Sum256([]byte(saltHex + password))
+	return saltHex + "$" + hex.EncodeToString(sum[:]), nil
+}
+
+func checkSharePassword(hash, password string) bool {
+	salt, want, ok := strings.Cut(hash, "$")
+	if !ok {
+		return false
+	}
+	sum := sha256.Sum256([]byte(salt + password))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(want)) == 1
+}
+
+// ShareMedia creates a public, expiring link to a cached file. :id is the
+// file's ID or its key (the file name at the end of its cached URL).
+func (h *AdminHandler) ShareMedia(c *fiber.Ctx) error {
+	var req models.MediaShareRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fail(c, 400, "Invalid request")
+		}
+	}
+	ttl := defaultShareTTL
+	if req.ExpiresIn < 0 {
+		return fail(c, 400, "expires_in must not be negative")
+	}
+	if req.ExpiresIn > 0 {
+		ttl = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if ttl > maxShareTTL {
+		return fail(c, 400, fmt.Sprintf("expires_in must be at most %d seconds", int(maxShareTTL.Seconds())))
+	}
+
+	id := c.Params("id")
+	var file *models.CachedFile
+	var err error
+	if n, convErr := strconv.ParseInt(id, 10, 64); convErr == nil {
+		file, err = h.db.GetCachedFile(n)
+	} else {
+		file, err = h.db.GetCachedFileByKey(id)
+	}
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if file == nil {
+		return fail(c, 404, "Media not found")
+	}
+
+	tokenBytes := make([]byte, 24)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	share := &models.MediaShare{
+		Token:     hex.EncodeToString(tokenBytes),
+		FileID:    file.ID,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	}
+	if req.Password != "" {
+		if share.PasswordHash, err = hashSharePassword(req.Password); err != nil {
+			return fail(c, 500, err.Error())
+		}
+	}
+	if err := h.db.AddMediaShare(share); err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	baseURL := strings.TrimRight(config.Get().Cache.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = c.BaseURL()
+	}
+	return respond(c, MediaShareLink{
+		URL:       baseURL + "/share/" + share.Token,
+		Token:     share.Token,
+		ExpiresAt: share.ExpiresAt,
+		Protected: share.PasswordHash != "",
+	})
+}
+
+// sharePasswordForm is shown for password-protected links opened in a browser
+const sharePasswordForm = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Flow2API</title></head>
+<body style="font-family:sans-serif;display:flex;justify-content:center;margin-top:15vh">
+<form method="post"><p>%s</p><input type="password" name="password" autofocus> <button type="submit">Open</button></form>
+</body></html>`
+
+// ServeShare serves the file behind a share link. Protected links take the
+// password from the X-Share-Password header, ?password= or a posted form.
+func (h *AdminHandler) ServeShare(c *fiber.Ctx) error {
+	share, err := h.db.GetMediaShare(c.Params("token"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if share == nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Share link not found"})
+	}
+	if time.Now().After(share.ExpiresAt) {
+		return c.Status(410).JSON(fiber.Map{"error": "Share link has expired"})
+	}
+
+	if share.PasswordHash != "" {
+		password := c.Get("X-Share-Password")
+		if password == "" {
+			password = c.Query("password")
+		}
+		if password == "" {
+			password = c.FormValue("password")
+		}
+		if password == "" || !checkSharePassword(share.PasswordHash, password) {
+			message := "This link is password protected."
+			status := 401
+			if password != "" {
+				message, status = "Wrong password.", 403
+			}
+			c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+			return c.Status(status).SendString(fmt.Sprintf(sharePasswordForm, html.EscapeString(message)))
+		}
+	}
+
+	file, err := h.db.GetCachedFile(share.FileID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if file == nil {
+		return c.Status(410).JSON(fiber.Map{"error": "Media is no longer available"})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	if file.Backend == "local" {
+		if err := c.SendFile(filepath.Join(services.CacheDir, filepath.Base(file.Key))); err != nil {
+			return c.Status(410).JSON(fiber.Map{"error": "Media is no longer available"})
+		}
+		return nil
+	}
+
+	// Other backends are proxied so the link does not reveal the object URL
+	resp, err := mediaClient.Get(storage.SignURL(file.URL))
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{"error": err.Error()})
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return c.Status(502).JSON(fiber.Map{"error": fmt.Sprintf("storage returned HTTP %d", resp.StatusCode)})
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		c.Set(fiber.HeaderContentType, ct)
+	}
+	return c.SendStream(resp.Body, int(resp.ContentLength))
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"flow2api/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// publicStatusTTL is how long the public status is reused, so an open
+// endpoint cannot be used to load the database
+const publicStatusTTL = 15 * time.Second
+
+type publicStatusCache struct {
+	mu     sync.Mutex
+	status *services.PublicStatus
+	at     time.Time
+}
+
+// statusPage serves the status page to browsers; API clients get the JSON
+// from the next handler
+func (h *Handler) statusPage(c *fiber.Ctx) error {
+	if c.Accepts(fiber.MIMEApplicationJSON, fiber.MIMETextHTML) == fiber.MIMETextHTML {
+		return c.SendFile("./static/status.html")
+	}
+	return c.Next()
+}
+
+// PublicStatus reports service health, model availability and success rates
+// over the last hour, without token details
+func (h *Handler) PublicStatus(c *fiber.Ctx) error {
+	cache := &h.publicStatus
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.status == nil || time.Since(cache.at) >= publicStatusTTL {
+		status, err := h.generationHandler.Status()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Status unavailable"})
+		}
+		status.Draining = h.workerPool.Draining()
+		cache.status, cache.at = status.Public(), time.Now()
+	}
+
+	// The announcement is set from the admin panel and shows immediately
+	public := *cache.status
+	public.Announcement = h.cfg.GetAnnouncement()
+	c.Set("Cache-Control", "public, max-age=15")
+	return c.JSON(public)
+}
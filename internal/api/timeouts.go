@@ -0,0 +1,116 @@
+package api
+
+import (
+	"bytes"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+var timeoutLog = logging.Component("timeouts")
+
+// Route classes with their own server-side timeouts
+const (
+	routeAdmin      = "admin"      // admin API and pages: short reads and writes
+	routeGeneration = "generation" // /v1: no write timeout, monitored instead
+	routeMedia      = "media"      // cached files, share links and archives
+	routeEvents     = "events"     // dashboard SSE, open as long as the page is
+)
+
+// routeClass classifies a request by its path before the body is read
+func routeClass(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/v1/"):
+		return routeGeneration
+	case path == "/api/events":
+		return routeEvents
+	case strings.HasPrefix(path, "/tmp/"), strings.HasPrefix(path, "/static/"),
+		strings.HasPrefix(path, "/share/"), path == "/api/media/archive":
+		return routeMedia
+	}
+	return routeAdmin
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
+
+// RouteTimeouts returns a fasthttp HeaderReceived hook that sets the body
+// read and response write timeouts of each request from its route class.
+// A zero timeout leaves the server default, which is unlimited for writes.
+func RouteTimeouts(cfg config.RouteTimeoutConfig) func(*fasthttp.RequestHeader) fasthttp.RequestConfig {
+	admin, media, upload := seconds(cfg.Admin), seconds(cfg.Media), seconds(cfg.Upload)
+	return func(header *fasthttp.RequestHeader) fasthttp.RequestConfig {
+		path := header.RequestURI()
+		if i := bytes.IndexByte(path, '?'); i >= 0 {
+			path = path[:i]
+		}
+		switch routeClass(string(path)) {
+		case routeGeneration:
+			return fasthttp.RequestConfig{ReadTimeout: upload}
+		case routeEvents:
+			return fasthttp.RequestConfig{ReadTimeout: admin}
+		case routeMedia:
+			return fasthttp.RequestConfig{ReadTimeout: admin, WriteTimeout: media}
+		}
+		return fasthttp.RequestConfig{ReadTimeout: admin, WriteTimeout: admin}
+	}
+}
+
+// generationWatch logs a generation response that is still open after the
+// stream_warn threshold, and how long it took once it finishes
+type generationWatch struct {
+	requestID string
+	path      string
+	start     time.Time
+	timer     *time.Timer
+	slow      atomic.Bool
+}
+
+// watchGenerations starts a watch for each generation request. Streaming
+// handlers take it over with generationWatchOf and finish it when the
+// stream ends; other responses are finished when the handler returns.
+func (h *Handler) watchGenerations(c *fiber.Ctx) error {
+	warnAfter := seconds(config.Get().Server.Timeouts.StreamWarn)
+	if warnAfter <= 0 {
+		return c.Next()
+	}
+
+	w := &generationWatch{requestID: requestID(c), path: strings.Clone(c.Path()), start: time.Now()}
+	w.timer = time.AfterFunc(warnAfter, func() {
+		w.slow.Store(true)
+		timeoutLog.Warn("Generation response still open", "request_id", w.requestID, "path", w.path, "elapsed", warnAfter)
+	})
+	c.Locals("generation_watch", w)
+
+	err := c.Next()
+	if !c.Response().IsBodyStream() {
+		w.done()
+	}
+	return err
+}
+
+// generationWatchOf returns the watch of the request, nil when monitoring is
+// disabled
+func generationWatchOf(c *fiber.Ctx) *generationWatch {
+	w, _ := c.Locals("generation_watch").(*generationWatch)
+	return w
+}
+
+// done stops the watch; it is safe on a nil watch
+func (w *generationWatch) done() {
+	if w == nil {
+		return
+	}
+	w.timer.Stop()
+	if w.slow.Load() {
+		timeoutLog.Info("Slow generation response finished", "request_id", w.requestID, "path", w.path,
+			"elapsed", time.Since(w.start).Round(time.Second))
+	}
+}
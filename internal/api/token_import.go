@@ -0,0 +1,506 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"flow2api/internal/config"
+	"flow2api/internal/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Token import/export formats
+const (
+	tokenFormatJSON = "json"
+	tokenFormatCSV  = "csv"
+	tokenFormatText = "txt" // one session token per line
+)
+
+// tokenCSVColumns is the CSV header written on export and understood on import
+var tokenCSVColumns = []string{
+	"session_token", "email", "remark", "project_id", "project_name",
+	"is_active", "image_enabled", "video_enabled", "image_concurrency", "video_concurrency",
+}
+
+// tokenRecord is one token in an import or export file. Unset fields keep the
+// current value of an existing token and the usual default for a new one.
+type tokenRecord struct {
+	ST               string `json:"session_token"`
+	Email            string `json:"email,omitempty"`
+	Remark           string `json:"remark,omitempty"`
+	ProjectID        string `json:"project_id,omitempty"`
+	ProjectName      string `json:"project_name,omitempty"`
+	IsActive         *bool  `json:"is_active,omitempty"`
+	ImageEnabled     *bool  `json:"image_enabled,omitempty"`
+	VideoEnabled     *bool  `json:"video_enabled,omitempty"`
+	ImageConcurrency *int   `json:"image_concurrency,omitempty"`
+	VideoConcurrency *int   `json:"video_concurrency,omitempty"`
+	Proxy            string `json:"proxy,omitempty"` // used while adding a new token, never stored
+
+	row int
+	err error
+}
+
+// TokenImportResult reports what happened (or, in a dry run, would happen) to
+// one entry: add, update, skip, invalid, failed or, when syncing, conflict
+type TokenImportResult struct {
+	Row    int    `json:"row"`
+	ST     string `json:"session_token"`
+	Email  string `json:"email,omitempty"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// importFormat picks the format from ?format= or, failing that, the body's
+// content type; JSON is the default
+func importFormat(c *fiber.Ctx) (string, error) {
+	if format := strings.ToLower(c.Query("format")); format != "" {
+		switch format {
+		case tokenFormatJSON, tokenFormatCSV, tokenFormatText:
+			return format, nil
+		case "text", "plain":
+			return tokenFormatText, nil
+		}
+		return "", fmt.Errorf("unsupported format %q (use json, csv or txt)", format)
+	}
+	contentType := strings.ToLower(c.Get(fiber.HeaderContentType))
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		return tokenFormatCSV, nil
+	case strings.HasPrefix(contentType, "text/plain"):
+		return tokenFormatText, nil
+	}
+	return tokenFormatJSON, nil
+}
+
+// parseTokenRecords reads an import body. JSON may be {"tokens": [...]} or a
+// bare array of objects or session token strings; CSV needs a header row
+// naming session_token unless it has a single column of tokens.
+func parseTokenRecords(format string, body []byte) ([]*tokenRecord, error) {
+	switch format {
+	case tokenFormatCSV:
+		return parseTokenCSV(body)
+	case tokenFormatText:
+		return parseTokenText(body), nil
+	}
+	return parseTokenJSON(body)
+}
+
+func parseTokenJSON(body []byte) ([]*tokenRecord, error) {
+	body = bytes.TrimSpace(body)
+	var items []json.RawMessage
+	if len(body) > 0 && body[0] == '{' {
+		var wrapper struct {
+			Tokens []json.RawMessage `json:"tokens"`
+		}
+		if err := json.Unmarshal(body, &wrapper); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		items = wrapper.Tokens
+	} else if err := json.Unmarshal(body, &items); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	records := make([]*tokenRecord, 0, len(items))
+	for i, item := range items {
+		rec := &tokenRecord{}
+		var st string
+		if err := json.Unmarshal(item, &st); err == nil {
+			rec.ST = st
+		} else if err := json.Unmarshal(item, rec); err != nil {
+			rec.err = fmt.Errorf("invalid entry: %w", err)
+		}
+		rec.row = i + 1
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func parseTokenCSV(body []byte) ([]*tokenRecord, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	var records []*tokenRecord
+	var columns map[string]int
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+
+		if columns == nil {
+			columns = map[string]int{"session_token": 0}
+			if containsFold(row, "session_token") || containsFold(row, "st") {
+				for i, name := range row {
+					name = strings.ToLower(strings.TrimSpace(name))
+					if name == "st" {
+						name = "session_token"
+					}
+					columns[name] = i
+				}
+				continue
+			}
+		}
+
+		rec := &tokenRecord{row: line}
+		cell := func(name string) string {
+			if idx, ok := columns[name]; ok && idx < len(row) {
+				return strings.TrimSpace(row[idx])
+			}
+			return ""
+		}
+		rec.ST = cell("session_token")
+		rec.Email = cell("email")
+		rec.Remark = cell("remark")
+		rec.ProjectID = cell("project_id")
+		rec.ProjectName = cell("project_name")
+		rec.Proxy = cell("proxy")
+		for name, dst := range map[string]**bool{
+			"is_active":     &rec.IsActive,
+			"image_enabled": &rec.ImageEnabled,
+			"video_enabled": &rec.VideoEnabled,
+		} {
+			if v := cell(name); v != "" {
+				b, err := strconv.ParseBool(v)
+				if err != nil {
+					rec.err = fmt.Errorf("%s: invalid boolean %q", name, v)
+					continue
+				}
+				*dst = &b
+			}
+		}
+		for name, dst := range map[string]**int{
+			"image_concurrency": &rec.ImageConcurrency,
+			"video_concurrency": &rec.VideoConcurrency,
+		} {
+			if v := cell(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					rec.err = fmt.Errorf("%s: invalid integer %q", name, v)
+					continue
+				}
+				*dst = &n
+			}
+		}
+		records = append(records, rec)
+	}
+}
+
+func parseTokenText(body []byte) []*tokenRecord {
+	var records []*tokenRecord
+	for i, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		records = append(records, &tokenRecord{ST: line, row: i + 1})
+	}
+	return records
+}
+
+func containsFold(values []string, want string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), want) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks an entry on its own, without looking at the database
+func (r *tokenRecord) validate() error {
+	if r.err != nil {
+		return r.err
+	}
+	if r.ST == "" {
+		return fmt.Errorf("session_token is required")
+	}
+	if strings.ContainsAny(r.ST, " \t\r\n,") {
+		return fmt.Errorf("session_token contains whitespace or commas")
+	}
+	for name, v := range map[string]*int{"image_concurrency": r.ImageConcurrency, "video_concurrency": r.VideoConcurrency} {
+		if v != nil && *v < -1 {
+			return fmt.Errorf("%s must be -1 (unlimited) or more", name)
+		}
+	}
+	if r.Proxy != "" {
+		u, err := url.Parse(r.Proxy)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			return fmt.Errorf("proxy must be an http(s) or socks5 URL")
+		}
+	}
+	return nil
+}
+
+// updates lists the columns an entry would change on an existing token
+func (r *tokenRecord) updates(token *models.Token) map[string]interface{} {
+	updates := make(map[string]interface{})
+	if r.Remark != "" && r.Remark != token.Remark {
+		updates["remark"] = r.Remark
+	}
+	if r.ProjectID != "" && r.ProjectID != token.CurrentProjectID {
+		updates["current_project_id"] = r.ProjectID
+	}
+	if r.ProjectName != "" && r.ProjectName != token.CurrentProjectName {
+		updates["current_project_name"] = r.ProjectName
+	}
+	if r.IsActive != nil && *r.IsActive != token.IsActive {
+		updates["is_active"] = *r.IsActive
+	}
+	if r.ImageEnabled != nil && *r.ImageEnabled != token.ImageEnabled {
+		updates["image_enabled"] = *r.ImageEnabled
+	}
+	if r.VideoEnabled != nil && *r.VideoEnabled != token.VideoEnabled {
+		updates["video_enabled"] = *r.VideoEnabled
+	}
+	if r.ImageConcurrency != nil && *r.ImageConcurrency != token.ImageConcurrency {
+		updates["image_concurrency"] = *r.ImageConcurrency
+	}
+	if r.VideoConcurrency != nil && *r.VideoConcurrency != token.VideoConcurrency {
+		updates["video_concurrency"] = *r.VideoConcurrency
+	}
+	return updates
+}
+
+// accountConflict explains why an entry names a different account than the
+// local tokens do, empty when it does not
+func accountConflict(rec *tokenRecord, token *models.Token, byEmail map[string]*models.Token) string {
+	if rec.Email == "" {
+		return ""
+	}
+	if token != nil {
+		if token.Email != "" && !strings.EqualFold(token.Email, rec.Email) {
+			return fmt.Sprintf("local token #%d has this session token for %s", token.ID, token.Email)
+		}
+		return ""
+	}
+	if other := byEmail[strings.ToLower(rec.Email)]; other != nil {
+		return fmt.Sprintf("local token #%d has another session token for this account", other.ID)
+	}
+	return ""
+}
+
+// maskST shortens a session token for display in import results
+func maskST(st string) string {
+	if len(st) <= 12 {
+		return st
+	}
+	return st[:8] + "..." + st[len(st)-4:]
+}
+
+func boolOr(v *bool, def bool) bool {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+func intOr(v *int, def int) int {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+// applyTokenRecords adds and updates tokens from import entries, or in a dry
+// run only reports what it would do. With checkAccounts an entry whose email
+// belongs to a local token with another session token, or whose session
+// token belongs to another email, is reported as a conflict and left alone.
+// progress, when set, is called after each entry.
+func (h *AdminHandler) applyTokenRecords(records []*tokenRecord, dryRun, checkAccounts bool, progress func(TokenImportResult)) (map[string]int, []TokenImportResult, error) {
+	existing, err := h.tokenManager.GetAllTokens()
+	if err != nil {
+		return nil, nil, err
+	}
+	byST := make(map[string]*models.Token, len(existing))
+	byEmail := make(map[string]*models.Token, len(existing))
+	for _, t := range existing {
+		byST[t.ST] = t
+		if t.Email != "" {
+			byEmail[strings.ToLower(t.Email)] = t
+		}
+	}
+
+	counts := map[string]int{"add": 0, "update": 0, "skip": 0, "invalid": 0, "failed": 0}
+	if checkAccounts {
+		counts["conflict"] = 0
+	}
+	results := make([]TokenImportResult, 0, len(records))
+	seen := make(map[string]int, len(records))
+	for _, rec := range records {
+		result := TokenImportResult{Row: rec.row, ST: maskST(rec.ST), Email: rec.Email}
+		token := byST[rec.ST]
+		if token != nil {
+			result.Email = token.Email
+		}
+
+		switch err := rec.validate(); {
+		case err != nil:
+			result.Action, result.Error = "invalid", err.Error()
+		case seen[rec.ST] != 0:
+			result.Action, result.Error = "invalid", fmt.Sprintf("duplicate of row %d", seen[rec.ST])
+		case checkAccounts && accountConflict(rec, token, byEmail) != "":
+			result.Action, result.Error = "conflict", accountConflict(rec, token, byEmail)
+		case token == nil:
+			result.Action = "add"
+			if !dryRun {
+				added, err := h.tokenManager.AddTokenViaProxy(rec.Proxy, rec.ST, rec.ProjectID, rec.ProjectName, rec.Remark,
+					boolOr(rec.ImageEnabled, true), boolOr(rec.VideoEnabled, true),
+					intOr(rec.ImageConcurrency, -1), intOr(rec.VideoConcurrency, -1))
+				if err == nil && !boolOr(rec.IsActive, true) {
+					err = h.tokenManager.DisableToken(added.ID)
+				}
+				if err != nil {
+					result.Action, result.Error = "failed", err.Error()
+				} else {
+					result.Email = added.Email
+				}
+			}
+		default:
+			updates := rec.updates(token)
+			if len(updates) == 0 {
+				result.Action = "skip"
+				break
+			}
+			result.Action = "update"
+			if !dryRun {
+				if err := h.tokenManager.UpdateToken(token.ID, updates); err != nil {
+					result.Action, result.Error = "failed", err.Error()
+				}
+			}
+		}
+		if rec.ST != "" && seen[rec.ST] == 0 {
+			seen[rec.ST] = rec.row
+		}
+		counts[result.Action]++
+		results = append(results, result)
+		if progress != nil {
+			progress(result)
+		}
+	}
+	return counts, results, nil
+}
+
+// ImportTokens adds new tokens and updates existing ones from a JSON, CSV or
+// plain text body. With ?dry_run=true nothing is written and the results show
+// what each entry would do; conversion of new session tokens is only checked
+// on a real import. New tokens are added token_import.interval apart, so an
+// import adding more than token_import.async_threshold of them (or any
+// import with ?async=true) runs in the background and answers 202 with a job
+// to poll at GET /api/tokens/import/:id.
+func (h *AdminHandler) ImportTokens(c *fiber.Ctx) error {
+	format, err := importFormat(c)
+	if err != nil {
+		return fail(c, 400, err.Error())
+	}
+	records, err := parseTokenRecords(format, c.Body())
+	if err != nil {
+		return fail(c, 400, err.Error())
+	}
+	dryRun := c.QueryBool("dry_run")
+
+	counts, results, err := h.applyTokenRecords(records, true, false, nil)
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	if !dryRun {
+		threshold := config.Get().TokenImport.AsyncThreshold
+		if c.QueryBool("async") || (threshold > 0 && counts["add"] > threshold) {
+			job := h.startImportJob(format, records)
+			return respondStatus(c, 202, ImportJobStarted{JobID: job.id, Total: job.total, Adding: counts["add"]})
+		}
+		counts, results, err = h.applyTokenRecords(records, false, false, nil)
+		if err != nil {
+			return fail(c, 500, err.Error())
+		}
+	}
+
+	return respond(c, TokenImportReport{
+		DryRun:  dryRun,
+		Format:  format,
+		Added:   counts["add"],
+		Updated: counts["update"],
+		Skipped: counts["skip"],
+		Invalid: counts["invalid"],
+		Failed:  counts["failed"],
+		Results: results,
+	})
+}
+
+// ExportTokens downloads every token as JSON (an array ImportTokens accepts),
+// CSV or a plain list of session tokens, chosen by ?format=
+func (h *AdminHandler) ExportTokens(c *fiber.Ctx) error {
+	format := strings.ToLower(c.Query("format", tokenFormatJSON))
+	if format == "text" || format == "plain" {
+		format = tokenFormatText
+	}
+	tokens, err := h.tokenManager.GetAllTokens()
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	var body bytes.Buffer
+	switch format {
+	case tokenFormatJSON:
+		records := make([]tokenRecord, 0, len(tokens))
+		for _, t := range tokens {
+			records = append(records, tokenRecord{
+				ST:               t.ST,
+				Email:            t.Email,
+				Remark:           t.Remark,
+				ProjectID:        t.CurrentProjectID,
+				ProjectName:      t.CurrentProjectName,
+				IsActive:         &t.IsActive,
+				ImageEnabled:     &t.ImageEnabled,
+				VideoEnabled:     &t.VideoEnabled,
+				ImageConcurrency: &t.ImageConcurrency,
+				VideoConcurrency: &t.VideoConcurrency,
+			})
+		}
+		enc := json.NewEncoder(&body)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(records); err != nil {
+			return fail(c, 500, err.Error())
+		}
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	case tokenFormatCSV:
+		w := csv.NewWriter(&body)
+		w.Write(tokenCSVColumns)
+		for _, t := range tokens {
+			w.Write([]string{
+				t.ST, t.Email, t.Remark, t.CurrentProjectID, t.CurrentProjectName,
+				strconv.FormatBool(t.IsActive), strconv.FormatBool(t.ImageEnabled), strconv.FormatBool(t.VideoEnabled),
+				strconv.Itoa(t.ImageConcurrency), strconv.Itoa(t.VideoConcurrency),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fail(c, 500, err.Error())
+		}
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	case tokenFormatText:
+		for _, t := range tokens {
+			body.WriteString(t.ST)
+			body.WriteByte('\n')
+		}
+		c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	default:
+		return fail(c, 400, fmt.Sprintf("unsupported format %q (use json, csv or txt)", format))
+	}
+
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="flow2api-tokens.%s"`, format))
+	return c.Send(body.Bytes())
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"flow2api/internal/logging"
+	"flow2api/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// importJobRetention is how long a finished background import stays queryable
+const importJobRetention = time.Hour
+
+// tokenImportJob is an import running in the background because it adds
+// more tokens than token_import.async_threshold
+type tokenImportJob struct {
+	id     string
+	format string
+	total  int
+
+	mu       sync.Mutex
+	status   string // running, done or failed
+	done     int
+	counts   map[string]int
+	results  []TokenImportResult
+	err      string
+	started  time.Time
+	finished time.Time
+}
+
+// snapshot returns the job's progress; results are listed once it finished
+func (j *tokenImportJob) snapshot() *ImportJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job := &ImportJob{
+		JobID:     j.id,
+		Status:    j.status,
+		Format:    j.format,
+		Total:     j.total,
+		Done:      j.done,
+		Added:     j.counts["add"],
+		Updated:   j.counts["update"],
+		Skipped:   j.counts["skip"],
+		Invalid:   j.counts["invalid"],
+		Failed:    j.counts["failed"],
+		StartedAt: j.started,
+		Error:     j.err,
+	}
+	if j.status != "running" {
+		finished := j.finished
+		job.FinishedAt = &finished
+		job.Results = j.results
+	}
+	return job
+}
+
+// startImportJob applies records in the background and returns the job
+func (h *AdminHandler) startImportJob(format string, records []*tokenRecord) *tokenImportJob {
+	now := time.Now()
+	h.importJobs.Range(func(key, value interface{}) bool {
+		job := value.(*tokenImportJob)
+		job.mu.Lock()
+		expired := job.status != "running" && now.Sub(job.finished) > importJobRetention
+		job.mu.Unlock()
+		if expired {
+			h.importJobs.Delete(key)
+		}
+		return true
+	})
+
+	job := &tokenImportJob{
+		id:      uuid.New().String(),
+		format:  format,
+		total:   len(records),
+		status:  "running",
+		counts:  map[string]int{},
+		started: now,
+	}
+	h.importJobs.Store(job.id, job)
+
+	go func() {
+		log := logging.Component("token_import")
+		log.Info("Background token import started", "job_id", job.id, "entries", job.total)
+
+		_, results, err := h.applyTokenRecords(records, false, false, func(result TokenImportResult) {
+			job.mu.Lock()
+			job.done++
+			job.counts[result.Action]++
+			done := job.done
+			job.mu.Unlock()
+			h.events.Publish(services.EventTokenImport, map[string]interface{}{
+				"job_id": job.id, "done": done, "total": job.total, "action": result.Action,
+			})
+		})
+
+		job.mu.Lock()
+		job.finished = time.Now()
+		job.results = results
+		if err != nil {
+			job.status, job.err = "failed", err.Error()
+		} else {
+			job.status = "done"
+		}
+		status := job.status
+		job.mu.Unlock()
+
+		h.events.Publish(services.EventTokenImport, map[string]interface{}{
+			"job_id": job.id, "done": job.total, "total": job.total, "status": status,
+		})
+		log.Info("Background token import finished", "job_id", job.id, "status", status,
+			"duration", time.Since(job.started).Round(time.Second))
+	}()
+	return job
+}
+
+// GetImportJob reports the progress of a background import
+func (h *AdminHandler) GetImportJob(c *fiber.Ctx) error {
+	value, ok := h.importJobs.Load(c.Params("id"))
+	if !ok {
+		return fail(c, 404, "Import job not found")
+	}
+	return respond(c, ImportJobStatus{Job: value.(*tokenImportJob).snapshot()})
+}
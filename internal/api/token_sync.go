@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var syncLog = logging.Component("token_sync")
+
+// syncTimeout bounds each request to the primary instance
+const syncTimeout = 30 * time.Second
+
+// maxSyncExport caps the export read from the primary
+const maxSyncExport = 32 << 20
+
+// tokenSyncSource is the instance a sync pulls from; empty fields fall back
+// to token_sync in the configuration
+type tokenSyncSource struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// tokenSyncResult is the outcome of one sync
+type tokenSyncResult struct {
+	counts    map[string]int
+	results   []TokenImportResult
+	localOnly []TokenImportResult // tokens the primary does not have; left untouched
+}
+
+// fetchSourceTokens logs in to the primary, downloads its JSON export and
+// logs out again
+func fetchSourceTokens(src tokenSyncSource) ([]*tokenRecord, error) {
+	client := &http.Client{Timeout: syncTimeout}
+	base := strings.TrimRight(src.URL, "/")
+
+	credentials, _ := json.Marshal(map[string]string{"username": src.Username, "password": src.Password})
+	resp, err := client.Post(base+"/api/login", fiber.MIMEApplicationJSON, bytes.NewReader(credentials))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %w", base, err)
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&login)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil || login.Token == "" {
+		return nil, fmt.Errorf("login to %s failed: HTTP %d", base, resp.StatusCode)
+	}
+	defer func() {
+		req, _ := http.NewRequest("POST", base+"/api/logout", nil)
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	req, err := http.NewRequest("GET", base+"/api/tokens/export?format=json", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export tokens from %s: %w", base, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to export tokens from %s: HTTP %d", base, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSyncExport))
+	if err != nil {
+		return nil, fmt.Errorf("failed to export tokens from %s: %w", base, err)
+	}
+	return parseTokenJSON(body)
+}
+
+// syncTokens pulls the primary's tokens and applies them: new tokens are
+// added and changed fields updated. Entries naming a different account than
+// the local token are reported as conflicts, and local tokens the primary
+// does not have are listed but never removed.
+func (h *AdminHandler) syncTokens(src tokenSyncSource, dryRun bool) (*tokenSyncResult, error) {
+	if !h.syncMu.TryLock() {
+		return nil, fmt.Errorf("a token sync is already running")
+	}
+	defer h.syncMu.Unlock()
+
+	records, err := fetchSourceTokens(src)
+	if err != nil {
+		return nil, err
+	}
+	counts, results, err := h.applyTokenRecords(records, dryRun, true, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := make(map[string]bool, len(records))
+	for _, rec := range records {
+		remote[rec.ST] = true
+	}
+	local, err := h.tokenManager.GetAllTokens()
+	if err != nil {
+		return nil, err
+	}
+	localOnly := []TokenImportResult{}
+	for _, t := range local {
+		if !remote[t.ST] {
+			localOnly = append(localOnly, TokenImportResult{ST: maskST(t.ST), Email: t.Email, Action: "keep"})
+		}
+	}
+	return &tokenSyncResult{counts: counts, results: results, localOnly: localOnly}, nil
+}
+
+// SyncTokens pulls tokens from the primary instance now. A JSON body may name
+// another source ({"url", "username", "password"}); with ?dry_run=true
+// nothing is written and the report shows what would change.
+func (h *AdminHandler) SyncTokens(c *fiber.Ctx) error {
+	settings := config.Get().TokenSync
+	src := tokenSyncSource{URL: settings.URL, Username: settings.Username, Password: settings.Password}
+	if len(bytes.TrimSpace(c.Body())) > 0 {
+		var req tokenSyncSource
+		if err := c.BodyParser(&req); err != nil {
+			return fail(c, 400, "Invalid request body")
+		}
+		if req.URL != "" {
+			src = req
+		}
+	}
+	if src.URL == "" {
+		return fail(c, 400, "url is required when token_sync.url is not configured")
+	}
+	dryRun := c.QueryBool("dry_run")
+
+	result, err := h.syncTokens(src, dryRun)
+	if err != nil {
+		return fail(c, 502, err.Error())
+	}
+	return respond(c, TokenSyncReport{
+		DryRun:    dryRun,
+		Source:    strings.TrimRight(src.URL, "/"),
+		Added:     result.counts["add"],
+		Updated:   result.counts["update"],
+		Skipped:   result.counts["skip"],
+		Invalid:   result.counts["invalid"],
+		Failed:    result.counts["failed"],
+		Conflicts: result.counts["conflict"],
+		Results:   result.results,
+		LocalOnly: result.localOnly,
+	})
+}
+
+// StartTokenSync syncs from token_sync.url every interval while token_sync is
+// enabled
+func (h *AdminHandler) StartTokenSync() {
+	if !config.Get().TokenSync.Enabled {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Get().TokenSync.Interval) * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			settings := config.Get().TokenSync
+			if !settings.Enabled || settings.URL == "" {
+				continue
+			}
+			result, err := h.syncTokens(tokenSyncSource{URL: settings.URL, Username: settings.Username, Password: settings.Password}, settings.DryRun)
+			if err != nil {
+				syncLog.Error("Token sync failed", "source", settings.URL, "error", err)
+				continue
+			}
+			for _, r := range result.results {
+				if r.Action == "conflict" || r.Action == "failed" {
+					syncLog.Warn("Token not synced", "session_token", r.ST, "email", r.Email, "action", r.Action, "error", r.Error)
+				}
+			}
+			syncLog.Info("Tokens synced", "source", settings.URL, "dry_run", settings.DryRun,
+				"added", result.counts["add"], "updated", result.counts["update"], "conflicts", result.counts["conflict"],
+				"failed", result.counts["failed"], "local_only", len(result.localOnly))
+		}
+	}()
+}
@@ -0,0 +1,319 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+	"flow2api/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// totpIssuer names the account in authenticator apps
+const totpIssuer = "Flow2API"
+
+var twoFactorLog = logging.Component("two_factor")
+
+// A six-digit code falls to guessing unless failures are limited: after
+// maxSecondFactorFailures wrong codes in a row, a user's codes are not
+// checked for secondFactorLockout
+const (
+	maxSecondFactorFailures = 5
+	secondFactorLockout     = 5 * time.Minute
+)
+
+// secondFactorFailures counts a user's wrong two-factor codes
+type secondFactorFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// secondFactorLockedError refuses a code while its user is locked out
+type secondFactorLockedError struct {
+	wait time.Duration
+}
+
+func (e *secondFactorLockedError) Error() string {
+	return fmt.Sprintf("Too many invalid two-factor codes, try again in %s", e.wait.Round(time.Second))
+}
+
+// secondFactorAllowed returns a *secondFactorLockedError while user is locked
+// out. The caller holds twoFactorMu.
+func (h *AdminHandler) secondFactorAllowed(user string) error {
+	if f := h.twoFactorFails[user]; f != nil {
+		if wait := time.Until(f.lockedUntil); wait > 0 {
+			return &secondFactorLockedError{wait: wait}
+		}
+	}
+	return nil
+}
+
+// recordSecondFactor counts a checked code of user; a valid one clears the
+// failures. The caller holds twoFactorMu.
+func (h *AdminHandler) recordSecondFactor(user string, valid bool) {
+	if valid {
+		delete(h.twoFactorFails, user)
+		return
+	}
+	if h.twoFactorFails == nil {
+		h.twoFactorFails = make(map[string]*secondFactorFailures)
+	}
+	f := h.twoFactorFails[user]
+	if f == nil {
+		f = &secondFactorFailures{}
+		h.twoFactorFails[user] = f
+	}
+	if f.count++; f.count >= maxSecondFactorFailures {
+		f.count = 0
+		f.lockedUntil = time.Now().Add(secondFactorLockout)
+		twoFactorLog.Warn("Two-factor checks locked after repeated invalid codes", "user", user, "for", secondFactorLockout)
+	}
+}
+
+// failSecondFactor answers a refused code: 429 with Retry-After during a
+// lockout, otherwise 400
+func failSecondFactor(c *fiber.Ctx, err error) error {
+	var locked *secondFactorLockedError
+	if errors.As(err, &locked) {
+		c.Set("Retry-After", strconv.Itoa(int(locked.wait.Seconds())+1))
+		return fail(c, 429, err.Error())
+	}
+	return fail(c, 400, "Invalid two-factor code")
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code
+// and records its use, so neither works twice. It reports whether the code
+// was a recovery code and how many of those are left. While the user is
+// locked out no code is checked and a *secondFactorLockedError is returned.
+func (h *AdminHandler) checkSecondFactor(code string) (ok, recovery bool, left int, err error) {
+	h.twoFactorMu.Lock()
+	defer h.twoFactorMu.Unlock()
+
+	cfg, err := h.db.GetAdminConfig()
+	if err != nil {
+		return false, false, 0, err
+	}
+	if err := h.secondFactorAllowed(cfg.Username); err != nil {
+		return false, false, len(cfg.RecoveryCodes), err
+	}
+	if step, valid := services.VerifyTOTP(cfg.TOTPSecret, code, time.Now(), cfg.TOTPLastStep); valid {
+		h.recordSecondFactor(cfg.Username, true)
+		return true, false, len(cfg.RecoveryCodes), h.db.UpdateAdminConfig(map[string]interface{}{"totp_last_step": step})
+	}
+	remaining, valid := services.UseRecoveryCode(cfg.RecoveryCodes, code)
+	h.recordSecondFactor(cfg.Username, valid)
+	if !valid {
+		return false, false, len(cfg.RecoveryCodes), nil
+	}
+	err = h.db.UpdateAdminConfig(map[string]interface{}{"recovery_codes": strings.Join(remaining, ",")})
+	return true, true, len(remaining), err
+}
+
+// GetTwoFactor reports whether two-factor login is on
+func (h *AdminHandler) GetTwoFactor(c *fiber.Ctx) error {
+	cfg, err := h.db.GetAdminConfig()
+	if err != nil {
+		return fail(c, 500, "Failed to get admin config")
+	}
+	return respond(c, TwoFactorStatus{
+		Enabled:           cfg.TOTPEnabled,
+		Pending:           !cfg.TOTPEnabled && cfg.TOTPPendingSecret != "",
+		RecoveryCodesLeft: len(cfg.RecoveryCodes),
+	})
+}
+
+// EnrollTwoFactor starts enrollment with a new secret. Two-factor login is
+// only switched on once ConfirmTwoFactor sees a code made from it.
+func (h *AdminHandler) EnrollTwoFactor(c *fiber.Ctx) error {
+	cfg, err := h.db.GetAdminConfig()
+	if err != nil {
+		return fail(c, 500, "Failed to get admin config")
+	}
+	if cfg.TOTPEnabled {
+		return fail(c, 400, "Two-factor authentication is already enabled")
+	}
+	secret, err := services.GenerateTOTPSecret()
+	if err != nil {
+		return fail(c, 500, "Failed to generate secret")
+	}
+	if err := h.db.UpdateAdminConfig(map[string]interface{}{"totp_pending_secret": secret}); err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, TwoFactorEnrollment{
+		Secret:     secret,
+		OTPAuthURI: services.TOTPURI(secret, cfg.Username, totpIssuer),
+	})
+}
+
+// ConfirmTwoFactor switches two-factor login on with the pending secret and
+// returns the recovery codes; they are only ever shown here
+func (h *AdminHandler) ConfirmTwoFactor(c *fiber.Ctx) error {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+
+	h.twoFactorMu.Lock()
+	defer h.twoFactorMu.Unlock()
+
+	cfg, err := h.db.GetAdminConfig()
+	if err != nil {
+		return fail(c, 500, "Failed to get admin config")
+	}
+	if cfg.TOTPEnabled {
+		return fail(c, 400, "Two-factor authentication is already enabled")
+	}
+	if cfg.TOTPPendingSecret == "" {
+		return fail(c, 400, "Start enrollment with POST /api/2fa/enroll first")
+	}
+	if err := h.secondFactorAllowed(cfg.Username); err != nil {
+		return failSecondFactor(c, err)
+	}
+	step, ok := services.VerifyTOTP(cfg.TOTPPendingSecret, req.Code, time.Now(), 0)
+	h.recordSecondFactor(cfg.Username, ok)
+	if !ok {
+		return failSecondFactor(c, nil)
+	}
+	codes, hashes, err := services.GenerateRecoveryCodes()
+	if err != nil {
+		return fail(c, 500, "Failed to generate recovery codes")
+	}
+	err = h.db.UpdateAdminConfig(map[string]interface{}{
+		"totp_enabled":        true,
+		"totp_secret":         cfg.TOTPPendingSecret,
+		"totp_pending_secret": "",
+		"totp_last_step":      step,
+		"recovery_codes":      strings.Join(hashes, ","),
+	})
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+
+	twoFactorLog.Info("Two-factor authentication enabled", "ip", c.IP())
+	return respond(c, RecoveryCodes{RecoveryCodes: codes})
+}
+
+// DisableTwoFactor switches two-factor login off; it takes the password and
+// a current or recovery code
+func (h *AdminHandler) DisableTwoFactor(c *fiber.Ctx) error {
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+	cfg, err := h.db.GetAdminConfig()
+	if err != nil {
+		return fail(c, 500, "Failed to get admin config")
+	}
+	if !cfg.TOTPEnabled {
+		return fail(c, 400, "Two-factor authentication is not enabled")
+	}
+	if req.Password != cfg.Password {
+		return fail(c, 400, "Invalid password")
+	}
+	ok, _, _, err := h.checkSecondFactor(req.Code)
+	var locked *secondFactorLockedError
+	switch {
+	case errors.As(err, &locked):
+		return failSecondFactor(c, err)
+	case err != nil:
+		return fail(c, 500, err.Error())
+	case !ok:
+		return failSecondFactor(c, nil)
+	}
+
+	err = h.db.UpdateAdminConfig(map[string]interface{}{
+		"totp_enabled":        false,
+		"totp_secret":         "",
+		"totp_pending_secret": "",
+		"totp_last_step":      0,
+		"recovery_codes":      "",
+	})
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	twoFactorLog.Info("Two-factor authentication disabled", "ip", c.IP())
+	return respond(c, Ack{})
+}
+
+// RegenerateRecoveryCodes replaces every recovery code after checking a
+// current code from the authenticator app
+func (h *AdminHandler) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fail(c, 400, "Invalid request")
+	}
+
+	h.twoFactorMu.Lock()
+	defer h.twoFactorMu.Unlock()
+
+	cfg, err := h.db.GetAdminConfig()
+	if err != nil {
+		return fail(c, 500, "Failed to get admin config")
+	}
+	if !cfg.TOTPEnabled {
+		return fail(c, 400, "Two-factor authentication is not enabled")
+	}
+	if err := h.secondFactorAllowed(cfg.Username); err != nil {
+		return failSecondFactor(c, err)
+	}
+	step, ok := services.VerifyTOTP(cfg.TOTPSecret, req.Code, time.Now(), cfg.TOTPLastStep)
+	h.recordSecondFactor(cfg.Username, ok)
+	if !ok {
+		return failSecondFactor(c, nil)
+	}
+	codes, hashes, err := services.GenerateRecoveryCodes()
+	if err != nil {
+		return fail(c, 500, "Failed to generate recovery codes")
+	}
+	err = h.db.UpdateAdminConfig(map[string]interface{}{
+		"totp_last_step": step,
+		"recovery_codes": strings.Join(hashes, ","),
+	})
+	if err != nil {
+		return fail(c, 500, err.Error())
+	}
+	return respond(c, RecoveryCodes{RecoveryCodes: codes})
+}
+
+// loginSecondFactor checks the two-factor code of a login whose password
+// matched. It returns 0 to let the login proceed, or the status, message and
+// details to refuse it with.
+func (h *AdminHandler) loginSecondFactor(c *fiber.Ctx, cfg *models.AdminConfig, code string) (int, string, fiber.Map) {
+	if !cfg.TOTPEnabled {
+		return 0, "", nil
+	}
+	required := fiber.Map{"two_factor_required": true}
+	if strings.TrimSpace(code) == "" {
+		return 401, "Two-factor code required", required
+	}
+	ok, recovery, left, err := h.checkSecondFactor(code)
+	var locked *secondFactorLockedError
+	if errors.As(err, &locked) {
+		twoFactorLog.Warn("Refused two-factor code during lockout", "ip", c.IP())
+		c.Set("Retry-After", strconv.Itoa(int(locked.wait.Seconds())+1))
+		return 429, err.Error(), required
+	}
+	if err != nil {
+		return 500, err.Error(), nil
+	}
+	if !ok {
+		twoFactorLog.Warn("Rejected two-factor code", "ip", c.IP())
+		return 401, "Invalid two-factor code", required
+	}
+	if recovery {
+		twoFactorLog.Warn("Recovery code used to sign in", "ip", c.IP(), "recovery_codes_left", left)
+	}
+	return 0, "", nil
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/models"
+	"flow2api/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// remoteImageTimeout bounds fetching one reference image URL
+const remoteImageTimeout = 30 * time.Second
+
+// imageClients holds one fetch client per proxy and policy
+var (
+	imageClientsMu sync.Mutex
+	imageClients   = make(map[string]*http.Client)
+)
+
+func imageClient(proxyURL string, public bool) *http.Client {
+	imageClientsMu.Lock()
+	defer imageClientsMu.Unlock()
+	key := fmt.Sprintf("%t|%s", public, proxyURL)
+	if client, ok := imageClients[key]; ok {
+		return client
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	transport := &http.Transport{TLSHandshakeTimeout: 10 * time.Second}
+	client := &http.Client{Timeout: remoteImageTimeout, Transport: transport}
+	if proxyURL != "" {
+		if parsed, err := url.Parse(proxyURL); err == nil {
+			transport.Proxy = http.ProxyURL(parsed)
+		}
+		if public {
+			client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return errors.New("stopped after 10 redirects")
+				}
+				return services.CheckPublicHost(req.URL.Hostname())
+			}
+		}
+	} else if public {
+		dialer.Control = services.PublicOnly
+	}
+	transport.DialContext = dialer.DialContext
+
+	imageClients[key] = client
+	return client
+}
+
+// imageProxy returns the proxy Flow requests go through: proxy.url, or the
+// one enabled in the admin panel
+func (h *Handler) imageProxy() string {
+	if proxyURL := config.Get().Proxy.URL; proxyURL != "" {
+		return proxyURL
+	}
+	if proxyConfig, err := h.db.GetProxyConfig(); err == nil && proxyConfig != nil && proxyConfig.Enabled {
+		return proxyConfig.ProxyURL
+	}
+	return ""
+}
+
+// maxReferenceImageBytes is the largest reference image accepted
+func maxReferenceImageBytes() int64 {
+	return int64(config.Get().Generation.MaxReferenceImageMB) << 20
+}
+
+// checkReferenceImage rejects images over the size limit and data that is
+// not an image
+func checkReferenceImage(data []byte, source string) error {
+	if limit := maxReferenceImageBytes(); int64(len(data)) > limit {
+		return fmt.Errorf("%s is larger than %d MB", source, limit>>20)
+	}
+	if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return fmt.Errorf("%s is not an image", source)
+	}
+	return nil
+}
+
+// fetchImage downloads a reference image URL through the upstream proxy,
+// under the remote_images policy
+func (h *Handler) fetchImage(rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image URL")
+	}
+	source := "image from " + u.Host
+
+	policy := config.Get().Generation.RemoteImages
+	if policy == "off" {
+		return nil, fmt.Errorf("image URLs are not accepted; send the image as a data URL or a multipart upload")
+	}
+	public := policy == "public"
+	proxyURL := h.imageProxy()
+	if public && proxyURL != "" {
+		if err := services.CheckPublicHost(u.Hostname()); err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", source, err)
+		}
+	}
+
+	resp, err := imageClient(proxyURL, public).Get(rawURL)
+	if err != nil {
+		if errors.Is(err, services.ErrPrivateAddress) {
+			return nil, fmt.Errorf("failed to fetch %s: %w", source, services.ErrPrivateAddress)
+		}
+		return nil, fmt.Errorf("failed to fetch %s", source)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: HTTP %d", source, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "image/") &&
+		!strings.HasPrefix(ct, "application/octet-stream") {
+		return nil, fmt.Errorf("%s is not an image (%s)", source, ct)
+	}
+
+	limit := maxReferenceImageBytes()
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%s is larger than %d MB", source, limit>>20)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s", source)
+	}
+	if err := checkReferenceImage(data, source); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// resolveImage returns the bytes of a reference image given as a data URL, an
+// http(s) URL or a finished upload of keyID; other values are not images and
+// yield nil
+func (h *Handler) resolveImage(ref, keyID string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(ref, "data:image"):
+		data := h.parseBase64Image(ref)
+		if data == nil {
+			return nil, fmt.Errorf("invalid image data URL")
+		}
+		if limit := maxReferenceImageBytes(); int64(len(data)) > limit {
+			return nil, fmt.Errorf("inline image is larger than %d MB", limit>>20)
+		}
+		return data, nil
+	case strings.HasPrefix(ref, "http://"), strings.HasPrefix(ref, "https://"):
+		return h.fetchImage(ref)
+	case strings.HasPrefix(ref, uploadRefPrefix):
+		return h.uploadedImage(ref, keyID)
+	}
+	return nil, nil
+}
+
+// isMultipart reports whether the request body is multipart/form-data
+func isMultipart(c *fiber.Ctx) bool {
+	return strings.HasPrefix(string(c.Request().Header.ContentType()), fiber.MIMEMultipartForm)
+}
+
+// formImages reads the reference images uploaded as image or image[] files
+func formImages(c *fiber.Ctx) ([][]byte, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart body")
+	}
+	return formFiles(form, "image", "image[]")
+}
+
+// formFrames reads the start_frame and end_frame files of a video request,
+// in that order; an end frame needs a start frame
+func formFrames(c *fiber.Ctx) ([][]byte, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, fmt.Errorf("invalid multipart body")
+	}
+	for _, field := range []string{"start_frame", "end_frame"} {
+		if len(form.File[field]) > 1 {
+			return nil, fmt.Errorf("upload one %s file", field)
+		}
+	}
+	if len(form.File["end_frame"]) > 0 && len(form.File["start_frame"]) == 0 {
+		return nil, fmt.Errorf("end_frame needs a start_frame")
+	}
+	return formFiles(form, "start_frame", "end_frame")
+}
+
+// formFiles reads and checks the images uploaded under fields, in order
+func formFiles(form *multipart.Form, fields ...string) ([][]byte, error) {
+	var images [][]byte
+	for _, field := range fields {
+		for _, fh := range form.File[field] {
+			if limit := maxReferenceImageBytes(); fh.Size > limit {
+				return nil, fmt.Errorf("%s is larger than %d MB", fh.Filename, limit>>20)
+			}
+			f, err := fh.Open()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s", fh.Filename)
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s", fh.Filename)
+			}
+			if err := checkReferenceImage(data, fh.Filename); err != nil {
+				return nil, err
+			}
+			images = append(images, data)
+		}
+	}
+	return images, nil
+}
+
+// chatForm completes a multipart chat request with the fields form decoding
+// cannot fill: messages, sent as JSON or as a plain prompt, the response
+// format and extra_body as JSON
+func chatForm(c *fiber.Ctx, req *models.ChatCompletionRequest) error {
+	if messages := c.FormValue("messages"); messages != "" {
+		if err := json.Unmarshal([]byte(messages), &req.Messages); err != nil {
+			return fmt.Errorf("messages must be a JSON array of chat messages")
+		}
+	} else if prompt := c.FormValue("prompt"); prompt != "" {
+		req.Messages = []models.ChatMessage{{Role: "user", Content: prompt}}
+	}
+	if format := c.FormValue("response_format"); format != "" {
+		req.ResponseFormat = &models.ResponseFormat{Type: format}
+	}
+	if extra := c.FormValue("extra_body"); extra != "" {
+		if err := json.Unmarshal([]byte(extra), &req.ExtraBody); err != nil {
+			return fmt.Errorf("extra_body must be a JSON object")
+		}
+	}
+	return nil
+}
+
+// formImageRefs returns the reference image URLs sent as images or images[]
+// fields of a multipart image request
+func formImageRefs(c *fiber.Ctx) []string {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil
+	}
+	return append(append([]string(nil), form.Value["images"]...), form.Value["images[]"]...)
+}
@@ -2,31 +2,52 @@ package browser
 
 import (
 	"fmt"
-	"log"
 	"math/rand"
-	"os"
-	"os/exec"
 	"sync"
 	"time"
 
 	"flow2api/internal/config"
+	"flow2api/internal/logging"
 
 	"github.com/go-rod/rod"
 	"github.com/go-rod/rod/lib/launcher"
 	"github.com/go-rod/rod/lib/proto"
 )
 
-// CaptchaService handles reCAPTCHA token generation using rod and xvfb
+var browserLog = logging.Component("browser_captcha")
+
+// CaptchaService handles reCAPTCHA token generation using rod. Solves run in
+// parallel on a pool of pages that stay open between requests.
 type CaptchaService struct {
 	browser     *rod.Browser
 	launcher    *launcher.Launcher
-	xvfbCmd     *exec.Cmd
-	display     string
+	xvfb        *xvfbDisplay
+	headless    bool
 	websiteKey  string
 	mu          sync.Mutex
 	initialized bool
+
+	slots   chan struct{} // one per page that may be solving at once
+	idle    []*pooledPage
+	poolGen int // bumped on restart so pages of a dead browser are dropped
+	poolM   sync.Mutex
+
+	backoff   restartBackoff
+	stopWatch chan struct{}
 }
 
+// pooledPage is a browser tab kept open for reuse, with reCAPTCHA already
+// loaded for projectID when ready is set
+type pooledPage struct {
+	page      *rod.Page
+	projectID string
+	ready     bool
+	gen       int
+}
+
+// flowHomeURL is where idle pages are warmed up before their first project
+const flowHomeURL = "https://labs.google/fx/tools/flow"
+
 var (
 	captchaInstance *CaptchaService
 	captchaOnce     sync.Once
@@ -42,7 +63,7 @@ func GetCaptchaService() *CaptchaService {
 	return captchaInstance
 }
 
-// Initialize starts xvfb and browser
+// Initialize starts the browser, with xvfb on platforms that need it
 func (c *CaptchaService) Initialize() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -51,52 +72,36 @@ func (c *CaptchaService) Initialize() error {
 		return nil
 	}
 
-	log.Println("[BrowserCaptcha] Initializing with xvfb...")
+	browserLog.Info("Initializing")
 
-	// Start Xvfb
-	if err := c.startXvfb(); err != nil {
+	// Get captcha config for proxy and display mode
+	cfg := config.Get()
+	c.headless = cfg.Captcha.BrowserHeadless
+
+	// Start Xvfb where a headed browser needs a virtual display
+	xvfb, err := startDisplay(c.headless, "1920x1080x24")
+	if err != nil {
 		return fmt.Errorf("failed to start xvfb: %w", err)
 	}
+	c.xvfb = xvfb
 
-	// Get captcha config for proxy
-	cfg := config.Get()
 	var proxyURL string
 	if cfg.Captcha.BrowserProxyEnabled && cfg.Captcha.BrowserProxyURL != "" {
 		proxyURL = cfg.Captcha.BrowserProxyURL
 	}
 
 	// Find system-installed browser
-	browserPath, found := launcher.LookPath()
+	browserPath, found := findBrowser()
 	if !found {
-		// Try common browser paths
-		commonPaths := []string{
-			"/usr/bin/chromium",
-			"/usr/bin/chromium-browser",
-			"/usr/bin/google-chrome",
-			"/usr/bin/google-chrome-stable",
-			"/snap/bin/chromium",
-			"/opt/google/chrome/chrome",
-		}
-		for _, p := range commonPaths {
-			if _, err := os.Stat(p); err == nil {
-				browserPath = p
-				found = true
-				break
-			}
-		}
-	}
-
-	if !found || browserPath == "" {
 		c.stopXvfb()
 		return fmt.Errorf("no browser found. Please install chromium or chrome")
 	}
 
-	log.Printf("[BrowserCaptcha] Using system browser: %s", browserPath)
+	browserLog.Info("Using system browser", "path", browserPath)
 
 	// Configure launcher with system browser
 	c.launcher = launcher.New().
 		Bin(browserPath).
-		Headless(false). // Use xvfb instead of headless
 		Set("disable-blink-features", "AutomationControlled").
 		Set("disable-dev-shm-usage").
 		Set("no-sandbox").
@@ -127,12 +132,12 @@ func (c *CaptchaService) Initialize() error {
 		Set("window-size", "1920,1080").
 		Set("start-maximized").
 		Set("lang", "en-US").
-		Set("user-agent", getRandomUserAgent()).
-		Env("DISPLAY", c.display)
+		Set("user-agent", getRandomUserAgent())
+	c.launcher = applyDisplayMode(c.launcher, c.xvfb, c.headless)
 
 	if proxyURL != "" {
 		c.launcher = c.launcher.Proxy(proxyURL)
-		log.Printf("[BrowserCaptcha] Using proxy: %s", proxyURL)
+		browserLog.Info("Using proxy", "proxy", proxyURL)
 	}
 
 	// Launch browser
@@ -144,91 +149,252 @@ func (c *CaptchaService) Initialize() error {
 
 	c.browser = rod.New().ControlURL(url)
 	if err := c.browser.Connect(); err != nil {
+		c.launcher.Kill()
 		c.stopXvfb()
 		return fmt.Errorf("failed to connect to browser: %w", err)
 	}
 
+	// Slots outlive restarts so solves still running on a crashed browser release them
+	poolSize := max(cfg.Captcha.BrowserPoolSize, 1)
+	if c.slots == nil {
+		c.slots = make(chan struct{}, poolSize)
+	}
 	c.initialized = true
-	log.Printf("[BrowserCaptcha] ✅ Browser initialized with xvfb (display=%s, proxy=%s)", c.display, proxyURL)
+	browserLog.Info("Browser initialized", "mode", displayModeName(c.xvfb, c.headless), "proxy", proxyURL, "pages", poolSize)
+
+	if c.stopWatch == nil {
+		c.stopWatch = make(chan struct{})
+		go runWatchdog(c.stopWatch, c.checkHealth, c.restart)
+	}
+	go c.warmPool(poolSize)
 	return nil
 }
 
-// startXvfb starts the Xvfb virtual display
-func (c *CaptchaService) startXvfb() error {
-	// Find an available display number
-	for display := 99; display < 200; display++ {
-		displayStr := fmt.Sprintf(":%d", display)
-		lockFile := fmt.Sprintf("/tmp/.X%d-lock", display)
+// Ready reports whether the browser is up. It does not wait for a launch or
+// restart in progress; the browser is not ready during one.
+func (c *CaptchaService) Ready() bool {
+	if !c.mu.TryLock() {
+		return false
+	}
+	defer c.mu.Unlock()
+	return c.initialized
+}
 
-		// Check if display is available
-		if _, err := os.Stat(lockFile); os.IsNotExist(err) {
-			c.display = displayStr
-			break
+// checkHealth pings the browser and checks the virtual display, returning the
+// browser that was checked
+func (c *CaptchaService) checkHealth() (*rod.Browser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.initialized {
+		return nil, fmt.Errorf("browser is not running")
+	}
+	if c.xvfb != nil && !c.xvfb.Alive() {
+		return c.browser, fmt.Errorf("xvfb exited")
+	}
+	return c.browser, pingBrowser(c.browser)
+}
+
+// restart tears down a crashed browser and launches a new one. Failed launches
+// back off exponentially; attempts inside the backoff window fail fast.
+func (c *CaptchaService) restart(failed *rod.Browser, cause error) error {
+	c.mu.Lock()
+	// Another caller may already have replaced the browser that failed
+	if c.initialized && c.browser == failed {
+		browserLog.Warn("Browser unhealthy, restarting", "cause", cause)
+		c.teardown()
+	}
+	if wait := c.backoff.remaining(); wait > 0 {
+		c.mu.Unlock()
+		return fmt.Errorf("browser restart backing off for %s: %w", wait.Round(time.Second), cause)
+	}
+	c.mu.Unlock()
+
+	if err := c.Initialize(); err != nil {
+		c.mu.Lock()
+		delay := c.backoff.failed()
+		c.mu.Unlock()
+		browserLog.Error("Restart failed", "retry_in", delay, "error", err)
+		return err
+	}
+
+	c.mu.Lock()
+	c.backoff.reset()
+	c.mu.Unlock()
+	return nil
+}
+
+// ensureRunning starts the browser, or restarts it when it no longer responds
+func (c *CaptchaService) ensureRunning() error {
+	browser, err := c.checkHealth()
+	if err == nil {
+		return nil
+	}
+	return c.restart(browser, err)
+}
+
+// teardown closes the browser, its pages and the display; c.mu must be held
+func (c *CaptchaService) teardown() {
+	c.poolM.Lock()
+	c.idle = nil
+	c.poolGen++
+	c.poolM.Unlock()
+
+	closeBrowser(c.browser, c.launcher)
+	c.browser = nil
+	if c.launcher != nil {
+		c.launcher.Cleanup()
+		c.launcher = nil
+	}
+
+	c.stopXvfb()
+	c.initialized = false
+}
+
+// warmPool opens the pool's pages ahead of the first requests
+func (c *CaptchaService) warmPool(size int) {
+	for i := 0; i < size; i++ {
+		pp, err := c.newPage()
+		if err != nil {
+			browserLog.Warn("Failed to warm page", "error", err)
+			return
+		}
+		if err := c.loadRecaptcha(pp.page, flowHomeURL); err != nil {
+			browserLog.Warn("Failed to warm page", "error", err)
+			pp.page.Close()
+			continue
+		}
+		c.poolM.Lock()
+		if pp.gen == c.poolGen {
+			c.idle = append(c.idle, pp)
 		}
+		c.poolM.Unlock()
 	}
+}
 
-	if c.display == "" {
-		c.display = ":99"
+// newPage opens a tab with the browser environment applied
+func (c *CaptchaService) newPage() (*pooledPage, error) {
+	// poolGen only changes under c.mu, so it matches the browser read here
+	c.mu.Lock()
+	browser := c.browser
+	c.poolM.Lock()
+	gen := c.poolGen
+	c.poolM.Unlock()
+	c.mu.Unlock()
+	if browser == nil {
+		return nil, fmt.Errorf("browser is not running")
 	}
 
-	// Start Xvfb
-	c.xvfbCmd = exec.Command("Xvfb", c.display, "-screen", "0", "1920x1080x24", "-ac")
-	c.xvfbCmd.Stdout = nil
-	c.xvfbCmd.Stderr = nil
+	page, err := browser.Page(proto.TargetCreateTarget{URL: "about:blank"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create page: %w", err)
+	}
+	if err := c.setupBrowserEnvironment(page); err != nil {
+		browserLog.Warn("Failed to set up browser environment", "error", err)
+	}
+	return &pooledPage{page: page, gen: gen}, nil
+}
+
+// acquirePage waits for a free slot and returns an idle page, preferring one
+// already on the project so navigation can be skipped
+func (c *CaptchaService) acquirePage(projectID string) (*pooledPage, error) {
+	c.slots <- struct{}{}
+
+	c.poolM.Lock()
+	pick := -1
+	for i, candidate := range c.idle {
+		if candidate.projectID == projectID {
+			pick = i
+			break
+		}
+		if pick < 0 {
+			pick = i
+		}
+	}
+	var pp *pooledPage
+	if pick >= 0 {
+		pp = c.idle[pick]
+		c.idle = append(c.idle[:pick], c.idle[pick+1:]...)
+	}
+	c.poolM.Unlock()
 
-	if err := c.xvfbCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start Xvfb: %w", err)
+	if pp != nil {
+		return pp, nil
+	}
+	pp, err := c.newPage()
+	if err != nil {
+		<-c.slots
+		return nil, err
 	}
+	return pp, nil
+}
 
-	// Wait for Xvfb to be ready
-	time.Sleep(500 * time.Millisecond)
+// releasePage returns a page to the pool, or closes it after a failure
+func (c *CaptchaService) releasePage(pp *pooledPage, healthy bool) {
+	c.poolM.Lock()
+	current := pp.gen == c.poolGen
+	if healthy && current {
+		c.idle = append(c.idle, pp)
+	}
+	c.poolM.Unlock()
 
-	log.Printf("[BrowserCaptcha] Xvfb started on display %s", c.display)
-	return nil
+	if !healthy && current {
+		pp.page.Close()
+	}
+	<-c.slots
 }
 
 // stopXvfb stops the Xvfb process
 func (c *CaptchaService) stopXvfb() {
-	if c.xvfbCmd != nil && c.xvfbCmd.Process != nil {
-		c.xvfbCmd.Process.Kill()
-		c.xvfbCmd.Wait()
-		c.xvfbCmd = nil
-		log.Println("[BrowserCaptcha] Xvfb stopped")
+	if c.xvfb != nil {
+		c.xvfb.Stop()
+		c.xvfb = nil
+		browserLog.Info("Xvfb stopped")
 	}
 }
 
 // GetToken obtains a reCAPTCHA token for the given project
 func (c *CaptchaService) GetToken(projectID string) (string, error) {
-	if !c.initialized {
-		if err := c.Initialize(); err != nil {
-			return "", err
-		}
+	if err := c.ensureRunning(); err != nil {
+		return "", err
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	startTime := time.Now()
 	websiteURL := fmt.Sprintf("https://labs.google/fx/tools/flow/project/%s", projectID)
 
-	log.Printf("[BrowserCaptcha] Getting token for: %s", websiteURL)
-
-	// Create new page
-	page, err := c.browser.Page(proto.TargetCreateTarget{URL: "about:blank"})
+	pp, err := c.acquirePage(projectID)
 	if err != nil {
-		return "", fmt.Errorf("failed to create page: %w", err)
+		return "", err
 	}
-	defer page.Close()
 
-	// Setup browser environment via CDP protocol
-	if err := c.setupBrowserEnvironment(page); err != nil {
-		log.Printf("[BrowserCaptcha] Warning: Failed to setup browser environment: %v", err)
+	// A page already on this project has reCAPTCHA loaded and can execute right away
+	if !pp.ready || pp.projectID != projectID {
+		browserLog.Debug("Loading reCAPTCHA page", "url", websiteURL)
+		pp.ready = false
+		if err := c.loadRecaptcha(pp.page, websiteURL); err != nil {
+			c.releasePage(pp, false)
+			return "", err
+		}
+		pp.projectID = projectID
+		pp.ready = true
+	}
+
+	token, err := c.execute(pp.page)
+	c.releasePage(pp, err == nil)
+	if err != nil {
+		return "", err
 	}
 
+	browserLog.Info("Token obtained", "project_id", projectID, "duration", time.Since(startTime).Round(time.Millisecond))
+	return token, nil
+}
+
+// loadRecaptcha navigates the page and waits until grecaptcha can execute
+func (c *CaptchaService) loadRecaptcha(page *rod.Page, websiteURL string) error {
 	// Navigate to page
-	err = page.Navigate(websiteURL)
+	err := page.Navigate(websiteURL)
 	if err != nil {
-		log.Printf("[BrowserCaptcha] Navigation error (may be expected): %v", err)
+		browserLog.Debug("Navigation error (may be expected)", "error", err)
 	}
 
 	// Wait for page to load
@@ -238,14 +404,14 @@ func (c *CaptchaService) GetToken(projectID string) (string, error) {
 	time.Sleep(1 * time.Second)
 
 	// Check if reCAPTCHA is loaded
-	log.Println("[BrowserCaptcha] Checking reCAPTCHA...")
+	browserLog.Debug("Checking reCAPTCHA")
 
 	scriptLoaded, err := page.Eval(`() => {
 		return window.grecaptcha && typeof window.grecaptcha.execute === 'function';
 	}`)
 	if err != nil || !scriptLoaded.Value.Bool() {
 		// Inject reCAPTCHA script
-		log.Println("[BrowserCaptcha] Injecting reCAPTCHA script...")
+		browserLog.Debug("Injecting reCAPTCHA script")
 		_, err = page.Eval(fmt.Sprintf(`() => {
 			return new Promise((resolve) => {
 				const script = document.createElement('script');
@@ -258,18 +424,18 @@ func (c *CaptchaService) GetToken(projectID string) (string, error) {
 			});
 		}`, c.websiteKey))
 		if err != nil {
-			return "", fmt.Errorf("failed to inject script: %w", err)
+			return fmt.Errorf("failed to inject script: %w", err)
 		}
 	}
 
 	// Wait for reCAPTCHA to be ready
-	log.Println("[BrowserCaptcha] Waiting for reCAPTCHA to initialize...")
+	browserLog.Debug("Waiting for reCAPTCHA to initialize")
 	for i := 0; i < 20; i++ {
 		ready, _ := page.Eval(`() => {
 			return window.grecaptcha && typeof window.grecaptcha.execute === 'function';
 		}`)
 		if ready != nil && ready.Value.Bool() {
-			log.Printf("[BrowserCaptcha] reCAPTCHA ready (waited %.1fs)", float64(i)*0.5)
+			browserLog.Debug("reCAPTCHA ready", "waited", time.Duration(i)*500*time.Millisecond)
 			break
 		}
 		time.Sleep(500 * time.Millisecond)
@@ -278,8 +444,13 @@ func (c *CaptchaService) GetToken(projectID string) (string, error) {
 	// Extra wait for initialization
 	time.Sleep(1 * time.Second)
 
+	return nil
+}
+
+// execute runs grecaptcha on a loaded page and returns the token
+func (c *CaptchaService) execute(page *rod.Page) (string, error) {
 	// Execute reCAPTCHA
-	log.Println("[BrowserCaptcha] Executing reCAPTCHA...")
+	browserLog.Debug("Executing reCAPTCHA")
 	result, err := page.Eval(fmt.Sprintf(`async () => {
 		try {
 			if (!window.grecaptcha) {
@@ -313,8 +484,6 @@ func (c *CaptchaService) GetToken(projectID string) (string, error) {
 		return "", fmt.Errorf("failed to execute reCAPTCHA: %w", err)
 	}
 
-	duration := time.Since(startTime)
-
 	// Parse result
 	resultMap := result.Value.Map()
 	if errVal, ok := resultMap["error"]; ok && errVal.Str() != "" {
@@ -324,7 +493,6 @@ func (c *CaptchaService) GetToken(projectID string) (string, error) {
 	if tokenVal, ok := resultMap["token"]; ok {
 		token := tokenVal.Str()
 		if token != "" {
-			log.Printf("[BrowserCaptcha] ✅ Token obtained (took %dms)", duration.Milliseconds())
 			return token, nil
 		}
 	}
@@ -337,20 +505,13 @@ func (c *CaptchaService) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.browser != nil {
-		c.browser.Close()
-		c.browser = nil
-	}
-
-	if c.launcher != nil {
-		c.launcher.Cleanup()
-		c.launcher = nil
+	if c.stopWatch != nil {
+		close(c.stopWatch)
+		c.stopWatch = nil
 	}
+	c.teardown()
 
-	c.stopXvfb()
-	c.initialized = false
-
-	log.Println("[BrowserCaptcha] Service closed")
+	browserLog.Info("Service closed")
 	return nil
 }
 
@@ -378,7 +539,7 @@ func (c *CaptchaService) setupBrowserEnvironment(page *rod.Page) error {
 		Platform:       "Win32",
 	}.Call(page)
 	if err != nil {
-		log.Printf("[BrowserEnv] Failed to set user agent: %v", err)
+		browserLog.Warn("Failed to set user agent", "error", err)
 	}
 
 	// Set viewport and device metrics via CDP
@@ -393,7 +554,7 @@ func (c *CaptchaService) setupBrowserEnvironment(page *rod.Page) error {
 		ScreenHeight:      &screenHeight,
 	}.Call(page)
 	if err != nil {
-		log.Printf("[BrowserEnv] Failed to set device metrics: %v", err)
+		browserLog.Warn("Failed to set device metrics", "error", err)
 	}
 
 	// Set geolocation (optional, simulates real location)
@@ -406,7 +567,7 @@ func (c *CaptchaService) setupBrowserEnvironment(page *rod.Page) error {
 		Accuracy:  &acc,
 	}.Call(page)
 	if err != nil {
-		log.Printf("[BrowserEnv] Failed to set geolocation: %v", err)
+		browserLog.Warn("Failed to set geolocation", "error", err)
 	}
 
 	// Set timezone
@@ -414,7 +575,7 @@ func (c *CaptchaService) setupBrowserEnvironment(page *rod.Page) error {
 		TimezoneID: "America/Los_Angeles",
 	}.Call(page)
 	if err != nil {
-		log.Printf("[BrowserEnv] Failed to set timezone: %v", err)
+		browserLog.Warn("Failed to set timezone", "error", err)
 	}
 
 	// Set locale
@@ -422,7 +583,7 @@ func (c *CaptchaService) setupBrowserEnvironment(page *rod.Page) error {
 		Locale: "en-US",
 	}.Call(page)
 	if err != nil {
-		log.Printf("[BrowserEnv] Failed to set locale: %v", err)
+		browserLog.Warn("Failed to set locale", "error", err)
 	}
 
 	// Disable webdriver flag via CDP
@@ -430,13 +591,13 @@ func (c *CaptchaService) setupBrowserEnvironment(page *rod.Page) error {
 		Source: `Object.defineProperty(navigator, 'webdriver', {get: () => undefined});`,
 	}.Call(page)
 	if err != nil {
-		log.Printf("[BrowserEnv] Failed to disable webdriver flag: %v", err)
+		browserLog.Warn("Failed to disable webdriver flag", "error", err)
 	}
 
 	// Enable network domain first
 	err = proto.NetworkEnable{}.Call(page)
 	if err != nil {
-		log.Printf("[BrowserEnv] Failed to enable network: %v", err)
+		browserLog.Warn("Failed to enable network", "error", err)
 	}
 
 	// Set extra HTTP headers using page method
@@ -447,6 +608,6 @@ func (c *CaptchaService) setupBrowserEnvironment(page *rod.Page) error {
 		"Sec-Ch-Ua-Platform", `"Windows"`,
 	})
 
-	log.Println("[BrowserEnv] ✅ Browser environment configured via CDP")
+	browserLog.Debug("Browser environment configured via CDP")
 	return nil
 }
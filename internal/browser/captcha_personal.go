@@ -2,31 +2,35 @@ package browser
 
 import (
 	"fmt"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sync"
 	"time"
 
 	"flow2api/internal/config"
+	"flow2api/internal/logging"
 
 	"github.com/go-rod/rod"
 	"github.com/go-rod/rod/lib/launcher"
 	"github.com/go-rod/rod/lib/proto"
 )
 
+var personalLog = logging.Component("personal_captcha")
+
 // PersonalCaptchaService handles reCAPTCHA with persistent browser profile (for logged-in sessions)
 type PersonalCaptchaService struct {
 	browser     *rod.Browser
 	launcher    *launcher.Launcher
-	xvfbCmd     *exec.Cmd
-	display     string
+	xvfb        *xvfbDisplay
+	headless    bool
 	websiteKey  string
 	userDataDir string
 	mu          sync.Mutex
 	initialized bool
+
+	backoff   restartBackoff
+	stopWatch chan struct{}
 }
 
 var (
@@ -46,7 +50,16 @@ func GetPersonalCaptchaService() *PersonalCaptchaService {
 	return personalInstance
 }
 
-// Initialize starts xvfb and browser with persistent user data
+// Ready reports whether the browser is up; it is not during a launch
+func (c *PersonalCaptchaService) Ready() bool {
+	if !c.mu.TryLock() {
+		return false
+	}
+	defer c.mu.Unlock()
+	return c.initialized
+}
+
+// Initialize starts the browser with persistent user data, with xvfb on platforms that need it
 func (c *PersonalCaptchaService) Initialize() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -55,57 +68,42 @@ func (c *PersonalCaptchaService) Initialize() error {
 		return nil
 	}
 
-	log.Printf("[PersonalCaptcha] Initializing with user data dir: %s", c.userDataDir)
+	personalLog.Info("Initializing", "user_data_dir", c.userDataDir)
 
 	// Create user data directory if not exists
 	if err := os.MkdirAll(c.userDataDir, 0755); err != nil {
 		return fmt.Errorf("failed to create user data dir: %w", err)
 	}
 
-	// Start Xvfb
-	if err := c.startXvfb(); err != nil {
+	// Get captcha config for proxy and display mode
+	cfg := config.Get()
+	c.headless = cfg.Captcha.BrowserHeadless
+
+	// Start Xvfb where a headed browser needs a virtual display
+	xvfb, err := startDisplay(c.headless, "1280x720x24")
+	if err != nil {
 		return fmt.Errorf("failed to start xvfb: %w", err)
 	}
+	c.xvfb = xvfb
 
-	// Get captcha config for proxy
-	cfg := config.Get()
 	var proxyURL string
 	if cfg.Captcha.BrowserProxyEnabled && cfg.Captcha.BrowserProxyURL != "" {
 		proxyURL = cfg.Captcha.BrowserProxyURL
 	}
 
 	// Find system-installed browser
-	browserPath, found := launcher.LookPath()
+	browserPath, found := findBrowser()
 	if !found {
-		commonPaths := []string{
-			"/usr/bin/chromium",
-			"/usr/bin/chromium-browser",
-			"/usr/bin/google-chrome",
-			"/usr/bin/google-chrome-stable",
-			"/snap/bin/chromium",
-			"/opt/google/chrome/chrome",
-		}
-		for _, p := range commonPaths {
-			if _, err := os.Stat(p); err == nil {
-				browserPath = p
-				found = true
-				break
-			}
-		}
-	}
-
-	if !found || browserPath == "" {
 		c.stopXvfb()
 		return fmt.Errorf("no browser found. Please install chromium or chrome")
 	}
 
-	log.Printf("[PersonalCaptcha] Using system browser: %s", browserPath)
+	personalLog.Info("Using system browser", "path", browserPath)
 
 	// Configure launcher with system browser and user data directory
 	c.launcher = launcher.New().
 		Bin(browserPath).
 		UserDataDir(c.userDataDir).
-		Headless(false). // Use xvfb
 		Set("disable-blink-features", "AutomationControlled").
 		Set("disable-dev-shm-usage").
 		Set("no-sandbox").
@@ -113,12 +111,12 @@ func (c *PersonalCaptchaService) Initialize() error {
 		Set("disable-infobars").
 		Set("disable-extensions").
 		Set("window-size", "1280,720").
-		Set("lang", "en-US").
-		Env("DISPLAY", c.display)
+		Set("lang", "en-US")
+	c.launcher = applyDisplayMode(c.launcher, c.xvfb, c.headless)
 
 	if proxyURL != "" {
 		c.launcher = c.launcher.Proxy(proxyURL)
-		log.Printf("[PersonalCaptcha] Using proxy: %s", proxyURL)
+		personalLog.Info("Using proxy", "proxy", proxyURL)
 	}
 
 	// Launch browser
@@ -130,57 +128,97 @@ func (c *PersonalCaptchaService) Initialize() error {
 
 	c.browser = rod.New().ControlURL(url)
 	if err := c.browser.Connect(); err != nil {
+		c.launcher.Kill()
 		c.stopXvfb()
 		return fmt.Errorf("failed to connect to browser: %w", err)
 	}
 
 	c.initialized = true
-	log.Printf("[PersonalCaptcha] ✅ Browser initialized with persistent profile (dir=%s)", c.userDataDir)
+	personalLog.Info("Browser initialized with persistent profile", "user_data_dir", c.userDataDir)
+
+	if c.stopWatch == nil {
+		c.stopWatch = make(chan struct{})
+		go runWatchdog(c.stopWatch, c.checkHealth, c.restart)
+	}
 	return nil
 }
 
-// startXvfb starts the Xvfb virtual display
-func (c *PersonalCaptchaService) startXvfb() error {
-	for display := 99; display < 200; display++ {
-		displayStr := fmt.Sprintf(":%d", display)
-		lockFile := fmt.Sprintf("/tmp/.X%d-lock", display)
-		if _, err := os.Stat(lockFile); os.IsNotExist(err) {
-			c.display = displayStr
-			break
-		}
+// checkHealth pings the browser and checks the virtual display, returning the
+// browser that was checked
+func (c *PersonalCaptchaService) checkHealth() (*rod.Browser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.initialized {
+		return nil, fmt.Errorf("browser is not running")
 	}
-	if c.display == "" {
-		c.display = ":99"
+	if c.xvfb != nil && !c.xvfb.Alive() {
+		return c.browser, fmt.Errorf("xvfb exited")
 	}
+	return c.browser, pingBrowser(c.browser)
+}
 
-	c.xvfbCmd = exec.Command("Xvfb", c.display, "-screen", "0", "1280x720x24", "-ac")
-	c.xvfbCmd.Stdout = nil
-	c.xvfbCmd.Stderr = nil
+// restart tears down a crashed browser and relaunches it on the same profile.
+// Failed launches back off exponentially; attempts inside the backoff window fail fast.
+func (c *PersonalCaptchaService) restart(failed *rod.Browser, cause error) error {
+	c.mu.Lock()
+	// Another caller may already have replaced the browser that failed
+	if c.initialized && c.browser == failed {
+		personalLog.Warn("Browser unhealthy, restarting", "cause", cause)
+		c.teardown()
+	}
+	if wait := c.backoff.remaining(); wait > 0 {
+		c.mu.Unlock()
+		return fmt.Errorf("browser restart backing off for %s: %w", wait.Round(time.Second), cause)
+	}
+	c.mu.Unlock()
 
-	if err := c.xvfbCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start Xvfb: %w", err)
+	if err := c.Initialize(); err != nil {
+		c.mu.Lock()
+		delay := c.backoff.failed()
+		c.mu.Unlock()
+		personalLog.Error("Restart failed", "retry_in", delay, "error", err)
+		return err
 	}
 
-	time.Sleep(500 * time.Millisecond)
-	log.Printf("[PersonalCaptcha] Xvfb started on display %s", c.display)
+	c.mu.Lock()
+	c.backoff.reset()
+	c.mu.Unlock()
 	return nil
 }
 
+// ensureRunning starts the browser, or restarts it when it no longer responds
+func (c *PersonalCaptchaService) ensureRunning() error {
+	browser, err := c.checkHealth()
+	if err == nil {
+		return nil
+	}
+	return c.restart(browser, err)
+}
+
+// teardown closes the browser and the display, keeping the profile on disk;
+// c.mu must be held
+func (c *PersonalCaptchaService) teardown() {
+	closeBrowser(c.browser, c.launcher)
+	c.browser = nil
+	c.launcher = nil
+
+	c.stopXvfb()
+	c.initialized = false
+}
+
 // stopXvfb stops the Xvfb process
 func (c *PersonalCaptchaService) stopXvfb() {
-	if c.xvfbCmd != nil && c.xvfbCmd.Process != nil {
-		c.xvfbCmd.Process.Kill()
-		c.xvfbCmd.Wait()
-		c.xvfbCmd = nil
+	if c.xvfb != nil {
+		c.xvfb.Stop()
+		c.xvfb = nil
 	}
 }
 
 // GetToken obtains a reCAPTCHA token using persistent browser session
 func (c *PersonalCaptchaService) GetToken(projectID string) (string, error) {
-	if !c.initialized {
-		if err := c.Initialize(); err != nil {
-			return "", err
-		}
+	if err := c.ensureRunning(); err != nil {
+		return "", err
 	}
 
 	c.mu.Lock()
@@ -189,7 +227,7 @@ func (c *PersonalCaptchaService) GetToken(projectID string) (string, error) {
 	startTime := time.Now()
 	websiteURL := fmt.Sprintf("https://labs.google/fx/tools/flow/project/%s", projectID)
 
-	log.Printf("[PersonalCaptcha] Getting token for: %s", websiteURL)
+	personalLog.Debug("Loading reCAPTCHA page", "url", websiteURL)
 
 	// Create new page (tab) in existing browser context
 	page, err := c.browser.Page(proto.TargetCreateTarget{URL: "about:blank"})
@@ -207,7 +245,7 @@ func (c *PersonalCaptchaService) GetToken(projectID string) (string, error) {
 	// Navigate to page
 	err = page.Navigate(websiteURL)
 	if err != nil {
-		log.Printf("[PersonalCaptcha] Navigation warning: %v", err)
+		personalLog.Debug("Navigation error (may be expected)", "error", err)
 	}
 
 	// Wait for page to load
@@ -215,11 +253,11 @@ func (c *PersonalCaptchaService) GetToken(projectID string) (string, error) {
 	time.Sleep(1 * time.Second)
 
 	// Check if reCAPTCHA is loaded
-	log.Println("[PersonalCaptcha] Checking reCAPTCHA...")
+	personalLog.Debug("Checking reCAPTCHA")
 	scriptLoaded, _ := page.Eval(`() => !!(window.grecaptcha && window.grecaptcha.execute)`)
 
 	if scriptLoaded == nil || !scriptLoaded.Value.Bool() {
-		log.Println("[PersonalCaptcha] Injecting reCAPTCHA script...")
+		personalLog.Debug("Injecting reCAPTCHA script")
 		_, _ = page.Eval(fmt.Sprintf(`() => {
 			const script = document.createElement('script');
 			script.src = 'https://www.google.com/recaptcha/api.js?render=%s';
@@ -240,7 +278,7 @@ func (c *PersonalCaptchaService) GetToken(projectID string) (string, error) {
 	}
 
 	// Execute reCAPTCHA
-	log.Println("[PersonalCaptcha] Executing reCAPTCHA...")
+	personalLog.Debug("Executing reCAPTCHA")
 	result, err := page.Eval(fmt.Sprintf(`async () => {
 		try {
 			return await window.grecaptcha.execute('%s', { action: 'FLOW_GENERATION' });
@@ -257,7 +295,7 @@ func (c *PersonalCaptchaService) GetToken(projectID string) (string, error) {
 
 	if result != nil && result.Value.Str() != "" {
 		token := result.Value.Str()
-		log.Printf("[PersonalCaptcha] ✅ Token obtained (took %dms)", duration.Milliseconds())
+		personalLog.Info("Token obtained", "project_id", projectID, "duration", duration.Round(time.Millisecond))
 		return token, nil
 	}
 
@@ -266,10 +304,8 @@ func (c *PersonalCaptchaService) GetToken(projectID string) (string, error) {
 
 // OpenLoginWindow opens a browser window for manual Google login
 func (c *PersonalCaptchaService) OpenLoginWindow() error {
-	if !c.initialized {
-		if err := c.Initialize(); err != nil {
-			return err
-		}
+	if err := c.ensureRunning(); err != nil {
+		return err
 	}
 
 	page, err := c.browser.Page(proto.TargetCreateTarget{URL: "https://accounts.google.com/"})
@@ -277,12 +313,7 @@ func (c *PersonalCaptchaService) OpenLoginWindow() error {
 		return fmt.Errorf("failed to open login page: %w", err)
 	}
 
-	log.Println("[PersonalCaptcha] ============================================")
-	log.Println("[PersonalCaptcha] 请在浏览器中登录Google账号")
-	log.Println("[PersonalCaptcha] 登录完成后，无需关闭浏览器")
-	log.Println("[PersonalCaptcha] 下次运行时会自动使用此登录状态")
-	log.Printf("[PersonalCaptcha] 用户数据目录: %s", c.userDataDir)
-	log.Println("[PersonalCaptcha] ============================================")
+	personalLog.Info("请在浏览器中登录Google账号，登录完成后无需关闭浏览器，下次运行时会自动使用此登录状态", "user_data_dir", c.userDataDir)
 
 	// Wait for user to login (blocking)
 	page.WaitLoad()
@@ -295,20 +326,13 @@ func (c *PersonalCaptchaService) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.browser != nil {
-		c.browser.Close()
-		c.browser = nil
+	if c.stopWatch != nil {
+		close(c.stopWatch)
+		c.stopWatch = nil
 	}
+	c.teardown()
 
-	if c.launcher != nil {
-		c.launcher.Cleanup()
-		c.launcher = nil
-	}
-
-	c.stopXvfb()
-	c.initialized = false
-
-	log.Println("[PersonalCaptcha] Service closed")
+	personalLog.Info("Service closed")
 	return nil
 }
 
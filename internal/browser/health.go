@@ -0,0 +1,84 @@
+package browser
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-rod/rod"
+	"github.com/go-rod/rod/lib/launcher"
+	"github.com/go-rod/rod/lib/proto"
+)
+
+const (
+	healthCheckInterval = 30 * time.Second
+	pingTimeout         = 5 * time.Second
+	restartBackoffMin   = 2 * time.Second
+	restartBackoffMax   = 5 * time.Minute
+)
+
+// pingBrowser checks that the browser still answers over CDP
+func pingBrowser(b *rod.Browser) error {
+	if b == nil {
+		return fmt.Errorf("browser is not running")
+	}
+	if _, err := (proto.BrowserGetVersion{}).Call(b.Timeout(pingTimeout)); err != nil {
+		return fmt.Errorf("browser not responding: %w", err)
+	}
+	return nil
+}
+
+// closeBrowser shuts a browser down without hanging on a dead connection and
+// makes sure its process is gone
+func closeBrowser(b *rod.Browser, l *launcher.Launcher) {
+	if b != nil {
+		b.Timeout(pingTimeout).Close()
+	}
+	if l != nil {
+		l.Kill()
+	}
+}
+
+// restartBackoff spaces out relaunch attempts, doubling the delay after each
+// failure up to restartBackoffMax
+type restartBackoff struct {
+	failures int
+	next     time.Time
+}
+
+// remaining is how long until the next attempt is allowed
+func (b *restartBackoff) remaining() time.Duration {
+	return time.Until(b.next)
+}
+
+// failed records a failed attempt and returns the delay before the next one
+func (b *restartBackoff) failed() time.Duration {
+	delay := restartBackoffMax
+	if b.failures < 16 {
+		delay = min(restartBackoffMin<<b.failures, restartBackoffMax)
+	}
+	b.failures++
+	b.next = time.Now().Add(delay)
+	return delay
+}
+
+func (b *restartBackoff) reset() {
+	*b = restartBackoff{}
+}
+
+// runWatchdog periodically checks a browser and hands failures to restart
+// until stop is closed
+func runWatchdog(stop <-chan struct{}, check func() (*rod.Browser, error), restart func(*rod.Browser, error) error) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if browser, err := check(); err != nil {
+			restart(browser, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package browser
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/go-rod/rod/lib/launcher"
+)
+
+// xvfbDisplay is a running Xvfb virtual display
+type xvfbDisplay struct {
+	cmd     *exec.Cmd
+	display string
+	done    chan struct{} // closed when the process exits
+}
+
+// findBrowser locates a system Chrome/Chromium binary
+func findBrowser() (string, bool) {
+	if browserPath, found := launcher.LookPath(); found {
+		return browserPath, true
+	}
+	for _, p := range browserCandidates() {
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// startDisplay starts Xvfb where the platform needs a virtual display for a
+// headed browser. It returns nil when the browser can use a native window.
+func startDisplay(headless bool, screen string) (*xvfbDisplay, error) {
+	if headless || !usesVirtualDisplay {
+		return nil, nil
+	}
+
+	if _, err := exec.LookPath("Xvfb"); err != nil && os.Getenv("DISPLAY") != "" {
+		browserLog.Warn("Xvfb not found, using existing display", "display", os.Getenv("DISPLAY"))
+		return nil, nil
+	}
+
+	// Find an available display number
+	display := ":99"
+	for n := 99; n < 200; n++ {
+		if _, err := os.Stat(fmt.Sprintf("/tmp/.X%d-lock", n)); os.IsNotExist(err) {
+			display = fmt.Sprintf(":%d", n)
+			break
+		}
+	}
+
+	cmd := exec.Command("Xvfb", display, "-screen", "0", screen, "-ac")
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start Xvfb: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+
+	// Wait for Xvfb to be ready
+	time.Sleep(500 * time.Millisecond)
+
+	browserLog.Info("Xvfb started", "display", display)
+	return &xvfbDisplay{cmd: cmd, display: display, done: done}, nil
+}
+
+// Stop kills the Xvfb process
+func (x *xvfbDisplay) Stop() {
+	if x.cmd != nil && x.cmd.Process != nil {
+		x.cmd.Process.Kill()
+		<-x.done
+	}
+}
+
+// Alive reports whether the Xvfb process is still running
+func (x *xvfbDisplay) Alive() bool {
+	select {
+	case <-x.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// applyDisplayMode configures the launcher for headless-new, Xvfb or a native window
+func applyDisplayMode(l *launcher.Launcher, xvfb *xvfbDisplay, headless bool) *launcher.Launcher {
+	if headless {
+		return l.HeadlessNew(true)
+	}
+	l = l.Headless(false)
+	if xvfb != nil {
+		l = l.Env(append(os.Environ(), "DISPLAY="+xvfb.display)...)
+	}
+	return l
+}
+
+// displayModeName describes the display mode for logs
+func displayModeName(xvfb *xvfbDisplay, headless bool) string {
+	switch {
+	case headless:
+		return "headless"
+	case xvfb != nil:
+		return "xvfb " + xvfb.display
+	default:
+		return "native window"
+	}
+}
@@ -0,0 +1,29 @@
+//go:build darwin
+
+package browser
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// usesVirtualDisplay is true where a headed browser needs Xvfb
+const usesVirtualDisplay = false
+
+func browserCandidates() []string {
+	apps := []string{
+		"Google Chrome.app/Contents/MacOS/Google Chrome",
+		"Chromium.app/Contents/MacOS/Chromium",
+		"Microsoft Edge.app/Contents/MacOS/Microsoft Edge",
+	}
+
+	var paths []string
+	home, _ := os.UserHomeDir()
+	for _, app := range apps {
+		paths = append(paths, filepath.Join("/Applications", app))
+		if home != "" {
+			paths = append(paths, filepath.Join(home, "Applications", app))
+		}
+	}
+	return paths
+}
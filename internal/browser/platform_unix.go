@@ -0,0 +1,17 @@
+//go:build !windows && !darwin
+
+package browser
+
+// usesVirtualDisplay is true where a headed browser needs Xvfb
+const usesVirtualDisplay = true
+
+func browserCandidates() []string {
+	return []string{
+		"/usr/bin/chromium",
+		"/usr/bin/chromium-browser",
+		"/usr/bin/google-chrome",
+		"/usr/bin/google-chrome-stable",
+		"/snap/bin/chromium",
+		"/opt/google/chrome/chrome",
+	}
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package browser
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// usesVirtualDisplay is true where a headed browser needs Xvfb
+const usesVirtualDisplay = false
+
+func browserCandidates() []string {
+	apps := []string{
+		`Google\Chrome\Application\chrome.exe`,
+		`Chromium\Application\chrome.exe`,
+		`Microsoft\Edge\Application\msedge.exe`,
+	}
+
+	var paths []string
+	for _, env := range []string{"LOCALAPPDATA", "PROGRAMFILES", "PROGRAMFILES(X86)"} {
+		base := os.Getenv(env)
+		if base == "" {
+			continue
+		}
+		for _, app := range apps {
+			paths = append(paths, filepath.Join(base, app))
+		}
+	}
+	return paths
+}
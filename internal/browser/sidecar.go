@@ -0,0 +1,114 @@
+package browser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Sidecar protocol
+//
+// A captcha sidecar is an HTTP service that owns the browser:
+//
+//	POST /solve   {"project_id": "..."}  ->  200 {"token": "..."}
+//	                                     ->  4xx/5xx {"error": "..."}
+//	GET  /health                         ->  200 {"status": "ok"}
+//
+// When an auth token is configured, requests carry "Authorization: Bearer <token>".
+
+// SidecarSolveRequest is the body of POST /solve
+type SidecarSolveRequest struct {
+	ProjectID string `json:"project_id"`
+}
+
+// SidecarSolveResponse is the body returned by POST /solve
+type SidecarSolveResponse struct {
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// SidecarClient obtains reCAPTCHA tokens from a captcha sidecar
+type SidecarClient struct {
+	baseURL   string
+	authToken string
+	client    *http.Client
+}
+
+// NewSidecarClient creates a new sidecar client
+func NewSidecarClient(baseURL, authToken string, timeout time.Duration) *SidecarClient {
+	return &SidecarClient{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		authToken: authToken,
+		client:    &http.Client{Timeout: timeout},
+	}
+}
+
+// GetToken asks the sidecar to solve reCAPTCHA for the given project
+func (s *SidecarClient) GetToken(projectID string) (string, error) {
+	if s.baseURL == "" {
+		return "", fmt.Errorf("captcha sidecar URL is not configured")
+	}
+
+	body, _ := json.Marshal(SidecarSolveRequest{ProjectID: projectID})
+	req, err := http.NewRequest("POST", s.baseURL+"/solve", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("sidecar request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+
+	var result SidecarSolveResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", fmt.Errorf("invalid sidecar response (HTTP %d): %s", resp.StatusCode, string(respBody))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("sidecar error (HTTP %d): %s", resp.StatusCode, result.Error)
+	}
+	if result.Token == "" {
+		return "", fmt.Errorf("sidecar returned an empty token")
+	}
+
+	return result.Token, nil
+}
+
+// Health checks that the sidecar answers GET /health
+func (s *SidecarClient) Health() error {
+	if s.baseURL == "" {
+		return fmt.Errorf("captcha sidecar URL is not configured")
+	}
+	req, err := http.NewRequest("GET", s.baseURL+"/health", nil)
+	if err != nil {
+		return err
+	}
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sidecar request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sidecar unhealthy (HTTP %d)", resp.StatusCode)
+	}
+	return nil
+}
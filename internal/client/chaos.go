@@ -0,0 +1,66 @@
+package client
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"flow2api/internal/config"
+)
+
+// Fake upstream errors, shaped like Google API errors so they are handled
+// exactly as real ones
+const (
+	chaos429Body = `{"error":{"code":429,"message":"Resource has been exhausted (injected by chaos)","status":"RESOURCE_EXHAUSTED"}}`
+	chaos503Body = `{"error":{"code":503,"message":"The service is currently unavailable (injected by chaos)","status":"UNAVAILABLE"}}`
+)
+
+// chaosMatches reports whether chaos applies to an upstream URL
+func chaosMatches(cfg config.ChaosConfig, urlStr string) bool {
+	if len(cfg.Match) == 0 {
+		return true
+	}
+	for _, m := range cfg.Match {
+		if strings.Contains(urlStr, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// injectChaos delays an upstream request by the configured latency and may
+// answer it with a fake error instead; ok is false when the request should
+// be sent
+func injectChaos(method, urlStr string) (status int, body []byte, ok bool) {
+	cfg := config.Get().Chaos
+	if !cfg.Enabled || !chaosMatches(cfg, urlStr) {
+		return 0, nil, false
+	}
+
+	delay := time.Duration(cfg.Latency) * time.Millisecond
+	if cfg.LatencyJitter > 0 {
+		delay += time.Duration(rand.Intn(cfg.LatencyJitter+1)) * time.Millisecond
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	roll := rand.Float64()
+	switch {
+	case roll < cfg.Error429Rate:
+		status, body = http.StatusTooManyRequests, []byte(chaos429Body)
+	case roll < cfg.Error429Rate+cfg.Error5xxRate:
+		status, body = http.StatusServiceUnavailable, []byte(chaos503Body)
+	default:
+		return 0, nil, false
+	}
+	clientLog.Warn("Chaos: injected upstream error", "method", method, "url", urlStr, "status", status)
+	return status, body, true
+}
+
+// injectCaptchaFailure reports whether chaos fails this captcha solve
+func injectCaptchaFailure() bool {
+	cfg := config.Get().Chaos
+	return cfg.Enabled && cfg.CaptchaFailureRate > 0 && rand.Float64() < cfg.CaptchaFailureRate
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	zstdEncoder     *zstd.Encoder
+	zstdEncoderOnce sync.Once
+)
+
+// compressBody encodes a request body with the given Content-Encoding
+func compressBody(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		zstdEncoderOnce.Do(func() {
+			zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		})
+		return zstdEncoder.EncodeAll(data, make([]byte, 0, len(data)/2)), nil
+	default:
+		return nil, fmt.Errorf("unsupported request encoding: %s", encoding)
+	}
+}
+
+// isEncodingRejected reports whether the upstream refused a compressed body:
+// a 415, or a 400 that names the Content-Encoding. Other errors that merely
+// mention an encoding, such as of an image, are not a rejection.
+func isEncodingRejected(statusCode int, body []byte) bool {
+	if statusCode == 415 {
+		return true
+	}
+	return statusCode == 400 && strings.Contains(strings.ToLower(string(body)), "content-encoding")
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+)
+
+// maxDebugBody caps how much of a request or response body debug logs keep
+const maxDebugBody = 4096
+
+// minMediaPayload is the length from which a base64 string is taken for media
+const minMediaPayload = 256
+
+// debugHeaders flattens request headers for debug logs, masking credentials
+func debugHeaders(header http.Header, mask bool) map[string]string {
+	out := make(map[string]string, len(header))
+	for name, values := range header {
+		value := values[0]
+		if mask && (name == "Authorization" || name == "Cookie") {
+			value = logging.Mask(value)
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// debugBody renders a body for debug logs. Prompts are redacted as
+// privacy.mode says, media payloads are dropped, token fields are masked and
+// what remains is truncated.
+func debugBody(body []byte, mask bool) string {
+	text := string(body)
+	var doc interface{}
+	if json.Unmarshal(body, &doc) == nil {
+		if scrubbed, err := json.Marshal(scrubDebugValue("", doc, config.Get().Privacy)); err == nil {
+			text = string(scrubbed)
+		}
+	}
+	if mask {
+		text = logging.MaskSecrets(text)
+	}
+	if len(text) > maxDebugBody {
+		return fmt.Sprintf("%s... (%d bytes)", text[:maxDebugBody], len(body))
+	}
+	return text
+}
+
+// scrubDebugValue redacts the prompt fields of a decoded JSON value and
+// replaces inline media with its size; key is the field holding value
+func scrubDebugValue(key string, value interface{}, privacy config.PrivacyConfig) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for name, field := range v {
+			v[name] = scrubDebugValue(name, field, privacy)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = scrubDebugValue(key, item, privacy)
+		}
+	case string:
+		if key == "prompt" || key == "negativePrompt" {
+			return models.RedactPrompt(privacy.Mode, privacy.TruncateLength, v)
+		}
+		if isMediaPayload(v) {
+			return fmt.Sprintf("[media: %d bytes]", len(v))
+		}
+	}
+	return value
+}
+
+// isMediaPayload reports whether s is a data URL or a long base64 string
+func isMediaPayload(s string) bool {
+	if strings.HasPrefix(s, "data:") {
+		return true
+	}
+	if len(s) < minMediaPayload {
+		return false
+	}
+	return strings.Trim(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/=-_") == ""
+}
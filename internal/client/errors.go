@@ -0,0 +1,135 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrorKind tells upstream failures apart by what should be done about them
+type ErrorKind int
+
+const (
+	ErrorOther          ErrorKind = iota
+	ErrorRateLimited              // 429 that passes within minutes
+	ErrorQuotaExhausted           // 429 for a used-up daily quota
+	ErrorAuth                     // 401/403: the session needs a new login
+	ErrorTransient                // 5xx worth retrying
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorRateLimited:
+		return "rate_limited"
+	case ErrorQuotaExhausted:
+		return "quota_exhausted"
+	case ErrorAuth:
+		return "auth"
+	case ErrorTransient:
+		return "transient"
+	}
+	return "other"
+}
+
+// UpstreamError is a Flow API answer with an error status. Status, Message
+// and Reasons come from the Google API error body when there is one.
+type UpstreamError struct {
+	StatusCode int
+	Status     string   // e.g. RESOURCE_EXHAUSTED
+	Message    string   // the error's message
+	Reasons    []string // reasons of the error details, e.g. PUBLIC_ERROR_USER_REQUESTS_THROTTLED
+	Body       []byte
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("HTTP Error %d: %s", e.StatusCode, string(e.Body))
+}
+
+// newUpstreamError parses an error response
+func newUpstreamError(statusCode int, body []byte) *UpstreamError {
+	e := &UpstreamError{StatusCode: statusCode, Body: body}
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+			Details []struct {
+				Reason string `json:"reason"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		e.Status, e.Message = parsed.Error.Status, parsed.Error.Message
+		for _, d := range parsed.Error.Details {
+			if d.Reason != "" {
+				e.Reasons = append(e.Reasons, d.Reason)
+			}
+		}
+	}
+	return e
+}
+
+// Kind classifies the error. A 429 is a used-up quota when its message or
+// reasons mention a quota; a 403 about reCAPTCHA is not the session's fault.
+func (e *UpstreamError) Kind() ErrorKind {
+	switch code := e.StatusCode; {
+	case code == http.StatusTooManyRequests:
+		if e.mentions("quota") {
+			return ErrorQuotaExhausted
+		}
+		return ErrorRateLimited
+	case code == http.StatusUnauthorized:
+		return ErrorAuth
+	case code == http.StatusForbidden:
+		if e.mentions("captcha") {
+			return ErrorOther
+		}
+		return ErrorAuth
+	case code == http.StatusInternalServerError, code == http.StatusBadGateway,
+		code == http.StatusServiceUnavailable, code == http.StatusGatewayTimeout:
+		return ErrorTransient
+	}
+	return ErrorOther
+}
+
+func (e *UpstreamError) mentions(word string) bool {
+	text := strings.ToLower(e.Message + " " + strings.Join(e.Reasons, " "))
+	return strings.Contains(text, word)
+}
+
+// ErrorKindOf returns the kind of an upstream error wrapped in err, or
+// ErrorOther
+func ErrorKindOf(err error) ErrorKind {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return upstream.Kind()
+	}
+	return ErrorOther
+}
+
+// Transient upstream errors are sent again up to transientRetries times,
+// waiting transientBackoff before the first retry and twice as long after
+// each one
+const (
+	transientRetries = 2
+	transientBackoff = time.Second
+)
+
+// RetryTransient calls fn until it succeeds, fails with other than a
+// transient upstream error, or the retries run out. Only use it for calls
+// that are safe to repeat: reads, status polls and uploads. A generation that
+// failed with a 5xx may still have been accepted, and a retry would pay twice.
+func RetryTransient[T any](fn func() (T, error)) (T, error) {
+	backoff := transientBackoff
+	for retry := 0; ; retry++ {
+		result, err := fn()
+		if err == nil || retry == transientRetries || ErrorKindOf(err) != ErrorTransient {
+			return result, err
+		}
+		clientLog.Warn("Transient upstream error, retrying", "retry", retry+1, "in", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
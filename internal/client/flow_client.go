@@ -2,35 +2,49 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"flow2api/internal/browser"
 	"flow2api/internal/config"
+	"flow2api/internal/logging"
 
 	"github.com/google/uuid"
 )
 
+var (
+	clientLog  = logging.Component("flow_client")
+	captchaLog = logging.Component("captcha")
+)
+
 // FlowClient handles communication with Flow API
 type FlowClient struct {
 	httpClient  *http.Client
 	labsBaseURL string
 	apiBaseURL  string
 	proxyURL    string
+
+	ctx context.Context // nil for requests that are never cancelled
 }
 
 // NewFlowClient creates a new Flow API client
 func NewFlowClient(proxyURL string) *FlowClient {
 	cfg := config.Get()
 
-	transport := &http.Transport{}
+	// Large base64 uploads benefit from bigger write buffers and connection reuse
+	transport := &http.Transport{
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		WriteBufferSize:     256 * 1024,
+	}
 	if proxyURL != "" {
 		if proxyParsed, err := url.Parse(proxyURL); err == nil {
 			transport.Proxy = http.ProxyURL(proxyParsed)
@@ -48,25 +62,101 @@ func NewFlowClient(proxyURL string) *FlowClient {
 	}
 }
 
+// WithContext returns a client whose requests are cancelled with ctx
+func (c *FlowClient) WithContext(ctx context.Context) *FlowClient {
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+func (c *FlowClient) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 // makeRequest performs an HTTP request with authentication
 func (c *FlowClient) makeRequest(method, urlStr string, body interface{}, useST bool, stToken string, useAT bool, atToken string) (map[string]interface{}, error) {
-	var bodyReader io.Reader
+	var bodyBytes []byte
 	if body != nil {
-		bodyBytes, err := json.Marshal(body)
+		var err error
+		bodyBytes, err = json.Marshal(body)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal body: %w", err)
 		}
-		bodyReader = bytes.NewReader(bodyBytes)
 	}
 
-	req, err := http.NewRequest(method, urlStr, bodyReader)
+	encoding := c.requestEncoding(urlStr, len(bodyBytes))
+	statusCode, respBody, err := c.send(method, urlStr, bodyBytes, encoding, useST, stToken, useAT, atToken)
+	if err == nil && encoding != "" && isEncodingRejected(statusCode, respBody) {
+		// Only this request falls back; a proxy or endpoint that refuses
+		// one body says nothing about the rest
+		clientLog.Warn("Upstream rejected compressed request body, resending it uncompressed", "encoding", encoding, "url", urlStr)
+		statusCode, respBody, err = c.send(method, urlStr, bodyBytes, "", useST, stToken, useAT, atToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if statusCode >= 400 {
+		return nil, newUpstreamError(statusCode, respBody)
+	}
+
+	var result map[string]interface{}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return result, nil
+}
+
+// requestEncoding picks the Content-Encoding for a request body, or "" to send it as-is
+func (c *FlowClient) requestEncoding(urlStr string, size int) string {
+	cfg := config.Get()
+	encoding := cfg.Flow.RequestCompression
+	if encoding == "" || encoding == "none" {
+		return ""
+	}
+	// Only the API host accepts compressed bodies; labs endpoints are plain
+	if size < cfg.Flow.CompressionMinSize || !strings.HasPrefix(urlStr, c.apiBaseURL) {
+		return ""
+	}
+	return encoding
+}
+
+// send performs a single HTTP round trip and returns the status code and body
+func (c *FlowClient) send(method, urlStr string, bodyBytes []byte, encoding string, useST bool, stToken string, useAT bool, atToken string) (int, []byte, error) {
+	if status, body, ok := injectChaos(method, urlStr); ok {
+		return status, body, nil
+	}
+	startTime := time.Now()
+	payload := bodyBytes
+	if encoding != "" {
+		compressed, err := compressBody(bodyBytes, encoding)
+		if err != nil {
+			return 0, nil, err
+		}
+		payload = compressed
+	}
+	encodeTime := time.Since(startTime)
+
+	var bodyReader io.Reader
+	if payload != nil {
+		bodyReader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(c.context(), method, urlStr, bodyReader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return 0, nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
 
 	if useST && stToken != "" {
 		req.Header.Set("Cookie", fmt.Sprintf("__Secure-next-auth.session-token=%s", stToken))
@@ -76,32 +166,38 @@ func (c *FlowClient) makeRequest(method, urlStr string, body interface{}, useST
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", atToken))
 	}
 
-	cfg := config.Get()
-	if cfg.Debug.Enabled {
-		log.Printf("[FlowClient] %s %s", method, urlStr)
+	debug := config.Get().Debug
+	if debug.Enabled && debug.LogRequests {
+		clientLog.Debug("Upstream request", "method", method, "url", urlStr,
+			"headers", debugHeaders(req.Header, debug.MaskToken), "body", debugBody(bodyBytes, debug.MaskToken))
 	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return 0, nil, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+		return 0, nil, fmt.Errorf("failed to read response: %w", err)
 	}
 
-	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("HTTP Error %d: %s", resp.StatusCode, string(respBody))
-	}
-
-	var result map[string]interface{}
-	if err := json.Unmarshal(respBody, &result); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+	if debug.Enabled {
+		if encoding == "" {
+			encoding = "identity"
+		}
+		attrs := []interface{}{"method", method, "url", urlStr, "status", resp.StatusCode,
+			"duration", time.Since(startTime).Round(time.Millisecond),
+			"body_bytes", len(bodyBytes), "sent_bytes", len(payload), "encoding", encoding,
+			"encode_time", encodeTime.Round(time.Microsecond)}
+		if debug.LogResponses {
+			attrs = append(attrs, "response", debugBody(respBody, debug.MaskToken))
+		}
+		clientLog.Debug("Upstream response", attrs...)
 	}
 
-	return result, nil
+	return resp.StatusCode, respBody, nil
 }
 
 // STToAT converts Session Token to Access Token
@@ -154,13 +250,75 @@ func (c *FlowClient) DeleteProject(st, projectID string) error {
 	return err
 }
 
+// UpstreamProject represents a project listed on a Flow account
+type UpstreamProject struct {
+	ID    string
+	Title string
+}
+
+// ListProjects retrieves all PINHOLE projects on the account, following pagination
+func (c *FlowClient) ListProjects(st string) ([]UpstreamProject, error) {
+	var projects []UpstreamProject
+	cursor := ""
+
+	for page := 0; page < 50; page++ {
+		input := map[string]interface{}{
+			"json": map[string]interface{}{
+				"pageSize": 50,
+				"toolName": "PINHOLE",
+				"cursor":   cursor,
+			},
+		}
+		inputJSON, _ := json.Marshal(input)
+		urlStr := fmt.Sprintf("%s/trpc/project.searchUserProjects?input=%s", c.labsBaseURL, url.QueryEscape(string(inputJSON)))
+
+		result, err := c.makeRequest("GET", urlStr, nil, true, st, false, "")
+		if err != nil {
+			return nil, err
+		}
+
+		resultData, _ := result["result"].(map[string]interface{})
+		data, _ := resultData["data"].(map[string]interface{})
+		jsonData, _ := data["json"].(map[string]interface{})
+		innerResult, _ := jsonData["result"].(map[string]interface{})
+		if innerResult == nil {
+			return nil, fmt.Errorf("failed to parse project list from response")
+		}
+
+		items, _ := innerResult["projects"].([]interface{})
+		for _, item := range items {
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			id, _ := entry["projectId"].(string)
+			if id == "" {
+				continue
+			}
+			title, _ := entry["projectTitle"].(string)
+			if info, ok := entry["projectInfo"].(map[string]interface{}); ok && title == "" {
+				title, _ = info["projectTitle"].(string)
+			}
+			projects = append(projects, UpstreamProject{ID: id, Title: title})
+		}
+
+		cursor, _ = innerResult["nextPageToken"].(string)
+		if cursor == "" {
+			break
+		}
+	}
+
+	return projects, nil
+}
+
 // GetCredits retrieves credit balance
 func (c *FlowClient) GetCredits(at string) (map[string]interface{}, error) {
 	url := fmt.Sprintf("%s/credits", c.apiBaseURL)
 	return c.makeRequest("GET", url, nil, false, "", true, at)
 }
 
-// UploadImage uploads an image and returns mediaGenerationId
+// UploadImage uploads an image and returns mediaGenerationId. The MIME type
+// is detected from the bytes.
 func (c *FlowClient) UploadImage(at string, imageBytes []byte, aspectRatio string) (string, error) {
 	// Convert video aspect ratio to image aspect ratio
 	if len(aspectRatio) > 6 && aspectRatio[:6] == "VIDEO_" {
@@ -168,12 +326,16 @@ func (c *FlowClient) UploadImage(at string, imageBytes []byte, aspectRatio strin
 	}
 
 	imageBase64 := base64.StdEncoding.EncodeToString(imageBytes)
+	mimeType := http.DetectContentType(imageBytes)
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = "image/jpeg"
+	}
 
 	url := fmt.Sprintf("%s:uploadUserImage", c.apiBaseURL)
 	body := map[string]interface{}{
 		"imageInput": map[string]interface{}{
 			"rawImageBytes":  imageBase64,
-			"mimeType":       "image/jpeg",
+			"mimeType":       mimeType,
 			"isUserUploaded": true,
 			"aspectRatio":    aspectRatio,
 		},
@@ -198,40 +360,69 @@ func (c *FlowClient) UploadImage(at string, imageBytes []byte, aspectRatio strin
 	return "", fmt.Errorf("failed to parse media ID from response")
 }
 
-// GenerateImage generates an image
-func (c *FlowClient) GenerateImage(at, projectID, prompt, modelName, aspectRatio string, imageInputs []map[string]interface{}) (map[string]interface{}, error) {
+// GenerateImage generates count images in one batch; each entry gets its own seed so results differ
+func (c *FlowClient) GenerateImage(at, projectID, prompt, negativePrompt, modelName, aspectRatio string, imageInputs []map[string]interface{}, seed, count int) (map[string]interface{}, error) {
 	recaptchaToken := c.getRecaptchaToken(projectID)
 	sessionID := c.generateSessionID()
 
 	url := fmt.Sprintf("%s/projects/%s/flowMedia:batchGenerateImages", c.apiBaseURL, projectID)
 
-	requestData := map[string]interface{}{
+	if count < 1 {
+		count = 1
+	}
+	requests := make([]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		requestData := map[string]interface{}{
+			"clientContext": map[string]interface{}{
+				"recaptchaToken": recaptchaToken,
+				"projectId":      projectID,
+				"sessionId":      sessionID,
+				"tool":           "PINHOLE",
+			},
+			"seed":             seed + i,
+			"imageModelName":   modelName,
+			"imageAspectRatio": aspectRatio,
+			"prompt":           prompt,
+			"imageInputs":      imageInputs,
+		}
+		if negativePrompt != "" {
+			requestData["negativePrompt"] = negativePrompt
+		}
+		requests = append(requests, requestData)
+	}
+
+	body := map[string]interface{}{
 		"clientContext": map[string]interface{}{
 			"recaptchaToken": recaptchaToken,
-			"projectId":      projectID,
 			"sessionId":      sessionID,
-			"tool":           "PINHOLE",
 		},
-		"seed":             rand.Intn(99999),
-		"imageModelName":   modelName,
-		"imageAspectRatio": aspectRatio,
-		"prompt":           prompt,
-		"imageInputs":      imageInputs,
+		"requests": requests,
 	}
 
+	return c.makeRequest("POST", url, body, false, "", true, at)
+}
+
+// UpscaleImage upsamples a generated or uploaded image to the target resolution
+func (c *FlowClient) UpscaleImage(at, projectID, mediaID, resolution string) (map[string]interface{}, error) {
+	recaptchaToken := c.getRecaptchaToken(projectID)
+
+	url := fmt.Sprintf("%s/flow/upsampleImage", c.apiBaseURL)
 	body := map[string]interface{}{
+		"mediaId":          mediaID,
+		"targetResolution": resolution,
 		"clientContext": map[string]interface{}{
 			"recaptchaToken": recaptchaToken,
-			"sessionId":      sessionID,
+			"projectId":      projectID,
+			"sessionId":      c.generateSessionID(),
+			"tool":           "PINHOLE",
 		},
-		"requests": []interface{}{requestData},
 	}
 
 	return c.makeRequest("POST", url, body, false, "", true, at)
 }
 
 // GenerateVideoText generates video from text
-func (c *FlowClient) GenerateVideoText(at, projectID, prompt, modelKey, aspectRatio, userPaygateTier string) (map[string]interface{}, error) {
+func (c *FlowClient) GenerateVideoText(at, projectID, prompt, negativePrompt, modelKey, aspectRatio, userPaygateTier string, seed int) (map[string]interface{}, error) {
 	recaptchaToken := c.getRecaptchaToken(projectID)
 	sessionID := c.generateSessionID()
 	sceneID := uuid.New().String()
@@ -248,11 +439,9 @@ func (c *FlowClient) GenerateVideoText(at, projectID, prompt, modelKey, aspectRa
 		},
 		"requests": []interface{}{
 			map[string]interface{}{
-				"aspectRatio": aspectRatio,
-				"seed":        rand.Intn(99999),
-				"textInput": map[string]interface{}{
-					"prompt": prompt,
-				},
+				"aspectRatio":   aspectRatio,
+				"seed":          seed,
+				"textInput":     textInput(prompt, negativePrompt),
 				"videoModelKey": modelKey,
 				"metadata": map[string]interface{}{
 					"sceneId": sceneID,
@@ -265,7 +454,7 @@ func (c *FlowClient) GenerateVideoText(at, projectID, prompt, modelKey, aspectRa
 }
 
 // GenerateVideoReferenceImages generates video from reference images
-func (c *FlowClient) GenerateVideoReferenceImages(at, projectID, prompt, modelKey, aspectRatio string, referenceImages []map[string]interface{}, userPaygateTier string) (map[string]interface{}, error) {
+func (c *FlowClient) GenerateVideoReferenceImages(at, projectID, prompt, negativePrompt, modelKey, aspectRatio string, referenceImages []map[string]interface{}, userPaygateTier string, seed int) (map[string]interface{}, error) {
 	recaptchaToken := c.getRecaptchaToken(projectID)
 	sessionID := c.generateSessionID()
 	sceneID := uuid.New().String()
@@ -282,11 +471,9 @@ func (c *FlowClient) GenerateVideoReferenceImages(at, projectID, prompt, modelKe
 		},
 		"requests": []interface{}{
 			map[string]interface{}{
-				"aspectRatio": aspectRatio,
-				"seed":        rand.Intn(99999),
-				"textInput": map[string]interface{}{
-					"prompt": prompt,
-				},
+				"aspectRatio":     aspectRatio,
+				"seed":            seed,
+				"textInput":       textInput(prompt, negativePrompt),
 				"videoModelKey":   modelKey,
 				"referenceImages": referenceImages,
 				"metadata": map[string]interface{}{
@@ -300,7 +487,7 @@ func (c *FlowClient) GenerateVideoReferenceImages(at, projectID, prompt, modelKe
 }
 
 // GenerateVideoStartEnd generates video from start and end frames
-func (c *FlowClient) GenerateVideoStartEnd(at, projectID, prompt, modelKey, aspectRatio, startMediaID, endMediaID, userPaygateTier string) (map[string]interface{}, error) {
+func (c *FlowClient) GenerateVideoStartEnd(at, projectID, prompt, negativePrompt, modelKey, aspectRatio, startMediaID, endMediaID, userPaygateTier string, seed int) (map[string]interface{}, error) {
 	recaptchaToken := c.getRecaptchaToken(projectID)
 	sessionID := c.generateSessionID()
 	sceneID := uuid.New().String()
@@ -308,11 +495,9 @@ func (c *FlowClient) GenerateVideoStartEnd(at, projectID, prompt, modelKey, aspe
 	url := fmt.Sprintf("%s/video:batchAsyncGenerateVideoStartAndEndImage", c.apiBaseURL)
 
 	requestData := map[string]interface{}{
-		"aspectRatio": aspectRatio,
-		"seed":        rand.Intn(99999),
-		"textInput": map[string]interface{}{
-			"prompt": prompt,
-		},
+		"aspectRatio":   aspectRatio,
+		"seed":          seed,
+		"textInput":     textInput(prompt, negativePrompt),
 		"videoModelKey": modelKey,
 		"startImage": map[string]interface{}{
 			"mediaId": startMediaID,
@@ -342,6 +527,54 @@ func (c *FlowClient) GenerateVideoStartEnd(at, projectID, prompt, modelKey, aspe
 	return c.makeRequest("POST", url, body, false, "", true, at)
 }
 
+// GenerateVideoExtend continues an existing clip in the same scene
+func (c *FlowClient) GenerateVideoExtend(at, projectID, prompt, negativePrompt, modelKey, aspectRatio, videoMediaID, sceneID, userPaygateTier string, seed int) (map[string]interface{}, error) {
+	recaptchaToken := c.getRecaptchaToken(projectID)
+	sessionID := c.generateSessionID()
+	if sceneID == "" {
+		sceneID = uuid.New().String()
+	}
+
+	url := fmt.Sprintf("%s/video:batchAsyncGenerateVideoExtendVideo", c.apiBaseURL)
+
+	body := map[string]interface{}{
+		"clientContext": map[string]interface{}{
+			"recaptchaToken":  recaptchaToken,
+			"sessionId":       sessionID,
+			"projectId":       projectID,
+			"tool":            "PINHOLE",
+			"userPaygateTier": userPaygateTier,
+		},
+		"requests": []interface{}{
+			map[string]interface{}{
+				"aspectRatio":   aspectRatio,
+				"seed":          seed,
+				"textInput":     textInput(prompt, negativePrompt),
+				"videoModelKey": modelKey,
+				"videoInput": map[string]interface{}{
+					"mediaId": videoMediaID,
+				},
+				"metadata": map[string]interface{}{
+					"sceneId": sceneID,
+				},
+			},
+		},
+	}
+
+	return c.makeRequest("POST", url, body, false, "", true, at)
+}
+
+// textInput builds the prompt block of a video request
+func textInput(prompt, negativePrompt string) map[string]interface{} {
+	input := map[string]interface{}{
+		"prompt": prompt,
+	}
+	if negativePrompt != "" {
+		input["negativePrompt"] = negativePrompt
+	}
+	return input
+}
+
 // CheckVideoStatus checks video generation status
 func (c *FlowClient) CheckVideoStatus(at string, operations []map[string]interface{}) (map[string]interface{}, error) {
 	url := fmt.Sprintf("%s/video:batchCheckAsyncVideoGenerationStatus", c.apiBaseURL)
@@ -352,6 +585,45 @@ func (c *FlowClient) CheckVideoStatus(at string, operations []map[string]interfa
 	return c.makeRequest("POST", url, body, false, "", true, at)
 }
 
+// DiscoveredModel represents a model key advertised by the Flow API
+type DiscoveredModel struct {
+	Key         string
+	Type        string // image or video
+	DisplayName string
+}
+
+// ListAvailableModels retrieves the image and video model keys available to the account
+func (c *FlowClient) ListAvailableModels(at string) ([]DiscoveredModel, error) {
+	url := fmt.Sprintf("%s/flow/modelConfigs?tool=PINHOLE", c.apiBaseURL)
+	result, err := c.makeRequest("GET", url, nil, false, "", true, at)
+	if err != nil {
+		return nil, err
+	}
+
+	var discovered []DiscoveredModel
+	collect := func(field, modelType string, keyFields ...string) {
+		items, _ := result[field].([]interface{})
+		for _, item := range items {
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for _, keyField := range keyFields {
+				if key, ok := entry[keyField].(string); ok && key != "" {
+					displayName, _ := entry["displayName"].(string)
+					discovered = append(discovered, DiscoveredModel{Key: key, Type: modelType, DisplayName: displayName})
+					break
+				}
+			}
+		}
+	}
+
+	collect("videoModels", "video", "videoModelKey", "modelKey", "key")
+	collect("imageModels", "image", "imageModelName", "modelName", "key")
+
+	return discovered, nil
+}
+
 // generateSessionID generates a session ID
 func (c *FlowClient) generateSessionID() string {
 	return fmt.Sprintf(";%d", time.Now().UnixMilli())
@@ -360,13 +632,17 @@ func (c *FlowClient) generateSessionID() string {
 // getRecaptchaToken gets reCAPTCHA token
 func (c *FlowClient) getRecaptchaToken(projectID string) string {
 	cfg := config.Get()
+	if injectCaptchaFailure() {
+		captchaLog.Warn("Chaos: injected captcha failure", "project_id", projectID)
+		return ""
+	}
 
 	if cfg.Captcha.CaptchaMethod == "browser" {
 		// Standard browser mode with xvfb (headless)
 		service := browser.GetCaptchaService()
 		token, err := service.GetToken(projectID)
 		if err != nil {
-			log.Printf("[reCAPTCHA] Browser error: %v", err)
+			captchaLog.Error("Browser captcha failed", "project_id", projectID, "error", err)
 			return ""
 		}
 		return token
@@ -377,7 +653,19 @@ func (c *FlowClient) getRecaptchaToken(projectID string) string {
 		service := browser.GetPersonalCaptchaService()
 		token, err := service.GetToken(projectID)
 		if err != nil {
-			log.Printf("[reCAPTCHA] Personal browser error: %v", err)
+			captchaLog.Error("Personal browser captcha failed", "project_id", projectID, "error", err)
+			return ""
+		}
+		return token
+	}
+
+	if cfg.Captcha.CaptchaMethod == "sidecar" {
+		// Browser running in a separate container
+		sidecar := browser.NewSidecarClient(cfg.Captcha.SidecarURL, cfg.Captcha.SidecarToken,
+			time.Duration(cfg.Captcha.SidecarTimeout)*time.Second)
+		token, err := sidecar.GetToken(projectID)
+		if err != nil {
+			captchaLog.Error("Sidecar captcha failed", "project_id", projectID, "error", err)
 			return ""
 		}
 		return token
@@ -411,7 +699,7 @@ func (c *FlowClient) getYesCaptchaToken(projectID string) string {
 	bodyBytes, _ := json.Marshal(createBody)
 	resp, err := http.Post(createURL, "application/json", bytes.NewReader(bodyBytes))
 	if err != nil {
-		log.Printf("[YesCaptcha] Create task error: %v", err)
+		captchaLog.Error("YesCaptcha task creation failed", "error", err)
 		return ""
 	}
 	defer resp.Body.Close()
@@ -421,11 +709,11 @@ func (c *FlowClient) getYesCaptchaToken(projectID string) string {
 
 	taskID, ok := result["taskId"].(string)
 	if !ok {
-		log.Printf("[YesCaptcha] No taskId in response")
+		captchaLog.Error("YesCaptcha returned no taskId")
 		return ""
 	}
 
-	log.Printf("[YesCaptcha] Created task: %s", taskID)
+	captchaLog.Debug("YesCaptcha task created", "captcha_task_id", taskID)
 
 	// Poll for result
 	getURL := fmt.Sprintf("%s/getTaskResult", cfg.Captcha.YesCaptchaBaseURL)
@@ -1,61 +1,198 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	Global     GlobalConfig     `toml:"global"`
-	Server     ServerConfig     `toml:"server"`
-	Flow       FlowConfig       `toml:"flow"`
-	Cache      CacheConfig      `toml:"cache"`
-	Debug      DebugConfig      `toml:"debug"`
-	Generation GenerationConfig `toml:"generation"`
-	Captcha    CaptchaConfig    `toml:"captcha"`
+	Global      GlobalConfig      `toml:"global"`
+	Server      ServerConfig      `toml:"server"`
+	Database    DatabaseConfig    `toml:"database"`
+	Proxy       ProxyConfig       `toml:"proxy"`
+	Flow        FlowConfig        `toml:"flow"`
+	Cache       CacheConfig       `toml:"cache"`
+	Debug       DebugConfig       `toml:"debug"`
+	Generation  GenerationConfig  `toml:"generation"`
+	Captcha     CaptchaConfig     `toml:"captcha"`
+	Federation  FederationConfig  `toml:"federation"`
+	TokenSync   TokenSyncConfig   `toml:"token_sync"`
+	TokenImport TokenImportConfig `toml:"token_import"`
+	Uploads     UploadsConfig     `toml:"uploads"`
+	Webhook     WebhookConfig     `toml:"webhook"`
+	Privacy     PrivacyConfig     `toml:"privacy"`
+	Watermark   WatermarkConfig   `toml:"watermark"`
+	Provenance  ProvenanceConfig  `toml:"provenance"`
+	SelfTest    SelfTestConfig    `toml:"selftest"`
+	Hooks       []HookConfig      `toml:"hooks"`
+	Chaos       ChaosConfig       `toml:"chaos"`
 
-	mu sync.RWMutex
+	path      string // file the configuration was read from
+	published bool   // readers may hold it, so it is replaced rather than changed
 }
 
 type GlobalConfig struct {
 	APIKey        string `toml:"api_key"`
+	APIKeyGrace   int    `toml:"api_key_grace"` // seconds the replaced key keeps working after a rotation
+	SessionTTL    int    `toml:"session_ttl"`   // hours an unused admin session stays signed in
 	AdminUsername string `toml:"admin_username"`
 	AdminPassword string `toml:"admin_password"`
+
+	// Key replaced by the last rotation and when it stops being accepted;
+	// kept in the database, not in setting.toml
+	PreviousAPIKey        string    `toml:"-"`
+	PreviousAPIKeyExpires time.Time `toml:"-"`
 }
 
 type ServerConfig struct {
-	Host string `toml:"host"`
-	Port int    `toml:"port"`
+	Host         string             `toml:"host"`
+	Port         int                `toml:"port"`
+	StatusFile   string             `toml:"status_file"`   // JSON file reporting readiness and drain progress; empty disables
+	DrainTimeout int                `toml:"drain_timeout"` // seconds to wait for running generations on shutdown
+	Timeouts     RouteTimeoutConfig `toml:"timeouts"`
+	Metrics      bool               `toml:"metrics"`       // serve Prometheus metrics at /metrics
+	MetricsToken string             `toml:"metrics_token"` // bearer token required by /metrics; empty leaves it open
+	StatusPage   string             `toml:"status_page"`   // /status access: public, key (API key required) or off
+
+	// Client addresses behind a reverse proxy, for the IP filters
+	ProxyHeader    string   `toml:"proxy_header"`    // header carrying the client address, e.g. X-Forwarded-For; empty uses the peer address
+	TrustedProxies []string `toml:"trusted_proxies"` // peers whose proxy_header is believed, as IPs or CIDR ranges
+
+	// Performance tuning for high request rates
+	Listeners       int `toml:"listeners"`         // SO_REUSEPORT sockets accepting on the port; 1 is a plain listener
+	ReadBufferSize  int `toml:"read_buffer_size"`  // bytes per connection for reading requests; also caps the header size
+	WriteBufferSize int `toml:"write_buffer_size"` // bytes per connection for writing responses
+}
+
+// RouteTimeoutConfig sets server-side timeouts per route class, in seconds;
+// 0 disables a timeout
+type RouteTimeoutConfig struct {
+	Admin      int `toml:"admin"`       // reading requests and writing responses of the admin API and pages
+	Media      int `toml:"media"`       // writing cached media, share links and archives
+	Upload     int `toml:"upload"`      // reading generation request bodies, which may carry images
+	StreamWarn int `toml:"stream_warn"` // log generation responses still open after this long
+	Idle       int `toml:"idle"`        // keep-alive connections between requests
+}
+
+type DatabaseConfig struct {
+	Path string `toml:"path"`
+}
+
+type ProxyConfig struct {
+	URL string `toml:"url"` // upstream proxy; overrides the one set in the admin panel when non-empty
 }
 
 type FlowConfig struct {
-	LabsBaseURL     string  `toml:"labs_base_url"`
-	APIBaseURL      string  `toml:"api_base_url"`
-	Timeout         int     `toml:"timeout"`
-	MaxRetries      int     `toml:"max_retries"`
-	PollInterval    float64 `toml:"poll_interval"`
-	MaxPollAttempts int     `toml:"max_poll_attempts"`
+	LabsBaseURL            string  `toml:"labs_base_url"`
+	APIBaseURL             string  `toml:"api_base_url"`
+	Timeout                int     `toml:"timeout"`
+	MaxRetries             int     `toml:"max_retries"`
+	PollInterval           float64 `toml:"poll_interval"`
+	MaxPollAttempts        int     `toml:"max_poll_attempts"`
+	PollTimeout            string  `toml:"poll_timeout"`             // error, or pending: answer with the task ID and keep polling in the background
+	PendingFinishReason    string  `toml:"pending_finish_reason"`    // finish_reason of a pending answer
+	Keepalive              string  `toml:"keepalive"`                // comment (": ping") or delta (an empty content chunk)
+	KeepaliveInterval      int     `toml:"keepalive_interval"`       // seconds between keepalives while streaming a video poll, 0 disables
+	ModelDiscoveryInterval int     `toml:"model_discovery_interval"` // minutes, 0 disables
+	RequestCompression     string  `toml:"request_compression"`      // none, gzip or zstd
+	CompressionMinSize     int     `toml:"compression_min_size"`     // bytes
+	ProjectNameTemplate    string  `toml:"project_name_template"`    // {email}, {user}, {seq}, {date}, {time}
+	ProjectRotateEvery     int     `toml:"project_rotate_every"`     // generations per project before a token moves to a new one; 0 never
 }
 
 type CacheConfig struct {
-	Enabled bool   `toml:"enabled"`
-	Timeout int    `toml:"timeout"`
-	BaseURL string `toml:"base_url"`
+	Enabled bool     `toml:"enabled"`
+	Timeout int      `toml:"timeout"`
+	BaseURL string   `toml:"base_url"`
+	Backend string   `toml:"backend"` // local or s3
+	FFprobe string   `toml:"ffprobe"` // ffprobe binary that must read each download before it is cached; empty skips the check
+	S3      S3Config `toml:"s3"`
+
+	Signing SigningConfig `toml:"signing"`
+}
+
+// SigningConfig selects how cached result URLs are signed each time they are
+// handed to a client
+type SigningConfig struct {
+	Mode  string `toml:"mode"`  // none, s3 (presigned GETs on a private bucket) or cdn (type-A auth token)
+	TTL   int    `toml:"ttl"`   // seconds a signed URL stays valid
+	Key   string `toml:"key"`   // cdn: the auth key configured on the CDN
+	Param string `toml:"param"` // cdn: query parameter carrying the token
+}
+
+type S3Config struct {
+	Endpoint  string `toml:"endpoint"`
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	PublicURL string `toml:"public_url"` // CDN or public bucket URL used in returned links
+	Prefix    string `toml:"prefix"`
+	PathStyle bool   `toml:"path_style"`
 }
 
 type DebugConfig struct {
-	Enabled      bool `toml:"enabled"`
-	LogRequests  bool `toml:"log_requests"`
-	LogResponses bool `toml:"log_responses"`
-	MaskToken    bool `toml:"mask_token"`
+	Enabled              bool   `toml:"enabled"`
+	LogRequests          bool   `toml:"log_requests"`
+	LogResponses         bool   `toml:"log_responses"`
+	MaskToken            bool   `toml:"mask_token"`
+	SlowRequestThreshold int    `toml:"slow_request_threshold"` // seconds, 0 disables slow-request traces
+	LogLevel             string `toml:"log_level"`              // debug, info, warn or error; debug mode always logs at debug
+	LogFormat            string `toml:"log_format"`             // text or json, fixed at startup
 }
 
 type GenerationConfig struct {
-	ImageTimeout int `toml:"image_timeout"`
-	VideoTimeout int `toml:"video_timeout"`
+	ImageTimeout  int    `toml:"image_timeout"`
+	VideoTimeout  int    `toml:"video_timeout"`
+	ImageWorkers  int    `toml:"image_workers"`  // concurrent image generations across all tokens
+	VideoWorkers  int    `toml:"video_workers"`  // concurrent video generations across all tokens
+	FrameMismatch string `toml:"frame_mismatch"` // error or crop, for i2v frames against the model orientation
+	QueueSize     int    `toml:"queue_size"`     // waiting jobs per type before requests are rejected
+
+	// InteractiveReserve is the fraction of workers batch requests may not
+	// use, so queued batch work cannot starve streaming clients
+	InteractiveReserve float64 `toml:"interactive_reserve"`
+
+	// Tokens with fewer credits are skipped for that generation type, after
+	// a refresh confirms the balance; 0 disables the check
+	MinImageCredits int `toml:"min_image_credits"`
+	MinVideoCredits int `toml:"min_video_credits"`
+
+	// Longest prompt, in characters, sent upstream for each generation type;
+	// PromptLimits overrides them per model ID or glob and 0 disables a limit
+	MaxImagePrompt int            `toml:"max_image_prompt"`
+	MaxVideoPrompt int            `toml:"max_video_prompt"`
+	PromptLimits   map[string]int `toml:"prompt_limits"`
+	PromptOverflow string         `toml:"prompt_overflow"` // error or truncate, for prompts over the limit
+
+	// Largest reference image accepted, uploaded or fetched, and which image
+	// URLs are fetched server-side: off, public (no private or loopback
+	// addresses) or any
+	MaxReferenceImageMB int    `toml:"max_reference_image_mb"`
+	RemoteImages        string `toml:"remote_images"`
+
+	// Reference images are upright-rotated and stripped of EXIF before
+	// upload. Those with a longer side than ReferenceMaxSide pixels are
+	// downscaled, 0 keeps their size; ReferenceJPEG re-encodes other formats
+	// as JPEG, which Flow accepts at larger sizes than PNG.
+	ReferenceMaxSide int  `toml:"reference_max_side"`
+	ReferenceJPEG    bool `toml:"reference_jpeg"`
+
+	// Tasks left processing without an update for StuckTaskTimeout seconds
+	// get one last status check and are then failed; 0 disables the watchdog
+	StuckTaskTimeout int `toml:"stuck_task_timeout"`
+
+	// Announcement is an operational notice sent to clients as the first
+	// reasoning chunk of generation streams and in generation error
+	// payloads; empty sends none
+	Announcement string `toml:"announcement"`
 }
 
 type CaptchaConfig struct {
@@ -66,115 +203,409 @@ type CaptchaConfig struct {
 	PageAction          string `toml:"page_action"`
 	BrowserProxyEnabled bool   `toml:"browser_proxy_enabled"`
 	BrowserProxyURL     string `toml:"browser_proxy_url"`
+	BrowserHeadless     bool   `toml:"browser_headless"`  // headless-new instead of a visible window or Xvfb
+	BrowserPoolSize     int    `toml:"browser_pool_size"` // pages solving captchas in parallel
+	SidecarURL          string `toml:"sidecar_url"`
+	SidecarToken        string `toml:"sidecar_token"`
+	SidecarTimeout      int    `toml:"sidecar_timeout"` // seconds
+}
+
+type FederationConfig struct {
+	Enabled bool         `toml:"enabled"`
+	Timeout int          `toml:"timeout"` // seconds per forwarded request
+	Peers   []PeerConfig `toml:"peers"`
+}
+
+// TokenSyncConfig pulls tokens from the export endpoint of a primary
+// flow2api instance, logging in with its admin credentials
+type TokenSyncConfig struct {
+	Enabled  bool   `toml:"enabled"` // sync on a schedule; POST /api/tokens/sync works either way
+	URL      string `toml:"url"`     // base URL of the primary instance
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	Interval int    `toml:"interval"` // minutes between scheduled syncs
+	DryRun   bool   `toml:"dry_run"`  // scheduled syncs only log what they would change
+}
+
+// TokenImportConfig paces the upstream calls made when imports and syncs add
+// new tokens, so a large batch does not arrive from one address in a burst
+type TokenImportConfig struct {
+	Interval       int      `toml:"interval"`        // milliseconds between adding two new tokens
+	Proxies        []string `toml:"proxies"`         // used in turn for new tokens that name no proxy of their own
+	AsyncThreshold int      `toml:"async_threshold"` // imports adding more tokens run in the background
+}
+
+// UploadsConfig limits resumable uploads, which reference media is sent in
+// chunks through before a generation request names it
+type UploadsConfig struct {
+	MaxSize int `toml:"max_size"` // MB per upload, capped at generation.max_reference_image_mb
+	Expire  int `toml:"expire"`   // minutes an upload is kept after its last chunk
+}
+
+type WebhookConfig struct {
+	Enabled   bool   `toml:"enabled"`
+	Secret    string `toml:"secret"`    // HMAC-SHA256 key shared with senders
+	Tolerance int    `toml:"tolerance"` // seconds a signed request stays valid
+}
+
+type PrivacyConfig struct {
+	Mode           string `toml:"mode"`            // off, truncate, hash or skip; API keys may override
+	TruncateLength int    `toml:"truncate_length"` // characters kept in truncate mode
+	SkipCache      bool   `toml:"skip_cache"`      // return upstream URLs instead of caching media
+
+	// Prompts of tasks older than PromptRetentionDays are redacted with
+	// RetentionMode (truncate, hash or skip); 0 keeps them
+	PromptRetentionDays int    `toml:"prompt_retention_days"`
+	RetentionMode       string `toml:"retention_mode"`
+}
+
+// WatermarkConfig stamps generated media with a label as it is cached
+type WatermarkConfig struct {
+	Enabled  bool    `toml:"enabled"`
+	Text     string  `toml:"text"`     // label drawn when no logo is set
+	Logo     string  `toml:"logo"`     // PNG or JPEG file drawn instead of the text
+	Position string  `toml:"position"` // top-left, top-right, bottom-left, bottom-right or center
+	Opacity  float64 `toml:"opacity"`  // 0 to 1
+	Scale    float64 `toml:"scale"`    // mark width as a fraction of the media width
+	Images   bool    `toml:"images"`
+	Videos   bool    `toml:"videos"`
+	FFmpeg   string  `toml:"ffmpeg"` // ffmpeg binary that stamps videos
+}
+
+// ProvenanceConfig embeds generation metadata into cached images
+type ProvenanceConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	Instance string `toml:"instance"` // names this instance in the metadata; empty uses the hostname
+	Manifest bool   `toml:"manifest"` // also embed an unsigned C2PA-style manifest
+}
+
+// SelfTestConfig enables end-to-end generation self-tests on a token set
+// aside for them
+type SelfTestConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	TokenID  int64  `toml:"token_id"` // token the test generations run on
+	Model    string `toml:"model"`    // image model
+	Prompt   string `toml:"prompt"`
+	MaxAge   int    `toml:"max_age"`  // seconds a passed test keeps the health check green
+	Interval int    `toml:"interval"` // minutes between scheduled tests; 0 runs them only on request
+}
+
+// HookConfig is an external HTTP hook called at the listed lifecycle stages
+type HookConfig struct {
+	Name     string   `toml:"name"`
+	URL      string   `toml:"url"`
+	Stages   []string `toml:"stages"`    // pre_select, pre_submit, post_complete, on_error
+	Secret   string   `toml:"secret"`    // signs requests like completion callbacks; empty sends them unsigned
+	Timeout  int      `toml:"timeout"`   // seconds per call
+	FailOpen bool     `toml:"fail_open"` // pre stages: let the request through when the hook fails
+}
+
+// ChaosConfig injects upstream faults so operators can rehearse incidents:
+// alerting, 429 bans and retries. It is a developer tool; keep it off in
+// production.
+type ChaosConfig struct {
+	Enabled            bool     `toml:"enabled"`
+	Latency            int      `toml:"latency"`              // milliseconds added to every upstream request
+	LatencyJitter      int      `toml:"latency_jitter"`       // up to this many more milliseconds, at random
+	Error429Rate       float64  `toml:"error_429_rate"`       // fraction of upstream requests answered with a fake HTTP 429
+	Error5xxRate       float64  `toml:"error_5xx_rate"`       // fraction answered with a fake HTTP 503
+	CaptchaFailureRate float64  `toml:"captcha_failure_rate"` // fraction of captcha solves that fail
+	Match              []string `toml:"match"`                // only upstream URLs containing one of these; empty matches all
+}
+
+type PeerConfig struct {
+	Name   string `toml:"name"`
+	URL    string `toml:"url"`
+	APIKey string `toml:"api_key"`
 }
 
 var (
-	cfg  *Config
-	once sync.Once
+	active  atomic.Pointer[Config]
+	once    sync.Once
+	writeMu sync.Mutex // serializes replacing the published configuration
 )
 
+// newConfig returns a configuration holding the built-in defaults
+func newConfig() *Config {
+	c := &Config{}
+	c.Server.Host = "0.0.0.0"
+	c.Server.Port = 8000
+	c.Server.DrainTimeout = 1800
+	c.Server.Listeners = 1
+	c.Server.StatusPage = "public"
+	c.Server.ReadBufferSize = 4096
+	c.Server.WriteBufferSize = 4096
+	c.Server.Timeouts = RouteTimeoutConfig{Admin: 30, Media: 300, Upload: 120, StreamWarn: 900, Idle: 120}
+	c.Database.Path = filepath.Join("data", "flow2api.db")
+	c.Flow.LabsBaseURL = "https://labs.google/fx/api"
+	c.Flow.APIBaseURL = "https://aisandbox-pa.googleapis.com/v1"
+	c.Flow.Timeout = 120
+	c.Flow.MaxRetries = 3
+	c.Flow.PollInterval = 3.0
+	c.Flow.MaxPollAttempts = 500
+	c.Flow.PollTimeout = "error"
+	c.Flow.PendingFinishReason = "stop"
+	c.Flow.Keepalive = "comment"
+	c.Flow.KeepaliveInterval = 15
+	c.Flow.ModelDiscoveryInterval = 360
+	c.Flow.RequestCompression = "none"
+	c.Flow.CompressionMinSize = 64 * 1024
+	c.Flow.ProjectNameTemplate = "flow2api-{email}-{seq}"
+	c.Cache.Timeout = 7200
+	c.Debug.SlowRequestThreshold = 60
+	c.Debug.LogLevel = "info"
+	c.Debug.LogFormat = "text"
+	c.Cache.Backend = "local"
+	c.Cache.S3.Region = "us-east-1"
+	c.Cache.S3.PathStyle = true
+	c.Cache.Signing.Mode = "none"
+	c.Cache.Signing.TTL = 3600
+	c.Cache.Signing.Param = "auth_key"
+	c.Generation.ImageTimeout = 300
+	c.Generation.VideoTimeout = 1500
+	c.Generation.ImageWorkers = 8
+	c.Generation.VideoWorkers = 8
+	c.Generation.QueueSize = 100
+	c.Generation.FrameMismatch = "error"
+	c.Generation.MaxImagePrompt = 5000
+	c.Generation.MaxVideoPrompt = 2000
+	c.Generation.PromptOverflow = "error"
+	c.Generation.MaxReferenceImageMB = 20
+	c.Generation.RemoteImages = "public"
+	c.Generation.ReferenceMaxSide = 2048
+	c.Generation.ReferenceJPEG = true
+	c.Generation.InteractiveReserve = 0.25
+	c.Generation.StuckTaskTimeout = 3600
+	c.Captcha.CaptchaMethod = "browser"
+	c.Captcha.YesCaptchaBaseURL = "https://api.yescaptcha.com"
+	c.Captcha.WebsiteKey = "6LdsFiUsAAAAAIjVDZcuLhaHiDn5nnHVXVRQGeMV"
+	c.Captcha.PageAction = "FLOW_GENERATION"
+	c.Captcha.SidecarTimeout = 60
+	c.Captcha.BrowserPoolSize = 3
+	c.Federation.Timeout = 1800
+	c.TokenSync.Interval = 60
+	c.TokenImport.Interval = 1000
+	c.TokenImport.AsyncThreshold = 20
+	c.Uploads.MaxSize = 20
+	c.Uploads.Expire = 60
+	c.Webhook.Tolerance = 300
+	c.Privacy.Mode = "off"
+	c.Privacy.TruncateLength = 64
+	c.Privacy.RetentionMode = "hash"
+	c.Watermark.Text = "AI generated"
+	c.Watermark.Position = "bottom-right"
+	c.Watermark.Opacity = 0.6
+	c.Watermark.Scale = 0.2
+	c.Watermark.Images = true
+	c.Watermark.Videos = true
+	c.Watermark.FFmpeg = "ffmpeg"
+	c.Provenance.Manifest = true
+	c.SelfTest.Model = "gemini-2.5-flash-image-landscape"
+	c.SelfTest.Prompt = "A red apple on a white table"
+	c.SelfTest.MaxAge = 3600
+	c.SelfTest.Interval = 30
+	c.Global.APIKey = "flow2api"
+	c.Global.APIKeyGrace = 3600
+	c.Global.SessionTTL = 24
+	c.Global.AdminUsername = "admin"
+	c.Global.AdminPassword = "admin123"
+	return c
+}
+
+// read loads the file over the defaults, then applies the environment. An
+// empty path reads config/setting.toml when it exists; a path that was given
+// must be readable. The returned config is never nil, even on error.
+func read(configPath string) (*Config, error) {
+	c := newConfig()
+	c.path = configPath
+	path := configPath
+	if path == "" {
+		path = filepath.Join("config", "setting.toml")
+	}
+	if _, statErr := os.Stat(path); statErr == nil || configPath != "" {
+		if _, err := toml.DecodeFile(path, c); err != nil {
+			return c, err
+		}
+	}
+
+	// FLOW2API_* environment variables override the file
+	_, err := c.ApplyEnv()
+	return c, err
+}
+
 func Load(configPath string) (*Config, error) {
 	var err error
 	once.Do(func() {
-		cfg = &Config{}
-
-		// Set defaults
-		cfg.Server.Host = "0.0.0.0"
-		cfg.Server.Port = 8000
-		cfg.Flow.LabsBaseURL = "https://labs.google/fx/api"
-		cfg.Flow.APIBaseURL = "https://aisandbox-pa.googleapis.com/v1"
-		cfg.Flow.Timeout = 120
-		cfg.Flow.MaxRetries = 3
-		cfg.Flow.PollInterval = 3.0
-		cfg.Flow.MaxPollAttempts = 500
-		cfg.Cache.Timeout = 7200
-		cfg.Generation.ImageTimeout = 300
-		cfg.Generation.VideoTimeout = 1500
-		cfg.Captcha.CaptchaMethod = "browser"
-		cfg.Captcha.YesCaptchaBaseURL = "https://api.yescaptcha.com"
-		cfg.Captcha.WebsiteKey = "6LdsFiUsAAAAAIjVDZcuLhaHiDn5nnHVXVRQGeMV"
-		cfg.Captcha.PageAction = "FLOW_GENERATION"
-		cfg.Global.APIKey = "flow2api"
-		cfg.Global.AdminUsername = "admin"
-		cfg.Global.AdminPassword = "admin123"
-
-		// Load from file if exists
-		if configPath == "" {
-			configPath = filepath.Join("config", "setting.toml")
-		}
-
-		if _, statErr := os.Stat(configPath); statErr == nil {
-			_, err = toml.DecodeFile(configPath, cfg)
-		}
+		var c *Config
+		c, err = read(configPath)
+		c.published = true
+		active.Store(c)
 	})
 
-	return cfg, err
+	return active.Load(), err
 }
 
+// Get returns the current configuration. It is never changed once returned:
+// setters and reloads publish a new one, so callers fetch it again rather
+// than keep it.
 func Get() *Config {
-	if cfg == nil {
-		cfg, _ = Load("")
+	if c := active.Load(); c != nil {
+		return c
+	}
+	c, _ := Load("")
+	return c
+}
+
+// update applies fn to c. A published configuration is not changed in place:
+// fn runs on a copy of the current one, which then replaces it.
+func (c *Config) update(fn func(*Config)) {
+	if !c.published {
+		fn(c)
+		return
 	}
-	return cfg
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	next := *active.Load()
+	fn(&next)
+	active.Store(&next)
+}
+
+// live is the configuration c stands for: the current one once c was published
+func (c *Config) live() *Config {
+	if c.published {
+		return Get()
+	}
+	return c
 }
 
 func (c *Config) SetAPIKey(key string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Global.APIKey = key
+	c.update(func(c *Config) {
+		c.Global.APIKey = key
+	})
 }
 
 func (c *Config) GetAPIKey() string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.Global.APIKey
+	return c.live().Global.APIKey
+}
+
+// SetPreviousAPIKey restores the key replaced by a rotation, accepted until
+// expires
+func (c *Config) SetPreviousAPIKey(key string, expires time.Time) {
+	c.update(func(c *Config) {
+		c.Global.PreviousAPIKey = key
+		c.Global.PreviousAPIKeyExpires = expires
+	})
+}
+
+// RotateAPIKey replaces the global key, keeping the current one valid for
+// grace so clients can switch over. It returns the old key and when it
+// expires, both zero when grace is not positive.
+func (c *Config) RotateAPIKey(key string, grace time.Duration) (previous string, expires time.Time) {
+	c.update(func(c *Config) {
+		c.Global.PreviousAPIKey, c.Global.PreviousAPIKeyExpires = "", time.Time{}
+		if grace > 0 && c.Global.APIKey != key {
+			c.Global.PreviousAPIKey = c.Global.APIKey
+			c.Global.PreviousAPIKeyExpires = time.Now().Add(grace).UTC()
+		}
+		c.Global.APIKey = key
+		previous, expires = c.Global.PreviousAPIKey, c.Global.PreviousAPIKeyExpires
+	})
+	return previous, expires
+}
+
+// MatchAPIKey reports whether key is the global API key, or the previous one
+// during its grace period. Keys are compared by digest in constant time so
+// neither their content nor their length leaks through timing.
+func (c *Config) MatchAPIKey(key string) bool {
+	c = c.live()
+	current, previous := c.Global.APIKey, c.Global.PreviousAPIKey
+	previousValid := previous != "" && time.Now().Before(c.Global.PreviousAPIKeyExpires)
+
+	digest := sha256.Sum256([]byte(key))
+	currentDigest := sha256.Sum256([]byte(current))
+	previousDigest := sha256.Sum256([]byte(previous))
+	matchCurrent := subtle.ConstantTimeCompare(digest[:], currentDigest[:])
+	matchPrevious := subtle.ConstantTimeCompare(digest[:], previousDigest[:])
+	return current != "" && matchCurrent == 1 || previousValid && matchPrevious == 1
 }
 
 func (c *Config) SetAdminCredentials(username, password string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Global.AdminUsername = username
-	c.Global.AdminPassword = password
+	c.update(func(c *Config) {
+		c.Global.AdminUsername = username
+		c.Global.AdminPassword = password
+	})
 }
 
 func (c *Config) SetCacheEnabled(enabled bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Cache.Enabled = enabled
+	c.update(func(c *Config) {
+		c.Cache.Enabled = enabled
+	})
 }
 
 func (c *Config) SetCacheTimeout(timeout int) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Cache.Timeout = timeout
+	c.update(func(c *Config) {
+		c.Cache.Timeout = timeout
+	})
 }
 
 func (c *Config) SetCacheBaseURL(url string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Cache.BaseURL = url
+	c.update(func(c *Config) {
+		c.Cache.BaseURL = url
+	})
+}
+
+func (c *Config) SetCacheStorage(backend string, s3 S3Config) {
+	c.update(func(c *Config) {
+		c.Cache.Backend = backend
+		c.Cache.S3 = s3
+	})
 }
 
 func (c *Config) SetDebugEnabled(enabled bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Debug.Enabled = enabled
+	c.update(func(c *Config) {
+		c.Debug.Enabled = enabled
+	})
+}
+
+func (c *Config) SetDebugLogging(logRequests, logResponses, maskToken bool) {
+	c.update(func(c *Config) {
+		c.Debug.LogRequests = logRequests
+		c.Debug.LogResponses = logResponses
+		c.Debug.MaskToken = maskToken
+	})
 }
 
 func (c *Config) SetCaptchaMethod(method string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Captcha.CaptchaMethod = method
+	c.update(func(c *Config) {
+		c.Captcha.CaptchaMethod = method
+	})
+}
+
+func (c *Config) SetCaptchaSidecar(url, token string) {
+	c.update(func(c *Config) {
+		c.Captcha.SidecarURL = url
+		c.Captcha.SidecarToken = token
+	})
 }
 
 func (c *Config) SetImageTimeout(timeout int) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Generation.ImageTimeout = timeout
+	c.update(func(c *Config) {
+		c.Generation.ImageTimeout = timeout
+	})
 }
 
 func (c *Config) SetVideoTimeout(timeout int) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.Generation.VideoTimeout = timeout
+	c.update(func(c *Config) {
+		c.Generation.VideoTimeout = timeout
+	})
+}
+
+func (c *Config) SetAnnouncement(message string) {
+	c.update(func(c *Config) {
+		c.Generation.Announcement = message
+	})
+}
+
+func (c *Config) GetAnnouncement() string {
+	return c.live().Generation.Announcement
 }
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// EnvPrefix starts every environment variable that overrides a config value
+const EnvPrefix = "FLOW2API_"
+
+// envOverrides maps environment variables (without EnvPrefix) to the values
+// they replace
+var envOverrides = []struct {
+	name  string
+	apply func(c *Config, value string) error
+}{
+	{"HOST", func(c *Config, v string) error { c.Server.Host = v; return nil }},
+	{"PORT", func(c *Config, v string) error { return setInt(&c.Server.Port, v) }},
+	{"STATUS_FILE", func(c *Config, v string) error { c.Server.StatusFile = v; return nil }},
+	{"STATUS_PAGE", func(c *Config, v string) error { c.Server.StatusPage = v; return nil }},
+	{"METRICS", func(c *Config, v string) error { return setBool(&c.Server.Metrics, v) }},
+	{"LISTENERS", func(c *Config, v string) error { return setInt(&c.Server.Listeners, v) }},
+	{"METRICS_TOKEN", func(c *Config, v string) error { c.Server.MetricsToken = v; return nil }},
+	{"API_KEY", func(c *Config, v string) error { c.Global.APIKey = v; return nil }},
+	{"DB_PATH", func(c *Config, v string) error { c.Database.Path = v; return nil }},
+	{"PROXY_URL", func(c *Config, v string) error { c.Proxy.URL = v; return nil }},
+	{"CAPTCHA_METHOD", func(c *Config, v string) error { c.Captcha.CaptchaMethod = v; return nil }},
+	{"YESCAPTCHA_API_KEY", func(c *Config, v string) error { c.Captcha.YesCaptchaAPIKey = v; return nil }},
+	{"SIDECAR_URL", func(c *Config, v string) error { c.Captcha.SidecarURL = v; return nil }},
+	{"SIDECAR_TOKEN", func(c *Config, v string) error { c.Captcha.SidecarToken = v; return nil }},
+	{"BROWSER_PROXY_URL", func(c *Config, v string) error {
+		c.Captcha.BrowserProxyURL = v
+		c.Captcha.BrowserProxyEnabled = v != ""
+		return nil
+	}},
+	{"BROWSER_HEADLESS", func(c *Config, v string) error { return setBool(&c.Captcha.BrowserHeadless, v) }},
+	{"LOG_LEVEL", func(c *Config, v string) error { c.Debug.LogLevel = v; return nil }},
+	{"LOG_FORMAT", func(c *Config, v string) error { c.Debug.LogFormat = v; return nil }},
+	{"CHAOS_ENABLED", func(c *Config, v string) error { return setBool(&c.Chaos.Enabled, v) }},
+	{"CHAOS_LATENCY", func(c *Config, v string) error { return setInt(&c.Chaos.Latency, v) }},
+	{"CHAOS_ERROR_429_RATE", func(c *Config, v string) error { return setFloat(&c.Chaos.Error429Rate, v) }},
+	{"CHAOS_ERROR_5XX_RATE", func(c *Config, v string) error { return setFloat(&c.Chaos.Error5xxRate, v) }},
+	{"CHAOS_CAPTCHA_FAILURE_RATE", func(c *Config, v string) error { return setFloat(&c.Chaos.CaptchaFailureRate, v) }},
+}
+
+func setInt(dst *int, v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", v)
+	}
+	*dst = n
+	return nil
+}
+
+func setFloat(dst *float64, v string) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", v)
+	}
+	*dst = f
+	return nil
+}
+
+func setBool(dst *bool, v string) error {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", v)
+	}
+	*dst = b
+	return nil
+}
+
+// ApplyEnv overrides values with the FLOW2API_* variables that are set, then
+// with the command-line flags, and returns their names. It runs after the
+// TOML file is loaded, and again at startup after settings stored in the
+// database, so the environment and flags win.
+func (c *Config) ApplyEnv() (applied []string, err error) {
+	c.update(func(c *Config) { applied, err = c.applyEnv() })
+	return applied, err
+}
+
+func (c *Config) applyEnv() ([]string, error) {
+	var applied []string
+	for _, o := range envOverrides {
+		name := EnvPrefix + o.name
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := o.apply(c, value); err != nil {
+			return applied, fmt.Errorf("%s: %w", name, err)
+		}
+		applied = append(applied, name)
+	}
+	return append(applied, commandLine.apply(c)...), nil
+}
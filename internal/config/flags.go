@@ -0,0 +1,40 @@
+package config
+
+// CommandLine holds the settings given as command-line flags. They override
+// the file, the database and the environment, on reloads too, so several
+// instances can share one setting.toml.
+type CommandLine struct {
+	Host     string
+	Port     int
+	DBPath   string
+	LogLevel string
+}
+
+var commandLine CommandLine
+
+// SetCommandLine records the flags; call it before Load
+func SetCommandLine(cl CommandLine) {
+	commandLine = cl
+}
+
+// apply overrides c with the flags that were given and returns their names
+func (cl CommandLine) apply(c *Config) []string {
+	var applied []string
+	if cl.Host != "" {
+		c.Server.Host = cl.Host
+		applied = append(applied, "--host")
+	}
+	if cl.Port != 0 {
+		c.Server.Port = cl.Port
+		applied = append(applied, "--port")
+	}
+	if cl.DBPath != "" {
+		c.Database.Path = cl.DBPath
+		applied = append(applied, "--db")
+	}
+	if cl.LogLevel != "" {
+		c.Debug.LogLevel = cl.LogLevel
+		applied = append(applied, "--log-level")
+	}
+	return applied
+}
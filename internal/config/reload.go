@@ -0,0 +1,86 @@
+package config
+
+import "reflect"
+
+// Reload re-reads the configuration file and publishes a configuration with
+// its mutable sections in one step, so readers never see a mix of old and new
+// values. overlay runs on
+// the fresh values before they are validated, letting callers re-apply the
+// sources layered over the file at startup; the environment is applied after
+// it. Nothing changes when the new configuration is invalid.
+//
+// Settings fixed at startup (listen address, database, upstream proxy, worker
+// and queue sizes, browser pool size, log format, HTTP hooks, schedule
+// intervals) keep their current values; the ones that differ in the file are
+// returned so callers can ask for a restart. Turning on token sync or
+// scheduled self-tests is applied but also needs a restart to start the
+// schedule.
+func (c *Config) Reload(overlay func(*Config), validateProxy ProxyValidator) ([]string, error) {
+	next, err := read(c.live().path)
+	if err != nil {
+		return nil, err
+	}
+	if overlay != nil {
+		overlay(next)
+	}
+	if _, err := next.ApplyEnv(); err != nil {
+		return nil, err
+	}
+	if err := next.Validate(validateProxy); err != nil {
+		return nil, err
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+	cur := active.Load()
+
+	var pending []string
+	keep := func(field string, changed bool) {
+		if changed {
+			pending = append(pending, field)
+		}
+	}
+	keep("server", !reflect.DeepEqual(next.Server, cur.Server))
+	keep("database.path", next.Database != cur.Database)
+	keep("proxy.url", next.Proxy != cur.Proxy)
+	keep("generation.image_workers", next.Generation.ImageWorkers != cur.Generation.ImageWorkers)
+	keep("generation.video_workers", next.Generation.VideoWorkers != cur.Generation.VideoWorkers)
+	keep("generation.queue_size", next.Generation.QueueSize != cur.Generation.QueueSize)
+	keep("captcha.browser_pool_size", next.Captcha.BrowserPoolSize != cur.Captcha.BrowserPoolSize)
+	keep("debug.log_format", next.Debug.LogFormat != cur.Debug.LogFormat)
+	keep("hooks", !reflect.DeepEqual(next.Hooks, cur.Hooks))
+	keep("token_sync.enabled", next.TokenSync.Enabled && !cur.TokenSync.Enabled)
+	keep("token_sync.interval", next.TokenSync.Interval != cur.TokenSync.Interval)
+	keep("selftest.enabled", next.SelfTest.Enabled && !cur.SelfTest.Enabled)
+	keep("selftest.interval", next.SelfTest.Interval != cur.SelfTest.Interval)
+
+	next.Generation.ImageWorkers = cur.Generation.ImageWorkers
+	next.Generation.VideoWorkers = cur.Generation.VideoWorkers
+	next.Generation.QueueSize = cur.Generation.QueueSize
+	next.Captcha.BrowserPoolSize = cur.Captcha.BrowserPoolSize
+	next.Debug.LogFormat = cur.Debug.LogFormat
+	next.TokenSync.Interval = cur.TokenSync.Interval
+	next.SelfTest.Interval = cur.SelfTest.Interval
+
+	merged := *cur
+	merged.Global = next.Global
+	merged.Flow = next.Flow
+	merged.Cache = next.Cache
+	merged.Debug = next.Debug
+	merged.Generation = next.Generation
+	merged.Captcha = next.Captcha
+	merged.Federation = next.Federation
+	merged.Webhook = next.Webhook
+	merged.Privacy = next.Privacy
+	merged.TokenSync = next.TokenSync
+	merged.TokenImport = next.TokenImport
+	merged.Uploads = next.Uploads
+	merged.Watermark = next.Watermark
+	merged.Provenance = next.Provenance
+	merged.SelfTest = next.SelfTest
+	merged.Chaos = next.Chaos
+
+	active.Store(&merged)
+
+	return pending, nil
+}
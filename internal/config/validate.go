@@ -0,0 +1,323 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// FieldError describes one invalid configuration value
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError lists every invalid value found in a configuration
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString("invalid configuration:")
+	for _, fe := range e.Errors {
+		fmt.Fprintf(&b, "\n  %s: %s", fe.Field, fe.Message)
+	}
+	return b.String()
+}
+
+// ProxyValidator checks a proxy URL and returns a message when it is unusable
+type ProxyValidator func(proxyURL string) (bool, string)
+
+type validator struct {
+	errors []FieldError
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.errors = append(v.errors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) positive(field string, value int) {
+	if value <= 0 {
+		v.fail(field, "must be greater than 0 (got %d)", value)
+	}
+}
+
+func (v *validator) nonNegative(field string, value int) {
+	if value < 0 {
+		v.fail(field, "must not be negative (got %d)", value)
+	}
+}
+
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(field, "must be one of %s (got %q)", strings.Join(allowed, ", "), value)
+}
+
+// rate requires a fraction between 0 and 1
+func (v *validator) rate(field string, value float64) {
+	if value < 0 || value > 1 {
+		v.fail(field, "must be between 0 and 1 (got %g)", value)
+	}
+}
+
+// httpURL requires an absolute http(s) URL; empty values pass unless required
+func (v *validator) httpURL(field, value string, required bool) {
+	if value == "" {
+		if required {
+			v.fail(field, "is required")
+		}
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.fail(field, "must be an absolute http(s) URL (got %q)", value)
+	}
+}
+
+// proxyURL requires an http(s) or socks5 proxy URL with a host
+func (v *validator) proxyURL(field, value string) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+		v.fail(field, "must be an http(s) or socks5 proxy URL (got %q)", value)
+	}
+}
+
+// Validate checks the effective configuration and reports every invalid value.
+// validateProxy checks the browser proxy URL when one is enabled.
+func (c *Config) Validate(validateProxy ProxyValidator) error {
+	c = c.live()
+
+	v := &validator{}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		v.fail("server.port", "must be between 1 and 65535 (got %d)", c.Server.Port)
+	}
+	v.nonNegative("server.drain_timeout", c.Server.DrainTimeout)
+	v.nonNegative("server.timeouts.admin", c.Server.Timeouts.Admin)
+	v.nonNegative("server.timeouts.media", c.Server.Timeouts.Media)
+	v.nonNegative("server.timeouts.upload", c.Server.Timeouts.Upload)
+	v.nonNegative("server.timeouts.stream_warn", c.Server.Timeouts.StreamWarn)
+	v.nonNegative("server.timeouts.idle", c.Server.Timeouts.Idle)
+	if c.Server.Listeners < 1 || c.Server.Listeners > 64 {
+		v.fail("server.listeners", "must be between 1 and 64 (got %d)", c.Server.Listeners)
+	}
+	v.oneOf("server.status_page", c.Server.StatusPage, "public", "key", "off")
+	if c.Server.ReadBufferSize < 1024 {
+		v.fail("server.read_buffer_size", "must be at least 1024 bytes (got %d)", c.Server.ReadBufferSize)
+	}
+	if c.Server.WriteBufferSize < 1024 {
+		v.fail("server.write_buffer_size", "must be at least 1024 bytes (got %d)", c.Server.WriteBufferSize)
+	}
+	if c.Server.ProxyHeader != "" && len(c.Server.TrustedProxies) == 0 {
+		v.fail("server.trusted_proxies", "is required with server.proxy_header, or any client could choose its own address")
+	}
+	for _, entry := range c.Server.TrustedProxies {
+		if _, err := netip.ParsePrefix(entry); err != nil {
+			if _, err := netip.ParseAddr(entry); err != nil {
+				v.fail("server.trusted_proxies", "%q is not an IP address or CIDR range", entry)
+			}
+		}
+	}
+	if c.Global.APIKey == "" {
+		v.fail("global.api_key", "is required")
+	}
+	v.nonNegative("global.api_key_grace", c.Global.APIKeyGrace)
+	v.positive("global.session_ttl", c.Global.SessionTTL)
+	if c.Database.Path == "" {
+		v.fail("database.path", "is required")
+	}
+
+	v.httpURL("flow.labs_base_url", c.Flow.LabsBaseURL, true)
+	v.httpURL("flow.api_base_url", c.Flow.APIBaseURL, true)
+	v.positive("flow.timeout", c.Flow.Timeout)
+	v.nonNegative("flow.max_retries", c.Flow.MaxRetries)
+	if c.Flow.PollInterval <= 0 {
+		v.fail("flow.poll_interval", "must be greater than 0 (got %g)", c.Flow.PollInterval)
+	}
+	v.positive("flow.max_poll_attempts", c.Flow.MaxPollAttempts)
+	v.oneOf("flow.poll_timeout", c.Flow.PollTimeout, "error", "pending")
+	if c.Flow.PendingFinishReason == "" {
+		v.fail("flow.pending_finish_reason", "must not be empty")
+	}
+	v.oneOf("flow.keepalive", c.Flow.Keepalive, "comment", "delta")
+	v.nonNegative("flow.keepalive_interval", c.Flow.KeepaliveInterval)
+	v.nonNegative("flow.model_discovery_interval", c.Flow.ModelDiscoveryInterval)
+	v.oneOf("flow.request_compression", c.Flow.RequestCompression, "", "none", "gzip", "zstd")
+	v.nonNegative("flow.compression_min_size", c.Flow.CompressionMinSize)
+	v.nonNegative("flow.project_rotate_every", c.Flow.ProjectRotateEvery)
+
+	v.nonNegative("cache.timeout", c.Cache.Timeout)
+	v.httpURL("cache.base_url", c.Cache.BaseURL, false)
+	v.oneOf("cache.backend", c.Cache.Backend, "", "local", "s3")
+	v.oneOf("cache.signing.mode", c.Cache.Signing.Mode, "none", "s3", "cdn")
+	if c.Cache.Signing.Mode != "none" {
+		v.positive("cache.signing.ttl", c.Cache.Signing.TTL)
+	}
+	if c.Cache.Signing.Mode == "cdn" {
+		if c.Cache.Signing.Key == "" {
+			v.fail("cache.signing.key", "is required when mode is cdn")
+		}
+		if c.Cache.Signing.Param == "" {
+			v.fail("cache.signing.param", "is required when mode is cdn")
+		}
+	}
+	if c.Cache.Backend == "s3" {
+		v.httpURL("cache.s3.endpoint", c.Cache.S3.Endpoint, true)
+		if c.Cache.S3.Bucket == "" {
+			v.fail("cache.s3.bucket", "is required for the s3 backend")
+		}
+		v.httpURL("cache.s3.public_url", c.Cache.S3.PublicURL, false)
+	}
+
+	v.nonNegative("debug.slow_request_threshold", c.Debug.SlowRequestThreshold)
+	v.oneOf("debug.log_level", c.Debug.LogLevel, "debug", "info", "warn", "error")
+	v.oneOf("debug.log_format", c.Debug.LogFormat, "text", "json")
+
+	v.positive("generation.image_timeout", c.Generation.ImageTimeout)
+	v.positive("generation.video_timeout", c.Generation.VideoTimeout)
+	v.positive("generation.image_workers", c.Generation.ImageWorkers)
+	v.positive("generation.video_workers", c.Generation.VideoWorkers)
+	v.positive("generation.queue_size", c.Generation.QueueSize)
+	v.oneOf("generation.frame_mismatch", c.Generation.FrameMismatch, "error", "crop")
+	v.nonNegative("generation.max_image_prompt", c.Generation.MaxImagePrompt)
+	v.nonNegative("generation.max_video_prompt", c.Generation.MaxVideoPrompt)
+	for pattern, limit := range c.Generation.PromptLimits {
+		if _, err := path.Match(pattern, ""); err != nil {
+			v.fail("generation.prompt_limits", "invalid model pattern %q", pattern)
+		}
+		v.nonNegative("generation.prompt_limits."+pattern, limit)
+	}
+	v.oneOf("generation.prompt_overflow", c.Generation.PromptOverflow, "error", "truncate")
+	v.positive("generation.max_reference_image_mb", c.Generation.MaxReferenceImageMB)
+	v.oneOf("generation.remote_images", c.Generation.RemoteImages, "off", "public", "any")
+	v.nonNegative("generation.reference_max_side", c.Generation.ReferenceMaxSide)
+	if r := c.Generation.InteractiveReserve; r < 0 || r >= 1 {
+		v.fail("generation.interactive_reserve", "must be at least 0 and below 1 (got %g)", r)
+	}
+	v.nonNegative("generation.min_image_credits", c.Generation.MinImageCredits)
+	v.nonNegative("generation.min_video_credits", c.Generation.MinVideoCredits)
+	v.nonNegative("generation.stuck_task_timeout", c.Generation.StuckTaskTimeout)
+
+	v.oneOf("captcha.captcha_method", c.Captcha.CaptchaMethod, "browser", "personal", "sidecar", "yescaptcha")
+	switch c.Captcha.CaptchaMethod {
+	case "browser":
+		v.positive("captcha.browser_pool_size", c.Captcha.BrowserPoolSize)
+	case "yescaptcha":
+		if c.Captcha.YesCaptchaAPIKey == "" {
+			v.fail("captcha.yescaptcha_api_key", "is required when captcha_method is yescaptcha")
+		}
+		v.httpURL("captcha.yescaptcha_base_url", c.Captcha.YesCaptchaBaseURL, true)
+	case "sidecar":
+		v.httpURL("captcha.sidecar_url", c.Captcha.SidecarURL, true)
+		v.positive("captcha.sidecar_timeout", c.Captcha.SidecarTimeout)
+	}
+	if c.Captcha.BrowserProxyEnabled && validateProxy != nil {
+		if ok, msg := validateProxy(c.Captcha.BrowserProxyURL); !ok {
+			v.fail("captcha.browser_proxy_url", "%s", msg)
+		}
+	}
+
+	if c.Federation.Enabled {
+		v.positive("federation.timeout", c.Federation.Timeout)
+		for i, peer := range c.Federation.Peers {
+			field := fmt.Sprintf("federation.peers[%d]", i)
+			if peer.Name == "" {
+				v.fail(field+".name", "is required")
+			}
+			v.httpURL(field+".url", peer.URL, true)
+		}
+	}
+
+	v.httpURL("token_sync.url", c.TokenSync.URL, c.TokenSync.Enabled)
+	if c.TokenSync.Enabled {
+		v.positive("token_sync.interval", c.TokenSync.Interval)
+	}
+	v.nonNegative("token_import.interval", c.TokenImport.Interval)
+	v.nonNegative("token_import.async_threshold", c.TokenImport.AsyncThreshold)
+	for i, proxy := range c.TokenImport.Proxies {
+		v.proxyURL(fmt.Sprintf("token_import.proxies[%d]", i), proxy)
+	}
+	v.positive("uploads.max_size", c.Uploads.MaxSize)
+	v.positive("uploads.expire", c.Uploads.Expire)
+
+	if c.Watermark.Enabled {
+		if c.Watermark.Text == "" && c.Watermark.Logo == "" {
+			v.fail("watermark.text", "or watermark.logo is required")
+		}
+		if len(c.Watermark.Text) > 64 {
+			v.fail("watermark.text", "must be at most 64 characters")
+		}
+		v.oneOf("watermark.position", c.Watermark.Position, "top-left", "top-right", "bottom-left", "bottom-right", "center")
+		if c.Watermark.Opacity <= 0 || c.Watermark.Opacity > 1 {
+			v.fail("watermark.opacity", "must be greater than 0 and at most 1 (got %g)", c.Watermark.Opacity)
+		}
+		if c.Watermark.Scale <= 0 || c.Watermark.Scale > 1 {
+			v.fail("watermark.scale", "must be greater than 0 and at most 1 (got %g)", c.Watermark.Scale)
+		}
+		if c.Watermark.Videos && c.Watermark.FFmpeg == "" {
+			v.fail("watermark.ffmpeg", "is required to stamp videos")
+		}
+	}
+
+	if c.SelfTest.Enabled {
+		v.positive("selftest.token_id", int(c.SelfTest.TokenID))
+		if c.SelfTest.Model == "" || c.SelfTest.Prompt == "" {
+			v.fail("selftest.model", "and selftest.prompt are required")
+		}
+		v.positive("selftest.max_age", c.SelfTest.MaxAge)
+		v.nonNegative("selftest.interval", c.SelfTest.Interval)
+		if c.SelfTest.Interval*60 >= c.SelfTest.MaxAge && c.SelfTest.MaxAge > 0 {
+			v.fail("selftest.interval", "must be shorter than selftest.max_age, or the health check goes stale between tests (got %d minutes)", c.SelfTest.Interval)
+		}
+	}
+
+	if c.Chaos.Enabled {
+		v.nonNegative("chaos.latency", c.Chaos.Latency)
+		v.nonNegative("chaos.latency_jitter", c.Chaos.LatencyJitter)
+		v.rate("chaos.error_429_rate", c.Chaos.Error429Rate)
+		v.rate("chaos.error_5xx_rate", c.Chaos.Error5xxRate)
+		v.rate("chaos.captcha_failure_rate", c.Chaos.CaptchaFailureRate)
+		if c.Chaos.Error429Rate+c.Chaos.Error5xxRate > 1 {
+			v.fail("chaos.error_5xx_rate", "plus error_429_rate must not exceed 1")
+		}
+	}
+
+	for i, hook := range c.Hooks {
+		field := fmt.Sprintf("hooks[%d]", i)
+		if hook.Name == "" {
+			v.fail(field+".name", "is required")
+		}
+		v.httpURL(field+".url", hook.URL, true)
+		if len(hook.Stages) == 0 {
+			v.fail(field+".stages", "must list at least one stage")
+		}
+		for _, stage := range hook.Stages {
+			v.oneOf(field+".stages", stage, "pre_select", "pre_submit", "post_complete", "on_error")
+		}
+		v.positive(field+".timeout", hook.Timeout)
+	}
+
+	if c.Webhook.Enabled {
+		if len(c.Webhook.Secret) < 16 {
+			v.fail("webhook.secret", "must be at least 16 characters when webhooks are enabled")
+		}
+		v.positive("webhook.tolerance", c.Webhook.Tolerance)
+	}
+
+	v.oneOf("privacy.mode", c.Privacy.Mode, "off", "truncate", "hash", "skip")
+	v.positive("privacy.truncate_length", c.Privacy.TruncateLength)
+	v.nonNegative("privacy.prompt_retention_days", c.Privacy.PromptRetentionDays)
+	v.oneOf("privacy.retention_mode", c.Privacy.RetentionMode, "truncate", "hash", "skip")
+
+	if len(v.errors) > 0 {
+		return &ValidationError{Errors: v.errors}
+	}
+	return nil
+}
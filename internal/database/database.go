@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -116,8 +118,17 @@ func (d *Database) initTables() error {
 			result_urls TEXT,
 			error_message TEXT,
 			scene_id TEXT,
+			operation_name TEXT,
+			media_id TEXT,
+			params TEXT,
+			upstream_status TEXT,
+			cache_error TEXT,
+			credits INTEGER DEFAULT 0,
+			cache_bytes INTEGER DEFAULT 0,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			completed_at DATETIME,
+			prompt_redacted INTEGER DEFAULT 0,
 			FOREIGN KEY (token_id) REFERENCES tokens(id) ON DELETE CASCADE
 		)`,
 		`CREATE TABLE IF NOT EXISTS admin_config (
@@ -125,7 +136,12 @@ func (d *Database) initTables() error {
 			username TEXT NOT NULL,
 			password TEXT NOT NULL,
 			api_key TEXT NOT NULL,
-			error_ban_threshold INTEGER DEFAULT 3
+			error_ban_threshold INTEGER DEFAULT 3,
+			totp_enabled BOOLEAN DEFAULT 0,
+			totp_secret TEXT DEFAULT '',
+			totp_pending_secret TEXT DEFAULT '',
+			totp_last_step INTEGER DEFAULT 0,
+			recovery_codes TEXT DEFAULT ''
 		)`,
 		`CREATE TABLE IF NOT EXISTS proxy_config (
 			id INTEGER PRIMARY KEY DEFAULT 1,
@@ -137,6 +153,15 @@ func (d *Database) initTables() error {
 			cache_enabled BOOLEAN DEFAULT 0,
 			cache_timeout INTEGER DEFAULT 7200,
 			cache_base_url TEXT,
+			storage_backend TEXT,
+			s3_endpoint TEXT,
+			s3_region TEXT,
+			s3_bucket TEXT,
+			s3_access_key TEXT,
+			s3_secret_key TEXT,
+			s3_public_url TEXT,
+			s3_prefix TEXT,
+			s3_path_style BOOLEAN DEFAULT 1,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
@@ -158,13 +183,162 @@ func (d *Database) initTables() error {
 			page_action TEXT DEFAULT 'FLOW_GENERATION',
 			browser_proxy_enabled BOOLEAN DEFAULT 0,
 			browser_proxy_url TEXT,
+			sidecar_url TEXT,
+			sidecar_token TEXT,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
 		`CREATE TABLE IF NOT EXISTS generation_config (
 			id INTEGER PRIMARY KEY DEFAULT 1,
 			image_timeout INTEGER DEFAULT 300,
-			video_timeout INTEGER DEFAULT 1500
+			video_timeout INTEGER DEFAULT 1500,
+			default_model TEXT DEFAULT '',
+			announcement TEXT DEFAULT ''
+		)`,
+		`CREATE TABLE IF NOT EXISTS upstream_models (
+			model_key TEXT PRIMARY KEY,
+			model_type TEXT NOT NULL,
+			display_name TEXT,
+			status TEXT DEFAULT 'new',
+			video_type TEXT,
+			first_seen_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS models (
+			name TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			video_type TEXT,
+			model_name TEXT,
+			model_key TEXT,
+			aspect_ratio TEXT,
+			supports_images BOOLEAN DEFAULT 0,
+			min_images INTEGER DEFAULT 0,
+			max_images INTEGER DEFAULT 0,
+			enabled BOOLEAN DEFAULT 1,
+			builtin BOOLEAN DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS model_aliases (
+			alias TEXT PRIMARY KEY,
+			model TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS key_usage (
+			key_id TEXT NOT NULL,
+			day TEXT NOT NULL,
+			requests INTEGER DEFAULT 0,
+			prompt_characters INTEGER DEFAULT 0,
+			media_count INTEGER DEFAULT 0,
+			credits INTEGER DEFAULT 0,
+			PRIMARY KEY (key_id, day)
+		)`,
+		`CREATE TABLE IF NOT EXISTS cache_files (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			key TEXT NOT NULL,
+			backend TEXT NOT NULL,
+			url TEXT,
+			size INTEGER DEFAULT 0,
+			media_type TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS canary_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			model TEXT NOT NULL,
+			target_model TEXT,
+			strategy TEXT,
+			percent INTEGER DEFAULT 0,
+			enabled BOOLEAN DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			key TEXT UNIQUE NOT NULL,
+			allowed_models TEXT DEFAULT '',
+			enabled BOOLEAN DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS rate_limits (
+			model TEXT PRIMARY KEY,
+			requests_per_minute REAL NOT NULL,
+			burst INTEGER NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS security_config (
+			id INTEGER PRIMARY KEY DEFAULT 1,
+			ip_allowlist TEXT DEFAULT '',
+			ip_denylist TEXT DEFAULT '',
+			requests_per_minute REAL DEFAULT 0,
+			burst INTEGER DEFAULT 0,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS token_refresh_config (
+			id INTEGER PRIMARY KEY DEFAULT 1,
+			enabled BOOLEAN DEFAULT 1,
+			interval_minutes INTEGER DEFAULT 10,
+			before_expiry_minutes INTEGER DEFAULT 60,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS ban_config (
+			id INTEGER PRIMARY KEY DEFAULT 1,
+			rate_limit_ban BOOLEAN DEFAULT 1,
+			rate_limit_ban_minutes INTEGER DEFAULT 720,
+			error_ban BOOLEAN DEFAULT 1,
+			error_ban_minutes INTEGER DEFAULT 0,
+			unban_check_minutes INTEGER DEFAULT 60,
+			quota_reset_hour INTEGER DEFAULT 0,
+			quota_reset_timezone TEXT DEFAULT 'America/Los_Angeles',
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS key_webhooks (
+			key_id TEXT PRIMARY KEY,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS token_groups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT,
+			models TEXT,
+			image_concurrency INTEGER DEFAULT -1,
+			video_concurrency INTEGER DEFAULT -1,
+			daily_image_limit INTEGER DEFAULT 0,
+			daily_video_limit INTEGER DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS admin_sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token_hash TEXT UNIQUE NOT NULL,
+			username TEXT NOT NULL,
+			ip TEXT,
+			user_agent TEXT,
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS media_shares (
+			token TEXT PRIMARY KEY,
+			file_id INTEGER NOT NULL,
+			password_hash TEXT,
+			expires_at DATETIME NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS config_versions (
+			section TEXT PRIMARY KEY,
+			version INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS request_logs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			task_id TEXT,
+			token_id INTEGER,
+			operation TEXT NOT NULL,
+			status_code INTEGER NOT NULL,
+			duration REAL NOT NULL,
+			trace TEXT,
+			selection TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
 	}
 
@@ -174,12 +348,172 @@ func (d *Database) initTables() error {
 		}
 	}
 
+	// Add columns introduced after the initial schema
+	if err := d.migrateColumns(); err != nil {
+		return err
+	}
+	if err := d.migrateKeyIDs(); err != nil {
+		return err
+	}
+
 	// Initialize default configs if not exist
 	d.initDefaultConfigs()
 
 	return nil
 }
 
+// migrateColumns adds missing columns to tables created by older versions
+func (d *Database) migrateColumns() error {
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+	}{
+		{"tasks", "operation_name", "TEXT"},
+		{"tasks", "params", "TEXT"},
+		{"tasks", "media_id", "TEXT"},
+		{"tasks", "upstream_status", "TEXT"},
+		{"tasks", "cache_error", "TEXT"},
+		{"tasks", "credits", "INTEGER DEFAULT 0"},
+		{"tasks", "cache_bytes", "INTEGER DEFAULT 0"},
+		{"tasks", "updated_at", "DATETIME"},
+		{"tasks", "prompt_redacted", "INTEGER DEFAULT 0"},
+		{"cache_config", "storage_backend", "TEXT"},
+		{"cache_config", "s3_endpoint", "TEXT"},
+		{"cache_config", "s3_region", "TEXT"},
+		{"cache_config", "s3_bucket", "TEXT"},
+		{"cache_config", "s3_access_key", "TEXT"},
+		{"cache_config", "s3_secret_key", "TEXT"},
+		{"cache_config", "s3_public_url", "TEXT"},
+		{"cache_config", "s3_prefix", "TEXT"},
+		{"cache_config", "s3_path_style", "BOOLEAN DEFAULT 1"},
+		{"generation_config", "default_model", "TEXT DEFAULT ''"},
+		{"generation_config", "announcement", "TEXT DEFAULT ''"},
+		{"captcha_config", "sidecar_url", "TEXT"},
+		{"captcha_config", "sidecar_token", "TEXT"},
+		{"projects", "generation_count", "INTEGER DEFAULT 0"},
+		{"admin_config", "previous_api_key", "TEXT DEFAULT ''"},
+		{"admin_config", "previous_api_key_expires_at", "TIMESTAMP"},
+		{"admin_config", "totp_enabled", "BOOLEAN DEFAULT 0"},
+		{"admin_config", "totp_secret", "TEXT DEFAULT ''"},
+		{"admin_config", "totp_pending_secret", "TEXT DEFAULT ''"},
+		{"admin_config", "totp_last_step", "INTEGER DEFAULT 0"},
+		{"admin_config", "recovery_codes", "TEXT DEFAULT ''"},
+		{"api_keys", "privacy_mode", "TEXT DEFAULT ''"},
+		{"api_keys", "skip_cache", "BOOLEAN DEFAULT 0"},
+		{"api_keys", "token_group_id", "INTEGER DEFAULT 0"},
+		{"tokens", "group_id", "INTEGER DEFAULT 0"},
+		{"request_logs", "selection", "TEXT"},
+		{"tokens", "daily_image_limit", "INTEGER DEFAULT 0"},
+		{"tokens", "daily_video_limit", "INTEGER DEFAULT 0"},
+		{"tokens", "version", "INTEGER DEFAULT 0"},
+		{"ban_config", "quota_reset_hour", "INTEGER DEFAULT 0"},
+		{"ban_config", "quota_reset_timezone", "TEXT DEFAULT 'America/Los_Angeles'"},
+		{"token_groups", "image_concurrency", "INTEGER DEFAULT -1"},
+		{"token_groups", "video_concurrency", "INTEGER DEFAULT -1"},
+		{"token_groups", "daily_image_limit", "INTEGER DEFAULT 0"},
+		{"token_groups", "daily_video_limit", "INTEGER DEFAULT 0"},
+		{"cache_files", "object_key", "TEXT"},
+	}
+
+	for _, col := range columns {
+		exists, err := d.columnExists(col.table, col.column)
+		if err != nil {
+			return fmt.Errorf("failed to inspect table %s: %w", col.table, err)
+		}
+		if exists {
+			continue
+		}
+		if _, err := d.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.column, col.definition)); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", col.table, col.column, err)
+		}
+	}
+
+	return nil
+}
+
+// keyIDsVersion is the user_version from which tasks, usage and webhooks
+// record additional keys by ID instead of name
+const keyIDsVersion = 1
+
+// migrateKeyIDs rewrites the key names older versions recorded to key IDs,
+// once. Records of names shared by several keys, or that look like an ID,
+// cannot be attributed and are left as they are.
+func (d *Database) migrateKeyIDs() error {
+	var version int
+	if err := d.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version >= keyIDsVersion {
+		return nil
+	}
+
+	rows, err := d.db.Query(`SELECT MIN(id), name FROM api_keys GROUP BY name HAVING COUNT(*) = 1`)
+	if err != nil {
+		return fmt.Errorf("failed to list API keys: %w", err)
+	}
+	names := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, err := strconv.ParseInt(name, 10, 64); err == nil || name == "default" || name == "webhook" {
+			continue
+		}
+		names[name] = id
+	}
+	rows.Close()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for name, id := range names {
+		keyID := models.APIKeyID(id)
+		for _, stmt := range []string{
+			`UPDATE key_usage SET key_id = ? WHERE key_id = ?`,
+			`UPDATE key_webhooks SET key_id = ? WHERE key_id = ?`,
+			`UPDATE tasks SET params = json_set(params, '$.key_id', ?)
+				WHERE json_valid(params) AND json_extract(params, '$.key_id') = ?`,
+		} {
+			if _, err := tx.Exec(stmt, keyID, name); err != nil {
+				return fmt.Errorf("failed to migrate key %q: %w", name, err)
+			}
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", keyIDsVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// columnExists reports whether a table has the given column
+func (d *Database) columnExists(table, column string) (bool, error) {
+	rows, err := d.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
+
 func (d *Database) initDefaultConfigs() {
 	// Admin config
 	d.db.Exec(`INSERT OR IGNORE INTO admin_config (id, username, password, api_key, error_ban_threshold) 
@@ -200,6 +534,34 @@ func (d *Database) initDefaultConfigs() {
 
 	// Generation config
 	d.db.Exec(`INSERT OR IGNORE INTO generation_config (id, image_timeout, video_timeout) VALUES (1, 300, 1500)`)
+
+	// Security config
+	d.db.Exec(`INSERT OR IGNORE INTO security_config (id) VALUES (1)`)
+
+	// Token refresh config
+	d.db.Exec(`INSERT OR IGNORE INTO token_refresh_config (id) VALUES (1)`)
+
+	// Ban config
+	d.db.Exec(`INSERT OR IGNORE INTO ban_config (id) VALUES (1)`)
+}
+
+// Ping checks that the database answers a query
+func (d *Database) Ping() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var one int
+	return d.db.QueryRow(`SELECT 1`).Scan(&one)
+}
+
+// CountActiveTokens returns how many tokens are enabled
+func (d *Database) CountActiveTokens() (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM tokens WHERE is_active = 1`).Scan(&count)
+	return count, err
 }
 
 func (d *Database) Close() error {
@@ -237,24 +599,31 @@ func (d *Database) AddToken(token *models.Token) (int64, error) {
 	return id, nil
 }
 
-func (d *Database) GetToken(id int64) (*models.Token, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const tokenColumns = `t.id, t.st, t.at, t.at_expires, t.email, t.name, t.remark, t.is_active, t.created_at, t.last_used_at,
+	t.use_count, t.credits, t.user_paygate_tier, t.current_project_id, t.current_project_name,
+	t.image_enabled, t.video_enabled, t.image_concurrency, t.video_concurrency, t.ban_reason, t.banned_at, t.group_id,
+	t.daily_image_limit, t.daily_video_limit, t.version`
 
+// scanToken reads tokenColumns followed by any extra destinations
+func scanToken(row rowScanner, extra ...interface{}) (*models.Token, error) {
 	token := &models.Token{}
 	var atExpires, createdAt, lastUsedAt, bannedAt sql.NullTime
 	var at, name, remark, userPaygateTier, projectID, projectName, banReason sql.NullString
+	var groupID, dailyImageLimit, dailyVideoLimit, version sql.NullInt64
 
-	err := d.db.QueryRow(`
-		SELECT id, st, at, at_expires, email, name, remark, is_active, created_at, last_used_at, use_count,
-			credits, user_paygate_tier, current_project_id, current_project_name,
-			image_enabled, video_enabled, image_concurrency, video_concurrency, ban_reason, banned_at
-		FROM tokens WHERE id = ?`, id).Scan(
+	dest := []interface{}{
 		&token.ID, &token.ST, &at, &atExpires, &token.Email, &name, &remark, &token.IsActive,
 		&createdAt, &lastUsedAt, &token.UseCount, &token.Credits, &userPaygateTier,
 		&projectID, &projectName, &token.ImageEnabled, &token.VideoEnabled,
-		&token.ImageConcurrency, &token.VideoConcurrency, &banReason, &bannedAt)
-	if err != nil {
+		&token.ImageConcurrency, &token.VideoConcurrency, &banReason, &bannedAt, &groupID,
+		&dailyImageLimit, &dailyVideoLimit, &version,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
 		return nil, err
 	}
 
@@ -291,10 +660,21 @@ func (d *Database) GetToken(id int64) (*models.Token, error) {
 	if bannedAt.Valid {
 		token.BannedAt = &bannedAt.Time
 	}
+	token.GroupID = groupID.Int64
+	token.DailyImageLimit = int(dailyImageLimit.Int64)
+	token.DailyVideoLimit = int(dailyVideoLimit.Int64)
+	token.Version = version.Int64
 
 	return token, nil
 }
 
+func (d *Database) GetToken(id int64) (*models.Token, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return scanToken(d.db.QueryRow(`SELECT `+tokenColumns+` FROM tokens t WHERE t.id = ?`, id))
+}
+
 func (d *Database) GetTokenByST(st string) (*models.Token, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
@@ -315,67 +695,78 @@ func (d *Database) GetTokenByST(st string) (*models.Token, error) {
 }
 
 func (d *Database) GetAllTokens() ([]*models.Token, error) {
+	return d.queryTokens(`SELECT ` + tokenColumns + ` FROM tokens t ORDER BY t.id`)
+}
+
+func (d *Database) GetActiveTokens() ([]*models.Token, error) {
+	return d.queryTokens(`SELECT ` + tokenColumns + ` FROM tokens t WHERE t.is_active = 1 ORDER BY t.id`)
+}
+
+func (d *Database) queryTokens(query string, args ...interface{}) ([]*models.Token, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	rows, err := d.db.Query(`SELECT id FROM tokens ORDER BY id`)
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var ids []int64
+	tokens := []*models.Token{}
 	for rows.Next() {
-		var id int64
-		if err := rows.Scan(&id); err != nil {
+		token, err := scanToken(rows)
+		if err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
-	}
-
-	d.mu.RUnlock()
-	tokens := make([]*models.Token, 0, len(ids))
-	for _, id := range ids {
-		token, err := d.GetToken(id)
-		if err == nil && token != nil {
-			tokens = append(tokens, token)
-		}
+		tokens = append(tokens, token)
 	}
-	d.mu.RLock()
 
-	return tokens, nil
+	return tokens, rows.Err()
 }
 
-func (d *Database) GetActiveTokens() ([]*models.Token, error) {
+// GetTokensWithStats returns every token with its statistics in a single query
+func (d *Database) GetTokensWithStats() ([]*models.TokenWithStats, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	rows, err := d.db.Query(`SELECT id FROM tokens WHERE is_active = 1 ORDER BY id`)
+	rows, err := d.db.Query(`
+		SELECT ` + tokenColumns + `,
+			COALESCE(s.image_count, 0), COALESCE(s.video_count, 0), COALESCE(s.success_count, 0),
+			COALESCE(s.error_count, 0), s.last_success_at, s.last_error_at,
+			COALESCE(s.today_image_count, 0), COALESCE(s.today_video_count, 0), COALESCE(s.today_error_count, 0),
+			s.today_date, COALESCE(s.consecutive_error_count, 0)
+		FROM tokens t LEFT JOIN token_stats s ON s.token_id = t.id
+		ORDER BY t.id`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var ids []int64
+	result := []*models.TokenWithStats{}
 	for rows.Next() {
-		var id int64
-		if err := rows.Scan(&id); err != nil {
+		stats := &models.TokenStats{}
+		var lastSuccessAt, lastErrorAt sql.NullTime
+		var todayDate sql.NullString
+		token, err := scanToken(rows,
+			&stats.ImageCount, &stats.VideoCount, &stats.SuccessCount, &stats.ErrorCount,
+			&lastSuccessAt, &lastErrorAt, &stats.TodayImageCount, &stats.TodayVideoCount,
+			&stats.TodayErrorCount, &todayDate, &stats.ConsecutiveErrorCount)
+		if err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
-	}
 
-	d.mu.RUnlock()
-	tokens := make([]*models.Token, 0, len(ids))
-	for _, id := range ids {
-		token, err := d.GetToken(id)
-		if err == nil && token != nil {
-			tokens = append(tokens, token)
+		stats.TokenID = token.ID
+		if lastSuccessAt.Valid {
+			stats.LastSuccessAt = &lastSuccessAt.Time
 		}
+		if lastErrorAt.Valid {
+			stats.LastErrorAt = &lastErrorAt.Time
+		}
+		stats.TodayDate = todayDate.String
+		result = append(result, &models.TokenWithStats{Token: token, Stats: stats})
 	}
-	d.mu.RLock()
 
-	return tokens, nil
+	return result, rows.Err()
 }
 
 func (d *Database) UpdateToken(id int64, updates map[string]interface{}) error {
@@ -406,6 +797,35 @@ func (d *Database) UpdateToken(id int64, updates map[string]interface{}) error {
 	return err
 }
 
+// EditToken applies an admin edit and returns the token's bumped version.
+// With a non-negative expected version the edit only applies while the token
+// is still at that version; it reports false when the token moved on.
+func (d *Database) EditToken(id, expected int64, updates map[string]interface{}) (int64, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	query := "UPDATE tokens SET version = version + 1"
+	args := make([]interface{}, 0, len(updates)+2)
+	for key, value := range updates {
+		query += ", " + key + " = ?"
+		args = append(args, value)
+	}
+	query += " WHERE id = ?"
+	args = append(args, id)
+	if expected >= 0 {
+		query += " AND version = ?"
+		args = append(args, expected)
+	}
+	query += " RETURNING version"
+
+	var version int64
+	err := d.db.QueryRow(query, args...).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return version, err == nil, err
+}
+
 func (d *Database) DeleteToken(id int64) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -451,11 +871,82 @@ func (d *Database) GetTokenStats(tokenID int64) (*models.TokenStats, error) {
 	return stats, nil
 }
 
+// statsToday is the date the today_* counters belong to
+func statsToday() string {
+	return time.Now().Format("2006-01-02")
+}
+
+// GetDailyUsage returns today's image and video counts, with the token's
+// group, for tokens that have generated anything today
+func (d *Database) GetDailyUsage() (map[int64]models.DailyUsage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT s.token_id, COALESCE(t.group_id, 0), s.today_image_count, s.today_video_count
+		FROM token_stats s LEFT JOIN tokens t ON t.id = s.token_id WHERE s.today_date = ?`, statsToday())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[int64]models.DailyUsage)
+	for rows.Next() {
+		var id int64
+		var u models.DailyUsage
+		if err := rows.Scan(&id, &u.GroupID, &u.Images, &u.Videos); err != nil {
+			return nil, err
+		}
+		usage[id] = u
+	}
+	return usage, rows.Err()
+}
+
+// RecordKeyUsage adds a completed generation to today's usage of an API key
+func (d *Database) RecordKeyUsage(keyID string, usage models.Usage) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+		INSERT INTO key_usage (key_id, day, requests, prompt_characters, media_count, credits)
+		VALUES (?, ?, 1, ?, ?, ?)
+		ON CONFLICT(key_id, day) DO UPDATE SET
+			requests = requests + 1,
+			prompt_characters = prompt_characters + excluded.prompt_characters,
+			media_count = media_count + excluded.media_count,
+			credits = credits + excluded.credits`,
+		keyID, statsToday(), usage.PromptCharacters, usage.MediaCount, usage.Credits)
+	return err
+}
+
+// GetKeyUsage returns the daily usage of every API key since the given day
+// (YYYY-MM-DD), newest first
+func (d *Database) GetKeyUsage(since string) ([]*models.KeyUsage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT key_id, day, requests, prompt_characters, media_count, credits
+		FROM key_usage WHERE day >= ? ORDER BY day DESC, key_id`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*models.KeyUsage
+	for rows.Next() {
+		u := &models.KeyUsage{}
+		if err := rows.Scan(&u.KeyID, &u.Day, &u.Requests, &u.PromptCharacters, &u.MediaCount, &u.Credits); err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, rows.Err()
+}
+
 func (d *Database) IncrementTokenStats(tokenID int64, statType string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	today := time.Now().Format("2006-01-02")
+	today := statsToday()
 
 	// Reset today's counters if date changed
 	d.db.Exec(`UPDATE token_stats SET today_image_count = 0, today_video_count = 0, today_error_count = 0, today_date = ? 
@@ -505,83 +996,226 @@ func (d *Database) AddProject(project *models.Project) (int64, error) {
 	return result.LastInsertId()
 }
 
-// ========== Task ==========
-
-func (d *Database) CreateTask(task *models.Task) (int64, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// GetProjectIDsByEmail returns IDs of projects flow2api created for any token of the account
+func (d *Database) GetProjectIDsByEmail(email string) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	resultURLs := ""
-	if len(task.ResultURLs) > 0 {
-		data, _ := json.Marshal(task.ResultURLs)
-		resultURLs = string(data)
+	rows, err := d.db.Query(`
+		SELECT p.project_id FROM projects p JOIN tokens t ON p.token_id = t.id
+		WHERE t.email = ?`, email)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	result, err := d.db.Exec(`
-		INSERT INTO tasks (task_id, token_id, model, prompt, status, progress, result_urls, error_message, scene_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		task.TaskID, task.TokenID, task.Model, task.Prompt, task.Status, task.Progress,
-		resultURLs, task.ErrorMessage, task.SceneID)
-	if err != nil {
-		return 0, err
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
 	}
 
-	return result.LastInsertId()
+	return ids, rows.Err()
 }
 
-func (d *Database) UpdateTask(taskID string, updates map[string]interface{}) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// GetProjectsByToken returns the projects recorded for a token, oldest first
+func (d *Database) GetProjectsByToken(tokenID int64) ([]*models.Project, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-	if len(updates) == 0 {
-		return nil
+	rows, err := d.db.Query(`
+		SELECT id, project_id, token_id, project_name, tool_name, is_active, generation_count, created_at
+		FROM projects WHERE token_id = ? ORDER BY id`, tokenID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	query := "UPDATE tasks SET "
-	args := make([]interface{}, 0, len(updates)+1)
-	first := true
-
-	for key, value := range updates {
-		if !first {
-			query += ", "
+	projects := []*models.Project{}
+	for rows.Next() {
+		project := &models.Project{}
+		var createdAt sql.NullTime
+		if err := rows.Scan(&project.ID, &project.ProjectID, &project.TokenID, &project.ProjectName,
+			&project.ToolName, &project.IsActive, &project.GenerationCount, &createdAt); err != nil {
+			return nil, err
 		}
-		query += key + " = ?"
-		if key == "result_urls" {
-			if urls, ok := value.([]string); ok {
-				data, _ := json.Marshal(urls)
-				args = append(args, string(data))
-			} else {
-				args = append(args, value)
-			}
-		} else {
-			args = append(args, value)
+		if createdAt.Valid {
+			project.CreatedAt = &createdAt.Time
 		}
-		first = false
+		projects = append(projects, project)
 	}
 
-	query += " WHERE task_id = ?"
-	args = append(args, taskID)
+	return projects, rows.Err()
+}
 
-	_, err := d.db.Exec(query, args...)
-	return err
+// IncrementProjectGenerations counts a generation run in a project and
+// returns the new total
+func (d *Database) IncrementProjectGenerations(projectID string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, err := d.db.Exec(`UPDATE projects SET generation_count = generation_count + 1 WHERE project_id = ?`, projectID); err != nil {
+		return 0, err
+	}
+	var count int
+	err := d.db.QueryRow(`SELECT COALESCE(MAX(generation_count), 0) FROM projects WHERE project_id = ?`, projectID).Scan(&count)
+	return count, err
 }
 
-// ========== Admin Config ==========
+func (d *Database) DeactivateProject(projectID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-func (d *Database) GetAdminConfig() (*models.AdminConfig, error) {
+	_, err := d.db.Exec(`UPDATE projects SET is_active = 0 WHERE project_id = ?`, projectID)
+	return err
+}
+
+// GetProjectNamesByEmail returns names of projects created for any token of the account
+func (d *Database) GetProjectNamesByEmail(email string) ([]string, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	config := &models.AdminConfig{}
-	err := d.db.QueryRow(`SELECT id, username, password, api_key, error_ban_threshold FROM admin_config WHERE id = 1`).Scan(
-		&config.ID, &config.Username, &config.Password, &config.APIKey, &config.ErrorBanThreshold)
+	rows, err := d.db.Query(`
+		SELECT p.project_name FROM projects p JOIN tokens t ON p.token_id = t.id
+		WHERE t.email = ?`, email)
 	if err != nil {
 		return nil, err
 	}
-	return config, nil
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
 }
 
-func (d *Database) UpdateAdminConfig(updates map[string]interface{}) error {
+// ========== Task ==========
+
+func (d *Database) CreateTask(task *models.Task) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	resultURLs := ""
+	if len(task.ResultURLs) > 0 {
+		data, _ := json.Marshal(task.ResultURLs)
+		resultURLs = string(data)
+	}
+
+	params := ""
+	if task.Params != nil {
+		data, _ := json.Marshal(task.Params)
+		params = string(data)
+	}
+
+	result, err := d.db.Exec(`
+		INSERT INTO tasks (task_id, token_id, model, prompt, status, progress, result_urls, error_message, scene_id,
+			operation_name, media_id, params)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		task.TaskID, task.TokenID, task.Model, task.Prompt, task.Status, task.Progress,
+		resultURLs, task.ErrorMessage, task.SceneID, task.OperationName, task.MediaID, params)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// taskColumns lists the columns read by scanTask
+const taskColumns = `id, task_id, token_id, model, prompt, status, progress, result_urls, error_message, scene_id,
+	operation_name, media_id, params, upstream_status, cache_error, created_at, completed_at`
+
+func scanTask(row rowScanner) (*models.Task, error) {
+	task := &models.Task{}
+	var resultURLs, errorMessage, sceneID, operationName, mediaID, params, upstreamStatus, cacheError sql.NullString
+	var createdAt, completedAt sql.NullTime
+
+	err := row.Scan(
+		&task.ID, &task.TaskID, &task.TokenID, &task.Model, &task.Prompt, &task.Status, &task.Progress,
+		&resultURLs, &errorMessage, &sceneID, &operationName, &mediaID, &params, &upstreamStatus, &cacheError, &createdAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if resultURLs.Valid && resultURLs.String != "" {
+		json.Unmarshal([]byte(resultURLs.String), &task.ResultURLs)
+	}
+	if errorMessage.Valid {
+		task.ErrorMessage = errorMessage.String
+	}
+	if sceneID.Valid {
+		task.SceneID = sceneID.String
+	}
+	if operationName.Valid {
+		task.OperationName = operationName.String
+	}
+	task.MediaID = mediaID.String
+	task.CacheError = cacheError.String
+	if params.Valid && params.String != "" {
+		task.Params = &models.TaskParams{}
+		json.Unmarshal([]byte(params.String), task.Params)
+	}
+	if upstreamStatus.Valid && upstreamStatus.String != "" {
+		task.UpstreamStatus = &models.UpstreamStatus{}
+		json.Unmarshal([]byte(upstreamStatus.String), task.UpstreamStatus)
+	}
+	if createdAt.Valid {
+		task.CreatedAt = &createdAt.Time
+	}
+	if completedAt.Valid {
+		task.CompletedAt = &completedAt.Time
+	}
+
+	return task, nil
+}
+
+func (d *Database) GetTask(taskID string) (*models.Task, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	task, err := scanTask(d.db.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE task_id = ?`, taskID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return task, err
+}
+
+// GetCompletedTasksBetween returns up to limit completed tasks created in
+// [from, to), oldest first
+func (d *Database) GetCompletedTasksBetween(from, to time.Time, limit int) ([]*models.Task, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	const layout = "2006-01-02 15:04:05"
+	rows, err := d.db.Query(`SELECT `+taskColumns+` FROM tasks
+		WHERE status = 'completed' AND created_at >= ? AND created_at < ? ORDER BY created_at, id LIMIT ?`,
+		from.UTC().Format(layout), to.UTC().Format(layout), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*models.Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// UpdateTask sets columns of a task and stamps it as updated now
+func (d *Database) UpdateTask(taskID string, updates map[string]interface{}) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
@@ -589,8 +1223,8 @@ func (d *Database) UpdateAdminConfig(updates map[string]interface{}) error {
 		return nil
 	}
 
-	query := "UPDATE admin_config SET "
-	args := make([]interface{}, 0, len(updates))
+	query := "UPDATE tasks SET "
+	args := make([]interface{}, 0, len(updates)+1)
 	first := true
 
 	for key, value := range updates {
@@ -598,115 +1232,318 @@ func (d *Database) UpdateAdminConfig(updates map[string]interface{}) error {
 			query += ", "
 		}
 		query += key + " = ?"
-		args = append(args, value)
+		switch v := value.(type) {
+		case []string:
+			data, _ := json.Marshal(v)
+			args = append(args, string(data))
+		case *models.TaskParams, *models.UpstreamStatus:
+			data, _ := json.Marshal(v)
+			args = append(args, string(data))
+		default:
+			args = append(args, value)
+		}
 		first = false
 	}
 
-	query += " WHERE id = 1"
+	query += ", updated_at = CURRENT_TIMESTAMP WHERE task_id = ?"
+	args = append(args, taskID)
+
 	_, err := d.db.Exec(query, args...)
 	return err
 }
 
-// ========== Proxy Config ==========
+// GetStaleTasks returns processing tasks that have not been updated for age.
+// Tasks from before updated_at was tracked count from their creation.
+func (d *Database) GetStaleTasks(age time.Duration) ([]*models.Task, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-func (d *Database) GetProxyConfig() (*models.ProxyConfig, error) {
+	rows, err := d.db.Query(`SELECT `+taskColumns+` FROM tasks
+		WHERE status = 'processing' AND COALESCE(updated_at, created_at) <= datetime('now', ?) ORDER BY id`,
+		fmt.Sprintf("-%d seconds", int64(age.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*models.Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// GetUnredactedTasks returns up to limit tasks created more than age ago
+// whose prompts have not been redacted for retention, oldest first
+func (d *Database) GetUnredactedTasks(age time.Duration, limit int) ([]*models.Task, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	config := &models.ProxyConfig{}
-	var proxyURL sql.NullString
-	err := d.db.QueryRow(`SELECT id, enabled, proxy_url FROM proxy_config WHERE id = 1`).Scan(
-		&config.ID, &config.Enabled, &proxyURL)
+	rows, err := d.db.Query(`SELECT `+taskColumns+` FROM tasks
+		WHERE prompt_redacted = 0 AND created_at <= datetime('now', ?) ORDER BY id LIMIT ?`,
+		fmt.Sprintf("-%d seconds", int64(age.Seconds())), limit)
 	if err != nil {
 		return nil, err
 	}
-	if proxyURL.Valid {
-		config.ProxyURL = proxyURL.String
+	defer rows.Close()
+
+	var tasks []*models.Task
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
 	}
-	return config, nil
+	return tasks, rows.Err()
 }
 
-func (d *Database) UpdateProxyConfig(enabled bool, proxyURL string) error {
+// RedactTaskPrompts replaces a task's prompt and params and marks them
+// redacted; counters, URLs and timestamps are left as they are
+func (d *Database) RedactTaskPrompts(taskID, prompt string, params *models.TaskParams) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	_, err := d.db.Exec(`UPDATE proxy_config SET enabled = ?, proxy_url = ? WHERE id = 1`, enabled, proxyURL)
+	var paramsJSON interface{}
+	if params != nil {
+		data, _ := json.Marshal(params)
+		paramsJSON = string(data)
+	}
+	_, err := d.db.Exec(`UPDATE tasks SET prompt = ?, params = ?, prompt_redacted = 1 WHERE task_id = ?`,
+		prompt, paramsJSON, taskID)
 	return err
 }
 
-// ========== Cache Config ==========
-
-func (d *Database) GetCacheConfig() (*models.CacheConfigDB, error) {
+// GetTaskStatsSince aggregates tasks created within the last window by model
+func (d *Database) GetTaskStatsSince(window time.Duration) ([]*models.ModelTaskStats, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	config := &models.CacheConfigDB{}
-	var baseURL sql.NullString
-	err := d.db.QueryRow(`SELECT id, cache_enabled, cache_timeout, cache_base_url FROM cache_config WHERE id = 1`).Scan(
-		&config.ID, &config.CacheEnabled, &config.CacheTimeout, &baseURL)
+	rows, err := d.db.Query(`
+		SELECT model,
+			SUM(CASE WHEN status = 'processing' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN status = 'completed' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN status = 'failed' THEN 1 ELSE 0 END),
+			COALESCE(AVG(CASE WHEN status = 'completed' AND completed_at IS NOT NULL
+				THEN (julianday(completed_at) - julianday(created_at)) * 86400 END), 0)
+		FROM tasks WHERE created_at >= datetime('now', ?) GROUP BY model ORDER BY model`,
+		fmt.Sprintf("-%d seconds", int64(window.Seconds())))
 	if err != nil {
 		return nil, err
 	}
-	if baseURL.Valid {
-		config.CacheBaseURL = baseURL.String
+	defer rows.Close()
+
+	var stats []*models.ModelTaskStats
+	for rows.Next() {
+		s := &models.ModelTaskStats{}
+		if err := rows.Scan(&s.Model, &s.Processing, &s.Completed, &s.Failed, &s.AvgCompletionSeconds); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
 	}
-	return config, nil
+
+	return stats, rows.Err()
 }
 
-func (d *Database) UpdateCacheConfig(enabled bool, timeout int, baseURL string) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
+// usageGroups maps the group_by values of a usage report to SQL expressions
+var usageGroups = map[string]string{
+	"day":     `date(t.created_at, 'localtime')`,
+	"token":   `CAST(t.token_id AS TEXT)`,
+	"api_key": `COALESCE(NULLIF(CASE WHEN json_valid(t.params) THEN json_extract(t.params, '$.key_id') END, ''), 'default')`,
+	"model":   `t.model`,
+}
 
-	_, err := d.db.Exec(`UPDATE cache_config SET cache_enabled = ?, cache_timeout = ?, cache_base_url = ?, updated_at = CURRENT_TIMESTAMP WHERE id = 1`,
-		enabled, timeout, baseURL)
-	return err
+// IsUsageGroup reports whether groupBy is a valid usage report grouping
+func IsUsageGroup(groupBy string) bool {
+	_, ok := usageGroups[groupBy]
+	return ok
 }
 
-// ========== Debug Config ==========
+// GetUsageReport aggregates the tasks created between two local days
+// (YYYY-MM-DD, inclusive) by day, token, api_key or model
+func (d *Database) GetUsageReport(from, to, groupBy string) ([]*models.UsageReportRow, error) {
+	group, ok := usageGroups[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown usage grouping: %s", groupBy)
+	}
+	// Token emails are only looked up when grouping by token
+	tokenJoin := "0"
+	if groupBy == "token" {
+		tokenJoin = "t.token_id = k.id"
+	}
 
-func (d *Database) GetDebugConfig() (*models.DebugConfigDB, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	config := &models.DebugConfigDB{}
-	err := d.db.QueryRow(`SELECT id, enabled, log_requests, log_responses, mask_token FROM debug_config WHERE id = 1`).Scan(
-		&config.ID, &config.Enabled, &config.LogRequests, &config.LogResponses, &config.MaskToken)
+	rows, err := d.db.Query(`
+		SELECT `+group+` AS grp, COALESCE(MAX(k.email), ''),
+			SUM(CASE WHEN t.status = 'completed' THEN 1 ELSE 0 END),
+			SUM(CASE WHEN t.status = 'failed' THEN 1 ELSE 0 END),
+			COALESCE(SUM(t.credits), 0),
+			COALESCE(SUM(t.cache_bytes), 0)
+		FROM tasks t LEFT JOIN tokens k ON `+tokenJoin+`
+		WHERE date(t.created_at, 'localtime') BETWEEN ? AND ?
+		GROUP BY grp ORDER BY grp`, from, to)
 	if err != nil {
 		return nil, err
 	}
-	return config, nil
+	defer rows.Close()
+
+	var report []*models.UsageReportRow
+	for rows.Next() {
+		r := &models.UsageReportRow{}
+		if err := rows.Scan(&r.Group, &r.Email, &r.Generations, &r.Errors, &r.Credits, &r.CacheBytes); err != nil {
+			return nil, err
+		}
+		report = append(report, r)
+	}
+	return report, rows.Err()
+}
+
+// GetTaskCountsByToken counts the tasks routed to each token since the given time
+func (d *Database) GetTaskCountsByToken(since time.Time) (map[int64]int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT token_id, COUNT(*) FROM tasks WHERE created_at >= ? GROUP BY token_id`,
+		since.UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var id int64
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
 }
 
-func (d *Database) UpdateDebugConfig(enabled bool) error {
+// ========== Request Logs ==========
+
+func (d *Database) AddRequestLog(entry *models.RequestLog) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	_, err := d.db.Exec(`UPDATE debug_config SET enabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = 1`, enabled)
+	var trace, selection interface{}
+	if len(entry.Trace) > 0 {
+		trace = string(entry.Trace)
+	}
+	if entry.Selection != nil {
+		data, err := json.Marshal(entry.Selection)
+		if err != nil {
+			return err
+		}
+		selection = string(data)
+	}
+
+	_, err := d.db.Exec(`
+		INSERT INTO request_logs (task_id, token_id, operation, status_code, duration, trace, selection)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		entry.TaskID, entry.TokenID, entry.Operation, entry.StatusCode, entry.Duration, trace, selection)
 	return err
 }
 
-// ========== Captcha Config ==========
+// GetRequestLogs returns the newest entries; tracedOnly limits to entries
+// with a trace, and a non-zero tokenID to the requests that token served
+func (d *Database) GetRequestLogs(limit int, tracedOnly bool, tokenID int64) ([]*models.RequestLog, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 
-func (d *Database) GetCaptchaConfig() (*models.CaptchaConfigDB, error) {
+	query := `
+		SELECT l.id, l.task_id, l.token_id, t.email, l.operation, l.status_code, l.duration, l.trace, l.selection, l.created_at
+		FROM request_logs l LEFT JOIN tokens t ON l.token_id = t.id WHERE 1 = 1`
+	var args []interface{}
+	if tracedOnly {
+		query += ` AND l.trace IS NOT NULL`
+	}
+	if tokenID != 0 {
+		query += ` AND l.token_id = ?`
+		args = append(args, tokenID)
+	}
+	query += ` ORDER BY l.id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []*models.RequestLog{}
+	for rows.Next() {
+		entry := &models.RequestLog{}
+		var taskID, email, trace, selection sql.NullString
+		var tokenID sql.NullInt64
+		var createdAt sql.NullTime
+		if err := rows.Scan(&entry.ID, &taskID, &tokenID, &email, &entry.Operation, &entry.StatusCode,
+			&entry.Duration, &trace, &selection, &createdAt); err != nil {
+			return nil, err
+		}
+		if selection.String != "" {
+			entry.Selection = &models.TokenChoice{}
+			if err := json.Unmarshal([]byte(selection.String), entry.Selection); err != nil {
+				entry.Selection = nil
+			}
+		}
+		entry.TaskID = taskID.String
+		entry.TokenID = tokenID.Int64
+		entry.TokenEmail = email.String
+		if trace.Valid && trace.String != "" {
+			entry.Trace = json.RawMessage(trace.String)
+		}
+		if createdAt.Valid {
+			entry.CreatedAt = &createdAt.Time
+		}
+		logs = append(logs, entry)
+	}
+
+	return logs, rows.Err()
+}
+
+// ========== Admin Config ==========
+
+func (d *Database) GetAdminConfig() (*models.AdminConfig, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	config := &models.CaptchaConfigDB{}
-	var proxyURL sql.NullString
-	err := d.db.QueryRow(`SELECT id, captcha_method, yescaptcha_api_key, yescaptcha_base_url, website_key, page_action, 
-		browser_proxy_enabled, browser_proxy_url FROM captcha_config WHERE id = 1`).Scan(
-		&config.ID, &config.CaptchaMethod, &config.YesCaptchaAPIKey, &config.YesCaptchaBaseURL,
-		&config.WebsiteKey, &config.PageAction, &config.BrowserProxyEnabled, &proxyURL)
+	config := &models.AdminConfig{}
+	var previousKey, totpSecret, totpPending, recoveryCodes sql.NullString
+	var previousExpires sql.NullTime
+	var totpEnabled sql.NullBool
+	var totpLastStep sql.NullInt64
+	err := d.db.QueryRow(`SELECT id, username, password, api_key, error_ban_threshold, previous_api_key, previous_api_key_expires_at,
+		totp_enabled, totp_secret, totp_pending_secret, totp_last_step, recovery_codes
+		FROM admin_config WHERE id = 1`).Scan(
+		&config.ID, &config.Username, &config.Password, &config.APIKey, &config.ErrorBanThreshold, &previousKey, &previousExpires,
+		&totpEnabled, &totpSecret, &totpPending, &totpLastStep, &recoveryCodes)
 	if err != nil {
 		return nil, err
 	}
-	if proxyURL.Valid {
-		config.BrowserProxyURL = proxyURL.String
+	config.PreviousAPIKey = previousKey.String
+	config.TOTPEnabled = totpEnabled.Bool
+	config.TOTPSecret = totpSecret.String
+	config.TOTPPendingSecret = totpPending.String
+	config.TOTPLastStep = totpLastStep.Int64
+	if recoveryCodes.String != "" {
+		config.RecoveryCodes = strings.Split(recoveryCodes.String, ",")
+	}
+	if previousExpires.Valid {
+		config.PreviousAPIKeyExpires = &previousExpires.Time
 	}
 	return config, nil
 }
 
-func (d *Database) UpdateCaptchaConfig(updates map[string]interface{}) error {
+func (d *Database) UpdateAdminConfig(updates map[string]interface{}) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
@@ -714,7 +1551,7 @@ func (d *Database) UpdateCaptchaConfig(updates map[string]interface{}) error {
 		return nil
 	}
 
-	query := "UPDATE captcha_config SET "
+	query := "UPDATE admin_config SET "
 	args := make([]interface{}, 0, len(updates))
 	first := true
 
@@ -727,31 +1564,1210 @@ func (d *Database) UpdateCaptchaConfig(updates map[string]interface{}) error {
 		first = false
 	}
 
-	query += ", updated_at = CURRENT_TIMESTAMP WHERE id = 1"
+	query += " WHERE id = 1"
 	_, err := d.db.Exec(query, args...)
 	return err
 }
 
-// ========== Generation Config ==========
+// ========== Proxy Config ==========
 
-func (d *Database) GetGenerationConfig() (*models.GenerationConfigDB, error) {
+func (d *Database) GetProxyConfig() (*models.ProxyConfig, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
-	config := &models.GenerationConfigDB{}
-	err := d.db.QueryRow(`SELECT id, image_timeout, video_timeout FROM generation_config WHERE id = 1`).Scan(
-		&config.ID, &config.ImageTimeout, &config.VideoTimeout)
+	config := &models.ProxyConfig{}
+	var proxyURL sql.NullString
+	err := d.db.QueryRow(`SELECT id, enabled, proxy_url FROM proxy_config WHERE id = 1`).Scan(
+		&config.ID, &config.Enabled, &proxyURL)
 	if err != nil {
 		return nil, err
 	}
+	if proxyURL.Valid {
+		config.ProxyURL = proxyURL.String
+	}
 	return config, nil
 }
 
-func (d *Database) UpdateGenerationConfig(imageTimeout, videoTimeout int) error {
+func (d *Database) UpdateProxyConfig(enabled bool, proxyURL string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	_, err := d.db.Exec(`UPDATE generation_config SET image_timeout = ?, video_timeout = ? WHERE id = 1`,
-		imageTimeout, videoTimeout)
+	_, err := d.db.Exec(`UPDATE proxy_config SET enabled = ?, proxy_url = ? WHERE id = 1`, enabled, proxyURL)
+	return err
+}
+
+// ========== Cache Config ==========
+
+func (d *Database) GetCacheConfig() (*models.CacheConfigDB, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	config := &models.CacheConfigDB{}
+	var baseURL, backend, endpoint, region, bucket, accessKey, secretKey, publicURL, prefix sql.NullString
+	var pathStyle sql.NullBool
+	err := d.db.QueryRow(`SELECT id, cache_enabled, cache_timeout, cache_base_url, storage_backend, s3_endpoint, s3_region,
+		s3_bucket, s3_access_key, s3_secret_key, s3_public_url, s3_prefix, s3_path_style FROM cache_config WHERE id = 1`).Scan(
+		&config.ID, &config.CacheEnabled, &config.CacheTimeout, &baseURL, &backend, &endpoint, &region,
+		&bucket, &accessKey, &secretKey, &publicURL, &prefix, &pathStyle)
+	if err != nil {
+		return nil, err
+	}
+	config.CacheBaseURL = baseURL.String
+	config.StorageBackend = backend.String
+	config.S3Endpoint = endpoint.String
+	config.S3Region = region.String
+	config.S3Bucket = bucket.String
+	config.S3AccessKey = accessKey.String
+	config.S3SecretKey = secretKey.String
+	config.S3PublicURL = publicURL.String
+	config.S3Prefix = prefix.String
+	config.S3PathStyle = !pathStyle.Valid || pathStyle.Bool
+	return config, nil
+}
+
+func (d *Database) UpdateCacheConfig(enabled bool, timeout int, baseURL string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE cache_config SET cache_enabled = ?, cache_timeout = ?, cache_base_url = ?, updated_at = CURRENT_TIMESTAMP WHERE id = 1`,
+		enabled, timeout, baseURL)
+	return err
+}
+
+func (d *Database) UpdateCacheStorageConfig(config *models.CacheConfigDB) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE cache_config SET storage_backend = ?, s3_endpoint = ?, s3_region = ?, s3_bucket = ?, s3_access_key = ?,
+		s3_secret_key = ?, s3_public_url = ?, s3_prefix = ?, s3_path_style = ?, updated_at = CURRENT_TIMESTAMP WHERE id = 1`,
+		config.StorageBackend, config.S3Endpoint, config.S3Region, config.S3Bucket, config.S3AccessKey,
+		config.S3SecretKey, config.S3PublicURL, config.S3Prefix, config.S3PathStyle)
+	return err
+}
+
+// ========== Cache Files ==========
+
+func (d *Database) AddCachedFile(file *models.CachedFile) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`INSERT INTO cache_files (key, backend, object_key, url, size, media_type) VALUES (?, ?, ?, ?, ?, ?)`,
+		file.Key, file.Backend, file.ObjectKey, file.URL, file.Size, file.MediaType)
 	return err
 }
+
+// GetCachedFilesOlderThan returns tracked files created more than age ago; age <= 0 returns all files
+func (d *Database) GetCachedFilesOlderThan(age time.Duration) ([]*models.CachedFile, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT id, key, backend, object_key, url, size, media_type, created_at FROM cache_files
+		WHERE created_at <= datetime('now', ?) ORDER BY id`, fmt.Sprintf("-%d seconds", int64(age.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []*models.CachedFile
+	for rows.Next() {
+		file := &models.CachedFile{}
+		var objectKey, url, mediaType sql.NullString
+		var createdAt sql.NullTime
+		if err := rows.Scan(&file.ID, &file.Key, &file.Backend, &objectKey, &url, &file.Size, &mediaType, &createdAt); err != nil {
+			return nil, err
+		}
+		file.ObjectKey = objectKey.String
+		file.URL = url.String
+		file.MediaType = mediaType.String
+		if createdAt.Valid {
+			file.CreatedAt = &createdAt.Time
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// GetCachedFile returns nil when no file has the given ID
+func (d *Database) GetCachedFile(id int64) (*models.CachedFile, error) {
+	return d.getCachedFile(`id = ?`, id)
+}
+
+// GetCachedFileByURL returns nil when no file was stored under the URL
+func (d *Database) GetCachedFileByURL(url string) (*models.CachedFile, error) {
+	return d.getCachedFile(`url = ?`, url)
+}
+
+// GetCachedFileByKey returns nil when no file has the given key
+func (d *Database) GetCachedFileByKey(key string) (*models.CachedFile, error) {
+	return d.getCachedFile(`key = ?`, key)
+}
+
+func (d *Database) getCachedFile(where string, arg interface{}) (*models.CachedFile, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	file := &models.CachedFile{}
+	var objectKey, url, mediaType sql.NullString
+	var createdAt sql.NullTime
+	err := d.db.QueryRow(`SELECT id, key, backend, object_key, url, size, media_type, created_at FROM cache_files WHERE `+where+` ORDER BY id DESC LIMIT 1`, arg).
+		Scan(&file.ID, &file.Key, &file.Backend, &objectKey, &url, &file.Size, &mediaType, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file.ObjectKey = objectKey.String
+	file.URL = url.String
+	file.MediaType = mediaType.String
+	if createdAt.Valid {
+		file.CreatedAt = &createdAt.Time
+	}
+	return file, nil
+}
+
+func (d *Database) DeleteCachedFile(id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`DELETE FROM cache_files WHERE id = ?`, id)
+	return err
+}
+
+func (d *Database) DeleteCachedFileByKey(backend, key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`DELETE FROM cache_files WHERE backend = ? AND key = ?`, backend, key)
+	return err
+}
+
+func (d *Database) GetCacheStats() ([]*models.CacheBackendStats, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT backend, COUNT(*), COALESCE(SUM(size), 0) FROM cache_files GROUP BY backend ORDER BY backend`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []*models.CacheBackendStats
+	for rows.Next() {
+		s := &models.CacheBackendStats{}
+		if err := rows.Scan(&s.Backend, &s.Files, &s.Bytes); err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
+
+// ========== Debug Config ==========
+
+func (d *Database) GetDebugConfig() (*models.DebugConfigDB, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	config := &models.DebugConfigDB{}
+	err := d.db.QueryRow(`SELECT id, enabled, log_requests, log_responses, mask_token FROM debug_config WHERE id = 1`).Scan(
+		&config.ID, &config.Enabled, &config.LogRequests, &config.LogResponses, &config.MaskToken)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (d *Database) UpdateDebugConfig(config *models.DebugConfigDB) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE debug_config SET enabled = ?, log_requests = ?, log_responses = ?, mask_token = ?, updated_at = CURRENT_TIMESTAMP WHERE id = 1`,
+		config.Enabled, config.LogRequests, config.LogResponses, config.MaskToken)
+	return err
+}
+
+// ========== Captcha Config ==========
+
+func (d *Database) GetCaptchaConfig() (*models.CaptchaConfigDB, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	config := &models.CaptchaConfigDB{}
+	var proxyURL, sidecarURL, sidecarToken sql.NullString
+	err := d.db.QueryRow(`SELECT id, captcha_method, yescaptcha_api_key, yescaptcha_base_url, website_key, page_action, 
+		browser_proxy_enabled, browser_proxy_url, sidecar_url, sidecar_token FROM captcha_config WHERE id = 1`).Scan(
+		&config.ID, &config.CaptchaMethod, &config.YesCaptchaAPIKey, &config.YesCaptchaBaseURL,
+		&config.WebsiteKey, &config.PageAction, &config.BrowserProxyEnabled, &proxyURL, &sidecarURL, &sidecarToken)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Valid {
+		config.BrowserProxyURL = proxyURL.String
+	}
+	config.SidecarURL = sidecarURL.String
+	config.SidecarToken = sidecarToken.String
+	return config, nil
+}
+
+func (d *Database) UpdateCaptchaConfig(updates map[string]interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(updates) == 0 {
+		return nil
+	}
+
+	query := "UPDATE captcha_config SET "
+	args := make([]interface{}, 0, len(updates))
+	first := true
+
+	for key, value := range updates {
+		if !first {
+			query += ", "
+		}
+		query += key + " = ?"
+		args = append(args, value)
+		first = false
+	}
+
+	query += ", updated_at = CURRENT_TIMESTAMP WHERE id = 1"
+	_, err := d.db.Exec(query, args...)
+	return err
+}
+
+// ========== Generation Config ==========
+
+func (d *Database) GetGenerationConfig() (*models.GenerationConfigDB, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	config := &models.GenerationConfigDB{}
+	err := d.db.QueryRow(`SELECT id, image_timeout, video_timeout FROM generation_config WHERE id = 1`).Scan(
+		&config.ID, &config.ImageTimeout, &config.VideoTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (d *Database) UpdateGenerationConfig(imageTimeout, videoTimeout int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE generation_config SET image_timeout = ?, video_timeout = ? WHERE id = 1`,
+		imageTimeout, videoTimeout)
+	return err
+}
+
+// GetAnnouncement returns the announcement set in the admin panel, "" when
+// there is none
+func (d *Database) GetAnnouncement() (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var message sql.NullString
+	err := d.db.QueryRow(`SELECT announcement FROM generation_config WHERE id = 1`).Scan(&message)
+	return message.String, err
+}
+
+func (d *Database) SetAnnouncement(message string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE generation_config SET announcement = ? WHERE id = 1`, message)
+	return err
+}
+
+// ========== Upstream Models ==========
+
+// UpsertUpstreamModel records a discovered model, keeping any operator decision on it
+func (d *Database) UpsertUpstreamModel(model *models.UpstreamModel) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+		INSERT INTO upstream_models (model_key, model_type, display_name, status)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(model_key) DO UPDATE SET
+			model_type = excluded.model_type,
+			display_name = excluded.display_name,
+			last_seen_at = CURRENT_TIMESTAMP,
+			status = CASE WHEN upstream_models.status IN ('enabled', 'ignored') THEN upstream_models.status ELSE excluded.status END`,
+		model.ModelKey, model.ModelType, model.DisplayName, model.Status)
+	return err
+}
+
+func (d *Database) GetUpstreamModels() ([]*models.UpstreamModel, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT model_key, model_type, display_name, status, video_type, first_seen_at, last_seen_at
+		FROM upstream_models ORDER BY first_seen_at DESC, model_key`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*models.UpstreamModel
+	for rows.Next() {
+		model := &models.UpstreamModel{}
+		var displayName, videoType sql.NullString
+		var firstSeenAt, lastSeenAt sql.NullTime
+		if err := rows.Scan(&model.ModelKey, &model.ModelType, &displayName, &model.Status, &videoType,
+			&firstSeenAt, &lastSeenAt); err != nil {
+			return nil, err
+		}
+		if displayName.Valid {
+			model.DisplayName = displayName.String
+		}
+		if videoType.Valid {
+			model.VideoType = videoType.String
+		}
+		if firstSeenAt.Valid {
+			model.FirstSeenAt = &firstSeenAt.Time
+		}
+		if lastSeenAt.Valid {
+			model.LastSeenAt = &lastSeenAt.Time
+		}
+		result = append(result, model)
+	}
+
+	return result, rows.Err()
+}
+
+func (d *Database) UpdateUpstreamModelStatus(modelKey, status, videoType string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`UPDATE upstream_models SET status = ?, video_type = ? WHERE model_key = ?`,
+		status, videoType, modelKey)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ========== Model Registry ==========
+
+// SeedModels adds the built-in models missing from the models table; rows
+// already there, edited or disabled, are left alone
+func (d *Database) SeedModels(builtin map[string]models.ModelConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for name, cfg := range builtin {
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO models (name, type, video_type, model_name, model_key, aspect_ratio,
+				supports_images, min_images, max_images, enabled, builtin)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 1, 1)`,
+			name, cfg.Type, cfg.VideoType, cfg.ModelName, cfg.ModelKey, cfg.AspectRatio,
+			cfg.SupportsImages, cfg.MinImages, cfg.MaxImages); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const registryModelColumns = `name, type, video_type, model_name, model_key, aspect_ratio,
+	supports_images, min_images, max_images, enabled, builtin, updated_at`
+
+func scanRegistryModel(scan func(dest ...any) error) (*models.RegistryModel, error) {
+	model := &models.RegistryModel{}
+	var videoType, modelName, modelKey, aspectRatio sql.NullString
+	var updatedAt sql.NullTime
+	if err := scan(&model.Name, &model.Type, &videoType, &modelName, &modelKey, &aspectRatio,
+		&model.SupportsImages, &model.MinImages, &model.MaxImages, &model.Enabled, &model.Builtin, &updatedAt); err != nil {
+		return nil, err
+	}
+	model.VideoType = videoType.String
+	model.ModelName = modelName.String
+	model.ModelKey = modelKey.String
+	model.AspectRatio = aspectRatio.String
+	if updatedAt.Valid {
+		model.UpdatedAt = &updatedAt.Time
+	}
+	return model, nil
+}
+
+// GetRegistryModels returns every model in the registry, enabled or not
+func (d *Database) GetRegistryModels() ([]*models.RegistryModel, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT ` + registryModelColumns + ` FROM models ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*models.RegistryModel
+	for rows.Next() {
+		model, err := scanRegistryModel(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, model)
+	}
+	return result, rows.Err()
+}
+
+func (d *Database) GetRegistryModel(name string) (*models.RegistryModel, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return scanRegistryModel(d.db.QueryRow(`SELECT `+registryModelColumns+` FROM models WHERE name = ?`, name).Scan)
+}
+
+// SaveRegistryModel adds a model or replaces its settings. Whether it is
+// built in never changes.
+func (d *Database) SaveRegistryModel(model *models.RegistryModel) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+		INSERT INTO models (name, type, video_type, model_name, model_key, aspect_ratio,
+			supports_images, min_images, max_images, enabled)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			type = excluded.type,
+			video_type = excluded.video_type,
+			model_name = excluded.model_name,
+			model_key = excluded.model_key,
+			aspect_ratio = excluded.aspect_ratio,
+			supports_images = excluded.supports_images,
+			min_images = excluded.min_images,
+			max_images = excluded.max_images,
+			enabled = excluded.enabled,
+			updated_at = CURRENT_TIMESTAMP`,
+		model.Name, model.Type, model.VideoType, model.ModelName, model.ModelKey, model.AspectRatio,
+		model.SupportsImages, model.MinImages, model.MaxImages, model.Enabled)
+	return err
+}
+
+func (d *Database) DeleteRegistryModel(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM models WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ========== Model Aliases ==========
+
+func (d *Database) GetModelAliases() ([]*models.ModelAlias, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT alias, model, created_at FROM model_aliases ORDER BY alias`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*models.ModelAlias
+	for rows.Next() {
+		alias := &models.ModelAlias{}
+		var createdAt sql.NullTime
+		if err := rows.Scan(&alias.Alias, &alias.Model, &createdAt); err != nil {
+			return nil, err
+		}
+		if createdAt.Valid {
+			alias.CreatedAt = &createdAt.Time
+		}
+		result = append(result, alias)
+	}
+	return result, rows.Err()
+}
+
+// SaveModelAlias adds an alias or points an existing one at another model
+func (d *Database) SaveModelAlias(alias, model string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`INSERT INTO model_aliases (alias, model) VALUES (?, ?)
+		ON CONFLICT(alias) DO UPDATE SET model = excluded.model`, alias, model)
+	return err
+}
+
+func (d *Database) DeleteModelAlias(alias string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM model_aliases WHERE alias = ?`, alias)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetDefaultModel returns the model used for unknown model names, "" when
+// they are rejected
+func (d *Database) GetDefaultModel() (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var model sql.NullString
+	err := d.db.QueryRow(`SELECT default_model FROM generation_config WHERE id = 1`).Scan(&model)
+	return model.String, err
+}
+
+func (d *Database) SetDefaultModel(model string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE generation_config SET default_model = ? WHERE id = 1`, model)
+	return err
+}
+
+// ========== Canary Rules ==========
+
+func (d *Database) GetCanaryRules() ([]*models.CanaryRule, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT id, model, target_model, strategy, percent, enabled, created_at FROM canary_rules ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*models.CanaryRule
+	for rows.Next() {
+		rule := &models.CanaryRule{}
+		var targetModel, strategy sql.NullString
+		var createdAt sql.NullTime
+		if err := rows.Scan(&rule.ID, &rule.Model, &targetModel, &strategy, &rule.Percent, &rule.Enabled, &createdAt); err != nil {
+			return nil, err
+		}
+		if targetModel.Valid {
+			rule.TargetModel = targetModel.String
+		}
+		if strategy.Valid {
+			rule.Strategy = strategy.String
+		}
+		if createdAt.Valid {
+			rule.CreatedAt = &createdAt.Time
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+func (d *Database) AddCanaryRule(rule *models.CanaryRule) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`INSERT INTO canary_rules (model, target_model, strategy, percent, enabled) VALUES (?, ?, ?, ?, ?)`,
+		rule.Model, rule.TargetModel, rule.Strategy, rule.Percent, rule.Enabled)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (d *Database) UpdateCanaryRule(rule *models.CanaryRule) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE canary_rules SET model = ?, target_model = ?, strategy = ?, percent = ?, enabled = ? WHERE id = ?`,
+		rule.Model, rule.TargetModel, rule.Strategy, rule.Percent, rule.Enabled, rule.ID)
+	return err
+}
+
+func (d *Database) DeleteCanaryRule(id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`DELETE FROM canary_rules WHERE id = ?`, id)
+	return err
+}
+
+// ========== API Keys ==========
+
+// scanAPIKey reads a key row; allowed_models is stored as comma-separated globs
+func scanAPIKey(row rowScanner) (*models.APIKey, error) {
+	key := &models.APIKey{AllowedModels: []string{}}
+	var allowed sql.NullString
+	var createdAt sql.NullTime
+	var privacyMode sql.NullString
+	var skipCache sql.NullBool
+	var tokenGroupID sql.NullInt64
+	if err := row.Scan(&key.ID, &key.Name, &key.Key, &allowed, &key.Enabled, &privacyMode, &skipCache, &tokenGroupID, &createdAt); err != nil {
+		return nil, err
+	}
+	if allowed.String != "" {
+		key.AllowedModels = strings.Split(allowed.String, ",")
+	}
+	key.PrivacyMode = privacyMode.String
+	key.SkipCache = skipCache.Bool
+	key.TokenGroupID = tokenGroupID.Int64
+	if createdAt.Valid {
+		key.CreatedAt = &createdAt.Time
+	}
+	return key, nil
+}
+
+func (d *Database) GetAPIKeys() ([]*models.APIKey, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT id, name, key, allowed_models, enabled, privacy_mode, skip_cache, token_group_id, created_at FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetAPIKeyByKey returns nil when no key matches
+func (d *Database) GetAPIKeyByKey(secret string) (*models.APIKey, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	key, err := scanAPIKey(d.db.QueryRow(`SELECT id, name, key, allowed_models, enabled, privacy_mode, skip_cache, token_group_id, created_at
+		FROM api_keys WHERE key = ?`, secret))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return key, err
+}
+
+func (d *Database) AddAPIKey(key *models.APIKey) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`INSERT INTO api_keys (name, key, allowed_models, enabled, privacy_mode, skip_cache, token_group_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key.Name, key.Key, strings.Join(key.AllowedModels, ","), key.Enabled, key.PrivacyMode, key.SkipCache, key.TokenGroupID)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (d *Database) UpdateAPIKey(key *models.APIKey) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE api_keys SET name = ?, allowed_models = ?, enabled = ?, privacy_mode = ?, skip_cache = ?,
+		token_group_id = ? WHERE id = ?`,
+		key.Name, strings.Join(key.AllowedModels, ","), key.Enabled, key.PrivacyMode, key.SkipCache, key.TokenGroupID, key.ID)
+	return err
+}
+
+func (d *Database) DeleteAPIKey(id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	return err
+}
+
+// ========== Rate Limits ==========
+
+func (d *Database) GetRateLimits() ([]*models.RateLimit, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT model, requests_per_minute, burst, updated_at FROM rate_limits ORDER BY model`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limits := []*models.RateLimit{}
+	for rows.Next() {
+		limit := &models.RateLimit{}
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&limit.Model, &limit.RequestsPerMinute, &limit.Burst, &updatedAt); err != nil {
+			return nil, err
+		}
+		if updatedAt.Valid {
+			limit.UpdatedAt = &updatedAt.Time
+		}
+		limits = append(limits, limit)
+	}
+
+	return limits, rows.Err()
+}
+
+func (d *Database) SetRateLimit(limit *models.RateLimit) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+		INSERT INTO rate_limits (model, requests_per_minute, burst, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(model) DO UPDATE SET requests_per_minute = excluded.requests_per_minute,
+			burst = excluded.burst, updated_at = CURRENT_TIMESTAMP`,
+		limit.Model, limit.RequestsPerMinute, limit.Burst)
+	return err
+}
+
+func (d *Database) DeleteRateLimit(model string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`DELETE FROM rate_limits WHERE model = ?`, model)
+	return err
+}
+
+// ========== Security Config ==========
+
+// GetConfigVersion returns how many times a config section was saved
+func (d *Database) GetConfigVersion(section string) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var version int64
+	err := d.db.QueryRow(`SELECT version FROM config_versions WHERE section = ?`, section).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// BumpConfigVersion records a save of a config section and returns its new version
+func (d *Database) BumpConfigVersion(section string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var version int64
+	err := d.db.QueryRow(`
+		INSERT INTO config_versions (section, version) VALUES (?, 1)
+		ON CONFLICT(section) DO UPDATE SET version = version + 1
+		RETURNING version`, section).Scan(&version)
+	return version, err
+}
+
+// GetSecurityConfig returns the IP filters; the lists are stored as
+// comma-separated entries
+func (d *Database) GetSecurityConfig() (*models.SecurityConfig, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	cfg := &models.SecurityConfig{IPAllowlist: []string{}, IPDenylist: []string{}}
+	var allow, deny sql.NullString
+	var updatedAt sql.NullTime
+	err := d.db.QueryRow(`SELECT ip_allowlist, ip_denylist, requests_per_minute, burst, updated_at FROM security_config WHERE id = 1`).Scan(
+		&allow, &deny, &cfg.RequestsPerMinute, &cfg.Burst, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if allow.String != "" {
+		cfg.IPAllowlist = strings.Split(allow.String, ",")
+	}
+	if deny.String != "" {
+		cfg.IPDenylist = strings.Split(deny.String, ",")
+	}
+	if updatedAt.Valid {
+		cfg.UpdatedAt = &updatedAt.Time
+	}
+	return cfg, nil
+}
+
+func (d *Database) UpdateSecurityConfig(cfg *models.SecurityConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+		UPDATE security_config SET ip_allowlist = ?, ip_denylist = ?, requests_per_minute = ?, burst = ?,
+			updated_at = CURRENT_TIMESTAMP WHERE id = 1`,
+		strings.Join(cfg.IPAllowlist, ","), strings.Join(cfg.IPDenylist, ","), cfg.RequestsPerMinute, cfg.Burst)
+	return err
+}
+
+// ========== Token Refresh Config ==========
+
+func (d *Database) GetTokenRefreshConfig() (*models.TokenRefreshConfig, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	cfg := &models.TokenRefreshConfig{}
+	var updatedAt sql.NullTime
+	err := d.db.QueryRow(`SELECT enabled, interval_minutes, before_expiry_minutes, updated_at FROM token_refresh_config WHERE id = 1`).Scan(
+		&cfg.Enabled, &cfg.IntervalMinutes, &cfg.BeforeExpiryMinutes, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if updatedAt.Valid {
+		cfg.UpdatedAt = &updatedAt.Time
+	}
+	return cfg, nil
+}
+
+func (d *Database) UpdateTokenRefreshConfig(cfg *models.TokenRefreshConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+		UPDATE token_refresh_config SET enabled = ?, interval_minutes = ?, before_expiry_minutes = ?,
+			updated_at = CURRENT_TIMESTAMP WHERE id = 1`,
+		cfg.Enabled, cfg.IntervalMinutes, cfg.BeforeExpiryMinutes)
+	return err
+}
+
+// ========== Ban Config ==========
+
+func (d *Database) GetBanConfig() (*models.BanConfig, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	cfg := &models.BanConfig{}
+	var updatedAt sql.NullTime
+	err := d.db.QueryRow(`SELECT rate_limit_ban, rate_limit_ban_minutes, error_ban, error_ban_minutes, unban_check_minutes, quota_reset_hour, quota_reset_timezone, updated_at
+		FROM ban_config WHERE id = 1`).Scan(
+		&cfg.RateLimitBan, &cfg.RateLimitBanMinutes, &cfg.ErrorBan, &cfg.ErrorBanMinutes, &cfg.UnbanCheckMinutes, &cfg.QuotaResetHour, &cfg.QuotaResetTimezone, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if updatedAt.Valid {
+		cfg.UpdatedAt = &updatedAt.Time
+	}
+	return cfg, nil
+}
+
+func (d *Database) UpdateBanConfig(cfg *models.BanConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+		UPDATE ban_config SET rate_limit_ban = ?, rate_limit_ban_minutes = ?, error_ban = ?, error_ban_minutes = ?,
+			unban_check_minutes = ?, quota_reset_hour = ?, quota_reset_timezone = ?,
+			updated_at = CURRENT_TIMESTAMP WHERE id = 1`,
+		cfg.RateLimitBan, cfg.RateLimitBanMinutes, cfg.ErrorBan, cfg.ErrorBanMinutes, cfg.UnbanCheckMinutes, cfg.QuotaResetHour, cfg.QuotaResetTimezone)
+	return err
+}
+
+// ========== Key Webhooks ==========
+
+// GetKeyWebhook returns nil when the key has no callback registered
+func (d *Database) GetKeyWebhook(keyID string) (*models.KeyWebhook, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	hook := &models.KeyWebhook{}
+	var updatedAt sql.NullTime
+	err := d.db.QueryRow(`SELECT key_id, url, secret, updated_at FROM key_webhooks WHERE key_id = ?`, keyID).
+		Scan(&hook.KeyID, &hook.URL, &hook.Secret, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if updatedAt.Valid {
+		hook.UpdatedAt = &updatedAt.Time
+	}
+	return hook, nil
+}
+
+func (d *Database) SetKeyWebhook(hook *models.KeyWebhook) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`
+		INSERT INTO key_webhooks (key_id, url, secret, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key_id) DO UPDATE SET url = excluded.url, secret = excluded.secret,
+			updated_at = CURRENT_TIMESTAMP`,
+		hook.KeyID, hook.URL, hook.Secret)
+	return err
+}
+
+func (d *Database) DeleteKeyWebhook(keyID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`DELETE FROM key_webhooks WHERE key_id = ?`, keyID)
+	return err
+}
+
+// ========== Token Groups ==========
+
+const tokenGroupColumns = `id, name, description, models, image_concurrency, video_concurrency,
+	daily_image_limit, daily_video_limit, created_at`
+
+// scanTokenGroup reads a group row; models is stored as comma-separated globs
+func scanTokenGroup(row rowScanner) (*models.TokenGroup, error) {
+	group := &models.TokenGroup{Models: []string{}}
+	var description, patterns sql.NullString
+	var createdAt sql.NullTime
+	if err := row.Scan(&group.ID, &group.Name, &description, &patterns, &group.ImageConcurrency, &group.VideoConcurrency,
+		&group.DailyImageLimit, &group.DailyVideoLimit, &createdAt); err != nil {
+		return nil, err
+	}
+	group.Description = description.String
+	if patterns.String != "" {
+		group.Models = strings.Split(patterns.String, ",")
+	}
+	if createdAt.Valid {
+		group.CreatedAt = &createdAt.Time
+	}
+	return group, nil
+}
+
+func (d *Database) GetTokenGroups() ([]*models.TokenGroup, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT ` + tokenGroupColumns + ` FROM token_groups ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*models.TokenGroup{}
+	for rows.Next() {
+		group, err := scanTokenGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+// GetTokenGroup returns nil when no group has the given ID
+func (d *Database) GetTokenGroup(id int64) (*models.TokenGroup, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	group, err := scanTokenGroup(d.db.QueryRow(`SELECT `+tokenGroupColumns+` FROM token_groups WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return group, err
+}
+
+func (d *Database) AddTokenGroup(group *models.TokenGroup) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`INSERT INTO token_groups (name, description, models, image_concurrency, video_concurrency,
+		daily_image_limit, daily_video_limit) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		group.Name, group.Description, strings.Join(group.Models, ","), group.ImageConcurrency, group.VideoConcurrency,
+		group.DailyImageLimit, group.DailyVideoLimit)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func (d *Database) UpdateTokenGroup(group *models.TokenGroup) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE token_groups SET name = ?, description = ?, models = ?, image_concurrency = ?,
+		video_concurrency = ?, daily_image_limit = ?, daily_video_limit = ? WHERE id = ?`,
+		group.Name, group.Description, strings.Join(group.Models, ","), group.ImageConcurrency, group.VideoConcurrency,
+		group.DailyImageLimit, group.DailyVideoLimit, group.ID)
+	return err
+}
+
+// DeleteTokenGroup removes a group and returns its tokens and keys to the
+// shared pool
+func (d *Database) DeleteTokenGroup(id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`UPDATE tokens SET group_id = 0 WHERE group_id = ?`,
+		`UPDATE api_keys SET token_group_id = 0 WHERE token_group_id = ?`,
+		`DELETE FROM token_groups WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ========== Admin Sessions ==========
+
+func (d *Database) AddAdminSession(session *models.AdminSession) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`
+		INSERT INTO admin_sessions (token_hash, username, ip, user_agent, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		session.TokenHash, session.Username, session.IP, session.UserAgent,
+		session.CreatedAt.UTC(), session.LastSeenAt.UTC(), session.ExpiresAt.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+const adminSessionColumns = `id, token_hash, username, ip, user_agent, created_at, last_seen_at, expires_at`
+
+func scanAdminSession(row interface{ Scan(...interface{}) error }) (*models.AdminSession, error) {
+	session := &models.AdminSession{}
+	var ip, userAgent sql.NullString
+	if err := row.Scan(&session.ID, &session.TokenHash, &session.Username, &ip, &userAgent,
+		&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt); err != nil {
+		return nil, err
+	}
+	session.IP, session.UserAgent = ip.String, userAgent.String
+	return session, nil
+}
+
+// GetAdminSessionByHash returns nil when no session has the token digest
+func (d *Database) GetAdminSessionByHash(tokenHash string) (*models.AdminSession, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	session, err := scanAdminSession(d.db.QueryRow(`SELECT `+adminSessionColumns+` FROM admin_sessions WHERE token_hash = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return session, err
+}
+
+// GetAdminSessions lists the sessions that have not expired, most recently
+// used first
+func (d *Database) GetAdminSessions() ([]*models.AdminSession, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	rows, err := d.db.Query(`SELECT `+adminSessionColumns+` FROM admin_sessions WHERE expires_at > ? ORDER BY last_seen_at DESC`, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*models.AdminSession{}
+	for rows.Next() {
+		session, err := scanAdminSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// TouchAdminSession records a use of the session and moves its expiry
+func (d *Database) TouchAdminSession(id int64, lastSeen, expires time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`UPDATE admin_sessions SET last_seen_at = ?, expires_at = ? WHERE id = ?`, lastSeen.UTC(), expires.UTC(), id)
+	return err
+}
+
+func (d *Database) DeleteAdminSession(id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM admin_sessions WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (d *Database) DeleteAllAdminSessions() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`DELETE FROM admin_sessions`)
+	return err
+}
+
+// DeleteExpiredAdminSessions removes sessions past their expiry
+func (d *Database) DeleteExpiredAdminSessions() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`DELETE FROM admin_sessions WHERE expires_at <= ?`, time.Now().UTC())
+	return err
+}
+
+// ========== Media Shares ==========
+
+func (d *Database) AddMediaShare(share *models.MediaShare) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, err := d.db.Exec(`INSERT INTO media_shares (token, file_id, password_hash, expires_at) VALUES (?, ?, ?, ?)`,
+		share.Token, share.FileID, share.PasswordHash, share.ExpiresAt.UTC())
+	return err
+}
+
+// GetMediaShare returns nil when the token is unknown; expired shares are
+// returned so callers can tell them apart
+func (d *Database) GetMediaShare(token string) (*models.MediaShare, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	share := &models.MediaShare{}
+	var passwordHash sql.NullString
+	var createdAt sql.NullTime
+	err := d.db.QueryRow(`SELECT token, file_id, password_hash, expires_at, created_at FROM media_shares WHERE token = ?`, token).
+		Scan(&share.Token, &share.FileID, &passwordHash, &share.ExpiresAt, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	share.PasswordHash = passwordHash.String
+	if createdAt.Valid {
+		share.CreatedAt = &createdAt.Time
+	}
+	return share, nil
+}
+
+// DeleteExpiredMediaShares removes shares past their expiry and returns how many
+func (d *Database) DeleteExpiredMediaShares() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result, err := d.db.Exec(`DELETE FROM media_shares WHERE expires_at <= ?`, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,156 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// JPEG markers
+const (
+	markerSOS  = 0xDA // start of scan; entropy-coded data follows
+	markerAPP0 = 0xE0 // JFIF
+	markerAPP1 = 0xE1 // EXIF and XMP
+	markerIPTC = 0xED // APP13, Photoshop IPTC
+	markerCOM  = 0xFE // comment
+)
+
+// jpegSegments calls fn for each marker segment before the scan data with
+// the segment's marker and its bytes including the marker. It stops at the
+// start of scan and returns the offset of the SOS marker, or -1 when the
+// data is not a well-formed JPEG.
+func jpegSegments(data []byte, fn func(marker byte, segment []byte)) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return -1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return -1
+		}
+		marker := data[pos+1]
+		if marker == 0xFF { // fill byte
+			pos++
+			continue
+		}
+		if marker == markerSOS {
+			return pos
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return -1
+		}
+		fn(marker, data[pos:end])
+		pos = end
+	}
+	return -1
+}
+
+// stripJPEGMetadata drops EXIF, XMP, IPTC and comment segments. Color
+// profiles and the other segments needed to decode are kept; malformed data
+// is returned unchanged.
+func stripJPEGMetadata(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	sos := jpegSegments(data, func(marker byte, segment []byte) {
+		if marker == markerAPP1 || marker == markerIPTC || marker == markerCOM {
+			return
+		}
+		out = append(out, segment...)
+	})
+	if sos < 0 {
+		return data
+	}
+	return append(out, data[sos:]...)
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, 1 when it
+// has none
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	jpegSegments(data, func(marker byte, segment []byte) {
+		if marker != markerAPP1 || len(segment) < 4 {
+			return
+		}
+		if o := exifOrientation(segment[4:]); o != 0 {
+			orientation = o
+		}
+	})
+	return orientation
+}
+
+// exifOrientation reads the orientation tag from an APP1 payload, 0 when
+// it is absent or invalid
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orient applies an EXIF orientation so the pixels display upright
+func orient(src image.Image, orientation int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flipped
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotate 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotate 90° counter-clockwise
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,112 @@
+package imageproc
+
+import (
+	"image"
+	"image/color"
+	"unicode"
+)
+
+// glyphs is a 5x7 bitmap font; each row keeps its pixels in the low five
+// bits, leftmost first. Lowercase letters are drawn as capitals and other
+// characters as '?'.
+var glyphs = map[rune][7]uint8{
+	' ':  {},
+	'A':  {0x0E, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'B':  {0x1E, 0x11, 0x11, 0x1E, 0x11, 0x11, 0x1E},
+	'C':  {0x0E, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0E},
+	'D':  {0x1C, 0x12, 0x11, 0x11, 0x11, 0x12, 0x1C},
+	'E':  {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x1F},
+	'F':  {0x1F, 0x10, 0x10, 0x1E, 0x10, 0x10, 0x10},
+	'G':  {0x0E, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0F},
+	'H':  {0x11, 0x11, 0x11, 0x1F, 0x11, 0x11, 0x11},
+	'I':  {0x0E, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'J':  {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0C},
+	'K':  {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L':  {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1F},
+	'M':  {0x11, 0x1B, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N':  {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O':  {0x0E, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'P':  {0x1E, 0x11, 0x11, 0x1E, 0x10, 0x10, 0x10},
+	'Q':  {0x0E, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0D},
+	'R':  {0x1E, 0x11, 0x11, 0x1E, 0x14, 0x12, 0x11},
+	'S':  {0x0F, 0x10, 0x10, 0x0E, 0x01, 0x01, 0x1E},
+	'T':  {0x1F, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0E},
+	'V':  {0x11, 0x11, 0x11, 0x11, 0x11, 0x0A, 0x04},
+	'W':  {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0A},
+	'X':  {0x11, 0x11, 0x0A, 0x04, 0x0A, 0x11, 0x11},
+	'Y':  {0x11, 0x11, 0x0A, 0x04, 0x04, 0x04, 0x04},
+	'Z':  {0x1F, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1F},
+	'0':  {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1':  {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2':  {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3':  {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4':  {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5':  {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6':  {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7':  {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8':  {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9':  {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	'.':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C},
+	',':  {0x00, 0x00, 0x00, 0x00, 0x0C, 0x04, 0x08},
+	'-':  {0x00, 0x00, 0x00, 0x1F, 0x00, 0x00, 0x00},
+	'_':  {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1F},
+	':':  {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	'!':  {0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04},
+	'?':  {0x0E, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+	'\'': {0x04, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00},
+	'/':  {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'(':  {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')':  {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	'&':  {0x0C, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0D},
+	'@':  {0x0E, 0x11, 0x01, 0x0D, 0x15, 0x15, 0x0E},
+	'#':  {0x0A, 0x0A, 0x1F, 0x0A, 0x1F, 0x0A, 0x0A},
+	'+':  {0x00, 0x04, 0x04, 0x1F, 0x04, 0x04, 0x00},
+}
+
+const (
+	glyphWidth   = 5
+	glyphHeight  = 7
+	glyphSpacing = 1
+	labelPadding = 2
+)
+
+// TextMark renders text as a label, white on a translucent dark band, for
+// Watermark. Each font pixel becomes a pixelSize square.
+func TextMark(text string, pixelSize int) image.Image {
+	runes := []rune(text)
+	pixelSize = max(pixelSize, 1)
+	width := 2*labelPadding + len(runes)*(glyphWidth+glyphSpacing) - glyphSpacing
+	height := 2*labelPadding + glyphHeight
+	dst := image.NewRGBA(image.Rect(0, 0, max(width, 1)*pixelSize, height*pixelSize))
+
+	band := color.RGBA{0, 0, 0, 0x80}
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = band.R, band.G, band.B, band.A
+	}
+
+	for n, r := range runes {
+		glyph, ok := glyphs[unicode.ToUpper(r)]
+		if !ok {
+			glyph = glyphs['?']
+		}
+		left := labelPadding + n*(glyphWidth+glyphSpacing)
+		for row, bits := range glyph {
+			for col := 0; col < glyphWidth; col++ {
+				if bits&(1<<(glyphWidth-1-col)) == 0 {
+					continue
+				}
+				fillSquare(dst, (left+col)*pixelSize, (labelPadding+row)*pixelSize, pixelSize, color.RGBA{0xFF, 0xFF, 0xFF, 0xFF})
+			}
+		}
+	}
+	return dst
+}
+
+func fillSquare(dst *image.RGBA, x, y, size int, c color.RGBA) {
+	for dy := 0; dy < size; dy++ {
+		for dx := 0; dx < size; dx++ {
+			dst.SetRGBA(x+dx, y+dy, c)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Package imageproc inspects and adjusts client-supplied images before they
+// are uploaded to Flow, and stamps generated ones with a watermark
+package imageproc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// MaxPixels caps the size of images that are decoded; a small compressed file
+// can otherwise expand to gigabytes of pixels
+const MaxPixels = 40_000_000
+
+// checkPixels rejects images over MaxPixels
+func checkPixels(cfg image.Config) error {
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return fmt.Errorf("image is %dx%d, over the %d megapixel limit", cfg.Width, cfg.Height, MaxPixels/1_000_000)
+	}
+	return nil
+}
+
+// decode decodes an image after checking its size from the header
+func decode(data []byte) (image.Image, string, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported image: %w", err)
+	}
+	if err := checkPixels(cfg); err != nil {
+		return nil, "", err
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported image: %w", err)
+	}
+	return src, format, nil
+}
+
+// Dimensions returns an image's size without decoding its pixels
+func Dimensions(data []byte) (width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, fmt.Errorf("unsupported image: %w", err)
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// CropToRatio center-crops an image to width:height = ratioW:ratioH. PNG input
+// stays PNG; everything else is re-encoded as JPEG.
+func CropToRatio(data []byte, ratioW, ratioH int) ([]byte, error) {
+	src, format, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	cropW, cropH := width, width*ratioH/ratioW
+	if cropH > height {
+		cropW, cropH = height*ratioW/ratioH, height
+	}
+	if cropW == width && cropH == height {
+		return data, nil
+	}
+
+	offset := image.Pt(bounds.Min.X+(width-cropW)/2, bounds.Min.Y+(height-cropH)/2)
+	dst := image.NewRGBA(image.Rect(0, 0, cropW, cropH))
+	draw.Draw(dst, dst.Bounds(), src, offset, draw.Src)
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 92})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cropped image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// PrepareOptions controls Prepare
+type PrepareOptions struct {
+	MaxSide int  // longest side in pixels; larger images are downscaled, 0 keeps the size
+	JPEG    bool // re-encode PNG and GIF as JPEG
+}
+
+// Prepare readies an image for upload: EXIF orientation is applied to the
+// pixels, metadata such as EXIF and XMP is dropped, and the image is resized
+// and converted as opts ask. JPEGs that need no pixel changes keep their
+// encoded data and only lose the metadata segments.
+func Prepare(data []byte, opts PrepareOptions) ([]byte, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image: %w", err)
+	}
+	if err := checkPixels(cfg); err != nil {
+		return nil, err
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	longer := max(cfg.Width, cfg.Height)
+	resize := opts.MaxSide > 0 && longer > opts.MaxSide
+	convert := opts.JPEG && format != "jpeg"
+	if !resize && !convert && orientation == 1 {
+		if format == "jpeg" {
+			return stripJPEGMetadata(data), nil
+		}
+		return data, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unsupported image: %w", err)
+	}
+	var dst image.Image = src
+	if orientation != 1 {
+		dst = orient(src, orientation)
+	}
+	if resize {
+		b := dst.Bounds()
+		dst = downscale(dst, b.Dx()*opts.MaxSide/longer, b.Dy()*opts.MaxSide/longer)
+	}
+
+	var buf bytes.Buffer
+	if format == "png" && !opts.JPEG {
+		err = png.Encode(&buf, dst)
+	} else {
+		// JPEG has no alpha channel; composite onto white
+		flat := image.NewRGBA(dst.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), dst, dst.Bounds().Min, draw.Over)
+		err = jpeg.Encode(&buf, flat, &jpeg.Options{Quality: 92})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// downscale shrinks src to width x height, averaging the source pixels that
+// fall in each destination pixel
+func downscale(src image.Image, width, height int) *image.RGBA {
+	width, height = max(width, 1), max(height, 1)
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		y0, y1 := bounds.Min.Y+y*srcH/height, bounds.Min.Y+max((y+1)*srcH/height, y*srcH/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := bounds.Min.X+x*srcW/width, bounds.Min.X+max((x+1)*srcW/width, x*srcW/width+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n >> 8)
+			dst.Pix[i+1] = uint8(g / n >> 8)
+			dst.Pix[i+2] = uint8(b / n >> 8)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
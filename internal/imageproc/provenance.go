@@ -0,0 +1,221 @@
+package imageproc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Provenance describes how a generated image came to be
+type Provenance struct {
+	Model        string
+	PromptSHA256 string // hex SHA-256 of the prompt; empty when there was none
+	TaskID       string
+	Instance     string // flow2api instance that generated the image
+	Created      time.Time
+	Manifest     bool // also embed a C2PA-style manifest
+}
+
+const (
+	xmpNamespace     = "http://ns.adobe.com/xap/1.0/"
+	xmpPNGKeyword    = "XML:com.adobe.xmp"
+	flow2apiXMPSpace = "https://github.com/XxxXTeam/flow2api/xmp/1.0/"
+
+	// digitalSourceType is the IPTC term for media made by a generative model
+	digitalSourceType = "http://cv.iptc.org/newscodes/digitalsourcetype/trainedAlgorithmicMedia"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// EmbedProvenance writes p into a PNG or JPEG as an XMP packet, replacing
+// any XMP the image carried. Other formats are returned unchanged. The
+// manifest's hash covers the image without the packet, so removing it gives
+// back bytes that verify.
+func EmbedProvenance(data []byte, p Provenance) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		data = stripPNGXMP(data)
+		return embedPNGXMP(data, provenanceXMP(data, "image/png", p))
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		data = stripJPEGXMP(data)
+		return embedJPEGXMP(data, provenanceXMP(data, "image/jpeg", p))
+	}
+	return data, nil
+}
+
+// provenanceXMP renders the XMP packet for an image
+func provenanceXMP(data []byte, format string, p Provenance) []byte {
+	var b bytes.Buffer
+	attr := func(name, value string) {
+		if value == "" {
+			return
+		}
+		b.WriteString("\n   " + name + `="`)
+		xml.EscapeText(&b, []byte(value))
+		b.WriteString(`"`)
+	}
+
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"")
+	attr("xmlns:xmp", xmpNamespace)
+	attr("xmlns:Iptc4xmpExt", "http://iptc.org/std/Iptc4xmpExt/2008-02-29/")
+	attr("xmlns:flow2api", flow2apiXMPSpace)
+	attr("xmp:CreatorTool", "flow2api")
+	attr("xmp:CreateDate", p.Created.UTC().Format(time.RFC3339))
+	attr("Iptc4xmpExt:DigitalSourceType", digitalSourceType)
+	attr("flow2api:Model", p.Model)
+	attr("flow2api:PromptSHA256", p.PromptSHA256)
+	attr("flow2api:TaskID", p.TaskID)
+	attr("flow2api:Instance", p.Instance)
+	if p.Manifest {
+		b.WriteString(">\n   <flow2api:Manifest>")
+		xml.EscapeText(&b, provenanceManifest(data, format, p))
+		b.WriteString("</flow2api:Manifest>\n  </rdf:Description>\n")
+	} else {
+		b.WriteString("/>\n")
+	}
+	b.WriteString(" </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"r\"?>")
+	return b.Bytes()
+}
+
+// provenanceManifest is an unsigned manifest shaped like a C2PA claim: a
+// creation action by the model and a hash of the image
+func provenanceManifest(data []byte, format string, p Provenance) []byte {
+	sum := sha256.Sum256(data)
+	manifest := map[string]interface{}{
+		"claim_generator": "flow2api",
+		"format":          format,
+		"assertions": []interface{}{
+			map[string]interface{}{
+				"label": "c2pa.actions",
+				"data": map[string]interface{}{
+					"actions": []interface{}{map[string]interface{}{
+						"action":            "c2pa.created",
+						"when":              p.Created.UTC().Format(time.RFC3339),
+						"softwareAgent":     p.Model,
+						"digitalSourceType": digitalSourceType,
+					}},
+				},
+			},
+			map[string]interface{}{
+				"label": "c2pa.hash.data",
+				"data":  map[string]interface{}{"alg": "sha256", "hash": base64.StdEncoding.EncodeToString(sum[:])},
+			},
+		},
+	}
+	encoded, _ := json.Marshal(manifest)
+	return encoded
+}
+
+// pngChunks calls fn for each chunk with its type and its bytes including
+// length and CRC. It returns false when the data is not a well-formed PNG.
+func pngChunks(data []byte, fn func(kind string, chunk []byte)) bool {
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if end > len(data) {
+			return false
+		}
+		fn(string(data[pos+4:pos+8]), data[pos:end])
+		pos = end
+	}
+	return pos == len(data)
+}
+
+func isPNGXMP(chunk []byte) bool {
+	return string(chunk[4:8]) == "iTXt" && bytes.HasPrefix(chunk[8:], []byte(xmpPNGKeyword+"\x00"))
+}
+
+// stripPNGXMP drops XMP chunks; malformed data is returned unchanged
+func stripPNGXMP(data []byte) []byte {
+	out := append([]byte{}, pngSignature...)
+	if !pngChunks(data, func(kind string, chunk []byte) {
+		if !isPNGXMP(chunk) {
+			out = append(out, chunk...)
+		}
+	}) {
+		return data
+	}
+	return out
+}
+
+// embedPNGXMP adds an uncompressed iTXt chunk with the packet right after
+// the header chunk
+func embedPNGXMP(data, packet []byte) ([]byte, error) {
+	payload := append([]byte(xmpPNGKeyword), 0, 0, 0, 0, 0) // no compression, no language or translation
+	payload = append(payload, packet...)
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], "iTXt")
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	out := make([]byte, 0, len(data)+len(chunk))
+	out = append(out, pngSignature...)
+	ok := pngChunks(data, func(kind string, c []byte) {
+		out = append(out, c...)
+		if kind == "IHDR" {
+			out = append(out, chunk...)
+		}
+	})
+	if !ok {
+		return nil, fmt.Errorf("malformed PNG")
+	}
+	return out, nil
+}
+
+func isJPEGXMP(marker byte, segment []byte) bool {
+	return marker == markerAPP1 && bytes.HasPrefix(segment[4:], []byte(xmpNamespace+"\x00"))
+}
+
+// stripJPEGXMP drops XMP segments; malformed data is returned unchanged
+func stripJPEGXMP(data []byte) []byte {
+	out := append([]byte{}, 0xFF, 0xD8)
+	sos := jpegSegments(data, func(marker byte, segment []byte) {
+		if !isJPEGXMP(marker, segment) {
+			out = append(out, segment...)
+		}
+	})
+	if sos < 0 {
+		return data
+	}
+	return append(out, data[sos:]...)
+}
+
+// embedJPEGXMP adds an APP1 segment with the packet after the JFIF header
+func embedJPEGXMP(data, packet []byte) ([]byte, error) {
+	payload := append([]byte(xmpNamespace+"\x00"), packet...)
+	if len(payload)+2 > 0xFFFF {
+		return nil, fmt.Errorf("XMP packet too large for a JPEG segment")
+	}
+	segment := []byte{0xFF, markerAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := make([]byte, 0, len(data)+len(segment))
+	out = append(out, 0xFF, 0xD8)
+	inserted := false
+	sos := jpegSegments(data, func(marker byte, s []byte) {
+		if !inserted && marker != markerAPP0 {
+			out = append(out, segment...)
+			inserted = true
+		}
+		out = append(out, s...)
+	})
+	if sos < 0 {
+		return nil, fmt.Errorf("malformed JPEG")
+	}
+	if !inserted {
+		out = append(out, segment...)
+	}
+	return append(out, data[sos:]...), nil
+}
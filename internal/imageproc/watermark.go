@@ -0,0 +1,92 @@
+package imageproc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+)
+
+// WatermarkOptions controls Watermark
+type WatermarkOptions struct {
+	Position string  // top-left, top-right, bottom-left, bottom-right or center
+	Opacity  float64 // 0 to 1
+	Scale    float64 // mark width as a fraction of the image width
+}
+
+// Watermark draws mark over an image, scaled to opts.Scale of its width and
+// kept off the edges by a small margin. PNG stays PNG; everything else is
+// re-encoded as JPEG.
+func Watermark(data []byte, mark image.Image, opts WatermarkOptions) ([]byte, error) {
+	src, format, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+
+	markBounds := mark.Bounds()
+	width := max(int(float64(bounds.Dx())*opts.Scale), 1)
+	height := max(width*markBounds.Dy()/markBounds.Dx(), 1)
+	if height > bounds.Dy() {
+		height = bounds.Dy()
+		width = max(height*markBounds.Dx()/markBounds.Dy(), 1)
+	}
+	scaled := resize(mark, width, height)
+
+	at := Placement(dst.Bounds().Size(), image.Pt(width, height), opts.Position)
+	alpha := image.NewUniform(color.Alpha{uint8(math.Round(opts.Opacity * 255))})
+	draw.DrawMask(dst, image.Rectangle{Min: at, Max: at.Add(image.Pt(width, height))}, scaled, scaled.Bounds().Min, alpha, image.Point{}, draw.Over)
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 92})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode watermarked image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Placement returns where a mark of size goes on a canvas at position,
+// keeping a margin of 2% of the canvas's shorter side from the edges
+func Placement(canvas, size image.Point, position string) image.Point {
+	margin := max(min(canvas.X, canvas.Y)/50, 1)
+	left, top := margin, margin
+	right, bottom := canvas.X-size.X-margin, canvas.Y-size.Y-margin
+	switch position {
+	case "top-left":
+		return image.Pt(left, top)
+	case "top-right":
+		return image.Pt(right, top)
+	case "bottom-left":
+		return image.Pt(left, bottom)
+	case "center":
+		return image.Pt((canvas.X-size.X)/2, (canvas.Y-size.Y)/2)
+	}
+	return image.Pt(right, bottom)
+}
+
+// resize scales src to width x height; shrinking averages pixels, enlarging
+// repeats them so bitmap text stays sharp
+func resize(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	if width <= bounds.Dx() && height <= bounds.Dy() {
+		return downscale(src, width, height)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,142 @@
+// Package lifecycle reports the process state to process managers, through a
+// JSON status file and systemd's sd_notify protocol, so restarts can wait for
+// long-running generations to finish
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Process states
+const (
+	StateStarting = "starting"
+	StateReady    = "ready"
+	StateDraining = "draining" // no new generations are accepted
+	StateStopped  = "stopped"
+)
+
+// Status is the content of the status file
+type Status struct {
+	State             string     `json:"state"`
+	PID               int        `json:"pid"`
+	StartedAt         time.Time  `json:"started_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	ActiveGenerations int        `json:"active_generations"`
+	QueuedGenerations int        `json:"queued_generations"`
+	DrainDeadline     *time.Time `json:"drain_deadline,omitempty"`
+}
+
+// Reporter publishes state changes. Without a status file path or a
+// NOTIFY_SOCKET it does nothing.
+type Reporter struct {
+	path   string
+	socket string
+
+	mu     sync.Mutex
+	status Status
+}
+
+// NewReporter creates a reporter writing to path, which may be empty
+func NewReporter(path string) *Reporter {
+	now := time.Now().UTC()
+	return &Reporter{
+		path:   path,
+		socket: os.Getenv("NOTIFY_SOCKET"),
+		status: Status{State: StateStarting, PID: os.Getpid(), StartedAt: now, UpdatedAt: now},
+	}
+}
+
+// Update records the state and generation counts. Entering StateDraining sets
+// the deadline by which running generations are abandoned.
+func (r *Reporter) Update(state string, active, queued int, drainDeadline time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.status.State
+	r.status.State = state
+	r.status.ActiveGenerations = active
+	r.status.QueuedGenerations = queued
+	r.status.UpdatedAt = time.Now().UTC()
+	r.status.DrainDeadline = nil
+	if state == StateDraining && !drainDeadline.IsZero() {
+		deadline := drainDeadline.UTC()
+		r.status.DrainDeadline = &deadline
+	}
+
+	if err := r.writeFile(); err != nil {
+		return err
+	}
+	return r.notify(previous)
+}
+
+// writeFile replaces the status file atomically so readers never see a
+// partial document
+func (r *Reporter) writeFile() error {
+	if r.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r.status, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), ".status-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// notify sends the state to systemd. READY=1 and STOPPING=1 go out once, on
+// the transition; while draining, each update extends the stop timeout to
+// the drain deadline so systemd does not kill the process early.
+func (r *Reporter) notify(previous string) error {
+	if r.socket == "" {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("STATUS=%s: %d running, %d queued",
+		r.status.State, r.status.ActiveGenerations, r.status.QueuedGenerations)}
+	switch r.status.State {
+	case StateReady:
+		if previous != StateReady {
+			lines = append(lines, "READY=1")
+		}
+	case StateDraining:
+		if previous != StateDraining {
+			lines = append(lines, "STOPPING=1")
+		}
+		if d := r.status.DrainDeadline; d != nil {
+			if remaining := time.Until(*d); remaining > 0 {
+				lines = append(lines, fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", remaining.Microseconds()+int64(10*time.Second/time.Microsecond)))
+			}
+		}
+	}
+
+	// A leading @ names a socket in the abstract namespace
+	name := r.socket
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(lines, "\n")))
+	return err
+}
@@ -0,0 +1,116 @@
+// Package logging provides the process-wide structured logger. Loggers are
+// handed out per component before the configuration is read, so the output
+// format and level can be chosen at startup and the level changed later.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"flow2api/internal/config"
+)
+
+var (
+	level slog.LevelVar
+	root  atomic.Pointer[slog.Handler]
+)
+
+func init() {
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &level})
+	root.Store(&h)
+	slog.SetDefault(slog.New(&handler{}))
+}
+
+// Setup selects the output format ("text" or "json") and applies the level
+// from cfg. Messages written with the standard log package are routed through
+// the same handler at info level.
+func Setup(cfg config.DebugConfig, w io.Writer) {
+	opts := &slog.HandlerOptions{Level: &level}
+	var h slog.Handler
+	if cfg.LogFormat == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	root.Store(&h)
+	Apply(cfg)
+}
+
+// Apply sets the minimum level from cfg; debug mode always logs at debug
+func Apply(cfg config.DebugConfig) {
+	if cfg.Enabled {
+		level.Set(slog.LevelDebug)
+		return
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		l = slog.LevelInfo
+	}
+	level.Set(l)
+}
+
+// Component returns a logger whose records carry component=name
+func Component(name string) *slog.Logger {
+	return slog.Default().With("component", name)
+}
+
+// handler forwards records to the current root handler, replaying the
+// attributes and groups added to it with With and WithGroup
+type handler struct {
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) current() slog.Handler {
+	next := *root.Load()
+	for _, op := range h.ops {
+		next = op(next)
+	}
+	return next
+}
+
+func (h *handler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	return h.current().Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) slog.Handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{ops: append(ops, op)}
+}
+
+// Mask shortens a secret to its first and last characters
+func Mask(secret string) string {
+	if len(secret) <= 12 {
+		return strings.Repeat("*", len(secret))
+	}
+	return secret[:6] + "..." + secret[len(secret)-4:]
+}
+
+// secretField matches JSON string fields whose name mentions a token or
+// secret, such as access_token, recaptchaToken or clientKey
+var secretField = regexp.MustCompile(`("[A-Za-z_]*(?i:token|secret|password|cookie|clientkey|apikey)[A-Za-z_]*"\s*:\s*")([^"]*)(")`)
+
+// MaskSecrets masks the values of token-like fields in a JSON document
+func MaskSecrets(body string) string {
+	return secretField.ReplaceAllStringFunc(body, func(field string) string {
+		parts := secretField.FindStringSubmatch(field)
+		return parts[1] + Mask(parts[2]) + parts[3]
+	})
+}
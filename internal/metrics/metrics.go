@@ -0,0 +1,146 @@
+// Package metrics keeps process metrics and writes them in the Prometheus
+// text exposition format
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Histogram counts observations into cumulative buckets, one series per
+// combination of label values
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*Histogram
+)
+
+// NewHistogram creates and registers a histogram with the given upper bucket
+// bounds, in increasing order
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*series)}
+	registryMu.Lock()
+	registry = append(registry, h)
+	registryMu.Unlock()
+	return h
+}
+
+// Observe records v under the label values, given in the order of the labels
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &series{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		labels := h.labelPairs(s.values)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.name, joinLabels(labels, `le="`+formatFloat(bound)+`"`), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.name, joinLabels(labels, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, braced(labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, braced(labels), s.count)
+	}
+}
+
+func (h *Histogram) labelPairs(values []string) string {
+	pairs := make([]string, len(h.labels))
+	for i, label := range h.labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = label + `="` + escapeLabel(value) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Write writes every registered metric in the Prometheus text format
+func Write(w io.Writer) {
+	registryMu.Lock()
+	histograms := append([]*Histogram(nil), registry...)
+	registryMu.Unlock()
+
+	for _, h := range histograms {
+		h.write(w)
+	}
+}
+
+// ContentType is the media type of Write's output
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
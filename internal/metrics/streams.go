@@ -0,0 +1,37 @@
+package metrics
+
+import "time"
+
+var (
+	streamDuration = NewHistogram("flow2api_stream_duration_seconds",
+		"How long SSE responses stay open, by route and model.",
+		[]float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600}, "route", "model")
+	streamChunks = NewHistogram("flow2api_stream_chunks",
+		"Chunks written per SSE response, by route and model.",
+		[]float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}, "route", "model")
+)
+
+// Stream measures one SSE response. It is used by the goroutine writing the
+// response only.
+type Stream struct {
+	route  string
+	model  string
+	start  time.Time
+	chunks int
+}
+
+// StartStream starts measuring a response on route for model
+func StartStream(route, model string) *Stream {
+	return &Stream{route: route, model: model, start: time.Now()}
+}
+
+// Chunk counts one chunk written to the client
+func (s *Stream) Chunk() {
+	s.chunks++
+}
+
+// Done records the stream once it has ended
+func (s *Stream) Done() {
+	streamDuration.Observe(time.Since(s.start).Seconds(), s.route, s.model)
+	streamChunks.Observe(float64(s.chunks), s.route, s.model)
+}
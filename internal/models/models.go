@@ -1,7 +1,16 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // Token represents a Flow API token
@@ -27,6 +36,54 @@ type Token struct {
 	VideoConcurrency   int        `json:"video_concurrency"`
 	BanReason          string     `json:"ban_reason,omitempty"`
 	BannedAt           *time.Time `json:"banned_at,omitempty"`
+	GroupID            int64      `json:"group_id"`          // token group; 0 is the shared pool
+	DailyImageLimit    int        `json:"daily_image_limit"` // images per day; 0 is unlimited
+	DailyVideoLimit    int        `json:"daily_video_limit"` // videos per day; 0 is unlimited
+	Version            int64      `json:"version"`           // bumped by every admin edit
+}
+
+// Reasons a token was banned; a ban disables the token until it is lifted
+const (
+	BanReasonRateLimit = "429_rate_limit"   // the upstream answered 429
+	BanReasonErrors    = "error_threshold"  // error_ban_threshold consecutive errors
+	BanReasonQuota     = "quota_exhausted"  // the daily quota is used up
+	BanReasonRelogin   = "relogin_required" // the upstream rejected the session
+)
+
+// DailyUsage counts a token's generations today
+type DailyUsage struct {
+	GroupID int64 // the token's group now, 0 when it was deleted
+	Images  int
+	Videos  int
+}
+
+// TokenGroup is a pool of tokens reserved for the API keys bound to it and for
+// the models matching its glob patterns. Tokens outside any group serve every
+// other request. The limits apply to the group's tokens together, on top of
+// each token's own.
+type TokenGroup struct {
+	ID               int64      `json:"id"`
+	Name             string     `json:"name"`
+	Description      string     `json:"description,omitempty"`
+	Models           []string   `json:"models"`
+	ImageConcurrency int        `json:"image_concurrency"` // -1 is unlimited
+	VideoConcurrency int        `json:"video_concurrency"` // -1 is unlimited
+	DailyImageLimit  int        `json:"daily_image_limit"` // images per day; 0 is unlimited
+	DailyVideoLimit  int        `json:"daily_video_limit"` // videos per day; 0 is unlimited
+	CreatedAt        *time.Time `json:"created_at,omitempty"`
+}
+
+// MatchesModel reports whether any of the given names matches one of the
+// group's model patterns; a group without patterns matches nothing
+func (g *TokenGroup) MatchesModel(names ...string) bool {
+	for _, pattern := range g.Models {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // Project represents a Flow project
@@ -38,6 +95,8 @@ type Project struct {
 	ToolName    string     `json:"tool_name"`
 	IsActive    bool       `json:"is_active"`
 	CreatedAt   *time.Time `json:"created_at,omitempty"`
+
+	GenerationCount int `json:"generation_count"` // generations run in the project
 }
 
 // TokenStats represents token usage statistics
@@ -56,20 +115,66 @@ type TokenStats struct {
 	ConsecutiveErrorCount int        `json:"consecutive_error_count"`
 }
 
+// TokenWithStats pairs a token with its usage statistics
+type TokenWithStats struct {
+	Token *Token
+	Stats *TokenStats
+}
+
 // Task represents a generation task
 type Task struct {
-	ID           int64      `json:"id"`
-	TaskID       string     `json:"task_id"`
-	TokenID      int64      `json:"token_id"`
-	Model        string     `json:"model"`
-	Prompt       string     `json:"prompt"`
-	Status       string     `json:"status"` // processing, completed, failed
-	Progress     int        `json:"progress"`
-	ResultURLs   []string   `json:"result_urls,omitempty"`
-	ErrorMessage string     `json:"error_message,omitempty"`
-	SceneID      string     `json:"scene_id,omitempty"`
-	CreatedAt    *time.Time `json:"created_at,omitempty"`
-	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	ID            int64       `json:"id"`
+	TaskID        string      `json:"task_id"`
+	TokenID       int64       `json:"token_id"`
+	Model         string      `json:"model"`
+	Prompt        string      `json:"prompt"`
+	Status        string      `json:"status"` // processing, completed, failed
+	Progress      int         `json:"progress"`
+	ResultURLs    []string    `json:"result_urls,omitempty"`
+	ErrorMessage  string      `json:"error_message,omitempty"`
+	SceneID       string      `json:"scene_id,omitempty"`
+	OperationName string      `json:"operation_name,omitempty"` // upstream video operation
+	MediaID       string      `json:"media_id,omitempty"`       // upstream mediaGenerationId of the result
+	CacheError    string      `json:"cache_error,omitempty"`    // why results are served from upstream instead of the cache
+	Params        *TaskParams `json:"params,omitempty"`
+	CreatedAt     *time.Time  `json:"created_at,omitempty"`
+	CompletedAt   *time.Time  `json:"completed_at,omitempty"`
+
+	// UpstreamStatus is the last video status check, shown to admins only
+	UpstreamStatus *UpstreamStatus `json:"upstream_status,omitempty"`
+}
+
+// UpstreamStatus records the last status check of a video operation, so a
+// failed or timed-out task shows whether Flow kept it pending or reported
+// errors
+type UpstreamStatus struct {
+	Status       string                 `json:"status,omitempty"` // MEDIA_GENERATION_STATUS_*, empty when the check failed
+	Error        string                 `json:"error,omitempty"`  // why the check itself failed
+	Attempt      int                    `json:"attempt"`          // 1-based poll attempt
+	SinceAttempt int                    `json:"since_attempt"`    // first attempt that saw this status
+	CheckedAt    time.Time              `json:"checked_at"`
+	Payload      map[string]interface{} `json:"payload,omitempty"` // the operation, with URLs and secrets stripped
+}
+
+// TaskParams represents the normalized client request stored with a task
+type TaskParams struct {
+	Model          string `json:"model"`
+	Type           string `json:"type"`                 // image or video
+	VideoType      string `json:"video_type,omitempty"` // t2v, i2v, r2v, extend
+	ModelKey       string `json:"model_key"`            // upstream model name or key
+	AspectRatio    string `json:"aspect_ratio"`
+	Seed           int    `json:"seed"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	N              int    `json:"n,omitempty"` // images requested, image models only
+	ResponseFormat string `json:"response_format,omitempty"`
+	ImageCount     int    `json:"image_count"`
+	Stream         bool   `json:"stream"`
+	KeyID          string `json:"key_id,omitempty"`
+	PriorTaskID    string `json:"prior_task_id,omitempty"` // video task being extended
+	Canary         string `json:"canary,omitempty"`        // canary arm when routed by a canary rule
+	Privacy        string `json:"privacy,omitempty"`       // privacy mode applied to the stored prompts
+	SkipCache      bool   `json:"skip_cache,omitempty"`    // results are returned uncached
+	FallbackFrom   string `json:"fallback_from,omitempty"` // video model this image preview stands in for
 }
 
 // AdminConfig represents admin configuration
@@ -79,6 +184,17 @@ type AdminConfig struct {
 	Password          string `json:"password"`
 	APIKey            string `json:"api_key"`
 	ErrorBanThreshold int    `json:"error_ban_threshold"`
+
+	// Key replaced by the last rotation, accepted until PreviousAPIKeyExpires
+	PreviousAPIKey        string     `json:"-"`
+	PreviousAPIKeyExpires *time.Time `json:"previous_api_key_expires_at,omitempty"`
+
+	// Two-factor login; the pending secret awaits its first code
+	TOTPEnabled       bool     `json:"totp_enabled"`
+	TOTPSecret        string   `json:"-"`
+	TOTPPendingSecret string   `json:"-"`
+	TOTPLastStep      int64    `json:"-"` // last accepted time step, refused from then on
+	RecoveryCodes     []string `json:"-"` // SHA-256 hashes of the unused recovery codes
 }
 
 // ProxyConfig represents proxy configuration
@@ -90,12 +206,112 @@ type ProxyConfig struct {
 
 // CacheConfigDB represents cache configuration in database
 type CacheConfigDB struct {
-	ID           int64      `json:"id"`
-	CacheEnabled bool       `json:"cache_enabled"`
-	CacheTimeout int        `json:"cache_timeout"`
-	CacheBaseURL string     `json:"cache_base_url,omitempty"`
-	CreatedAt    *time.Time `json:"created_at,omitempty"`
-	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	ID             int64      `json:"id"`
+	CacheEnabled   bool       `json:"cache_enabled"`
+	CacheTimeout   int        `json:"cache_timeout"`
+	CacheBaseURL   string     `json:"cache_base_url,omitempty"`
+	StorageBackend string     `json:"storage_backend"`
+	S3Endpoint     string     `json:"s3_endpoint"`
+	S3Region       string     `json:"s3_region"`
+	S3Bucket       string     `json:"s3_bucket"`
+	S3AccessKey    string     `json:"s3_access_key"`
+	S3SecretKey    string     `json:"s3_secret_key,omitempty"`
+	S3PublicURL    string     `json:"s3_public_url"`
+	S3Prefix       string     `json:"s3_prefix"`
+	S3PathStyle    bool       `json:"s3_path_style"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	UpdatedAt      *time.Time `json:"updated_at,omitempty"`
+}
+
+// CachedFile represents a media file stored by a cache backend
+type CachedFile struct {
+	ID        int64      `json:"id"`
+	Key       string     `json:"key"`
+	Backend   string     `json:"backend"`
+	ObjectKey string     `json:"object_key,omitempty"` // where the backend stored it; empty for files cached before it was tracked
+	URL       string     `json:"url"`
+	Size      int64      `json:"size"`
+	MediaType string     `json:"media_type"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+// CacheBackendStats summarizes tracked files for one backend
+type CacheBackendStats struct {
+	Backend string `json:"backend"`
+	Files   int64  `json:"files"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// RequestLog represents one generation request in the admin log
+type RequestLog struct {
+	ID         int64           `json:"id"`
+	TaskID     string          `json:"task_id,omitempty"`
+	TokenID    int64           `json:"token_id,omitempty"`
+	TokenEmail string          `json:"token_email,omitempty"`
+	Operation  string          `json:"operation"`
+	StatusCode int             `json:"status_code"`
+	Duration   float64         `json:"duration"`        // seconds
+	Trace      json.RawMessage `json:"trace,omitempty"` // phase timings, set for slow or traced requests
+	Selection  *TokenChoice    `json:"selection,omitempty"`
+	CreatedAt  *time.Time      `json:"created_at,omitempty"`
+}
+
+// Reasons a token was chosen for a request
+const (
+	ChoiceBestScore  = "best_score"  // ranked first under the strategy
+	ChoiceRoundRobin = "round_robin" // ranked first, taking its turn among equally scored tokens
+	ChoiceFallback   = "fallback"    // better ranked tokens had no free slot
+	ChoicePriorTask  = "prior_task"  // fixed by the task being extended or upscaled
+)
+
+// TokenChoice records why a token served a request
+type TokenChoice struct {
+	Reason     string  `json:"reason"`
+	Strategy   string  `json:"strategy,omitempty"`
+	GroupID    int64   `json:"group_id"`
+	Score      float64 `json:"score"`
+	Rank       int     `json:"rank,omitempty"`       // 1 for the best ranked candidate
+	Candidates int     `json:"candidates,omitempty"` // eligible tokens in the group
+	Tied       int     `json:"tied,omitempty"`       // candidates sharing the chosen score, itself included
+}
+
+// ModelTaskStats summarizes recent tasks for one model
+type ModelTaskStats struct {
+	Model                string  `json:"model"`
+	Processing           int     `json:"processing"`
+	Completed            int     `json:"completed"`
+	Failed               int     `json:"failed"`
+	AvgCompletionSeconds float64 `json:"avg_completion_seconds"`
+}
+
+// UsageReportRow aggregates the tasks of one group in a usage report
+type UsageReportRow struct {
+	Group       string `json:"group"` // day, token ID, API key or model, per group_by
+	Email       string `json:"email,omitempty"`
+	Generations int    `json:"generations"` // completed tasks
+	Errors      int    `json:"errors"`      // failed tasks
+	Credits     int    `json:"credits"`     // estimated Flow credits consumed
+	CacheBytes  int64  `json:"cache_bytes"` // result bytes written to the cache
+}
+
+// TokenShare is one token's part of the traffic in a fairness report
+type TokenShare struct {
+	TokenID       int64   `json:"token_id"`
+	Email         string  `json:"email"`
+	GroupID       int64   `json:"group_id"`
+	Active        bool    `json:"active"`
+	Requests      int     `json:"requests"`
+	Share         float64 `json:"share"`          // of all requests in the window
+	GroupShare    float64 `json:"group_share"`    // of the requests of its token group
+	ExpectedShare float64 `json:"expected_share"` // of its group, were traffic split evenly
+}
+
+// GroupFairness summarizes how evenly a token group's traffic was split
+type GroupFairness struct {
+	GroupID  int64    `json:"group_id"`
+	Tokens   int      `json:"tokens"`
+	Requests int      `json:"requests"`
+	Fairness *float64 `json:"fairness"` // Jain's index, 1 when even; null without traffic
 }
 
 // DebugConfigDB represents debug configuration in database
@@ -119,6 +335,8 @@ type CaptchaConfigDB struct {
 	PageAction          string     `json:"page_action"`
 	BrowserProxyEnabled bool       `json:"browser_proxy_enabled"`
 	BrowserProxyURL     string     `json:"browser_proxy_url,omitempty"`
+	SidecarURL          string     `json:"sidecar_url"`
+	SidecarToken        string     `json:"sidecar_token,omitempty"`
 	CreatedAt           *time.Time `json:"created_at,omitempty"`
 	UpdatedAt           *time.Time `json:"updated_at,omitempty"`
 }
@@ -130,6 +348,182 @@ type GenerationConfigDB struct {
 	VideoTimeout int   `json:"video_timeout"`
 }
 
+// CanaryRule routes a percentage of a model's traffic to a different model or balancing strategy
+type CanaryRule struct {
+	ID          int64      `json:"id"`
+	Model       string     `json:"model"`
+	TargetModel string     `json:"target_model,omitempty"`
+	Strategy    string     `json:"strategy,omitempty"`
+	Percent     int        `json:"percent"`
+	Enabled     bool       `json:"enabled"`
+	CreatedAt   *time.Time `json:"created_at,omitempty"`
+}
+
+// RateLimit is a token bucket limit for one base model, or for all requests
+// when Model is RateLimitGlobal
+type RateLimit struct {
+	Model             string     `json:"model"`
+	RequestsPerMinute float64    `json:"requests_per_minute"`
+	Burst             int        `json:"burst"`
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+}
+
+// RateLimitGlobal is the RateLimit model name that applies across all models
+const RateLimitGlobal = "*"
+
+// SecurityConfig filters clients of the /v1 and /api routes by address.
+// Lists hold IPs or CIDR ranges; the denylist wins over the allowlist, and an
+// empty allowlist admits every address. RequestsPerMinute limits each
+// address, 0 disables the limit.
+type SecurityConfig struct {
+	IPAllowlist       []string   `json:"ip_allowlist"`
+	IPDenylist        []string   `json:"ip_denylist"`
+	RequestsPerMinute float64    `json:"requests_per_minute"`
+	Burst             int        `json:"burst"`
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+}
+
+// BanConfig decides how tokens are banned and when bans are lifted. A token
+// that hits 429 is banned for RateLimitBanMinutes, unless RateLimitBan is off
+// and the 429 only counts as an error. One that reaches the admin config's
+// error_ban_threshold is banned for ErrorBanMinutes, 0 keeping it disabled
+// until an admin enables it. A token out of daily quota is banned until the
+// quota resets at QuotaResetHour in QuotaResetTimezone and its credits show
+// the quota is back; one whose session the upstream rejects stays disabled
+// until it is logged in again and enabled. Bans are checked every
+// UnbanCheckMinutes and at each quota reset.
+type BanConfig struct {
+	RateLimitBan        bool       `json:"rate_limit_ban"`
+	RateLimitBanMinutes int        `json:"rate_limit_ban_minutes"`
+	ErrorBan            bool       `json:"error_ban"`
+	ErrorBanMinutes     int        `json:"error_ban_minutes"`
+	UnbanCheckMinutes   int        `json:"unban_check_minutes"`
+	QuotaResetHour      int        `json:"quota_reset_hour"`
+	QuotaResetTimezone  string     `json:"quota_reset_timezone"` // IANA name, e.g. America/Los_Angeles
+	UpdatedAt           *time.Time `json:"updated_at,omitempty"`
+}
+
+// TokenRefreshConfig schedules AT refreshes ahead of expiry so generation
+// requests do not wait on one: every IntervalMinutes, active tokens whose AT
+// expires within BeforeExpiryMinutes are refreshed.
+type TokenRefreshConfig struct {
+	Enabled             bool       `json:"at_auto_refresh_enabled"`
+	IntervalMinutes     int        `json:"interval_minutes"`
+	BeforeExpiryMinutes int        `json:"before_expiry_minutes"`
+	UpdatedAt           *time.Time `json:"updated_at,omitempty"`
+}
+
+// Privacy modes for prompts kept in task records and logs
+const (
+	PrivacyOff      = "off"      // keep prompts as sent
+	PrivacyTruncate = "truncate" // keep the first privacy.truncate_length characters
+	PrivacyHash     = "hash"     // keep a SHA-256 of the prompt
+	PrivacySkip     = "skip"     // keep nothing
+)
+
+// PrivacyModes lists the valid privacy modes
+var PrivacyModes = []string{PrivacyOff, PrivacyTruncate, PrivacyHash, PrivacySkip}
+
+// RedactPrompt returns the form of a prompt that mode allows to be stored or
+// logged; truncateLength applies to truncate mode
+func RedactPrompt(mode string, truncateLength int, text string) string {
+	if text == "" {
+		return ""
+	}
+	switch mode {
+	case PrivacySkip:
+		return ""
+	case PrivacyHash:
+		sum := sha256.Sum256([]byte(text))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	case PrivacyTruncate:
+		if runes := []rune(text); len(runes) > truncateLength {
+			return string(runes[:truncateLength]) + "…"
+		}
+	}
+	return text
+}
+
+// KeyWebhook is the completion callback registered by an API key; KeyID is the
+// key ID recorded with its tasks, "default" for the global key
+type KeyWebhook struct {
+	KeyID     string     `json:"key_id"`
+	URL       string     `json:"url"`
+	Secret    string     `json:"-"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// MediaShare is a public, expiring link to one cached file. PasswordHash is
+// "salt$sha256hex", empty when the link is open.
+type MediaShare struct {
+	Token        string     `json:"token"`
+	FileID       int64      `json:"file_id"`
+	PasswordHash string     `json:"-"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+}
+
+// AdminSession is a signed-in admin panel session. Only a digest of its
+// bearer token is stored.
+type AdminSession struct {
+	ID         int64     `json:"id"`
+	TokenHash  string    `json:"-"`
+	Username   string    `json:"username"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current,omitempty"` // the session making the request
+}
+
+// APIKey is an additional client key; AllowedModels holds glob patterns such as
+// "veo_3_1_*" and an empty list allows every model
+type APIKey struct {
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	Key           string     `json:"key"`
+	AllowedModels []string   `json:"allowed_models"`
+	Enabled       bool       `json:"enabled"`
+	PrivacyMode   string     `json:"privacy_mode"`   // overrides privacy.mode when set
+	SkipCache     bool       `json:"skip_cache"`     // never cache this key's media, whatever privacy.skip_cache says
+	TokenGroupID  int64      `json:"token_group_id"` // serve this key only from the given token group; 0 routes by model
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+}
+
+// APIKeyID is the key_id recorded for an additional key's tasks, usage,
+// webhook and uploads
+func APIKeyID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// AllowsModel reports whether any of the given names (requested, base or
+// resolved model) matches the key's allowlist
+func (k *APIKey) AllowsModel(names ...string) bool {
+	if k == nil || len(k.AllowedModels) == 0 {
+		return true
+	}
+	for _, pattern := range k.AllowedModels {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpstreamModel represents a model key discovered from the Flow API
+type UpstreamModel struct {
+	ModelKey    string     `json:"model_key"`
+	ModelType   string     `json:"model_type"` // image or video
+	DisplayName string     `json:"display_name,omitempty"`
+	Status      string     `json:"status"`               // new, known, enabled, ignored
+	VideoType   string     `json:"video_type,omitempty"` // t2v, i2v, r2v (set when enabled)
+	FirstSeenAt *time.Time `json:"first_seen_at,omitempty"`
+	LastSeenAt  *time.Time `json:"last_seen_at,omitempty"`
+}
+
 // ChatMessage represents an OpenAI-compatible chat message
 type ChatMessage struct {
 	Role    string      `json:"role"`
@@ -150,13 +544,81 @@ type ImageURL struct {
 
 // ChatCompletionRequest represents an OpenAI-compatible chat completion request
 type ChatCompletionRequest struct {
-	Model       string        `json:"model"`
-	Messages    []ChatMessage `json:"messages"`
-	Stream      bool          `json:"stream"`
-	Temperature *float64      `json:"temperature,omitempty"`
-	MaxTokens   *int          `json:"max_tokens,omitempty"`
-	Image       string        `json:"image,omitempty"` // deprecated
-	Video       string        `json:"video,omitempty"` // deprecated
+	Model          string          `json:"model" form:"model"`
+	Messages       []ChatMessage   `json:"messages" form:"-"`
+	Stream         bool            `json:"stream" form:"stream"`
+	Temperature    *float64        `json:"temperature,omitempty" form:"temperature"`
+	MaxTokens      *int            `json:"max_tokens,omitempty" form:"max_tokens"`
+	Image          string          `json:"image,omitempty" form:"-"`                   // deprecated
+	Video          string          `json:"video,omitempty" form:"-"`                   // deprecated
+	TaskID         string          `json:"task_id,omitempty" form:"task_id"`           // prior video task for extend models
+	AspectRatio    string          `json:"aspect_ratio,omitempty" form:"aspect_ratio"` // landscape, portrait, square, 16:9, ...
+	Size           string          `json:"size,omitempty" form:"size"`                 // OpenAI-style WxH, used when aspect_ratio is empty
+	Seed           *int            `json:"seed,omitempty" form:"seed"`
+	NegativePrompt string          `json:"negative_prompt,omitempty" form:"negative_prompt"`
+	N              int             `json:"n,omitempty" form:"n"` // images per request, image models only
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty" form:"-"`
+	ImageFallback  bool            `json:"image_fallback,omitempty" form:"image_fallback"` // video models: return an image preview when no video token is available
+	ExtraBody      *ExtraBody      `json:"extra_body,omitempty" form:"-"`                  // clients that nest non-OpenAI fields
+}
+
+// ResponseFormat selects how results are returned; "json" (or "json_object") yields a structured payload
+type ResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// ExtraBody holds generation options sent under extra_body; top-level fields take precedence
+type ExtraBody struct {
+	Seed           *int   `json:"seed,omitempty"`
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	AspectRatio    string `json:"aspect_ratio,omitempty"`
+	TaskID         string `json:"task_id,omitempty"`
+	ImageFallback  bool   `json:"image_fallback,omitempty"`
+}
+
+// ImageGenerationRequest represents an OpenAI-compatible image generation request
+type ImageGenerationRequest struct {
+	Model          string   `json:"model" form:"model"`
+	Prompt         string   `json:"prompt" form:"prompt"`
+	N              int      `json:"n,omitempty" form:"n"`
+	Size           string   `json:"size,omitempty" form:"size"`
+	AspectRatio    string   `json:"aspect_ratio,omitempty" form:"aspect_ratio"`
+	Seed           *int     `json:"seed,omitempty" form:"seed"`
+	NegativePrompt string   `json:"negative_prompt,omitempty" form:"negative_prompt"`
+	ResponseFormat string   `json:"response_format,omitempty" form:"response_format"` // url only
+	Images         []string `json:"images,omitempty" form:"-"`                        // reference images as data, http(s) or upload: URLs; multipart requests upload files instead
+}
+
+// EstimateRequest asks what a generation would cost without running it
+type EstimateRequest struct {
+	Model       string `json:"model"`
+	N           int    `json:"n,omitempty"`
+	Size        string `json:"size,omitempty"`
+	AspectRatio string `json:"aspect_ratio,omitempty"`
+	ImageCount  int    `json:"image_count,omitempty"` // reference images that would be sent
+}
+
+// UpscaleRequest represents an image upscale request
+type UpscaleRequest struct {
+	Image          string `json:"image,omitempty" form:"-"`           // base64, data URL or http(s) URL; multipart requests upload a file
+	MediaID        string `json:"media_id,omitempty" form:"media_id"` // mediaGenerationId of a prior result
+	TaskID         string `json:"task_id,omitempty" form:"task_id"`   // prior generation task
+	Resolution     string `json:"resolution,omitempty" form:"resolution"`
+	ResponseFormat string `json:"response_format,omitempty" form:"response_format"` // url or b64_json
+	AspectRatio    string `json:"aspect_ratio,omitempty" form:"aspect_ratio"`       // of an uploaded image
+	Size           string `json:"size,omitempty" form:"size"`
+}
+
+// KeyWebhookRequest registers the calling key's completion callback
+type KeyWebhookRequest struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"` // generated when empty
+}
+
+// MediaShareRequest creates a share link; ExpiresIn is in seconds
+type MediaShareRequest struct {
+	ExpiresIn int    `json:"expires_in"`
+	Password  string `json:"password,omitempty"`
 }
 
 // ChatCompletionResponse represents an OpenAI-compatible chat completion response
@@ -198,7 +660,7 @@ type ErrorDetail struct {
 // ModelConfig represents model configuration
 type ModelConfig struct {
 	Type           string `json:"type"`       // image or video
-	VideoType      string `json:"video_type"` // t2v, i2v, r2v
+	VideoType      string `json:"video_type"` // t2v, i2v, r2v, extend
 	ModelName      string `json:"model_name"` // for image
 	ModelKey       string `json:"model_key"`  // for video
 	AspectRatio    string `json:"aspect_ratio"`
@@ -207,28 +669,239 @@ type ModelConfig struct {
 	MaxImages      int    `json:"max_images"`
 }
 
-// ModelConfigs contains all supported models
-var ModelConfigs = map[string]ModelConfig{
+// RegistryModel is a model as stored in the models table
+type RegistryModel struct {
+	Name string `json:"name"`
+	ModelConfig
+	Enabled   bool       `json:"enabled"`
+	Builtin   bool       `json:"builtin"` // seeded from the built-in list; disable rather than delete
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// Validate checks a model configuration before it is stored
+func (m ModelConfig) Validate() error {
+	switch m.Type {
+	case "image":
+		if m.ModelName == "" {
+			return fmt.Errorf("model_name is required for image models")
+		}
+	case "video":
+		if m.ModelKey == "" {
+			return fmt.Errorf("model_key is required for video models")
+		}
+		switch m.VideoType {
+		case "t2v", "i2v", "r2v", "extend":
+		default:
+			return fmt.Errorf("video_type must be one of t2v, i2v, r2v, extend")
+		}
+	default:
+		return fmt.Errorf("type must be image or video")
+	}
+	if m.Aspect() == "" {
+		return fmt.Errorf("aspect_ratio %q is not a Flow %s aspect ratio", m.AspectRatio, m.Type)
+	}
+	if m.MinImages < 0 || m.MaxImages < -1 {
+		return fmt.Errorf("min_images must be 0 or more and max_images -1 (unlimited) or more")
+	}
+	if m.MaxImages >= 0 && m.MinImages > m.MaxImages {
+		return fmt.Errorf("min_images must not exceed max_images")
+	}
+	return nil
+}
+
+// CreditCost estimates the Flow credits one generation consumes. Image
+// generation is free; video follows Flow's fast/quality pricing tiers.
+func (m ModelConfig) CreditCost() int {
+	if m.Type != "video" {
+		return 0
+	}
+	switch {
+	case strings.HasPrefix(m.ModelKey, "veo_2") && strings.Contains(m.ModelKey, "fast"):
+		return 10
+	case strings.Contains(m.ModelKey, "fast"):
+		return 20
+	default:
+		return 100
+	}
+}
+
+// Usage reports what a generation consumed in the shape of OpenAI's usage
+// object. Flow does not count tokens, so prompt tokens are prompt characters
+// and completion tokens are generated media.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	PromptCharacters int `json:"prompt_characters"`
+	MediaCount       int `json:"media_count"`
+	Credits          int `json:"credits"` // estimated Flow credits consumed
+}
+
+// NewUsage builds the usage of a generation that produced mediaCount results
+func NewUsage(prompt string, m ModelConfig, mediaCount int) Usage {
+	chars := utf8.RuneCountInString(prompt)
+	return Usage{
+		PromptTokens:     chars,
+		CompletionTokens: mediaCount,
+		TotalTokens:      chars + mediaCount,
+		PromptCharacters: chars,
+		MediaCount:       mediaCount,
+		Credits:          m.CreditCost() * mediaCount,
+	}
+}
+
+// KeyUsage aggregates the usage of an API key over one day
+type KeyUsage struct {
+	KeyID            string `json:"key_id"`
+	Day              string `json:"day,omitempty"`
+	Requests         int    `json:"requests"`
+	PromptCharacters int    `json:"prompt_characters"`
+	MediaCount       int    `json:"media_count"`
+	Credits          int    `json:"credits"`
+}
+
+// ImageCountError reports a reference image count the model cannot accept
+type ImageCountError struct {
+	Model string
+	Count int
+	Min   int
+	Max   int // -1 means no upper bound
+}
+
+func (e *ImageCountError) Error() string {
+	switch {
+	case e.Max == 0:
+		return fmt.Sprintf("model %s does not accept reference images, got %d", e.Model, e.Count)
+	case e.Max < 0:
+		return fmt.Sprintf("model %s requires at least %d reference image(s), got %d", e.Model, e.Min, e.Count)
+	case e.Min == e.Max:
+		return fmt.Sprintf("model %s requires exactly %d reference image(s), got %d", e.Model, e.Min, e.Count)
+	default:
+		return fmt.Sprintf("model %s accepts %d-%d reference image(s), got %d", e.Model, e.Min, e.Max, e.Count)
+	}
+}
+
+// FrameOrientationErrorCode is the error code clients see for a FrameOrientationError
+const FrameOrientationErrorCode = "frame_orientation_mismatch"
+
+// FrameOrientationError reports an i2v frame whose orientation contradicts the
+// video model's aspect ratio
+type FrameOrientationError struct {
+	Model    string
+	Frame    int    // 1-based frame index
+	Expected string // aspect of the model
+	Got      string // aspect of the frame
+}
+
+func (e *FrameOrientationError) Error() string {
+	return fmt.Sprintf("model %s generates %s video but frame %d is %s; crop the frame or request aspect_ratio %s",
+		e.Model, e.Expected, e.Frame, e.Got, e.Got)
+}
+
+// PromptTooLongErrorCode is the error code clients see for a PromptTooLongError
+const PromptTooLongErrorCode = "prompt_too_long"
+
+// PromptTooLongError reports a prompt over the model's configured limit
+type PromptTooLongError struct {
+	Model  string
+	Length int // characters
+	Limit  int
+}
+
+func (e *PromptTooLongError) Error() string {
+	return fmt.Sprintf("prompt is %d characters but model %s accepts at most %d; shorten it by %d characters",
+		e.Length, e.Model, e.Limit, e.Length-e.Limit)
+}
+
+// GenerationTimeoutErrorCode is the error code clients see for a
+// GenerationTimeoutError
+const GenerationTimeoutErrorCode = "generation_timeout"
+
+// GenerationTimeoutError reports a generation that ran past its configured
+// image or video timeout, or a video that outlasted its status checks
+type GenerationTimeoutError struct {
+	Type    string // image or video
+	Timeout time.Duration
+	Polls   int // status checks made, when they ran out first
+}
+
+func (e *GenerationTimeoutError) Error() string {
+	if e.Polls > 0 {
+		return fmt.Sprintf("%s generation timed out after %d status checks", e.Type, e.Polls)
+	}
+	return fmt.Sprintf("%s generation timed out after %s", e.Type, e.Timeout)
+}
+
+// Aspect returns the normalized aspect ratio the model generates, or "" when
+// its Flow aspect ratio is unknown
+func (m ModelConfig) Aspect() string {
+	for aspect, value := range flowAspectRatios[m.Type] {
+		if value == m.AspectRatio {
+			return aspect
+		}
+	}
+	return ""
+}
+
+// CheckImageCount validates the number of reference images for an image model
+// before anything is uploaded. Video models keep their own handling.
+func (m ModelConfig) CheckImageCount(model string, count int) error {
+	if m.Type != "image" {
+		return nil
+	}
+	maxImages := m.MaxImages
+	if !m.SupportsImages {
+		maxImages = 0
+	}
+	if count < m.MinImages || (maxImages >= 0 && count > maxImages) {
+		return &ImageCountError{Model: model, Count: count, Min: m.MinImages, Max: maxImages}
+	}
+	return nil
+}
+
+// ImageInputLimits returns the reference image limits of a known upstream image
+// model; unknown models accept any number and leave validation to Flow
+func ImageInputLimits(modelName string) (supportsImages bool, maxImages int) {
+	modelConfigsMu.RLock()
+	defer modelConfigsMu.RUnlock()
+
+	for _, cfg := range ModelConfigs {
+		if cfg.Type == "image" && cfg.ModelName == modelName {
+			return cfg.SupportsImages, cfg.MaxImages
+		}
+	}
+	return true, -1
+}
+
+// builtinModels are the models compiled into flow2api. They seed the models
+// table, which holds the registry from then on.
+var builtinModels = map[string]ModelConfig{
 	// Image generation - GEM_PIX (Gemini 2.5 Flash)
 	"gemini-2.5-flash-image-landscape": {
 		Type: "image", ModelName: "GEM_PIX", AspectRatio: "IMAGE_ASPECT_RATIO_LANDSCAPE",
+		SupportsImages: true, MaxImages: 3,
 	},
 	"gemini-2.5-flash-image-portrait": {
 		Type: "image", ModelName: "GEM_PIX", AspectRatio: "IMAGE_ASPECT_RATIO_PORTRAIT",
+		SupportsImages: true, MaxImages: 3,
 	},
 	// Image generation - GEM_PIX_2 (Gemini 3.0 Pro)
 	"gemini-3.0-pro-image-landscape": {
 		Type: "image", ModelName: "GEM_PIX_2", AspectRatio: "IMAGE_ASPECT_RATIO_LANDSCAPE",
+		SupportsImages: true, MaxImages: 3,
 	},
 	"gemini-3.0-pro-image-portrait": {
 		Type: "image", ModelName: "GEM_PIX_2", AspectRatio: "IMAGE_ASPECT_RATIO_PORTRAIT",
+		SupportsImages: true, MaxImages: 3,
 	},
 	// Image generation - IMAGEN_3_5 (Imagen 4.0)
 	"imagen-4.0-generate-preview-landscape": {
 		Type: "image", ModelName: "IMAGEN_3_5", AspectRatio: "IMAGE_ASPECT_RATIO_LANDSCAPE",
+		SupportsImages: false,
 	},
 	"imagen-4.0-generate-preview-portrait": {
 		Type: "image", ModelName: "IMAGEN_3_5", AspectRatio: "IMAGE_ASPECT_RATIO_PORTRAIT",
+		SupportsImages: false,
 	},
 	// T2V - Text to Video
 	"veo_3_1_t2v_fast_portrait": {
@@ -289,4 +962,282 @@ var ModelConfigs = map[string]ModelConfig{
 		Type: "video", VideoType: "r2v", ModelKey: "veo_3_0_r2v_fast",
 		AspectRatio: "VIDEO_ASPECT_RATIO_LANDSCAPE", SupportsImages: true, MinImages: 0, MaxImages: -1,
 	},
+	// Extend - Continue a previously generated video (requires task_id)
+	"veo_3_1_extend_portrait": {
+		Type: "video", VideoType: "extend", ModelKey: "veo_3_1_extend_fast_portrait",
+		AspectRatio: "VIDEO_ASPECT_RATIO_PORTRAIT", SupportsImages: false,
+	},
+	"veo_3_1_extend_landscape": {
+		Type: "video", VideoType: "extend", ModelKey: "veo_3_1_extend_fast",
+		AspectRatio: "VIDEO_ASPECT_RATIO_LANDSCAPE", SupportsImages: false,
+	},
+}
+
+// ModelConfigs is the registry of supported models, loaded from the models
+// table at startup; it starts as the built-in list
+var ModelConfigs = BuiltinModels()
+
+var modelConfigsMu sync.RWMutex
+
+// BuiltinModels returns a copy of the models compiled into flow2api
+func BuiltinModels() map[string]ModelConfig {
+	models := make(map[string]ModelConfig, len(builtinModels))
+	for name, cfg := range builtinModels {
+		models[name] = cfg
+	}
+	return models
+}
+
+// ReplaceModels swaps in a whole new registry
+func ReplaceModels(registry map[string]ModelConfig) {
+	modelConfigsMu.Lock()
+	defer modelConfigsMu.Unlock()
+
+	ModelConfigs = registry
+}
+
+// GetModelConfig returns the configuration for a registered model
+func GetModelConfig(name string) (ModelConfig, bool) {
+	modelConfigsMu.RLock()
+	defer modelConfigsMu.RUnlock()
+
+	cfg, ok := ModelConfigs[name]
+	return cfg, ok
+}
+
+// RegisterModel adds or replaces a model at runtime
+func RegisterModel(name string, cfg ModelConfig) {
+	modelConfigsMu.Lock()
+	defer modelConfigsMu.Unlock()
+
+	ModelConfigs[name] = cfg
+}
+
+// ListModelConfigs returns a snapshot of all registered models
+func ListModelConfigs() map[string]ModelConfig {
+	modelConfigsMu.RLock()
+	defer modelConfigsMu.RUnlock()
+
+	snapshot := make(map[string]ModelConfig, len(ModelConfigs))
+	for name, cfg := range ModelConfigs {
+		snapshot[name] = cfg
+	}
+	return snapshot
+}
+
+// IsKnownUpstreamModel reports whether any registered model uses the upstream key or name
+func IsKnownUpstreamModel(key string) bool {
+	modelConfigsMu.RLock()
+	defer modelConfigsMu.RUnlock()
+
+	for _, cfg := range ModelConfigs {
+		if cfg.ModelKey == key || cfg.ModelName == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Aspect ratios accepted through the aspect_ratio and size request fields
+const (
+	AspectLandscape = "landscape"
+	AspectPortrait  = "portrait"
+	AspectSquare    = "square"
+)
+
+var aspectRatioAliases = map[string]string{
+	"landscape": AspectLandscape,
+	"16:9":      AspectLandscape,
+	"portrait":  AspectPortrait,
+	"9:16":      AspectPortrait,
+	"square":    AspectSquare,
+	"1:1":       AspectSquare,
+}
+
+// flowAspectRatios maps aspect ratios to Flow enum values per generation type;
+// missing entries are not supported upstream
+var flowAspectRatios = map[string]map[string]string{
+	"image": {
+		AspectLandscape: "IMAGE_ASPECT_RATIO_LANDSCAPE",
+		AspectPortrait:  "IMAGE_ASPECT_RATIO_PORTRAIT",
+		AspectSquare:    "IMAGE_ASPECT_RATIO_SQUARE",
+	},
+	"video": {
+		AspectLandscape: "VIDEO_ASPECT_RATIO_LANDSCAPE",
+		AspectPortrait:  "VIDEO_ASPECT_RATIO_PORTRAIT",
+	},
+}
+
+// ParseAspectRatio normalizes an aspect_ratio value or an OpenAI-style size
+// such as "1024x1792"; aspect_ratio wins when both are set
+func ParseAspectRatio(aspectRatio, size string) (string, error) {
+	if aspectRatio != "" {
+		aspect, ok := aspectRatioAliases[strings.ToLower(strings.TrimSpace(aspectRatio))]
+		if !ok {
+			return "", fmt.Errorf("unsupported aspect_ratio: %s", aspectRatio)
+		}
+		return aspect, nil
+	}
+	if size == "" {
+		return "", nil
+	}
+
+	parts := strings.SplitN(strings.ToLower(strings.TrimSpace(size)), "x", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid size: %s", size)
+	}
+	width, err1 := strconv.Atoi(parts[0])
+	height, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid size: %s", size)
+	}
+
+	// Flow has no wider ratio, so ultrawide sizes get landscape
+	switch ratio := float64(width) / float64(height); {
+	case ratio > 1:
+		return AspectLandscape, nil
+	case ratio < 1:
+		return AspectPortrait, nil
+	default:
+		return AspectSquare, nil
+	}
+}
+
+// FlowAspectRatio returns the Flow enum value for an aspect ratio and generation type
+func FlowAspectRatio(generationType, aspect string) (string, bool) {
+	value, ok := flowAspectRatios[generationType][aspect]
+	return value, ok
+}
+
+// SupportedAspectRatios lists the aspect ratios Flow accepts for a generation type
+func SupportedAspectRatios(generationType string) []string {
+	var aspects []string
+	for _, aspect := range []string{AspectLandscape, AspectPortrait, AspectSquare} {
+		if _, ok := flowAspectRatios[generationType][aspect]; ok {
+			aspects = append(aspects, aspect)
+		}
+	}
+	return aspects
+}
+
+// BaseModelName strips a -landscape/_portrait style suffix from a model name
+func BaseModelName(name string) string {
+	for _, aspect := range []string{AspectLandscape, AspectPortrait} {
+		for _, sep := range []string{"-", "_"} {
+			if base := strings.TrimSuffix(name, sep+aspect); base != name {
+				return base
+			}
+		}
+	}
+	return name
+}
+
+// ResolveModel maps a model name and an optional aspect ratio to a registered
+// model. Names may be a base name ("veo_3_1_t2v_fast") or a legacy suffixed
+// name; an explicit aspect ratio overrides the suffix.
+func ResolveModel(name, aspect string) (string, ModelConfig, error) {
+	modelConfigsMu.RLock()
+	defer modelConfigsMu.RUnlock()
+
+	if aspect == "" {
+		if cfg, ok := ModelConfigs[name]; ok {
+			return name, cfg, nil
+		}
+		aspect = AspectLandscape
+	}
+
+	base := BaseModelName(name)
+	variant := func(aspect string) (string, ModelConfig, bool) {
+		for _, sep := range []string{"-", "_"} {
+			if cfg, ok := ModelConfigs[base+sep+aspect]; ok {
+				return base + sep + aspect, cfg, true
+			}
+		}
+		return "", ModelConfig{}, false
+	}
+
+	// Variants with their own entry may use a different upstream model key
+	if resolved, cfg, ok := variant(aspect); ok {
+		return resolved, cfg, nil
+	}
+
+	// Otherwise derive the variant from a sibling by swapping the aspect ratio
+	resolved, cfg, ok := variant(AspectLandscape)
+	if !ok {
+		resolved, cfg, ok = variant(AspectPortrait)
+	}
+	if ok {
+		resolved = base + resolved[len(base):len(base)+1] + aspect
+	} else if cfg, ok = ModelConfigs[name]; ok {
+		resolved = name
+	} else {
+		return "", ModelConfig{}, fmt.Errorf("unsupported model: %s", name)
+	}
+
+	flowAspect, ok := FlowAspectRatio(cfg.Type, aspect)
+	if !ok {
+		return "", ModelConfig{}, fmt.Errorf("aspect ratio %s is not supported for %s models", aspect, cfg.Type)
+	}
+	cfg.AspectRatio = flowAspect
+	return resolved, cfg, nil
+}
+
+// ModelAlias maps a model name clients send to a registered model
+type ModelAlias struct {
+	Alias     string     `json:"alias"`
+	Model     string     `json:"model"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+var (
+	aliasesMu    sync.RWMutex
+	modelAliases = map[string]string{}
+	defaultModel string
+)
+
+// SetAliases replaces the model aliases and the model used for unknown names;
+// an empty fallback rejects unknown names
+func SetAliases(aliases map[string]string, fallback string) {
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+
+	modelAliases = aliases
+	defaultModel = fallback
+}
+
+// ListAliases returns a copy of the model aliases
+func ListAliases() map[string]string {
+	aliasesMu.RLock()
+	defer aliasesMu.RUnlock()
+
+	snapshot := make(map[string]string, len(modelAliases))
+	for alias, model := range modelAliases {
+		snapshot[alias] = model
+	}
+	return snapshot
+}
+
+// CanonicalModel returns the model a client name stands for: the alias
+// target, the name itself when it is registered, or else the default model.
+// Names are returned unchanged when nothing applies, so callers still report
+// them as unsupported.
+func CanonicalModel(name string) string {
+	aliasesMu.RLock()
+	target, aliased := modelAliases[name]
+	fallback := defaultModel
+	aliasesMu.RUnlock()
+
+	known := func(model string) bool {
+		_, _, err := ResolveModel(model, "")
+		return err == nil
+	}
+	switch {
+	case aliased && known(target):
+		return target
+	case name != "" && known(name):
+		return name
+	case fallback != "" && known(fallback):
+		return fallback
+	}
+	return name
 }
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/database"
+	"flow2api/internal/models"
+)
+
+// sessionTouchInterval limits how often a session's sliding expiry is written
+// to the database
+const sessionTouchInterval = time.Minute
+
+// AdminSessions issues admin panel tokens and keeps their sessions in the
+// database, so they survive restarts and expire after global.session_ttl
+// hours without use
+type AdminSessions struct {
+	db *database.Database
+
+	mu    sync.Mutex
+	cache map[string]*models.AdminSession // by token digest
+}
+
+// NewAdminSessions creates the admin session store
+func NewAdminSessions(db *database.Database) *AdminSessions {
+	return &AdminSessions{db: db, cache: make(map[string]*models.AdminSession)}
+}
+
+func sessionTTL() time.Duration {
+	return time.Duration(config.Get().Global.SessionTTL) * time.Hour
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create signs in username and returns the new bearer token
+func (s *AdminSessions) Create(username, ip, userAgent string) (string, *models.AdminSession, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", nil, err
+	}
+	token := "admin-" + hex.EncodeToString(bytes)
+
+	now := time.Now().UTC()
+	session := &models.AdminSession{
+		TokenHash:  hashSessionToken(token),
+		Username:   username,
+		IP:         ip,
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sessionTTL()),
+	}
+	id, err := s.db.AddAdminSession(session)
+	if err != nil {
+		return "", nil, err
+	}
+	session.ID = id
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache[session.TokenHash] = session
+	s.pruneLocked(now)
+	return token, session, nil
+}
+
+// Validate returns the session of token, nil when it is unknown or expired.
+// Each use pushes the expiry back to a full TTL.
+func (s *AdminSessions) Validate(token string) *models.AdminSession {
+	return s.lookup(token, true)
+}
+
+// Active reports whether token's session is still signed in. It does not
+// count as a use, so an open event stream cannot keep a session alive.
+func (s *AdminSessions) Active(token string) bool {
+	return s.lookup(token, false) != nil
+}
+
+func (s *AdminSessions) lookup(token string, touch bool) *models.AdminSession {
+	if token == "" {
+		return nil
+	}
+	hash := hashSessionToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session := s.cache[hash]
+	if session == nil {
+		stored, err := s.db.GetAdminSessionByHash(hash)
+		if err != nil || stored == nil {
+			return nil
+		}
+		session = stored
+		s.cache[hash] = session
+	}
+
+	now := time.Now().UTC()
+	if !now.Before(session.ExpiresAt) {
+		delete(s.cache, hash)
+		return nil
+	}
+	if touch && now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		session.LastSeenAt, session.ExpiresAt = now, now.Add(sessionTTL())
+		s.db.TouchAdminSession(session.ID, session.LastSeenAt, session.ExpiresAt)
+	}
+
+	current := *session
+	return &current
+}
+
+// List returns the sessions that have not expired
+func (s *AdminSessions) List() ([]*models.AdminSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions, err := s.db.GetAdminSessions()
+	if err != nil {
+		return nil, err
+	}
+	// Expiries slid since the last write are only known to the cache
+	for _, session := range sessions {
+		if cached := s.cache[session.TokenHash]; cached != nil {
+			session.LastSeenAt, session.ExpiresAt = cached.LastSeenAt, cached.ExpiresAt
+		}
+	}
+	return sessions, nil
+}
+
+// Revoke signs out the session with id; it returns sql.ErrNoRows when there
+// is none
+func (s *AdminSessions) Revoke(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.db.DeleteAdminSession(id); err != nil {
+		return err
+	}
+	for hash, session := range s.cache {
+		if session.ID == id {
+			delete(s.cache, hash)
+		}
+	}
+	return nil
+}
+
+// RevokeAll signs out every session
+func (s *AdminSessions) RevokeAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cache = make(map[string]*models.AdminSession)
+	return s.db.DeleteAllAdminSessions()
+}
+
+// pruneLocked drops expired sessions. Called with s.mu held.
+func (s *AdminSessions) pruneLocked(now time.Time) {
+	for hash, session := range s.cache {
+		if !now.Before(session.ExpiresAt) {
+			delete(s.cache, hash)
+		}
+	}
+	s.db.DeleteExpiredAdminSessions()
+}
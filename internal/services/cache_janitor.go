@@ -0,0 +1,183 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/database"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+	"flow2api/internal/storage"
+)
+
+var cacheLog = logging.Component("cache")
+
+// staleDownloadAge is how long a download temp file goes unwritten before it
+// is taken for the leftover of an interrupted download
+const staleDownloadAge = time.Hour
+
+// CacheStats summarizes cache usage
+type CacheStats struct {
+	LocalFiles   int64                       `json:"local_files"`
+	LocalBytes   int64                       `json:"local_bytes"`
+	Tracked      []*models.CacheBackendStats `json:"tracked"`
+	CacheTimeout int                         `json:"cache_timeout"`
+}
+
+// CacheJanitor removes cached media older than cache_timeout, and expired
+// resumable uploads
+type CacheJanitor struct {
+	db       *database.Database
+	cacheDir string
+	uploads  *UploadStore
+}
+
+// NewCacheJanitor creates a new cache janitor; uploads may be nil
+func NewCacheJanitor(db *database.Database, cacheDir string, uploads *UploadStore) *CacheJanitor {
+	return &CacheJanitor{
+		db:       db,
+		cacheDir: cacheDir,
+		uploads:  uploads,
+	}
+}
+
+// Start sweeps expired files, uploads and share links, and redacts old prompts, on
+// the given interval until the process exits
+func (cj *CacheJanitor) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if cj.uploads != nil {
+				cj.uploads.Sweep()
+			}
+			if n, err := cj.db.DeleteExpiredMediaShares(); err != nil {
+				cacheLog.Error("Share link cleanup failed", "error", err)
+			} else if n > 0 {
+				cacheLog.Info("Removed expired share links", "count", n)
+			}
+			if n, err := cj.RedactOldPrompts(); err != nil {
+				cacheLog.Error("Prompt redaction failed", "error", err)
+			} else if n > 0 {
+				cacheLog.Info("Redacted old task prompts", "count", n)
+			}
+
+			timeout := config.Get().Cache.Timeout
+			if timeout <= 0 {
+				continue
+			}
+			removed, err := cj.Sweep(time.Duration(timeout) * time.Second)
+			if err != nil {
+				cacheLog.Error("Cleanup failed", "error", err)
+			} else if removed > 0 {
+				cacheLog.Info("Removed expired files", "count", removed)
+			}
+		}
+	}()
+}
+
+// Purge removes every cached file regardless of age
+func (cj *CacheJanitor) Purge() (int, error) {
+	return cj.Sweep(0)
+}
+
+// Sweep removes tracked files and local cache files older than maxAge
+func (cj *CacheJanitor) Sweep(maxAge time.Duration) (int, error) {
+	removed := 0
+
+	files, err := cj.db.GetCachedFilesOlderThan(maxAge)
+	if err != nil {
+		return 0, err
+	}
+
+	backends := make(map[string]storage.Backend)
+	for _, file := range files {
+		backend, ok := backends[file.Backend]
+		if !ok {
+			backend, err = cj.backendFor(file.Backend)
+			if err != nil {
+				cacheLog.Error("Cannot delete cached file", "key", file.Key, "backend", file.Backend, "error", err)
+				continue
+			}
+			backends[file.Backend] = backend
+		}
+
+		// The prefix or directory may have changed since the file was stored
+		objectKey := file.ObjectKey
+		if objectKey == "" {
+			objectKey = backend.ObjectKey(file.Key)
+		}
+		if err := backend.Delete(objectKey); err != nil {
+			cacheLog.Error("Failed to delete cached file", "key", file.Key, "backend", file.Backend, "error", err)
+			continue
+		}
+		cj.db.DeleteCachedFile(file.ID)
+		removed++
+	}
+
+	// Local files not tracked in the database (older versions, interrupted downloads)
+	cutoff := time.Now().Add(-maxAge)
+	entries, err := os.ReadDir(cj.cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return removed, nil
+		}
+		return removed, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		// A download is written to its temp file as it arrives; even a purge
+		// leaves it alone until it has been idle long enough to be abandoned
+		if strings.HasPrefix(entry.Name(), "download-") && time.Since(info.ModTime()) < staleDownloadAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cj.cacheDir, entry.Name())); err == nil {
+			cj.db.DeleteCachedFileByKey("local", entry.Name())
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// Stats reports local cache directory usage and tracked files per backend
+func (cj *CacheJanitor) Stats() (*CacheStats, error) {
+	stats := &CacheStats{CacheTimeout: config.Get().Cache.Timeout}
+
+	entries, err := os.ReadDir(cj.cacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			stats.LocalFiles++
+			stats.LocalBytes += info.Size()
+		}
+	}
+
+	stats.Tracked, err = cj.db.GetCacheStats()
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (cj *CacheJanitor) backendFor(name string) (storage.Backend, error) {
+	cfg := config.Get()
+	if name == "s3" {
+		return storage.NewS3Backend(cfg.Cache.S3)
+	}
+	return storage.NewLocalBackend(cj.cacheDir, cfg), nil
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"flow2api/internal/database"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+	"flow2api/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+var callbackLog = logging.Component("callback")
+
+// callbackAttempts is how many times a completion callback is delivered
+// before it is dropped; the delay doubles from one second between attempts
+const callbackAttempts = 4
+
+// CallbackPayload is the body POSTed to a key's webhook when a task finishes.
+// It is signed like inbound webhooks, with the key's own secret.
+type CallbackPayload struct {
+	Event       string     `json:"event"` // generation.completed or generation.failed
+	TaskID      string     `json:"task_id"`
+	Model       string     `json:"model"`
+	Status      string     `json:"status"`
+	URLs        []string   `json:"urls,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// CallbackNotifier delivers completion callbacks to the webhook registered by
+// the API key that submitted a task
+type CallbackNotifier struct {
+	db     *database.Database
+	client *http.Client
+}
+
+// NewCallbackNotifier creates a new callback notifier. Callbacks only
+// connect to public addresses, whatever the webhook's host resolves to now.
+func NewCallbackNotifier(db *database.Database) *CallbackNotifier {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: PublicOnly}
+	return &CallbackNotifier{
+		db: db,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		},
+	}
+}
+
+// Notify sends the task's outcome to its key's webhook in the background; tasks
+// from keys without a webhook are ignored
+func (cn *CallbackNotifier) Notify(taskID string) {
+	go func() {
+		if err := cn.notify(taskID); err != nil {
+			callbackLog.Warn("Callback failed", "task_id", taskID, "error", err)
+		}
+	}()
+}
+
+func (cn *CallbackNotifier) notify(taskID string) error {
+	task, err := cn.db.GetTask(taskID)
+	if err != nil {
+		return fmt.Errorf("failed to load task: %w", err)
+	}
+	if task == nil || task.Params == nil || task.Params.KeyID == "" {
+		return nil
+	}
+	hook, err := cn.db.GetKeyWebhook(task.Params.KeyID)
+	if err != nil {
+		return fmt.Errorf("failed to load webhook: %w", err)
+	}
+	if hook == nil {
+		return nil
+	}
+
+	payload := CallbackPayload{
+		Event:       EventGenerationCompleted,
+		TaskID:      task.TaskID,
+		Model:       task.Model,
+		Status:      task.Status,
+		URLs:        storage.SignURLs(task.ResultURLs),
+		Error:       task.ErrorMessage,
+		CompletedAt: task.CompletedAt,
+	}
+	if task.Status == "failed" {
+		payload.Event = EventGenerationFailed
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err = cn.deliver(hook, body)
+		if err == nil {
+			callbackLog.Info("Callback delivered", "event", payload.Event, "task_id", taskID, "key_id", hook.KeyID, "attempt", attempt)
+			return nil
+		}
+		if attempt == callbackAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// deliver POSTs one signed attempt; each attempt gets a fresh timestamp and
+// nonce so receivers can apply replay checks
+func (cn *CallbackNotifier) deliver(hook *models.KeyWebhook, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := uuid.New().String()
+
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookNonceHeader, nonce)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(hook.Secret, timestamp, nonce, body))
+
+	resp, err := cn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"flow2api/internal/database"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+)
+
+var canaryLog = logging.Component("canary")
+
+// Canary arms
+const (
+	CanaryArmControl = "control"
+	CanaryArmCanary  = "canary"
+)
+
+// CanaryDecision describes how a single request was routed
+type CanaryDecision struct {
+	RuleID   int64
+	Arm      string
+	Model    string
+	Strategy string
+}
+
+// CanaryArmStats aggregates outcomes for one arm of a canary rule
+type CanaryArmStats struct {
+	Requests     int64   `json:"requests"`
+	Errors       int64   `json:"errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+
+	totalLatency time.Duration
+}
+
+// CanaryRuleStats compares the control and canary arms of a rule
+type CanaryRuleStats struct {
+	Rule    *models.CanaryRule `json:"rule"`
+	Control CanaryArmStats     `json:"control"`
+	Canary  CanaryArmStats     `json:"canary"`
+}
+
+// CanaryRouter splits traffic between the requested model/strategy and a canary
+type CanaryRouter struct {
+	db    *database.Database
+	rules map[string]*models.CanaryRule // keyed by source model
+	stats map[int64]map[string]*CanaryArmStats
+	mu    sync.Mutex
+}
+
+// NewCanaryRouter creates a new canary router and loads the stored rules
+func NewCanaryRouter(db *database.Database) *CanaryRouter {
+	cr := &CanaryRouter{
+		db:    db,
+		rules: make(map[string]*models.CanaryRule),
+		stats: make(map[int64]map[string]*CanaryArmStats),
+	}
+	if err := cr.Reload(); err != nil {
+		canaryLog.Error("Failed to load rules", "error", err)
+	}
+	return cr
+}
+
+// Reload refreshes the rule set from the database
+func (cr *CanaryRouter) Reload() error {
+	rules, err := cr.db.GetCanaryRules()
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.rules = make(map[string]*models.CanaryRule)
+	for _, rule := range rules {
+		if rule.Enabled {
+			cr.rules[rule.Model] = rule
+		}
+	}
+	return nil
+}
+
+// Route decides whether a request for model goes to the control or canary arm
+func (cr *CanaryRouter) Route(model string) CanaryDecision {
+	decision := CanaryDecision{Model: model, Strategy: StrategyScore}
+
+	cr.mu.Lock()
+	rule, ok := cr.rules[model]
+	cr.mu.Unlock()
+	if !ok {
+		return decision
+	}
+
+	decision.RuleID = rule.ID
+	decision.Arm = CanaryArmControl
+	if rand.Intn(100) >= rule.Percent {
+		return decision
+	}
+
+	decision.Arm = CanaryArmCanary
+	if rule.TargetModel != "" {
+		decision.Model = rule.TargetModel
+	}
+	if rule.Strategy != "" {
+		decision.Strategy = rule.Strategy
+	}
+	return decision
+}
+
+// Record stores the outcome of a routed request
+func (cr *CanaryRouter) Record(decision CanaryDecision, duration time.Duration, err error) {
+	if decision.RuleID == 0 {
+		return
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	arms, ok := cr.stats[decision.RuleID]
+	if !ok {
+		arms = map[string]*CanaryArmStats{
+			CanaryArmControl: {},
+			CanaryArmCanary:  {},
+		}
+		cr.stats[decision.RuleID] = arms
+	}
+
+	arm := arms[decision.Arm]
+	arm.Requests++
+	if err != nil {
+		arm.Errors++
+	}
+	arm.totalLatency += duration
+}
+
+// Stats returns per-rule arm statistics for all stored rules
+func (cr *CanaryRouter) Stats() ([]*CanaryRuleStats, error) {
+	rules, err := cr.db.GetCanaryRules()
+	if err != nil {
+		return nil, err
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	result := make([]*CanaryRuleStats, 0, len(rules))
+	for _, rule := range rules {
+		entry := &CanaryRuleStats{Rule: rule}
+		if arms, ok := cr.stats[rule.ID]; ok {
+			entry.Control = arms[CanaryArmControl].snapshot()
+			entry.Canary = arms[CanaryArmCanary].snapshot()
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// ResetStats clears collected statistics for a rule
+func (cr *CanaryRouter) ResetStats(ruleID int64) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	delete(cr.stats, ruleID)
+}
+
+func (s *CanaryArmStats) snapshot() CanaryArmStats {
+	out := CanaryArmStats{Requests: s.Requests, Errors: s.Errors}
+	if s.Requests > 0 {
+		out.ErrorRate = float64(s.Errors) / float64(s.Requests)
+		out.AvgLatencyMs = float64(s.totalLatency.Milliseconds()) / float64(s.Requests)
+	}
+	return out
+}
@@ -1,19 +1,52 @@
 package services
 
 import (
+	"context"
+	"fmt"
 	"sync"
+	"time"
 
+	"flow2api/internal/logging"
 	"flow2api/internal/models"
 )
 
-// ConcurrencyManager manages concurrent generation limits
+var concurrencyLog = logging.Component("concurrency")
+
+// slotLease is a slot held by a task. Slots are leased rather than counted
+// so one that is never released, by a stuck or crashed generation, can be
+// reclaimed by Reconcile instead of lowering the token's capacity for good.
+type slotLease struct {
+	tokenID  int64
+	group    int64 // token group the slot also counts against, 0 for none
+	video    bool
+	owner    string
+	acquired time.Time
+	expires  time.Time
+	suspect  bool // the owner looked finished at the previous reconcile
+}
+
+func leaseKey(tokenID int64, video bool, owner string) string {
+	return fmt.Sprintf("%t:%d:%s", video, tokenID, owner)
+}
+
+// ConcurrencyManager manages concurrent generation limits. Besides its
+// token's limit, a slot counts against the limit of the token's group.
 type ConcurrencyManager struct {
 	imageSlots map[int64]int
 	videoSlots map[int64]int
+	leases     map[string]*slotLease
 	limits     map[int64]struct {
 		imageLimit int
 		videoLimit int
 	}
+
+	tokenGroups     map[int64]int64 // token ID -> group ID
+	groupImageSlots map[int64]int
+	groupVideoSlots map[int64]int
+	groupLimits     map[int64]struct {
+		imageLimit int
+		videoLimit int
+	}
 	mu sync.RWMutex
 }
 
@@ -22,10 +55,18 @@ func NewConcurrencyManager() *ConcurrencyManager {
 	return &ConcurrencyManager{
 		imageSlots: make(map[int64]int),
 		videoSlots: make(map[int64]int),
+		leases:     make(map[string]*slotLease),
 		limits: make(map[int64]struct {
 			imageLimit int
 			videoLimit int
 		}),
+		tokenGroups:     make(map[int64]int64),
+		groupImageSlots: make(map[int64]int),
+		groupVideoSlots: make(map[int64]int),
+		groupLimits: make(map[int64]struct {
+			imageLimit int
+			videoLimit int
+		}),
 	}
 }
 
@@ -42,9 +83,68 @@ func (cm *ConcurrencyManager) Initialize(tokens []*models.Token) {
 			imageLimit: token.ImageConcurrency,
 			videoLimit: token.VideoConcurrency,
 		}
+		cm.tokenGroups[token.ID] = token.GroupID
 	}
 }
 
+// SetGroups replaces the group limits. Slots already leased keep counting
+// against the group they were leased in.
+func (cm *ConcurrencyManager) SetGroups(groups []*models.TokenGroup) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	clear(cm.groupLimits)
+	for _, group := range groups {
+		cm.groupLimits[group.ID] = struct {
+			imageLimit int
+			videoLimit int
+		}{
+			imageLimit: group.ImageConcurrency,
+			videoLimit: group.VideoConcurrency,
+		}
+	}
+}
+
+// WatchTokens keeps token and group limits in step with store: on every
+// token or group change published on events, and every minute in case an
+// event was missed, until ctx is done
+func (cm *ConcurrencyManager) WatchTokens(ctx context.Context, store TokenStore, events *EventBus) {
+	reload := func() {
+		tokens, err := store.GetActiveTokens()
+		if err != nil {
+			concurrencyLog.Error("Failed to reload token limits", "error", err)
+			return
+		}
+		groups, err := store.GetTokenGroups()
+		if err != nil {
+			concurrencyLog.Error("Failed to reload group limits", "error", err)
+			return
+		}
+		cm.Initialize(tokens)
+		cm.SetGroups(groups)
+	}
+	reload()
+
+	changes, unsubscribe := events.Subscribe()
+	go func() {
+		defer unsubscribe()
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-changes:
+				if event.Type != EventTokenUpdated && event.Type != EventTokenGroupUpdated {
+					continue
+				}
+			case <-ticker.C:
+			}
+			reload()
+		}
+	}()
+}
+
 // UpdateTokenLimits updates limits for a token
 func (cm *ConcurrencyManager) UpdateTokenLimits(tokenID int64, imageLimit, videoLimit int) {
 	cm.mu.Lock()
@@ -63,84 +163,230 @@ func (cm *ConcurrencyManager) UpdateTokenLimits(tokenID int64, imageLimit, video
 func (cm *ConcurrencyManager) CanAcquireImage(tokenID int64) bool {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
-
-	limit, ok := cm.limits[tokenID]
-	if !ok || limit.imageLimit < 0 {
-		return true // No limit
-	}
-
-	current := cm.imageSlots[tokenID]
-	return current < limit.imageLimit
+	return cm.freeLocked(tokenID, false)
 }
 
 // CanAcquireVideo checks if video slot is available
 func (cm *ConcurrencyManager) CanAcquireVideo(tokenID int64) bool {
 	cm.mu.RLock()
 	defer cm.mu.RUnlock()
+	return cm.freeLocked(tokenID, true)
+}
+
+// freeLocked reports whether both the token and its group have a free slot;
+// a negative or missing limit is no limit
+func (cm *ConcurrencyManager) freeLocked(tokenID int64, video bool) bool {
+	if limit, ok := cm.limits[tokenID]; ok {
+		slots, most := cm.imageSlots, limit.imageLimit
+		if video {
+			slots, most = cm.videoSlots, limit.videoLimit
+		}
+		if most >= 0 && slots[tokenID] >= most {
+			return false
+		}
+	}
 
-	limit, ok := cm.limits[tokenID]
-	if !ok || limit.videoLimit < 0 {
-		return true // No limit
+	group := cm.tokenGroups[tokenID]
+	if limit, ok := cm.groupLimits[group]; ok && group != 0 {
+		slots, most := cm.groupImageSlots, limit.imageLimit
+		if video {
+			slots, most = cm.groupVideoSlots, limit.videoLimit
+		}
+		if most >= 0 && slots[group] >= most {
+			return false
+		}
 	}
+	return true
+}
+
+// AcquireImage leases an image slot to owner, a unique task ID, until it is
+// released or ttl passes
+func (cm *ConcurrencyManager) AcquireImage(tokenID int64, owner string, ttl time.Duration) bool {
+	return cm.acquire(tokenID, false, owner, ttl)
+}
+
+// ReleaseImage releases the owner's image slot
+func (cm *ConcurrencyManager) ReleaseImage(tokenID int64, owner string) {
+	cm.release(tokenID, false, owner)
+}
 
-	current := cm.videoSlots[tokenID]
-	return current < limit.videoLimit
+// AcquireVideo leases a video slot to owner, a unique task ID, until it is
+// released or ttl passes
+func (cm *ConcurrencyManager) AcquireVideo(tokenID int64, owner string, ttl time.Duration) bool {
+	return cm.acquire(tokenID, true, owner, ttl)
 }
 
-// AcquireImage acquires an image slot
-func (cm *ConcurrencyManager) AcquireImage(tokenID int64) bool {
+// ReleaseVideo releases the owner's video slot
+func (cm *ConcurrencyManager) ReleaseVideo(tokenID int64, owner string) {
+	cm.release(tokenID, true, owner)
+}
+
+// RenewVideo extends the owner's video slot lease to ttl from now. It
+// returns false when the owner holds no such slot, e.g. it was reclaimed.
+func (cm *ConcurrencyManager) RenewVideo(tokenID int64, owner string, ttl time.Duration) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	lease, ok := cm.leases[leaseKey(tokenID, true, owner)]
+	if !ok {
+		return false
+	}
+	lease.expires = time.Now().Add(ttl)
+	return true
+}
+
+func (cm *ConcurrencyManager) acquire(tokenID int64, video bool, owner string, ttl time.Duration) bool {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
 
-	limit, ok := cm.limits[tokenID]
-	if !ok || limit.imageLimit < 0 {
-		cm.imageSlots[tokenID]++
+	key := leaseKey(tokenID, video, owner)
+	if _, held := cm.leases[key]; held {
 		return true
 	}
 
-	if cm.imageSlots[tokenID] >= limit.imageLimit {
+	if !cm.freeLocked(tokenID, video) {
 		return false
 	}
 
-	cm.imageSlots[tokenID]++
+	slots, groupSlots := cm.imageSlots, cm.groupImageSlots
+	if video {
+		slots, groupSlots = cm.videoSlots, cm.groupVideoSlots
+	}
+	group := cm.tokenGroups[tokenID]
+	slots[tokenID]++
+	if group != 0 {
+		groupSlots[group]++
+	}
+	now := time.Now()
+	cm.leases[key] = &slotLease{tokenID: tokenID, group: group, video: video, owner: owner, acquired: now, expires: now.Add(ttl)}
 	return true
 }
 
-// ReleaseImage releases an image slot
-func (cm *ConcurrencyManager) ReleaseImage(tokenID int64) {
+// release frees a leased slot; a lease already reclaimed is left alone so
+// the slot is not freed twice
+func (cm *ConcurrencyManager) release(tokenID int64, video bool, owner string) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	cm.releaseLocked(leaseKey(tokenID, video, owner))
+}
 
-	if cm.imageSlots[tokenID] > 0 {
-		cm.imageSlots[tokenID]--
+func (cm *ConcurrencyManager) releaseLocked(key string) {
+	lease, ok := cm.leases[key]
+	if !ok {
+		return
+	}
+	delete(cm.leases, key)
+	slots, groupSlots := cm.imageSlots, cm.groupImageSlots
+	if lease.video {
+		slots, groupSlots = cm.videoSlots, cm.groupVideoSlots
+	}
+	if slots[lease.tokenID] > 0 {
+		slots[lease.tokenID]--
+	}
+	if groupSlots[lease.group] > 0 {
+		groupSlots[lease.group]--
 	}
 }
 
-// AcquireVideo acquires a video slot
-func (cm *ConcurrencyManager) AcquireVideo(tokenID int64) bool {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+// Reconcile reclaims slots whose lease expired, and slots whose owner
+// finished reports done on two passes in a row, which leaves the owner time
+// to release the slot itself. finished may be nil. It returns the number of
+// slots reclaimed.
+func (cm *ConcurrencyManager) Reconcile(finished func(owner string) bool) int {
+	now := time.Now()
+	var expired, check []string
+	owners := make(map[string]string)
 
-	limit, ok := cm.limits[tokenID]
-	if !ok || limit.videoLimit < 0 {
-		cm.videoSlots[tokenID]++
-		return true
+	cm.mu.RLock()
+	for key, lease := range cm.leases {
+		if now.After(lease.expires) {
+			expired = append(expired, key)
+		} else if finished != nil {
+			check = append(check, key)
+			owners[key] = lease.owner
+		}
 	}
+	cm.mu.RUnlock()
 
-	if cm.videoSlots[tokenID] >= limit.videoLimit {
-		return false
+	// Ask about owners without the lock; finished may hit the database
+	done := make(map[string]bool, len(check))
+	for _, key := range check {
+		done[key] = finished(owners[key])
 	}
 
-	cm.videoSlots[tokenID]++
-	return true
-}
-
-// ReleaseVideo releases a video slot
-func (cm *ConcurrencyManager) ReleaseVideo(tokenID int64) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	reclaimed := 0
+	for _, key := range expired {
+		if lease, ok := cm.leases[key]; ok {
+			concurrencyLog.Warn("Reclaimed expired slot", "token_id", lease.tokenID, "video", lease.video,
+				"task_id", lease.owner, "held", now.Sub(lease.acquired).Round(time.Second))
+			cm.releaseLocked(key)
+			reclaimed++
+		}
+	}
+	for _, key := range check {
+		lease, ok := cm.leases[key]
+		if !ok {
+			continue
+		}
+		if !done[key] {
+			lease.suspect = false
+			continue
+		}
+		if !lease.suspect {
+			lease.suspect = true
+			continue
+		}
+		concurrencyLog.Warn("Reclaimed slot of finished task", "token_id", lease.tokenID, "video", lease.video,
+			"task_id", lease.owner, "held", now.Sub(lease.acquired).Round(time.Second))
+		cm.releaseLocked(key)
+		reclaimed++
+	}
+	return reclaimed
+}
+
+// StartReconciler runs Reconcile on the given interval until the process exits
+func (cm *ConcurrencyManager) StartReconciler(interval time.Duration, finished func(owner string) bool) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			cm.Reconcile(finished)
+		}
+	}()
+}
+
+// PoolLoad summarizes slot usage across a set of tokens; a capacity of -1 means unlimited
+type PoolLoad struct {
+	ImageInUse    int `json:"image_in_use"`
+	ImageCapacity int `json:"image_capacity"`
+	VideoInUse    int `json:"video_in_use"`
+	VideoCapacity int `json:"video_capacity"`
+}
+
+// Load returns slot usage and capacity for the given tokens
+func (cm *ConcurrencyManager) Load(tokens []*models.Token) PoolLoad {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	var load PoolLoad
+	for _, token := range tokens {
+		limit, ok := cm.limits[token.ID]
+		if token.ImageEnabled {
+			load.ImageInUse += cm.imageSlots[token.ID]
+			load.ImageCapacity = addCapacity(load.ImageCapacity, limit.imageLimit, ok)
+		}
+		if token.VideoEnabled {
+			load.VideoInUse += cm.videoSlots[token.ID]
+			load.VideoCapacity = addCapacity(load.VideoCapacity, limit.videoLimit, ok)
+		}
+	}
+	return load
+}
 
-	if cm.videoSlots[tokenID] > 0 {
-		cm.videoSlots[tokenID]--
+func addCapacity(total, limit int, limited bool) int {
+	if total < 0 || !limited || limit < 0 {
+		return -1
 	}
+	return total + limit
 }
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"runtime"
+	"sort"
+	"time"
+
+	"flow2api/internal/logging"
+)
+
+// InFlightGeneration is a running generation as reported by state dumps
+type InFlightGeneration struct {
+	TaskID  string
+	Model   string
+	KeyID   string
+	TokenID int64
+	Batch   bool
+	Phase   string
+	Elapsed time.Duration
+}
+
+// InFlight lists the generations currently running, longest-running first
+func (gh *GenerationHandler) InFlight() []InFlightGeneration {
+	now := time.Now()
+	var running []InFlightGeneration
+	gh.inFlight.Range(func(key, value interface{}) bool {
+		trace, req := key.(*RequestTrace), value.(*GenerationRequest)
+		taskID, tokenID, phase := trace.current()
+		running = append(running, InFlightGeneration{
+			TaskID:  taskID,
+			Model:   trace.Model,
+			KeyID:   req.KeyID,
+			TokenID: tokenID,
+			Batch:   req.Batch,
+			Phase:   phase,
+			Elapsed: now.Sub(trace.start),
+		})
+		return true
+	})
+	sort.Slice(running, func(i, j int) bool { return running[i].Elapsed > running[j].Elapsed })
+	return running
+}
+
+// LogState writes the worker queues, the running generations and the stacks
+// of all goroutines to the log, for debugging a stuck instance in place
+func (wp *WorkerPool) LogState() {
+	logger := logging.Component("dump")
+	running := wp.gh.InFlight()
+	logger.Info("Runtime state", "goroutines", runtime.NumGoroutine(), "in_flight", len(running))
+	for _, generationType := range []string{"image", "video"} {
+		s := wp.queues[generationType].stats()
+		logger.Info("Queue", "type", generationType, "workers", s.Workers, "busy", s.Busy,
+			"batch_busy", s.BatchBusy, "queued", s.Queued, "batch_queued", s.BatchQueued)
+	}
+	for _, g := range running {
+		logger.Info("In flight", "task_id", g.TaskID, "model", g.Model, "key_id", g.KeyID, "token_id", g.TokenID,
+			"batch", g.Batch, "phase", g.Phase, "elapsed", g.Elapsed.Round(time.Second))
+	}
+
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	logger.Info("Goroutine stacks", "stacks", string(buf))
+}
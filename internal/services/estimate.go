@@ -0,0 +1,86 @@
+package services
+
+import (
+	"fmt"
+
+	"flow2api/internal/models"
+)
+
+// Estimate is the expected cost and wait of a generation, computed without
+// solving a captcha or taking a concurrency slot
+type Estimate struct {
+	Model                    string  `json:"model"`
+	Type                     string  `json:"type"`
+	Credits                  int     `json:"credits"`
+	EligibleToken            bool    `json:"eligible_token"`
+	SufficientCredits        bool    `json:"sufficient_credits"`
+	QueueDepth               int     `json:"queue_depth"` // tasks of the same type currently processing
+	EstimatedWaitSeconds     float64 `json:"estimated_wait_seconds"`
+	EstimatedDurationSeconds float64 `json:"estimated_duration_seconds"`
+}
+
+// Estimate reports the credit cost of a request, whether a token could take it
+// right now, and how long it is expected to wait and run
+func (gh *GenerationHandler) Estimate(model, aspectRatio string, n, imageCount int, keyGroup int64) (*Estimate, error) {
+	resolved, modelConfig, err := models.ResolveModel(model, aspectRatio)
+	if err != nil {
+		return nil, err
+	}
+	if err := modelConfig.CheckImageCount(resolved, imageCount); err != nil {
+		return nil, err
+	}
+	if n > 1 && modelConfig.Type != "image" {
+		return nil, fmt.Errorf("n > 1 is only supported for image models")
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	estimate := &Estimate{
+		Model:   resolved,
+		Type:    modelConfig.Type,
+		Credits: modelConfig.CreditCost() * n,
+	}
+
+	// SelectToken only checks free slots; nothing is acquired
+	token, _ := gh.loadBalancer.SelectToken(modelConfig.Type == "image", modelConfig.Type == "video", resolved, keyGroup)
+	if token != nil {
+		estimate.EligibleToken = true
+		estimate.SufficientCredits = token.Credits >= estimate.Credits
+	}
+
+	taskStats, err := gh.db.GetTaskStatsSince(StatusWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fall back to the type-wide average when the model has no recent completions
+	var modelTotal, typeTotal float64
+	var modelCompleted, typeCompleted int
+	for _, s := range taskStats {
+		_, cfg, err := models.ResolveModel(s.Model, "")
+		if err != nil || cfg.Type != modelConfig.Type {
+			continue
+		}
+		estimate.QueueDepth += s.Processing
+		typeTotal += s.AvgCompletionSeconds * float64(s.Completed)
+		typeCompleted += s.Completed
+		if models.BaseModelName(s.Model) == models.BaseModelName(resolved) {
+			modelTotal += s.AvgCompletionSeconds * float64(s.Completed)
+			modelCompleted += s.Completed
+		}
+	}
+	switch {
+	case modelCompleted > 0:
+		estimate.EstimatedDurationSeconds = modelTotal / float64(modelCompleted)
+	case typeCompleted > 0:
+		estimate.EstimatedDurationSeconds = typeTotal / float64(typeCompleted)
+	}
+
+	// Without a free slot the request waits for a running task to finish
+	if !estimate.EligibleToken && typeCompleted > 0 {
+		estimate.EstimatedWaitSeconds = typeTotal / float64(typeCompleted)
+	}
+
+	return estimate, nil
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types pushed to dashboard subscribers
+const (
+	EventTokenUpdated        = "token.updated"
+	EventTokenBanned         = "token.banned"
+	EventGenerationStarted   = "generation.started"
+	EventGenerationCompleted = "generation.completed"
+	EventGenerationFailed    = "generation.failed"
+	EventTokenImport         = "token.import"
+	EventTokenGroupUpdated   = "token_group.updated"
+)
+
+// Event is a single notification published on the event bus
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// EventBus fans out events to live subscribers; slow subscribers miss events instead of blocking publishers
+type EventBus struct {
+	subscribers map[chan Event]struct{}
+	mu          sync.RWMutex
+}
+
+// NewEventBus creates a new event bus
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish sends an event to all current subscribers
+func (b *EventBus) Publish(eventType string, data interface{}) {
+	event := Event{Type: eventType, Time: time.Now(), Data: data}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a subscriber; call the returned function to unsubscribe
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
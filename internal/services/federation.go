@@ -0,0 +1,146 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+)
+
+var federationLog = logging.Component("federation")
+
+// ForwardedHeader marks requests relayed from a peer so they are never forwarded again
+const ForwardedHeader = "X-Flow2API-Forwarded"
+
+// peerStatusTTL is how long a peer's /v1/status answer is trusted
+const peerStatusTTL = 15 * time.Second
+
+type peerStatus struct {
+	available map[string]bool
+	fetchedAt time.Time
+}
+
+// Federation forwards requests to peer flow2api instances when the local pool cannot serve them
+type Federation struct {
+	client       *http.Client
+	statusClient *http.Client
+	status       map[string]*peerStatus // keyed by peer URL
+	mu           sync.Mutex
+}
+
+// NewFederation creates a new federation forwarder
+func NewFederation() *Federation {
+	timeout := config.Get().Federation.Timeout
+	return &Federation{
+		client:       &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		statusClient: &http.Client{Timeout: 5 * time.Second},
+		status:       make(map[string]*peerStatus),
+	}
+}
+
+// Enabled reports whether federation is on and has peers
+func (f *Federation) Enabled() bool {
+	cfg := config.Get().Federation
+	return cfg.Enabled && len(cfg.Peers) > 0
+}
+
+// PickPeer returns the first configured peer that reports the model as available
+func (f *Federation) PickPeer(model string) (config.PeerConfig, bool) {
+	baseModel := models.BaseModelName(model)
+	for _, peer := range config.Get().Federation.Peers {
+		if f.peerStatus(peer).available[baseModel] {
+			return peer, true
+		}
+	}
+	return config.PeerConfig{}, false
+}
+
+// Forward relays a chat completion body to a peer; the caller closes the response body
+func (f *Federation) Forward(peer config.PeerConfig, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", strings.TrimRight(peer.URL, "/")+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+peer.APIKey)
+	req.Header.Set(ForwardedHeader, "1")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		f.invalidate(peer)
+		return nil, fmt.Errorf("peer %s request failed: %w", peerName(peer), err)
+	}
+	return resp, nil
+}
+
+// peerStatus returns cached availability for a peer, refreshing it when stale.
+// Failures are cached too so an unreachable peer is not retried on every request.
+func (f *Federation) peerStatus(peer config.PeerConfig) *peerStatus {
+	f.mu.Lock()
+	cached := f.status[peer.URL]
+	f.mu.Unlock()
+	if cached != nil && time.Since(cached.fetchedAt) < peerStatusTTL {
+		return cached
+	}
+
+	status := &peerStatus{available: make(map[string]bool), fetchedAt: time.Now()}
+	remote, err := f.fetchStatus(peer)
+	if err != nil {
+		federationLog.Warn("Peer status unavailable", "peer", peerName(peer), "error", err)
+	} else {
+		for _, m := range remote.Models {
+			if m.Available {
+				status.available[m.ID] = true
+			}
+		}
+	}
+
+	f.mu.Lock()
+	f.status[peer.URL] = status
+	f.mu.Unlock()
+	return status
+}
+
+func (f *Federation) fetchStatus(peer config.PeerConfig) (*ServiceStatus, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(peer.URL, "/")+"/v1/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+peer.APIKey)
+
+	resp, err := f.statusClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	var status ServiceStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func (f *Federation) invalidate(peer config.PeerConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.status, peer.URL)
+}
+
+func peerName(peer config.PeerConfig) string {
+	if peer.Name != "" {
+		return peer.Name
+	}
+	return peer.URL
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"fmt"
+
+	"flow2api/internal/config"
+	"flow2api/internal/imageproc"
+	"flow2api/internal/models"
+)
+
+// frameMismatchRatio is how far from square a frame must be before its
+// orientation clearly contradicts the model's
+const frameMismatchRatio = 1.2
+
+// FitFrames checks i2v start and end frames against the model's orientation.
+// A clearly landscape frame for a portrait model (or the reverse) is
+// center-cropped when generation.frame_mismatch is "crop" and rejected with a
+// FrameOrientationError otherwise. Frames that cannot be decoded are passed
+// through for upstream to judge.
+func FitFrames(model string, modelConfig models.ModelConfig, images [][]byte) ([][]byte, error) {
+	if modelConfig.Type != "video" || modelConfig.VideoType != "i2v" {
+		return images, nil
+	}
+	expected := modelConfig.Aspect()
+	if expected != models.AspectLandscape && expected != models.AspectPortrait {
+		return images, nil
+	}
+
+	fitted := images
+	copied := false
+	for i, img := range images {
+		width, height, err := imageproc.Dimensions(img)
+		if err != nil || width == 0 || height == 0 {
+			continue
+		}
+		ratio := float64(width) / float64(height)
+		var got string
+		switch {
+		case expected == models.AspectPortrait && ratio >= frameMismatchRatio:
+			got = models.AspectLandscape
+		case expected == models.AspectLandscape && ratio <= 1/frameMismatchRatio:
+			got = models.AspectPortrait
+		default:
+			continue
+		}
+
+		if config.Get().Generation.FrameMismatch != "crop" {
+			return nil, &models.FrameOrientationError{Model: model, Frame: i + 1, Expected: expected, Got: got}
+		}
+
+		ratioW, ratioH := 16, 9
+		if expected == models.AspectPortrait {
+			ratioW, ratioH = 9, 16
+		}
+		cropped, err := imageproc.CropToRatio(img, ratioW, ratioH)
+		if err != nil {
+			generationLog.Warn("Failed to crop frame", "model", model, "frame", i+1, "error", err)
+			continue
+		}
+		// Leave the caller's slice untouched
+		if !copied {
+			fitted = append([][]byte(nil), images...)
+			copied = true
+		}
+		fitted[i] = cropped
+		generationLog.Info("Cropped frame", "model", model, "frame", i+1, "orientation", got,
+			"width", width, "height", height, "ratio", fmt.Sprintf("%d:%d", ratioW, ratioH))
+	}
+	return fitted, nil
+}
+
+// PrepareReferences readies reference images for upload: EXIF orientation
+// is applied and metadata stripped, then generation.reference_max_side and
+// reference_jpeg are applied. Images that cannot be decoded are passed
+// through for upstream to judge.
+func PrepareReferences(images [][]byte) [][]byte {
+	cfg := config.Get().Generation
+	opts := imageproc.PrepareOptions{MaxSide: cfg.ReferenceMaxSide, JPEG: cfg.ReferenceJPEG}
+	prepared := make([][]byte, len(images))
+	for i, img := range images {
+		out, err := imageproc.Prepare(img, opts)
+		if err != nil {
+			generationLog.Warn("Failed to prepare reference image", "image", i+1, "error", err)
+			out = img
+		}
+		prepared[i] = out
+	}
+	return prepared
+}
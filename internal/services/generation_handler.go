@@ -1,44 +1,68 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"flow2api/internal/client"
 	"flow2api/internal/config"
 	"flow2api/internal/database"
+	"flow2api/internal/logging"
 	"flow2api/internal/models"
+	"flow2api/internal/storage"
 
 	"github.com/google/uuid"
 )
 
+// CacheDir is the local directory for cached media, served under /tmp
+const CacheDir = "tmp"
+
 // GenerationHandler handles image and video generation
 type GenerationHandler struct {
 	flowClient         *client.FlowClient
-	tokenManager       *TokenManager
-	loadBalancer       *LoadBalancer
+	tokenManager       TokenStore
+	loadBalancer       Balancer
 	db                 *database.Database
-	concurrencyManager *ConcurrencyManager
+	concurrencyManager Limiter
+	canaryRouter       *CanaryRouter
+	events             *EventBus
+	callbacks          *CallbackNotifier
+	hooks              *HookRegistry
 	cacheDir           string
+	inFlight           sync.Map // *RequestTrace -> *GenerationRequest of running generations
+	panics             atomic.Int64
+	selfTestMu         sync.Mutex // one self-test at a time
+	lastSelfTest       atomic.Pointer[SelfTestResult]
+
+	// queuePreview hands an image preview to the image workers; nil runs it
+	// on the worker of the video request
+	queuePreview func(req *GenerationRequest, chunkChan chan<- string) error
 }
 
 // NewGenerationHandler creates a new generation handler
 func NewGenerationHandler(
 	fc *client.FlowClient,
-	tm *TokenManager,
-	lb *LoadBalancer,
+	tm TokenStore,
+	lb Balancer,
 	db *database.Database,
-	cm *ConcurrencyManager,
+	cm Limiter,
+	cr *CanaryRouter,
+	events *EventBus,
 ) *GenerationHandler {
-	cacheDir := "tmp"
-	os.MkdirAll(cacheDir, 0755)
+	os.MkdirAll(CacheDir, 0755)
 
 	return &GenerationHandler{
 		flowClient:         fc,
@@ -46,10 +70,19 @@ func NewGenerationHandler(
 		loadBalancer:       lb,
 		db:                 db,
 		concurrencyManager: cm,
-		cacheDir:           cacheDir,
+		canaryRouter:       cr,
+		events:             events,
+		callbacks:          NewCallbackNotifier(db),
+		hooks:              NewHookRegistry(),
+		cacheDir:           CacheDir,
 	}
 }
 
+// Hooks returns the registry of request lifecycle hooks
+func (gh *GenerationHandler) Hooks() *HookRegistry {
+	return gh.hooks
+}
+
 // StreamChunk represents a streaming response chunk
 type StreamChunk struct {
 	Content      string
@@ -58,28 +91,161 @@ type StreamChunk struct {
 	IsReasoning  bool
 }
 
+// GenerationRequest represents a normalized generation request from the API layer
+type GenerationRequest struct {
+	RequestID      string // HTTP request ID, for log correlation
+	Model          string
+	Prompt         string
+	Images         [][]byte
+	Stream         bool
+	KeyID          string
+	PriorTaskID    string // video task to continue, for extend models
+	AspectRatio    string // normalized aspect ratio; empty keeps the model's default
+	Seed           *int   // fixed seed for reproducible output; nil picks a random one
+	NegativePrompt string
+	N              int    // images per request, image models only
+	TaskID         string // preassigned task ID; empty generates one
+	ResponseFormat string // "json" returns a structured payload instead of markdown
+	Trace          bool   // store a phase trace with the request log regardless of duration
+	PrivacyMode    string // per-key privacy mode; empty uses privacy.mode
+	SkipCache      bool   // per-key opt-out of media caching
+	TokenGroupID   int64  // token group bound to the calling key; 0 routes by model
+	Batch          bool   // queued behind interactive requests and kept out of their reserved workers
+	ImageFallback  bool   // video models: generate an image preview when no video token is available
+	FallbackFrom   string // video model an image preview stands in for; set on the fallback run
+
+	// AllowModel, when set, checks a model the generation switches to, such
+	// as the image preview, against the calling key's allowlist and takes a
+	// request from its rate limit
+	AllowModel func(model string) bool
+
+	// Context is cancelled, with ErrClientDisconnected as the cause, when the
+	// client goes away; upstream calls and the video poll stop with it. Nil
+	// is never cancelled.
+	Context context.Context
+}
+
+// errPreviewQueued is returned by HandleGeneration when it handed the
+// request to the image workers as a preview; the preview owns the channel
+var errPreviewQueued = errors.New("image preview queued")
+
+// ErrClientDisconnected is the cause of a generation cancelled because its
+// client closed the connection
+var ErrClientDisconnected = errors.New("client disconnected")
+
+func (req *GenerationRequest) context() context.Context {
+	if req.Context == nil {
+		return context.Background()
+	}
+	return req.Context
+}
+
+// ResponseFormatJSON selects the structured result payload
+const ResponseFormatJSON = "json"
+
+// GenerationPayload is the final message content in JSON response mode
+type GenerationPayload struct {
+	TaskID   string   `json:"task_id"`
+	Model    string   `json:"model"`
+	Type     string   `json:"type"`
+	URLs     []string `json:"urls"`
+	MimeType string   `json:"mime_type"`
+	Duration float64  `json:"duration"` // seconds from submission to result
+
+	// Set when an image preview was generated in place of the requested video
+	Fallback       string `json:"fallback,omitempty"`
+	RequestedModel string `json:"requested_model,omitempty"`
+
+	// Set when the video was still processing at the poll timeout
+	Status    string `json:"status,omitempty"`
+	StatusURL string `json:"status_url,omitempty"`
+}
+
+var generationLog = logging.Component("generation")
+
+// PreviewImageModel generates the still preview offered when a video request
+// finds no video-capable token; its aspect follows the requested video
+const PreviewImageModel = "gemini-2.5-flash-image"
+
+// FallbackImagePreview labels results generated by the image preview fallback
+const FallbackImagePreview = "image_preview"
+
+// MaxImagesPerRequest is the largest n accepted for image generation
+const MaxImagesPerRequest = 4
+
+// GenerationResult is the outcome of a generation run without a streaming consumer
+type GenerationResult struct {
+	TaskID string
+	URLs   []string
+	Usage  models.Usage
+}
+
 // HandleGeneration handles generation requests
-func (gh *GenerationHandler) HandleGeneration(model, prompt string, images [][]byte, stream bool, chunkChan chan<- string) error {
-	defer close(chunkChan)
+func (gh *GenerationHandler) HandleGeneration(req *GenerationRequest, chunkChan chan<- string) (err error) {
+	defer func() {
+		if !errors.Is(err, errPreviewQueued) {
+			close(chunkChan)
+		}
+	}()
+	// A panic must not take the worker, or the process, down with it
+	defer func() {
+		if r := recover(); r != nil {
+			err = gh.recoverGeneration(r, req.RequestID, "", chunkChan)
+		}
+	}()
 
 	startTime := time.Now()
+	ctx := req.context()
 
-	// Validate model
-	modelConfig, ok := models.ModelConfigs[model]
-	if !ok {
-		errResp := gh.createErrorResponse(fmt.Sprintf("Unsupported model: %s", model))
-		chunkChan <- errResp
-		return fmt.Errorf("unsupported model: %s", model)
+	// Route through canary rules; the task records the model actually served
+	route := gh.canaryRouter.Route(req.Model)
+	if route.Arm == CanaryArmCanary {
+		canaryLog.Info("Routed to canary", "request_id", req.RequestID, "rule_id", route.RuleID,
+			"requested_model", req.Model, "model", route.Model, "strategy", route.Strategy)
+	}
+
+	// Validate model and apply the requested aspect ratio
+	model, modelConfig, err := models.ResolveModel(route.Model, req.AspectRatio)
+	if err != nil {
+		chunkChan <- gh.createErrorResponse(err.Error())
+		return err
 	}
 
 	generationType := modelConfig.Type
-	log.Printf("[GENERATION] Starting - Model: %s, Type: %s, Prompt: %.50s...", model, generationType, prompt)
+	if err := modelConfig.CheckImageCount(model, len(req.Images)); err != nil {
+		chunkChan <- gh.createErrorResponse(err.Error())
+		return err
+	}
+	// Upright first, so frames are checked in the orientation they display in
+	req.Images = PrepareReferences(req.Images)
+	if req.Images, err = FitFrames(model, modelConfig, req.Images); err != nil {
+		chunkChan <- gh.createErrorResponseCode(err.Error(), models.FrameOrientationErrorCode)
+		return err
+	}
+	prompt, promptLength, err := FitPrompt(model, modelConfig, req.Prompt)
+	if err != nil {
+		chunkChan <- gh.createErrorResponseCode(err.Error(), models.PromptTooLongErrorCode)
+		return err
+	}
+	req.Prompt = prompt
+	if req.N > 1 && generationType != "image" {
+		err := fmt.Errorf("n > 1 is only supported for image models")
+		chunkChan <- gh.createErrorResponse(err.Error())
+		return err
+	}
+
+	privacy := privacyPolicy(req)
+	logger := generationLog.With("request_id", req.RequestID, "model", model)
+	logger.Info("Generation requested", "type", generationType, "stream", req.Stream, "prompt", truncate(privacy.Redact(req.Prompt), 50))
+	if promptLength > 0 {
+		logger.Warn("Prompt truncated", "length", promptLength, "kept", utf8.RuneCountInString(req.Prompt))
+	}
 
 	// Non-streaming: just check availability
-	if !stream {
+	if !req.Stream {
 		isImage := generationType == "image"
 		isVideo := generationType == "video"
-		token, _ := gh.loadBalancer.SelectToken(isImage, isVideo, model)
+		token, _ := gh.loadBalancer.SelectTokenWithStrategy(isImage, isVideo, model, route.Strategy, req.TokenGroupID)
 
 		var message string
 		if token != nil {
@@ -91,6 +257,9 @@ func (gh *GenerationHandler) HandleGeneration(model, prompt string, images [][]b
 		} else {
 			if isImage {
 				message = "No tokens available for image generation"
+			} else if req.ImageFallback {
+				// Only a check; the preview is generated by a streaming request
+				message = "No tokens available for video generation. A streaming request would get an image preview instead."
 			} else {
 				message = "No tokens available for video generation"
 			}
@@ -100,33 +269,122 @@ func (gh *GenerationHandler) HandleGeneration(model, prompt string, images [][]b
 		return nil
 	}
 
-	// Send start message
+	// Hooks may reject the request or route it to another token group. An
+	// image preview already passed them as the video request it replaces.
+	hookEvent := &HookEvent{
+		RequestID: req.RequestID, TaskID: req.TaskID, Model: model, Type: generationType, Prompt: req.Prompt,
+		KeyID: req.KeyID, TokenGroupID: req.TokenGroupID, Strategy: route.Strategy,
+	}
+	if req.FallbackFrom == "" {
+		if err := gh.hooks.Run(HookPreSelect, hookEvent); err != nil {
+			logger.Warn("Rejected by hook", "stage", HookPreSelect, "error", err)
+			chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", err.Error()), "", false)
+			chunkChan <- gh.createErrorResponse(err.Error())
+			return err
+		}
+	}
+	keyGroup, strategy := hookEvent.TokenGroupID, hookEvent.Strategy
+
+	// Fall back before anything is recorded, so the video attempt does not
+	// count against its canary route or the request log
+	if req.ImageFallback && generationType == "video" && modelConfig.VideoType != "extend" {
+		if token, _ := gh.loadBalancer.SelectTokenWithStrategy(false, true, model, strategy, keyGroup); token == nil {
+			return gh.generateImagePreview(req, model, modelConfig, keyGroup, chunkChan)
+		}
+	}
+
+	trace := newRequestTrace(model, req.Trace, logger)
+	gh.inFlight.Store(trace, req)
+	defer func() {
+		// Recover here so the request log, canary stats and hooks see the failure
+		if r := recover(); r != nil {
+			err = gh.recoverGeneration(r, req.RequestID, trace.TaskID, chunkChan)
+		}
+		gh.inFlight.Delete(trace)
+		gh.canaryRouter.Record(route, time.Since(startTime), err)
+		gh.recordRequest(trace, generationType, err)
+		if err != nil {
+			hookEvent.Error = err.Error()
+			hookEvent.DurationMs = time.Since(startTime).Milliseconds()
+			gh.hooks.Notify(HookOnError, hookEvent)
+		}
+	}()
+
+	// Send the announcement, then the start message
+	if announcement := config.Get().GetAnnouncement(); announcement != "" {
+		chunkChan <- gh.createStreamChunk(fmt.Sprintf("📢 %s\n", announcement), "", false)
+	}
 	chunkChan <- gh.createStreamChunk(fmt.Sprintf("✨ %s generation task started\n",
 		map[bool]string{true: "Video", false: "Image"}[generationType == "video"]), "", false)
+	if promptLength > 0 {
+		chunkChan <- gh.createStreamChunk(fmt.Sprintf("⚠️ Prompt truncated from %d to %d characters to fit the %s limit\n",
+			promptLength, utf8.RuneCountInString(req.Prompt), model), "", false)
+	}
+
+	// A client that left while the request was queued is not worth a token
+	if err := context.Cause(ctx); err != nil {
+		logger.Info("Client gone before the generation started", "cause", err)
+		return err
+	}
 
-	// Select token
-	log.Println("[GENERATION] Selecting token...")
+	// Select a token and lease its slot in one step, so concurrent requests
+	// cannot both take the last one; extensions must run on the account that
+	// owns the prior clip
+	trace.Mark("select_token")
 	isImage := generationType == "image"
 	isVideo := generationType == "video"
-	token, err := gh.loadBalancer.SelectToken(isImage, isVideo, model)
+	if req.TaskID == "" {
+		req.TaskID = uuid.New().String()
+	}
+	var token *models.Token
+	var choice *models.TokenChoice
+	if modelConfig.VideoType == "extend" {
+		token, err = gh.priorVideoToken(req.PriorTaskID)
+		if err != nil {
+			errMsg := err.Error()
+			chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
+			chunkChan <- gh.createErrorResponse(errMsg)
+			return err
+		}
+		if !gh.concurrencyManager.AcquireVideo(token.ID, req.TaskID, slotTTL(true)) {
+			errMsg := "Video concurrency limit reached"
+			chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
+			chunkChan <- gh.createErrorResponse(errMsg)
+			return fmt.Errorf(errMsg)
+		}
+		choice = &models.TokenChoice{Reason: models.ChoicePriorTask, GroupID: token.GroupID}
+	} else {
+		token, choice, err = gh.loadBalancer.AcquireToken(isImage, isVideo, model, strategy, keyGroup, req.TaskID, slotTTL(isVideo))
+	}
 	if err != nil || token == nil {
 		errMsg := gh.getNoTokenErrorMessage(generationType)
-		log.Printf("[GENERATION] %s", errMsg)
+		logger.Warn("No token available", "type", generationType)
 		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
 		chunkChan <- gh.createErrorResponse(errMsg)
 		return fmt.Errorf(errMsg)
 	}
 
-	log.Printf("[GENERATION] Selected Token: %d (%s)", token.ID, token.Email)
+	// The generation takes over the slot below; until then every return
+	// releases it here
+	slotHeld, slotToken := true, token.ID
+	defer func() {
+		if slotHeld {
+			gh.releaseSlot(slotToken, req.TaskID, isVideo)
+		}
+	}()
+
+	trace.setToken(token.ID, choice)
+	logger = trace.logger
+	logger.Debug("Token selected", "email", token.Email, "reason", choice.Reason, "score", choice.Score)
 
 	// Ensure AT is valid
-	log.Println("[GENERATION] Checking AT validity...")
+	trace.Mark("check_at")
 	chunkChan <- gh.createStreamChunk("Initializing generation environment...\n", "", false)
 
 	valid, err := gh.tokenManager.IsATValid(token.ID)
 	if !valid || err != nil {
 		errMsg := "Token AT invalid or refresh failed"
-		log.Printf("[GENERATION] %s", errMsg)
+		logger.Warn(errMsg, "error", err)
 		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
 		chunkChan <- gh.createErrorResponse(errMsg)
 		return fmt.Errorf(errMsg)
@@ -136,62 +394,353 @@ func (gh *GenerationHandler) HandleGeneration(model, prompt string, images [][]b
 	token, _ = gh.tokenManager.GetToken(token.ID)
 
 	// Ensure project exists
-	log.Println("[GENERATION] Checking/creating project...")
+	trace.Mark("ensure_project")
 	projectID, err := gh.tokenManager.EnsureProjectExists(token.ID)
 	if err != nil {
 		errMsg := fmt.Sprintf("Failed to ensure project: %v", err)
+		logger.Error("Failed to ensure project", "error", err)
 		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
 		chunkChan <- gh.createErrorResponse(errMsg)
 		return err
 	}
-	log.Printf("[GENERATION] Project ID: %s", projectID)
+	logger.Debug("Project ready", "project_id", projectID)
+
+	hookEvent.TokenID = token.ID
+	if err := gh.hooks.Run(HookPreSubmit, hookEvent); err != nil {
+		logger.Warn("Rejected by hook", "stage", HookPreSubmit, "error", err)
+		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", err.Error()), "", false)
+		chunkChan <- gh.createErrorResponse(err.Error())
+		return err
+	}
 
-	// Handle generation based on type
+	// Record task with the normalized request so it can be audited or replayed
+	task := gh.newTask(req, model, token, modelConfig)
+	task.Params.Canary = route.Arm
+	task.Params.Privacy = privacy.Mode
+	task.Params.SkipCache = privacy.SkipCache
+	task.Params.FallbackFrom = req.FallbackFrom
+	trace.setTask(task.TaskID)
+	hookEvent.TaskID = task.TaskID
+	logger = trace.logger
+	if _, err := gh.db.CreateTask(privacy.storedTask(task)); err != nil {
+		logger.Error("Failed to record task", "error", err)
+	}
+	gh.events.Publish(EventGenerationStarted, map[string]interface{}{
+		"task_id": task.TaskID, "model": model, "type": generationType, "token_id": token.ID,
+	})
+
+	// Handle generation based on type; the handlers release the slot
 	var genErr error
+	logger.Info("Generation started", "type", generationType)
+	slotHeld = false
+	genCtx, cancel := withGenerationTimeout(ctx, generationType)
+	defer cancel()
 	if generationType == "image" {
-		log.Println("[GENERATION] Starting image generation...")
-		genErr = gh.handleImageGeneration(token, projectID, modelConfig, prompt, images, chunkChan)
+		genErr = gh.handleImageGeneration(genCtx, token, projectID, modelConfig, task, req.Images, trace, chunkChan)
 	} else {
-		log.Println("[GENERATION] Starting video generation...")
-		genErr = gh.handleVideoGeneration(token, projectID, modelConfig, prompt, images, chunkChan)
+		genErr = gh.handleVideoGeneration(genCtx, token, projectID, modelConfig, task, req.Images, trace, chunkChan)
+	}
+
+	// The client has its answer; the video is finished in the background
+	var pending *videoPending
+	if errors.As(genErr, &pending) {
+		logger.Info("Video still processing, polling in the background", "task_id", task.TaskID)
+		go gh.pollPending(pending, task, logger, func(err error) {
+			gh.finishTask(task, token, hookEvent, startTime, logger, err)
+			if err != nil {
+				hookEvent.Error = err.Error()
+				hookEvent.DurationMs = time.Since(startTime).Milliseconds()
+				gh.hooks.Notify(HookOnError, hookEvent)
+			}
+		})
+		return nil
+	}
+	if genErr != nil && genCtx.Err() != nil {
+		genErr = context.Cause(genCtx)
 	}
+	return gh.finishTask(task, token, hookEvent, startTime, logger, genErr)
+}
 
+// finishTask records the outcome of a generation that reached Flow on the
+// task, the token and the listeners, and returns genErr
+func (gh *GenerationHandler) finishTask(task *models.Task, token *models.Token, hookEvent *HookEvent, startTime time.Time, logger *slog.Logger, genErr error) error {
 	if genErr != nil {
-		// Check for 429 error
-		if strings.Contains(genErr.Error(), "429") {
-			log.Printf("[429_BAN] Token %d hit 429, banning", token.ID)
-			gh.tokenManager.BanTokenFor429(token.ID)
-		} else {
-			gh.tokenManager.RecordError(token.ID)
+		gh.db.UpdateTask(task.TaskID, map[string]interface{}{
+			"status":        "failed",
+			"error_message": genErr.Error(),
+			"completed_at":  time.Now(),
+		})
+
+		gh.events.Publish(EventGenerationFailed, map[string]interface{}{
+			"task_id": task.TaskID, "model": task.Model, "token_id": token.ID, "error": genErr.Error(),
+		})
+		gh.callbacks.Notify(task.TaskID)
+		logger.Error("Generation failed", "error", genErr, "duration", time.Since(startTime).Round(time.Millisecond))
+
+		// The upstream's answer decides what happens to the token; a result
+		// that failed to be stamped or a client that left is not the token's
+		// fault
+		if errors.Is(genErr, ErrWatermark) {
+			logger.Warn("Result not served: watermarking failed")
+			return genErr
+		}
+		if errors.Is(genErr, ErrClientDisconnected) || errors.Is(genErr, context.Canceled) {
+			logger.Info("Generation cancelled, its slot is released")
+			return genErr
 		}
+		gh.blameToken(token.ID, genErr, logger)
 		return genErr
 	}
 
 	// Record usage
-	gh.tokenManager.RecordUsage(token.ID, isVideo)
+	gh.tokenManager.RecordUsage(token.ID, task.Params.Type == "video")
 	gh.tokenManager.RecordSuccess(token.ID)
+	stored, err := gh.db.GetTask(task.TaskID)
+	if err == nil && stored != nil {
+		keyID := task.Params.KeyID
+		if keyID == "" {
+			keyID = "default"
+		}
+		usage := taskUsage(task, task.Prompt, len(stored.ResultURLs))
+		if err := gh.db.RecordKeyUsage(keyID, usage); err != nil {
+			logger.Warn("Failed to record key usage", "error", err)
+		}
+		gh.db.UpdateTask(task.TaskID, map[string]interface{}{
+			"credits":     usage.Credits,
+			"cache_bytes": gh.cachedBytes(stored.ResultURLs),
+		})
+	}
+
+	gh.events.Publish(EventGenerationCompleted, map[string]interface{}{
+		"task_id": task.TaskID, "model": task.Model, "token_id": token.ID, "duration": time.Since(startTime).Seconds(),
+	})
+	gh.callbacks.Notify(task.TaskID)
+
+	if gh.hooks.Has(HookPostComplete) {
+		if stored != nil {
+			hookEvent.ResultURLs = stored.ResultURLs
+		}
+		hookEvent.DurationMs = time.Since(startTime).Milliseconds()
+		gh.hooks.Notify(HookPostComplete, hookEvent)
+	}
 
-	log.Printf("[GENERATION] ✅ Completed in %.2fs", time.Since(startTime).Seconds())
+	logger.Info("Generation completed", "duration", time.Since(startTime).Round(time.Millisecond))
 	return nil
 }
 
-func (gh *GenerationHandler) handleImageGeneration(token *models.Token, projectID string, modelConfig models.ModelConfig, prompt string, images [][]byte, chunkChan chan<- string) error {
-	// Acquire concurrency slot
-	if !gh.concurrencyManager.AcquireImage(token.ID) {
-		errMsg := "Image concurrency limit reached"
-		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
-		chunkChan <- gh.createErrorResponse(errMsg)
-		return fmt.Errorf(errMsg)
+// collectResult drains a generation's chunks and loads its stored result URLs
+func (gh *GenerationHandler) collectResult(req *GenerationRequest, chunkChan <-chan string) (*GenerationResult, error) {
+	// Progress chunks are only meaningful to streaming clients; the last one
+	// carries the error when the generation failed before a task was recorded
+	var last string
+	for chunk := range chunkChan {
+		last = chunk
+	}
+
+	task, err := gh.db.GetTask(req.TaskID)
+	if err != nil {
+		return nil, err
+	}
+	if task == nil || task.Status != "completed" {
+		var resp struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if task != nil && task.ErrorMessage != "" {
+			return nil, fmt.Errorf("%s", task.ErrorMessage)
+		}
+		if task != nil && task.Status == "processing" {
+			return nil, fmt.Errorf("video is still processing; wait on task %s", task.TaskID)
+		}
+		if json.Unmarshal([]byte(last), &resp) == nil && resp.Error.Message != "" {
+			return nil, fmt.Errorf("%s", resp.Error.Message)
+		}
+		return nil, fmt.Errorf("generation produced no results")
+	}
+	if len(task.ResultURLs) == 0 {
+		return nil, fmt.Errorf("generation produced no results")
+	}
+	return &GenerationResult{
+		TaskID: task.TaskID,
+		URLs:   storage.SignURLs(task.ResultURLs),
+		Usage:  taskUsage(task, req.Prompt, len(task.ResultURLs)),
+	}, nil
+}
+
+// CanServe reports whether a local token is currently eligible for the model
+func (gh *GenerationHandler) CanServe(model, aspectRatio string) bool {
+	_, modelConfig, err := models.ResolveModel(model, aspectRatio)
+	if err != nil {
+		return false
+	}
+	token, _ := gh.loadBalancer.SelectToken(modelConfig.Type == "image", modelConfig.Type == "video", model, 0)
+	return token != nil
+}
+
+// newTask builds the task record for a request, including its normalized parameters
+func (gh *GenerationHandler) newTask(req *GenerationRequest, model string, token *models.Token, modelConfig models.ModelConfig) *models.Task {
+	modelKey := modelConfig.ModelKey
+	if modelConfig.Type == "image" {
+		modelKey = modelConfig.ModelName
+	}
+
+	seed := rand.Intn(99999)
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	taskID := req.TaskID
+	if taskID == "" {
+		taskID = uuid.New().String()
+	}
+	n := req.N
+	if n < 1 {
+		n = 1
+	}
+	createdAt := time.Now()
+
+	return &models.Task{
+		TaskID:    taskID,
+		CreatedAt: &createdAt,
+		TokenID:   token.ID,
+		Model:     model,
+		Prompt:    req.Prompt,
+		Status:    "processing",
+		Params: &models.TaskParams{
+			Model:          model,
+			Type:           modelConfig.Type,
+			VideoType:      modelConfig.VideoType,
+			ModelKey:       modelKey,
+			AspectRatio:    modelConfig.AspectRatio,
+			Seed:           seed,
+			N:              n,
+			ImageCount:     len(req.Images),
+			Stream:         req.Stream,
+			KeyID:          req.KeyID,
+			PriorTaskID:    req.PriorTaskID,
+			NegativePrompt: req.NegativePrompt,
+			ResponseFormat: req.ResponseFormat,
+		},
+	}
+}
+
+// priorVideoToken validates the task being extended and returns the token that produced it
+func (gh *GenerationHandler) priorVideoToken(priorTaskID string) (*models.Token, error) {
+	if priorTaskID == "" {
+		return nil, fmt.Errorf("task_id of the video to extend is required")
+	}
+
+	prior, err := gh.db.GetTask(priorTaskID)
+	if err != nil {
+		return nil, err
+	}
+	if prior == nil || prior.Status != "completed" || prior.MediaID == "" ||
+		prior.Params == nil || prior.Params.Type != "video" {
+		return nil, fmt.Errorf("task %s is not a completed video", priorTaskID)
+	}
+
+	token, err := gh.tokenManager.GetToken(prior.TokenID)
+	if err != nil || token == nil || !token.IsActive || !token.VideoEnabled {
+		return nil, fmt.Errorf("token for task %s is no longer available", priorTaskID)
+	}
+	return token, nil
+}
+
+// slotLeaseGrace is how long a generation may hold its concurrency slot past
+// the generation timeout, for reference uploads and result caching
+const slotLeaseGrace = 5 * time.Minute
+
+// slotTTL is how long a generation's slot lease lasts before it is reclaimed
+func slotTTL(video bool) time.Duration {
+	return generationTimeout(video) + slotLeaseGrace
+}
+
+// generationTimeout is generation.image_timeout or video_timeout, which the
+// admin panel may have changed
+func generationTimeout(video bool) time.Duration {
+	timeout := config.Get().Generation.ImageTimeout
+	if video {
+		timeout = config.Get().Generation.VideoTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// withGenerationTimeout bounds a generation's upstream calls and video poll by
+// its type's timeout; the context's cause is then a GenerationTimeoutError
+func withGenerationTimeout(ctx context.Context, generationType string) (context.Context, context.CancelFunc) {
+	timeout := generationTimeout(generationType == "video")
+	return context.WithTimeoutCause(ctx, timeout, &models.GenerationTimeoutError{Type: generationType, Timeout: timeout})
+}
+
+// failureResponse is the error response for a failed generation step,
+// carrying the timeout error code when the generation ran out of time
+func (gh *GenerationHandler) failureResponse(errMsg string, err error) string {
+	var timeout *models.GenerationTimeoutError
+	if errors.As(err, &timeout) {
+		return gh.createErrorResponseCode(errMsg, models.GenerationTimeoutErrorCode)
+	}
+	return gh.createErrorResponse(errMsg)
+}
+
+// releaseSlot releases the image or video slot leased to owner
+func (gh *GenerationHandler) releaseSlot(tokenID int64, owner string, video bool) {
+	if video {
+		gh.concurrencyManager.ReleaseVideo(tokenID, owner)
+	} else {
+		gh.concurrencyManager.ReleaseImage(tokenID, owner)
+	}
+}
+
+// TaskFinished reports whether the task has completed or failed; it is the
+// owner check for reclaiming concurrency slots
+func (gh *GenerationHandler) TaskFinished(taskID string) bool {
+	task, err := gh.db.GetTask(taskID)
+	if err != nil || task == nil {
+		return false
+	}
+	return task.Status != "processing"
+}
+
+// blameToken applies the policy for how a request with the token failed:
+// quota exhaustion and 429s ban it, a rejected session gets one AT refresh
+// and then needs a re-login, and anything else counts as an error
+func (gh *GenerationHandler) blameToken(tokenID int64, err error, logger *slog.Logger) {
+	switch client.ErrorKindOf(err) {
+	case client.ErrorQuotaExhausted:
+		gh.tokenManager.BanTokenForQuota(tokenID)
+	case client.ErrorRateLimited:
+		logger.Warn("Token hit 429, banning")
+		gh.tokenManager.BanTokenFor429(tokenID)
+	case client.ErrorAuth:
+		if gh.tokenManager.RefreshRejectedAT(tokenID) {
+			logger.Warn("Upstream rejected the access token, refreshed it")
+			return
+		}
+		gh.tokenManager.DeactivateForRelogin(tokenID)
+	default:
+		gh.tokenManager.RecordError(tokenID)
 	}
-	defer gh.concurrencyManager.ReleaseImage(token.ID)
+}
+
+// uploadImage uploads a reference image, retrying transient upstream errors
+func (gh *GenerationHandler) uploadImage(ctx context.Context, at string, image []byte, aspectRatio string) (string, error) {
+	return client.RetryTransient(func() (string, error) {
+		return gh.flowClient.WithContext(ctx).UploadImage(at, image, aspectRatio)
+	})
+}
+
+func (gh *GenerationHandler) handleImageGeneration(ctx context.Context, token *models.Token, projectID string, modelConfig models.ModelConfig, task *models.Task, images [][]byte, trace *RequestTrace, chunkChan chan<- string) error {
+	// The slot was leased when the token was selected
+	defer gh.concurrencyManager.ReleaseImage(token.ID, task.TaskID)
 
 	// Upload images if any
 	var imageInputs []map[string]interface{}
 	if len(images) > 0 {
 		chunkChan <- gh.createStreamChunk(fmt.Sprintf("Uploading %d reference image(s)...\n", len(images)), "", false)
+		trace.Mark("upload")
 
 		for i, imgBytes := range images {
-			mediaID, err := gh.flowClient.UploadImage(token.AT, imgBytes, modelConfig.AspectRatio)
+			mediaID, err := gh.uploadImage(ctx, token.AT, imgBytes, modelConfig.AspectRatio)
 			if err != nil {
 				return fmt.Errorf("failed to upload image %d: %w", i+1, err)
 			}
@@ -205,16 +754,18 @@ func (gh *GenerationHandler) handleImageGeneration(token *models.Token, projectI
 
 	// Generate
 	chunkChan <- gh.createStreamChunk("Generating image...\n", "", false)
+	trace.Mark("generate")
 
-	result, err := gh.flowClient.GenerateImage(token.AT, projectID, prompt, modelConfig.ModelName, modelConfig.AspectRatio, imageInputs)
+	// Not retried: a generation that failed may still have been accepted and charged
+	result, err := gh.flowClient.WithContext(ctx).GenerateImage(token.AT, projectID, task.Prompt, task.Params.NegativePrompt, modelConfig.ModelName, modelConfig.AspectRatio, imageInputs, task.Params.Seed, task.Params.N)
 	if err != nil {
 		errMsg := fmt.Sprintf("Generation failed: %v", err)
 		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
-		chunkChan <- gh.createErrorResponse(errMsg)
+		chunkChan <- gh.failureResponse(errMsg, err)
 		return err
 	}
 
-	// Extract URL
+	// Extract URLs
 	media, ok := result["media"].([]interface{})
 	if !ok || len(media) == 0 {
 		errMsg := "Empty generation result"
@@ -223,45 +774,93 @@ func (gh *GenerationHandler) handleImageGeneration(token *models.Token, projectI
 		return fmt.Errorf(errMsg)
 	}
 
-	mediaItem := media[0].(map[string]interface{})
-	image := mediaItem["image"].(map[string]interface{})
-	genImage := image["generatedImage"].(map[string]interface{})
-	imageURL := genImage["fifeUrl"].(string)
+	var imageURLs []string
+	var mediaID string
+	for _, item := range media {
+		mediaItem, _ := item.(map[string]interface{})
+		image, _ := mediaItem["image"].(map[string]interface{})
+		genImage, _ := image["generatedImage"].(map[string]interface{})
+		imageURL, _ := genImage["fifeUrl"].(string)
+		if imageURL == "" {
+			continue
+		}
+		imageURLs = append(imageURLs, imageURL)
+
+		// The first image is the one follow-up operations such as upscaling refer to
+		if mediaID == "" {
+			mediaID, _ = genImage["mediaGenerationId"].(string)
+			if mediaID == "" {
+				mediaID, _ = mediaItem["name"].(string)
+			}
+		}
+	}
+	if len(imageURLs) == 0 {
+		errMsg := "Empty generation result"
+		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
+		chunkChan <- gh.createErrorResponse(errMsg)
+		return fmt.Errorf(errMsg)
+	}
 
 	// Cache if enabled
-	localURL := imageURL
+	localURLs := make([]string, len(imageURLs))
+	copy(localURLs, imageURLs)
+	var cacheErrors []string
 	cfg := config.Get()
-	if cfg.Cache.Enabled {
+	// Stamped results are always cached and never fall back to the upstream URL
+	stamp := stampsMedia(cfg, "image")
+	if cfg.Cache.Enabled && !task.Params.SkipCache || stamp {
 		chunkChan <- gh.createStreamChunk("Caching image...\n", "", false)
-		if cachedURL, err := gh.cacheFile(imageURL, "image"); err == nil {
-			localURL = cachedURL
+		trace.Mark("cache")
+		for i, imageURL := range imageURLs {
+			if cachedURL, err := gh.cacheFile(ctx, imageURL, "image", task, nil); err == nil {
+				localURLs[i] = cachedURL
+			} else if stamp {
+				chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %v\n", err), "", false)
+				chunkChan <- gh.createErrorResponse(err.Error())
+				return err
+			} else {
+				trace.logger.Warn("Failed to cache result", "url", imageURL, "error", err)
+				chunkChan <- gh.createStreamChunk(fmt.Sprintf("⚠️ Cache failed, returning the upstream URL: %v\n", err), "", false)
+				cacheErrors = append(cacheErrors, err.Error())
+			}
+		}
+		if len(cacheErrors) < len(imageURLs) {
 			chunkChan <- gh.createStreamChunk("✅ Image cached\n", "", false)
-		} else {
-			log.Printf("[CACHE] Failed: %v", err)
-			chunkChan <- gh.createStreamChunk(fmt.Sprintf("⚠️ Cache failed: %v\n", err), "", false)
 		}
 	}
 
+	gh.db.UpdateTask(task.TaskID, map[string]interface{}{
+		"cache_error":  strings.Join(cacheErrors, "; "),
+		"status":       "completed",
+		"progress":     100,
+		"result_urls":  localURLs,
+		"media_id":     mediaID,
+		"completed_at": time.Now(),
+	})
+
 	// Return result
-	chunkChan <- gh.createStreamChunk(fmt.Sprintf("![Generated Image](%s)", localURL), "stop", true)
+	chunkChan <- gh.resultChunk(task, localURLs)
 	return nil
 }
 
-func (gh *GenerationHandler) handleVideoGeneration(token *models.Token, projectID string, modelConfig models.ModelConfig, prompt string, images [][]byte, chunkChan chan<- string) error {
-	// Acquire concurrency slot
-	if !gh.concurrencyManager.AcquireVideo(token.ID) {
-		errMsg := "Video concurrency limit reached"
-		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
-		chunkChan <- gh.createErrorResponse(errMsg)
-		return fmt.Errorf(errMsg)
-	}
-	defer gh.concurrencyManager.ReleaseVideo(token.ID)
+func (gh *GenerationHandler) handleVideoGeneration(ctx context.Context, token *models.Token, projectID string, modelConfig models.ModelConfig, task *models.Task, images [][]byte, trace *RequestTrace, chunkChan chan<- string) (err error) {
+	// The slot was leased when the token was selected
+	defer func() {
+		// A pending video keeps its slot until the background poll ends
+		if _, pending := err.(*videoPending); !pending {
+			gh.concurrencyManager.ReleaseVideo(token.ID, task.TaskID)
+		}
+	}()
 
 	videoType := modelConfig.VideoType
 	imageCount := len(images)
 
 	// Validate images based on video type
-	if videoType == "t2v" && imageCount > 0 {
+	if videoType == "extend" && imageCount > 0 {
+		chunkChan <- gh.createStreamChunk("⚠️ Extend model doesn't support images, ignoring...\n", "", false)
+		images = nil
+		imageCount = 0
+	} else if videoType == "t2v" && imageCount > 0 {
 		chunkChan <- gh.createStreamChunk("⚠️ T2V model doesn't support images, ignoring...\n", "", false)
 		images = nil
 		imageCount = 0
@@ -275,6 +874,7 @@ func (gh *GenerationHandler) handleVideoGeneration(token *models.Token, projectI
 	}
 
 	// Upload images
+	trace.Mark("upload")
 	var startMediaID, endMediaID string
 	var referenceImages []map[string]interface{}
 
@@ -282,18 +882,18 @@ func (gh *GenerationHandler) handleVideoGeneration(token *models.Token, projectI
 		if len(images) == 1 {
 			chunkChan <- gh.createStreamChunk("Uploading start frame...\n", "", false)
 			var err error
-			startMediaID, err = gh.flowClient.UploadImage(token.AT, images[0], modelConfig.AspectRatio)
+			startMediaID, err = gh.uploadImage(ctx, token.AT, images[0], modelConfig.AspectRatio)
 			if err != nil {
 				return fmt.Errorf("failed to upload start frame: %w", err)
 			}
 		} else if len(images) >= 2 {
 			chunkChan <- gh.createStreamChunk("Uploading start and end frames...\n", "", false)
 			var err error
-			startMediaID, err = gh.flowClient.UploadImage(token.AT, images[0], modelConfig.AspectRatio)
+			startMediaID, err = gh.uploadImage(ctx, token.AT, images[0], modelConfig.AspectRatio)
 			if err != nil {
 				return fmt.Errorf("failed to upload start frame: %w", err)
 			}
-			endMediaID, err = gh.flowClient.UploadImage(token.AT, images[1], modelConfig.AspectRatio)
+			endMediaID, err = gh.uploadImage(ctx, token.AT, images[1], modelConfig.AspectRatio)
 			if err != nil {
 				return fmt.Errorf("failed to upload end frame: %w", err)
 			}
@@ -301,7 +901,7 @@ func (gh *GenerationHandler) handleVideoGeneration(token *models.Token, projectI
 	} else if videoType == "r2v" && len(images) > 0 {
 		chunkChan <- gh.createStreamChunk(fmt.Sprintf("Uploading %d reference images...\n", len(images)), "", false)
 		for i, img := range images {
-			mediaID, err := gh.flowClient.UploadImage(token.AT, img, modelConfig.AspectRatio)
+			mediaID, err := gh.uploadImage(ctx, token.AT, img, modelConfig.AspectRatio)
 			if err != nil {
 				return fmt.Errorf("failed to upload reference image %d: %w", i+1, err)
 			}
@@ -320,21 +920,42 @@ func (gh *GenerationHandler) handleVideoGeneration(token *models.Token, projectI
 		userPaygateTier = "PAYGATE_TIER_ONE"
 	}
 
-	var result map[string]interface{}
-	var err error
-
-	if videoType == "i2v" && startMediaID != "" {
-		result, err = gh.flowClient.GenerateVideoStartEnd(token.AT, projectID, prompt, modelConfig.ModelKey, modelConfig.AspectRatio, startMediaID, endMediaID, userPaygateTier)
+	prompt := task.Prompt
+	negativePrompt := task.Params.NegativePrompt
+	seed := task.Params.Seed
+
+	trace.Mark("submit")
+	fc := gh.flowClient.WithContext(ctx)
+	var submit func() (map[string]interface{}, error)
+	if videoType == "extend" {
+		prior, _ := gh.db.GetTask(task.Params.PriorTaskID)
+		if prior == nil {
+			return fmt.Errorf("task %s not found", task.Params.PriorTaskID)
+		}
+		chunkChan <- gh.createStreamChunk("Extending previous video...\n", "", false)
+		submit = func() (map[string]interface{}, error) {
+			return fc.GenerateVideoExtend(token.AT, projectID, prompt, negativePrompt, modelConfig.ModelKey, modelConfig.AspectRatio, prior.MediaID, prior.SceneID, userPaygateTier, seed)
+		}
+	} else if videoType == "i2v" && startMediaID != "" {
+		submit = func() (map[string]interface{}, error) {
+			return fc.GenerateVideoStartEnd(token.AT, projectID, prompt, negativePrompt, modelConfig.ModelKey, modelConfig.AspectRatio, startMediaID, endMediaID, userPaygateTier, seed)
+		}
 	} else if videoType == "r2v" && len(referenceImages) > 0 {
-		result, err = gh.flowClient.GenerateVideoReferenceImages(token.AT, projectID, prompt, modelConfig.ModelKey, modelConfig.AspectRatio, referenceImages, userPaygateTier)
+		submit = func() (map[string]interface{}, error) {
+			return fc.GenerateVideoReferenceImages(token.AT, projectID, prompt, negativePrompt, modelConfig.ModelKey, modelConfig.AspectRatio, referenceImages, userPaygateTier, seed)
+		}
 	} else {
-		result, err = gh.flowClient.GenerateVideoText(token.AT, projectID, prompt, modelConfig.ModelKey, modelConfig.AspectRatio, userPaygateTier)
+		submit = func() (map[string]interface{}, error) {
+			return fc.GenerateVideoText(token.AT, projectID, prompt, negativePrompt, modelConfig.ModelKey, modelConfig.AspectRatio, userPaygateTier, seed)
+		}
 	}
+	// Not retried: a generation that failed may still have been accepted and charged
+	result, err := submit()
 
 	if err != nil {
 		errMsg := fmt.Sprintf("Video generation failed: %v", err)
 		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
-		chunkChan <- gh.createErrorResponse(errMsg)
+		chunkChan <- gh.failureResponse(errMsg, err)
 		return err
 	}
 
@@ -349,45 +970,155 @@ func (gh *GenerationHandler) handleVideoGeneration(token *models.Token, projectI
 
 	operation := operations[0].(map[string]interface{})
 	operationData := operation["operation"].(map[string]interface{})
-	taskID := operationData["name"].(string)
+	operationName, _ := operationData["name"].(string)
+	sceneID, _ := operation["sceneId"].(string)
 
-	// Save task
-	task := &models.Task{
-		TaskID:  taskID,
-		TokenID: token.ID,
-		Model:   modelConfig.ModelKey,
-		Prompt:  prompt,
-		Status:  "processing",
-	}
-	gh.db.CreateTask(task)
+	// Link the task to the upstream operation
+	gh.db.UpdateTask(task.TaskID, map[string]interface{}{
+		"operation_name": operationName,
+		"scene_id":       sceneID,
+	})
 
 	// Poll for result
 	chunkChan <- gh.createStreamChunk("Video generating...\n", "", false)
 
-	return gh.pollVideoResult(token, []map[string]interface{}{operation}, chunkChan)
+	trace.Mark("poll")
+	return gh.pollVideoResult(ctx, token, task, []map[string]interface{}{operation}, trace, chunkChan, true)
+}
+
+// videoPending is returned by pollVideoResult when a video outlives the poll
+// window and flow.poll_timeout is "pending". The client has been answered with
+// the task ID; the video's slot stays held until pollPending finishes it.
+type videoPending struct {
+	token      *models.Token
+	operations []map[string]interface{}
 }
 
-func (gh *GenerationHandler) pollVideoResult(token *models.Token, operations []map[string]interface{}, chunkChan chan<- string) error {
+func (p *videoPending) Error() string {
+	return "video still processing"
+}
+
+// pollPending polls a pending video for another max_poll_attempts, then
+// releases its slot and hands the outcome to finish
+func (gh *GenerationHandler) pollPending(p *videoPending, task *models.Task, logger *slog.Logger, finish func(error)) {
+	defer gh.concurrencyManager.ReleaseVideo(p.token.ID, task.TaskID)
+
+	// Nobody reads the progress any more
+	discard := make(chan string)
+	go func() {
+		for range discard {
+		}
+	}()
+	defer close(discard)
+
+	// A panic must not take the process down, and the task still finishes
+	finished := false
+	defer func() {
+		if r := recover(); r != nil {
+			err := gh.recoverGeneration(r, "", task.TaskID, nil)
+			if !finished {
+				finish(err)
+			}
+		}
+	}()
+
+	// The lease was partly used by the first poll; renew it for this one so
+	// the slot is not reclaimed while the video is still polled
+	if !gh.concurrencyManager.RenewVideo(p.token.ID, task.TaskID, slotTTL(true)) &&
+		!gh.concurrencyManager.AcquireVideo(p.token.ID, task.TaskID, slotTTL(true)) {
+		logger.Warn("Video slot was reclaimed and the token is full, polling without one")
+	}
+
+	// Listed as in flight so the watchdog leaves the task to this poll
+	trace := newRequestTrace(task.Model, false, logger)
+	trace.setTask(task.TaskID)
+	trace.setToken(p.token.ID, nil)
+	gh.inFlight.Store(trace, &GenerationRequest{Model: task.Model, KeyID: task.Params.KeyID, TaskID: task.TaskID})
+	defer gh.inFlight.Delete(trace)
+
+	ctx, cancel := withGenerationTimeout(context.Background(), "video")
+	defer cancel()
+	err := gh.pollVideoResult(ctx, p.token, task, p.operations, trace, discard, false)
+	finished = true
+	finish(err)
+}
+
+// pendingResponse is the final chunk of a video answered before it finished:
+// the task ID and where to wait for it, with flow.pending_finish_reason
+func (gh *GenerationHandler) pendingResponse(task *models.Task) string {
+	cfg := config.Get()
+	statusURL := strings.TrimRight(cfg.Cache.BaseURL, "/") + "/v1/tasks/" + task.TaskID + "/wait"
+
+	var content string
+	if task.Params.ResponseFormat == ResponseFormatJSON {
+		data, _ := json.Marshal(GenerationPayload{
+			TaskID: task.TaskID, Model: task.Model, Type: task.Params.Type, URLs: []string{}, MimeType: "video/mp4",
+			Status: "processing", StatusURL: statusURL,
+		})
+		content = string(data)
+	} else {
+		content = fmt.Sprintf("⏳ The video is still processing. Task ID: `%s`\n\nCheck for the result at %s\n", task.TaskID, statusURL)
+	}
+
+	chunk := gh.newStreamChunk(content, cfg.Flow.PendingFinishReason, true)
+	chunk["task_id"] = task.TaskID
+	chunk["status_url"] = statusURL
+	data, _ := json.Marshal(chunk)
+	return fmt.Sprintf("data: %s\n\n", string(data))
+}
+
+// pollVideoResult polls until the video succeeds, fails or runs out of
+// attempts or of ctx's generation timeout. With allowPending a timeout under
+// flow.poll_timeout "pending" answers the client and returns *videoPending
+// instead of failing.
+func (gh *GenerationHandler) pollVideoResult(ctx context.Context, token *models.Token, task *models.Task, operations []map[string]interface{}, trace *RequestTrace, chunkChan chan<- string, allowPending bool) error {
 	cfg := config.Get()
 	maxAttempts := cfg.Flow.MaxPollAttempts
 	pollInterval := time.Duration(cfg.Flow.PollInterval * float64(time.Second))
 
+	// The last check is kept on the task to diagnose failures and timeouts
+	upstream := &upstreamTracker{gh: gh, taskID: task.TaskID}
+
+	// Progress chunks are sparse; keep streaming connections from going silent
+	if task.Params != nil && task.Params.Stream {
+		defer gh.keepalive(chunkChan)()
+	}
+
+	var timeout error = &models.GenerationTimeoutError{Type: "video", Polls: maxAttempts}
+poll:
 	for attempt := 0; attempt < maxAttempts; attempt++ {
-		time.Sleep(pollInterval)
+		// The client leaving stops the poll; the video's slot goes with it.
+		// Running out of video_timeout ends it like running out of attempts.
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			cause := context.Cause(ctx)
+			var timeoutErr *models.GenerationTimeoutError
+			if !errors.As(cause, &timeoutErr) {
+				upstream.save()
+				return cause
+			}
+			timeout = cause
+			break poll
+		}
 
-		result, err := gh.flowClient.CheckVideoStatus(token.AT, operations)
+		trace.PollCount++
+		result, err := gh.flowClient.WithContext(ctx).CheckVideoStatus(token.AT, operations)
 		if err != nil {
-			log.Printf("[POLL] Error: %v", err)
+			trace.logger.Warn("Video status poll failed", "attempt", attempt+1, "error", err)
+			upstream.record(attempt+1, "", err, nil)
 			continue
 		}
 
 		checkedOps, ok := result["operations"].([]interface{})
 		if !ok || len(checkedOps) == 0 {
+			upstream.record(attempt+1, "", fmt.Errorf("no operations in status response"), result)
 			continue
 		}
 
-		op := checkedOps[0].(map[string]interface{})
+		op, _ := checkedOps[0].(map[string]interface{})
 		status, _ := op["status"].(string)
+		upstream.record(attempt+1, status, nil, op)
 
 		// Progress update every ~20 seconds
 		if attempt%7 == 0 {
@@ -396,34 +1127,9 @@ func (gh *GenerationHandler) pollVideoResult(token *models.Token, operations []m
 		}
 
 		if status == "MEDIA_GENERATION_STATUS_SUCCESSFUL" {
-			opData := op["operation"].(map[string]interface{})
-			metadata := opData["metadata"].(map[string]interface{})
-			video := metadata["video"].(map[string]interface{})
-			videoURL := video["fifeUrl"].(string)
-
-			// Cache if enabled
-			localURL := videoURL
-			if cfg.Cache.Enabled {
-				chunkChan <- gh.createStreamChunk("Caching video...\n", "", false)
-				if cachedURL, err := gh.cacheFile(videoURL, "video"); err == nil {
-					localURL = cachedURL
-					chunkChan <- gh.createStreamChunk("✅ Video cached\n", "", false)
-				}
-			}
-
-			// Update task
-			taskID := opData["name"].(string)
-			gh.db.UpdateTask(taskID, map[string]interface{}{
-				"status":       "completed",
-				"progress":     100,
-				"result_urls":  []string{localURL},
-				"completed_at": time.Now(),
-			})
-
-			// Return result
-			chunkChan <- gh.createStreamChunk(fmt.Sprintf("<video src='%s' controls style='max-width:100%%'></video>", localURL), "stop", true)
-			return nil
+			return gh.completeVideo(ctx, task, op, trace, chunkChan)
 		} else if strings.HasPrefix(status, "MEDIA_GENERATION_STATUS_ERROR") {
+			upstream.save()
 			errMsg := fmt.Sprintf("Video generation failed: %s", status)
 			chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
 			chunkChan <- gh.createErrorResponse(errMsg)
@@ -431,45 +1137,343 @@ func (gh *GenerationHandler) pollVideoResult(token *models.Token, operations []m
 		}
 	}
 
-	errMsg := fmt.Sprintf("Video generation timeout (polled %d times)", maxAttempts)
+	upstream.save()
+	if allowPending && cfg.Flow.PollTimeout == "pending" {
+		chunkChan <- gh.createStreamChunk("⏳ Still processing, returning the task ID\n", "", false)
+		chunkChan <- gh.pendingResponse(task)
+		return &videoPending{token: token, operations: operations}
+	}
+	errMsg := fmt.Sprintf("Timeout: %v", timeout)
 	chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
-	chunkChan <- gh.createErrorResponse(errMsg)
-	return fmt.Errorf(errMsg)
+	chunkChan <- gh.failureResponse(errMsg, timeout)
+	return timeout
+}
+
+// completeVideo caches a successful video operation's result and completes
+// the task with it
+func (gh *GenerationHandler) completeVideo(ctx context.Context, task *models.Task, op map[string]interface{}, trace *RequestTrace, chunkChan chan<- string) error {
+	cfg := config.Get()
+	opData, _ := op["operation"].(map[string]interface{})
+	metadata, _ := opData["metadata"].(map[string]interface{})
+	video, _ := metadata["video"].(map[string]interface{})
+	videoURL, _ := video["fifeUrl"].(string)
+	mediaID, _ := video["mediaGenerationId"].(string)
+	if videoURL == "" {
+		errMsg := "No video URL in the successful operation"
+		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errMsg), "", false)
+		chunkChan <- gh.createErrorResponse(errMsg)
+		return errors.New(errMsg)
+	}
+
+	// Cache if enabled
+	localURL := videoURL
+	cacheError := ""
+	stamp := stampsMedia(cfg, "video")
+	if cfg.Cache.Enabled && !task.Params.SkipCache || stamp {
+		chunkChan <- gh.createStreamChunk("Caching video...\n", "", false)
+		trace.Mark("cache")
+		progress := func(stage string, percent int) {
+			chunkChan <- gh.createStreamChunk(fmt.Sprintf("Caching video: %s %d%%\n", stage, percent), "", false)
+		}
+		if cachedURL, err := gh.cacheFile(ctx, videoURL, "video", task, progress); err == nil {
+			localURL = cachedURL
+			chunkChan <- gh.createStreamChunk("✅ Video cached\n", "", false)
+		} else if stamp {
+			chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %v\n", err), "", false)
+			chunkChan <- gh.createErrorResponse(err.Error())
+			return err
+		} else {
+			trace.logger.Warn("Failed to cache result", "url", videoURL, "error", err)
+			chunkChan <- gh.createStreamChunk(fmt.Sprintf("⚠️ Cache failed, returning the upstream URL: %v\n", err), "", false)
+			cacheError = err.Error()
+		}
+	}
+
+	// Update task
+	gh.db.UpdateTask(task.TaskID, map[string]interface{}{
+		"cache_error":  cacheError,
+		"status":       "completed",
+		"progress":     100,
+		"result_urls":  []string{localURL},
+		"media_id":     mediaID,
+		"completed_at": time.Now(),
+	})
+
+	// Return result
+	chunkChan <- gh.resultChunk(task, []string{localURL})
+	return nil
+}
+
+// keepalive sends a keepalive to a streaming client every
+// flow.keepalive_interval seconds until the returned stop is called
+func (gh *GenerationHandler) keepalive(chunkChan chan<- string) (stop func()) {
+	cfg := config.Get().Flow
+	if cfg.KeepaliveInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(time.Duration(cfg.KeepaliveInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			ping := ": ping\n\n"
+			if cfg.Keepalive == "delta" {
+				ping = gh.createStreamChunk("", "", true)
+			}
+			select {
+			case chunkChan <- ping:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
 }
 
-func (gh *GenerationHandler) cacheFile(urlStr, mediaType string) (string, error) {
-	resp, err := http.Get(urlStr)
+// progressReader reports how much of a known-size stream has been read, once
+// per progressStep percent
+type progressReader struct {
+	r        io.Reader
+	total    int64
+	read     int64
+	reported int
+	report   func(percent int)
+}
+
+const progressStep = 10
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if percent := int(p.read * 100 / p.total); percent >= p.reported+progressStep {
+		p.reported = percent - percent%progressStep
+		p.report(p.reported)
+	}
+	return n, err
+}
+
+// withProgress wraps r when there is a callback and a known size
+func withProgress(r io.Reader, total int64, stage string, progress func(stage string, percent int)) io.Reader {
+	if progress == nil || total <= 0 {
+		return r
+	}
+	return &progressReader{r: r, total: total, report: func(percent int) { progress(stage, percent) }}
+}
+
+// downloadClient fetches generated media from upstream; the timeout covers
+// the whole transfer, so a stalled CDN cannot hold a worker and its slot
+var downloadClient = &http.Client{Timeout: 10 * time.Minute}
+
+// cacheFile downloads media, stamps it when watermarking applies, embeds the
+// task's provenance into images when configured, and stores it in the cache
+// backend. progress, when set, receives download and upload percentages.
+func (gh *GenerationHandler) cacheFile(ctx context.Context, urlStr, mediaType string, task *models.Task, progress func(stage string, percent int)) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := downloadClient.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	ext := ".jpg"
-	if mediaType == "video" {
-		ext = ".mp4"
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: HTTP %d", resp.StatusCode)
 	}
 
-	filename := uuid.New().String() + ext
-	filePath := filepath.Join(gh.cacheDir, filename)
+	// Download to a temp file first so the backend gets a known size
+	tmpFile, err := os.CreateTemp(gh.cacheDir, "download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer func() { tmpFile.Close() }()
 
-	file, err := os.Create(filePath)
+	size, err := io.Copy(tmpFile, withProgress(resp.Body, resp.ContentLength, "downloading", progress))
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, resp.Body)
+	// Never cache an error page or a truncated file in place of the result
+	format, err := verifyMedia(tmpFile, size, resp.ContentLength, mediaType)
 	if err != nil {
 		return "", err
 	}
 
 	cfg := config.Get()
-	baseURL := cfg.Cache.BaseURL
-	if baseURL == "" {
-		baseURL = fmt.Sprintf("http://localhost:%d", cfg.Server.Port)
+	rewritten := false
+	if stampsMedia(cfg, mediaType) {
+		if format, err = watermarkFile(tmpFile.Name(), format, mediaType, cfg.Watermark); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrWatermark, err)
+		}
+		rewritten = true
+	}
+	if cfg.Provenance.Enabled && mediaType == "image" {
+		if err := embedProvenanceFile(tmpFile.Name(), cfg, task); err != nil {
+			cacheLog.Warn("Failed to embed provenance", "task_id", task.TaskID, "error", err)
+		} else {
+			rewritten = true
+		}
+	}
+	if rewritten {
+		// Stamping or embedding rewrote the file
+		tmpFile.Close()
+		if tmpFile, err = os.Open(tmpFile.Name()); err != nil {
+			return "", err
+		}
+		info, err := tmpFile.Stat()
+		if err != nil {
+			return "", err
+		}
+		size = info.Size()
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return gh.saveMedia(withProgress(tmpFile, size, "uploading", progress), size, format.ext, format.contentType, mediaType)
+}
+
+// saveMedia stores media through the configured cache backend and tracks it for expiry
+func (gh *GenerationHandler) saveMedia(r io.Reader, size int64, ext, contentType, mediaType string) (string, error) {
+	backend, err := storage.New(gh.cacheDir, config.Get())
+	if err != nil {
+		return "", err
+	}
+
+	filename := uuid.New().String() + ext
+	cachedURL, err := backend.Save(filename, r, size, contentType)
+	if err != nil {
+		return "", fmt.Errorf("%s backend: %w", backend.Name(), err)
 	}
 
-	return fmt.Sprintf("%s/tmp/%s", baseURL, filename), nil
+	// Track the file so the cache janitor can expire it
+	if err := gh.db.AddCachedFile(&models.CachedFile{
+		Key:       filename,
+		Backend:   backend.Name(),
+		ObjectKey: backend.ObjectKey(filename),
+		URL:       cachedURL,
+		Size:      size,
+		MediaType: mediaType,
+	}); err != nil {
+		cacheLog.Error("Failed to track cached file", "key", filename, "error", err)
+	}
+
+	return cachedURL, nil
+}
+
+// resultContent renders the final message: markdown/HTML by default, or a JSON payload
+func (gh *GenerationHandler) resultContent(task *models.Task, urls []string) string {
+	isVideo := task.Params.Type == "video"
+	urls = storage.SignURLs(urls)
+
+	if task.Params.ResponseFormat == ResponseFormatJSON {
+		payload := GenerationPayload{
+			TaskID:   task.TaskID,
+			Model:    task.Model,
+			Type:     task.Params.Type,
+			URLs:     urls,
+			MimeType: "image/jpeg",
+		}
+		if isVideo {
+			payload.MimeType = "video/mp4"
+		}
+		if task.CreatedAt != nil {
+			payload.Duration = math.Round(time.Since(*task.CreatedAt).Seconds()*100) / 100
+		}
+		if task.Params.FallbackFrom != "" {
+			payload.Fallback = FallbackImagePreview
+			payload.RequestedModel = task.Params.FallbackFrom
+		}
+		data, _ := json.Marshal(payload)
+		return string(data)
+	}
+
+	if task.Params.FallbackFrom != "" {
+		return fmt.Sprintf("_Image preview: no video token was available for %s_\n\n", task.Params.FallbackFrom) +
+			gh.markdownContent(urls, false)
+	}
+	return gh.markdownContent(urls, isVideo)
+}
+
+// markdownContent renders result URLs for the default (non-JSON) response format
+func (gh *GenerationHandler) markdownContent(urls []string, isVideo bool) string {
+	if isVideo {
+		return fmt.Sprintf("<video src='%s' controls style='max-width:100%%'></video>", urls[0])
+	}
+	if len(urls) == 1 {
+		return fmt.Sprintf("![Generated Image](%s)", urls[0])
+	}
+	var content strings.Builder
+	for i, url := range urls {
+		fmt.Fprintf(&content, "- ![Generated Image %d](%s)\n", i+1, url)
+	}
+	return content.String()
+}
+
+// generateImagePreview runs the prompt of a video request that found no video
+// token through PreviewImageModel at the video's aspect ratio, in the token
+// group the video request was routed to. The result is labeled as a fallback
+// in its content and task parameters. A key that may not use the preview
+// model, or is over its rate limit, gets the no-token error instead.
+func (gh *GenerationHandler) generateImagePreview(req *GenerationRequest, model string, modelConfig models.ModelConfig, tokenGroupID int64, chunkChan chan<- string) error {
+	preview, _, err := models.ResolveModel(PreviewImageModel, modelConfig.Aspect())
+	if err == nil && req.AllowModel != nil && !req.AllowModel(preview) {
+		err = fmt.Errorf("not allowed for this key or rate limited")
+	}
+	if err != nil {
+		errMsg := gh.getNoTokenErrorMessage("video")
+		chunkChan <- gh.createErrorResponse(errMsg)
+		return fmt.Errorf("%s (image preview unavailable: %v)", errMsg, err)
+	}
+
+	generationLog.Info("No video token, generating image preview", "request_id", req.RequestID, "model", model, "preview_model", preview)
+	chunkChan <- gh.createStreamChunk(fmt.Sprintf("⚠️ No video tokens available for %s, generating an image preview instead\n", model), "", false)
+
+	previewReq := *req
+	previewReq.Model = preview
+	previewReq.AspectRatio = ""
+	previewReq.Images = nil
+	previewReq.N = 1
+	previewReq.PriorTaskID = ""
+	previewReq.ImageFallback = false
+	previewReq.FallbackFrom = model
+	previewReq.TokenGroupID = tokenGroupID
+	previewReq.AllowModel = nil
+
+	if gh.queuePreview != nil {
+		if err := gh.queuePreview(&previewReq, chunkChan); err != nil {
+			chunkChan <- gh.createErrorResponse(err.Error())
+			return err
+		}
+		return errPreviewQueued
+	}
+
+	// The preview run closes the channel it is given, while ours is closed by
+	// the caller, so its chunks are relayed
+	relay := make(chan string, cap(chunkChan))
+	done := make(chan struct{})
+	go func() {
+		for chunk := range relay {
+			chunkChan <- chunk
+		}
+		close(done)
+	}()
+	err = gh.HandleGeneration(&previewReq, relay)
+	<-done
+	return err
 }
 
 func (gh *GenerationHandler) getNoTokenErrorMessage(genType string) string {
@@ -480,6 +1484,11 @@ func (gh *GenerationHandler) getNoTokenErrorMessage(genType string) string {
 }
 
 func (gh *GenerationHandler) createStreamChunk(content, finishReason string, isContent bool) string {
+	data, _ := json.Marshal(gh.newStreamChunk(content, finishReason, isContent))
+	return fmt.Sprintf("data: %s\n\n", string(data))
+}
+
+func (gh *GenerationHandler) newStreamChunk(content, finishReason string, isContent bool) map[string]interface{} {
 	chunk := map[string]interface{}{
 		"id":      fmt.Sprintf("chatcmpl-%d", time.Now().UnixMilli()),
 		"object":  "chat.completion.chunk",
@@ -506,10 +1515,38 @@ func (gh *GenerationHandler) createStreamChunk(content, finishReason string, isC
 		chunk["choices"].([]map[string]interface{})[0]["finish_reason"] = finishReason
 	}
 
+	return chunk
+}
+
+// resultChunk is the final chunk of a successful generation, carrying its
+// results and usage
+func (gh *GenerationHandler) resultChunk(task *models.Task, urls []string) string {
+	chunk := gh.newStreamChunk(gh.resultContent(task, urls), "stop", true)
+	chunk["usage"] = taskUsage(task, task.Prompt, len(urls))
 	data, _ := json.Marshal(chunk)
 	return fmt.Sprintf("data: %s\n\n", string(data))
 }
 
+// cachedBytes sums the sizes of the results served from the cache
+func (gh *GenerationHandler) cachedBytes(urls []string) int64 {
+	var total int64
+	for _, u := range urls {
+		if file, err := gh.db.GetCachedFileByURL(u); err == nil && file != nil {
+			total += file.Size
+		}
+	}
+	return total
+}
+
+// taskUsage is the usage of a task that produced mediaCount results
+func taskUsage(task *models.Task, prompt string, mediaCount int) models.Usage {
+	modelConfig := models.ModelConfig{}
+	if task.Params != nil {
+		modelConfig.Type, modelConfig.ModelKey = task.Params.Type, task.Params.ModelKey
+	}
+	return models.NewUsage(prompt, modelConfig, mediaCount)
+}
+
 func (gh *GenerationHandler) createCompletionResponse(content, mediaType string, isAvailabilityCheck bool) string {
 	formattedContent := content
 	if !isAvailabilityCheck {
@@ -535,6 +1572,8 @@ func (gh *GenerationHandler) createCompletionResponse(content, mediaType string,
 				"finish_reason": "stop",
 			},
 		},
+		// Availability checks generate nothing
+		"usage": models.Usage{},
 	}
 
 	data, _ := json.Marshal(response)
@@ -542,14 +1581,28 @@ func (gh *GenerationHandler) createCompletionResponse(content, mediaType string,
 }
 
 func (gh *GenerationHandler) createErrorResponse(errMsg string) string {
-	response := map[string]interface{}{
-		"error": map[string]interface{}{
-			"message": errMsg,
-			"type":    "invalid_request_error",
-			"code":    "generation_failed",
-		},
+	return gh.createErrorResponseCode(errMsg, "generation_failed")
+}
+
+func (gh *GenerationHandler) createErrorResponseCode(errMsg, code string) string {
+	errObj := map[string]interface{}{
+		"message": errMsg,
+		"type":    "invalid_request_error",
+		"code":    code,
 	}
+	if announcement := config.Get().GetAnnouncement(); announcement != "" {
+		errObj["announcement"] = announcement
+	}
+	response := map[string]interface{}{"error": errObj}
 
 	data, _ := json.Marshal(response)
 	return string(data)
 }
+
+// truncate shortens s to at most n characters for log output
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n]) + "..."
+	}
+	return s
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+
+	"github.com/google/uuid"
+)
+
+var hookLog = logging.Component("hooks")
+
+// Lifecycle stages at which hooks run
+const (
+	HookPreSelect    = "pre_select"    // before a token is chosen; may reject or re-route
+	HookPreSubmit    = "pre_submit"    // token chosen, before the request reaches Flow; may reject
+	HookPostComplete = "post_complete" // generation succeeded
+	HookOnError      = "on_error"      // generation failed
+)
+
+// HookEvent describes a generation to hooks. Pre-select hooks may change
+// TokenGroupID and Strategy to route the request.
+type HookEvent struct {
+	Stage        string   `json:"stage"`
+	RequestID    string   `json:"request_id,omitempty"`
+	TaskID       string   `json:"task_id,omitempty"`
+	Model        string   `json:"model"`
+	Type         string   `json:"type"` // image or video
+	Prompt       string   `json:"prompt"`
+	KeyID        string   `json:"key_id,omitempty"`
+	TokenGroupID int64    `json:"token_group_id,omitempty"`
+	Strategy     string   `json:"strategy,omitempty"`
+	TokenID      int64    `json:"token_id,omitempty"`
+	ResultURLs   []string `json:"result_urls,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	DurationMs   int64    `json:"duration_ms,omitempty"`
+}
+
+// Hook is called at a lifecycle stage. An error from a pre-stage hook rejects
+// the request with the error's message; errors from post stages are logged.
+type Hook func(ev *HookEvent) error
+
+// HookRejection is returned when a pre-stage hook turns a request down
+type HookRejection struct {
+	Hook   string
+	Reason string
+}
+
+func (e *HookRejection) Error() string {
+	return fmt.Sprintf("request rejected by %s: %s", e.Hook, e.Reason)
+}
+
+type namedHook struct {
+	name string
+	fn   Hook
+}
+
+// HookRegistry holds the hooks of each stage, run in registration order
+type HookRegistry struct {
+	mu    sync.RWMutex
+	hooks map[string][]namedHook
+}
+
+// NewHookRegistry creates an empty registry
+func NewHookRegistry() *HookRegistry {
+	return &HookRegistry{hooks: make(map[string][]namedHook)}
+}
+
+// Register adds a hook for stage; name identifies it in logs and rejections
+func (r *HookRegistry) Register(stage, name string, hook Hook) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks[stage] = append(r.hooks[stage], namedHook{name: name, fn: hook})
+}
+
+// Has reports whether any hook is registered for stage
+func (r *HookRegistry) Has(stage string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.hooks[stage]) > 0
+}
+
+func (r *HookRegistry) stage(stage string) []namedHook {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.hooks[stage]
+}
+
+// Run calls the hooks of a pre stage in order and stops at the first that
+// rejects the request
+func (r *HookRegistry) Run(stage string, ev *HookEvent) error {
+	ev.Stage = stage
+	for _, h := range r.stage(stage) {
+		if err := h.fn(ev); err != nil {
+			if rejection, ok := err.(*HookRejection); ok {
+				return rejection
+			}
+			return &HookRejection{Hook: h.name, Reason: err.Error()}
+		}
+	}
+	return nil
+}
+
+// Notify calls the hooks of a post stage in the background
+func (r *HookRegistry) Notify(stage string, ev *HookEvent) {
+	hooks := r.stage(stage)
+	if len(hooks) == 0 {
+		return
+	}
+	ev.Stage = stage
+	go func() {
+		for _, h := range hooks {
+			if err := h.fn(ev); err != nil {
+				hookLog.Warn("Hook failed", "hook", h.name, "stage", stage, "request_id", ev.RequestID, "task_id", ev.TaskID, "error", err)
+			}
+		}
+	}()
+}
+
+// hookResponse is what pre-stage HTTP hooks may answer; an empty body or
+// omitted allow lets the request through
+type hookResponse struct {
+	Allow        *bool  `json:"allow"`
+	Reason       string `json:"reason"`
+	TokenGroupID *int64 `json:"token_group_id"`
+	Strategy     string `json:"strategy"`
+}
+
+// RegisterHTTPHooks registers the external hooks from the configuration
+func RegisterHTTPHooks(r *HookRegistry, hooks []config.HookConfig) {
+	for _, hc := range hooks {
+		hook := newHTTPHook(hc)
+		for _, stage := range hc.Stages {
+			r.Register(stage, hc.Name, hook)
+		}
+		hookLog.Info("HTTP hook registered", "hook", hc.Name, "url", hc.URL, "stages", hc.Stages)
+	}
+}
+
+// newHTTPHook POSTs the event to an external service. Failing pre-stage calls
+// reject the request unless the hook fails open.
+func newHTTPHook(hc config.HookConfig) Hook {
+	client := &http.Client{Timeout: time.Duration(hc.Timeout) * time.Second}
+	return func(ev *HookEvent) error {
+		resp, err := callHTTPHook(client, hc, ev)
+		if err != nil {
+			if hc.FailOpen {
+				hookLog.Warn("Hook unavailable, failing open", "hook", hc.Name, "stage", ev.Stage, "request_id", ev.RequestID, "error", err)
+				return nil
+			}
+			return &HookRejection{Hook: hc.Name, Reason: "hook unavailable"}
+		}
+		if resp.Allow != nil && !*resp.Allow {
+			reason := resp.Reason
+			if reason == "" {
+				reason = "not allowed"
+			}
+			return &HookRejection{Hook: hc.Name, Reason: reason}
+		}
+		if ev.Stage == HookPreSelect {
+			if resp.TokenGroupID != nil {
+				ev.TokenGroupID = *resp.TokenGroupID
+			}
+			if resp.Strategy != "" && IsValidStrategy(resp.Strategy) {
+				ev.Strategy = resp.Strategy
+			}
+		}
+		return nil
+	}
+}
+
+func callHTTPHook(client *http.Client, hc config.HookConfig, ev *HookEvent) (*hookResponse, error) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", hc.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hc.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		nonce := uuid.New().String()
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookNonceHeader, nonce)
+		req.Header.Set(WebhookSignatureHeader, signWebhook(hc.Secret, timestamp, nonce, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("hook returned HTTP %d", resp.StatusCode)
+	}
+
+	var result hookResponse
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("invalid hook response: %w", err)
+		}
+	}
+	return &result, nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"time"
+
+	"flow2api/internal/models"
+)
+
+// The generation pipeline depends on these interfaces rather than on the
+// concrete services, so programs embedding flow2api (see pkg/flow2api) can
+// replace token storage, balancing or concurrency limits with their own.
+
+// TokenStore provides the tokens used for generation and records their use.
+// TokenManager is the database-backed implementation.
+type TokenStore interface {
+	GetToken(id int64) (*models.Token, error)
+	GetActiveTokens() ([]*models.Token, error)
+	GetTokenGroups() ([]*models.TokenGroup, error)
+	GetDailyUsage() (map[int64]models.DailyUsage, error)
+
+	// IsATValid reports whether the token's access token is usable,
+	// refreshing it when it has expired
+	IsATValid(id int64) (bool, error)
+	// EnsureProjectExists returns the token's Flow project ID, creating the
+	// project when needed
+	EnsureProjectExists(id int64) (string, error)
+	// RefreshCredits re-reads the token's credit balance from Flow
+	RefreshCredits(id int64) (int, error)
+
+	RecordUsage(id int64, isVideo bool) error
+	RecordSuccess(id int64) error
+	RecordError(id int64) error
+	BanTokenFor429(id int64) error
+	BanTokenForQuota(id int64) error
+	// RefreshRejectedAT refreshes an access token the upstream rejected, once;
+	// false means the session itself needs a re-login
+	RefreshRejectedAT(id int64) bool
+	DeactivateForRelogin(id int64) error
+}
+
+// Balancer picks the token for each generation. LoadBalancer is the default
+// implementation. keyGroup is the token group bound to the calling API key,
+// 0 when it has none. The Select methods only check for a free slot;
+// AcquireToken also leases it to owner, as the Limiter acquire methods do,
+// and returns nil when no token has one.
+type Balancer interface {
+	SelectToken(forImage, forVideo bool, model string, keyGroup int64) (*models.Token, error)
+	SelectTokenWithStrategy(forImage, forVideo bool, model, strategy string, keyGroup int64) (*models.Token, error)
+	AcquireToken(forImage, forVideo bool, model, strategy string, keyGroup int64, owner string, ttl time.Duration) (*models.Token, *models.TokenChoice, error)
+}
+
+// Limiter bounds concurrent generations per token. ConcurrencyManager is the
+// default implementation. Acquire methods lease a slot to owner, the task
+// ID, and return false when the token is at its limit; every successful
+// acquire is paired with a release, and a slot not released within ttl may
+// be reclaimed.
+type Limiter interface {
+	CanAcquireImage(tokenID int64) bool
+	CanAcquireVideo(tokenID int64) bool
+	AcquireImage(tokenID int64, owner string, ttl time.Duration) bool
+	AcquireVideo(tokenID int64, owner string, ttl time.Duration) bool
+	ReleaseImage(tokenID int64, owner string)
+	ReleaseVideo(tokenID int64, owner string)
+	RenewVideo(tokenID int64, owner string, ttl time.Duration) bool
+	Load(tokens []*models.Token) PoolLoad
+}
+
+// Generator runs generations. GenerationHandler is the implementation; the
+// HTTP API only depends on this interface.
+type Generator interface {
+	// HandleGeneration streams the chunks of one generation to chunkChan and
+	// closes it when done
+	HandleGeneration(req *GenerationRequest, chunkChan chan<- string) error
+	HandleUpscale(req *UpscaleRequest) (*UpscaleResult, error)
+	Estimate(model, aspectRatio string, n, imageCount int, keyGroup int64) (*Estimate, error)
+	CanServe(model, aspectRatio string) bool
+	Status() (*ServiceStatus, error)
+	RunSelfTest() (*SelfTestResult, error)
+	LastSelfTest() *SelfTestResult
+}
+
+var (
+	_ TokenStore = (*TokenManager)(nil)
+	_ Balancer   = (*LoadBalancer)(nil)
+	_ Limiter    = (*ConcurrencyManager)(nil)
+	_ Generator  = (*GenerationHandler)(nil)
+)
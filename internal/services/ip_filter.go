@@ -0,0 +1,180 @@
+package services
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"flow2api/internal/database"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+)
+
+var ipFilterLog = logging.Component("ip_filter")
+
+// ipSweepInterval is how often buckets of addresses that went quiet are dropped
+const ipSweepInterval = time.Minute
+
+// IPFilter admits clients by address and limits the request rate of each
+// address, following the security config
+type IPFilter struct {
+	db *database.Database
+
+	mu        sync.Mutex
+	allow     []netip.Prefix
+	deny      []netip.Prefix
+	rate      float64 // requests per second per address, 0 when unlimited
+	burst     float64
+	buckets   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewIPFilter creates an IP filter and loads the stored security config
+func NewIPFilter(db *database.Database) *IPFilter {
+	f := &IPFilter{
+		db:      db,
+		buckets: make(map[netip.Addr]*tokenBucket),
+	}
+	if err := f.Reload(); err != nil {
+		ipFilterLog.Error("Failed to load security config", "error", err)
+	}
+	return f
+}
+
+// Reload refreshes the lists and rate from the database; per-address fill
+// levels are reset when the rate changes
+func (f *IPFilter) Reload() error {
+	cfg, err := f.db.GetSecurityConfig()
+	if err != nil {
+		return err
+	}
+	allow, err := ParseIPList(cfg.IPAllowlist)
+	if err != nil {
+		return err
+	}
+	deny, err := ParseIPList(cfg.IPDenylist)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rate, burst := cfg.RequestsPerMinute/60, float64(max(cfg.Burst, 1))
+	if rate != f.rate || burst != f.burst {
+		f.buckets = make(map[netip.Addr]*tokenBucket)
+	}
+	f.allow, f.deny, f.rate, f.burst = allow, deny, rate, burst
+	return nil
+}
+
+// Check reports whether a request from ip may proceed. A rejected request
+// has a retryAfter when it hit the rate limit, and none when the address is
+// not admitted at all.
+func (f *IPFilter) Check(ip string) (bool, time.Duration) {
+	addr, err := netip.ParseAddr(ip)
+	if err == nil {
+		addr = addr.Unmap()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !admitted(addr, f.allow, f.deny) {
+		return false, 0
+	}
+	if f.rate <= 0 || !addr.IsValid() {
+		return true, 0
+	}
+
+	now := time.Now()
+	if now.Sub(f.lastSweep) >= ipSweepInterval {
+		f.sweep(now)
+	}
+	b, ok := f.buckets[addr]
+	if !ok {
+		b = &tokenBucket{rate: f.rate, burst: f.burst, tokens: f.burst, last: now}
+		f.buckets[addr] = b
+	}
+	b.refill(now)
+	if wait := b.wait(); wait > 0 {
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that have refilled, which behave like new ones.
+// Called with f.mu held.
+func (f *IPFilter) sweep(now time.Time) {
+	for addr, b := range f.buckets {
+		b.refill(now)
+		if b.tokens >= b.burst {
+			delete(f.buckets, addr)
+		}
+	}
+	f.lastSweep = now
+}
+
+// Admits reports whether cfg would admit ip, ignoring the rate limit
+func Admits(cfg *models.SecurityConfig, ip string) (bool, error) {
+	allow, err := ParseIPList(cfg.IPAllowlist)
+	if err != nil {
+		return false, err
+	}
+	deny, err := ParseIPList(cfg.IPDenylist)
+	if err != nil {
+		return false, err
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err == nil {
+		addr = addr.Unmap()
+	}
+	return admitted(addr, allow, deny), nil
+}
+
+// ParseIPList parses addresses and CIDR ranges such as 10.0.0.0/8
+func ParseIPList(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR range %q", entry)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q", entry)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// admitted applies the denylist, then the allowlist when it is not empty.
+// An unparseable address only passes an empty allowlist.
+func admitted(addr netip.Addr, allow, deny []netip.Prefix) bool {
+	for _, prefix := range deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, prefix := range allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,43 +1,226 @@
 package services
 
 import (
+	"math"
+	"sort"
 	"sync"
 	"time"
 
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
 	"flow2api/internal/models"
 )
 
+var balancerLog = logging.Component("load_balancer")
+
+// creditRefreshInterval limits how often a low-credit token's balance is
+// re-read from Flow during selection
+const creditRefreshInterval = 5 * time.Minute
+
+// creditRefreshTimeout bounds how long a selection waits for those re-reads;
+// slower ones finish in the background for later selections
+const creditRefreshTimeout = 3 * time.Second
+
 // LoadBalancer handles token selection for generation
 type LoadBalancer struct {
-	tokenManager       *TokenManager
-	concurrencyManager *ConcurrencyManager
+	tokenManager       TokenStore
+	concurrencyManager Limiter
 	mu                 sync.RWMutex
+	creditChecks       map[int64]time.Time // last credit refresh of tokens found below the minimum
+	lastPicked         map[int64]int64     // token group -> token AcquireToken leased last
 }
 
 // NewLoadBalancer creates a new load balancer
-func NewLoadBalancer(tm *TokenManager, cm *ConcurrencyManager) *LoadBalancer {
+func NewLoadBalancer(tm TokenStore, cm Limiter) *LoadBalancer {
 	return &LoadBalancer{
 		tokenManager:       tm,
 		concurrencyManager: cm,
+		creditChecks:       make(map[int64]time.Time),
+		lastPicked:         make(map[int64]int64),
 	}
 }
 
-// SelectToken selects an appropriate token for generation
-func (lb *LoadBalancer) SelectToken(forImage, forVideo bool, model string) (*models.Token, error) {
+// Balancing strategies
+const (
+	StrategyScore     = "score"      // prefer more credits and less recent usage
+	StrategyLeastUsed = "least_used" // prefer the lowest use count
+)
+
+// IsValidStrategy reports whether name is a known balancing strategy
+func IsValidStrategy(name string) bool {
+	return name == StrategyScore || name == StrategyLeastUsed
+}
+
+// SelectToken selects an appropriate token for generation. keyGroup is the
+// token group bound to the calling API key, 0 when it has none.
+func (lb *LoadBalancer) SelectToken(forImage, forVideo bool, model string, keyGroup int64) (*models.Token, error) {
+	return lb.SelectTokenWithStrategy(forImage, forVideo, model, StrategyScore, keyGroup)
+}
+
+// TokenGroupFor returns the group whose tokens serve a request: the key's
+// group when it is bound to one, else the first group claiming the model,
+// else 0 for the tokens outside every group
+func (lb *LoadBalancer) TokenGroupFor(keyGroup int64, model string) (int64, error) {
+	if keyGroup != 0 {
+		return keyGroup, nil
+	}
+	if model == "" {
+		return 0, nil
+	}
+	groups, err := lb.tokenManager.GetTokenGroups()
+	if err != nil {
+		return 0, err
+	}
+	for _, group := range groups {
+		if group.MatchesModel(model) {
+			return group.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// SelectTokenWithStrategy selects a token from the request's token group using
+// the named balancing strategy. Nothing is acquired, so the token may be at
+// its limit by the time the caller acquires a slot; use AcquireToken to run
+// a generation.
+func (lb *LoadBalancer) SelectTokenWithStrategy(forImage, forVideo bool, model, strategy string, keyGroup int64) (*models.Token, error) {
+	ranked, _, _, err := lb.rankTokens(forImage, forVideo, model, strategy, keyGroup)
+	if err != nil || len(ranked) == 0 {
+		return nil, err
+	}
+	return ranked[0], nil
+}
+
+// AcquireToken selects a token like SelectTokenWithStrategy and leases it an
+// image or video slot for owner in the same step, so concurrent requests
+// cannot both claim a token's last slot. Tokens whose slots were taken since
+// ranking are skipped. It returns nil when no token has a free slot; the
+// caller releases the slot when the generation ends. The choice explains
+// why the token was taken.
+func (lb *LoadBalancer) AcquireToken(forImage, forVideo bool, model, strategy string, keyGroup int64, owner string, ttl time.Duration) (*models.Token, *models.TokenChoice, error) {
+	ranked, scores, group, err := lb.rankTokens(forImage, forVideo, model, strategy, keyGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, token := range ranked {
+		if (forVideo && lb.concurrencyManager.AcquireVideo(token.ID, owner, ttl)) ||
+			(!forVideo && lb.concurrencyManager.AcquireImage(token.ID, owner, ttl)) {
+			lb.mu.Lock()
+			lb.lastPicked[token.GroupID] = token.ID
+			lb.mu.Unlock()
+			return token, explainChoice(ranked, scores, i, strategy, group), nil
+		}
+		balancerLog.Debug("Token reached its limit after selection, trying the next", "token_id", token.ID, "task_id", owner)
+	}
+	return nil, nil, nil
+}
+
+// explainChoice describes taking ranked[i]
+func explainChoice(ranked []*models.Token, scores map[int64]float64, i int, strategy string, group int64) *models.TokenChoice {
+	if strategy != StrategyLeastUsed {
+		strategy = StrategyScore
+	}
+	score := scores[ranked[i].ID]
+	choice := &models.TokenChoice{
+		Reason:     models.ChoiceBestScore,
+		Strategy:   strategy,
+		GroupID:    group,
+		Score:      score,
+		Rank:       i + 1,
+		Candidates: len(ranked),
+	}
+	for _, token := range ranked {
+		if scores[token.ID] == score {
+			choice.Tied++
+		}
+	}
+	switch {
+	case scores[ranked[0].ID] != score:
+		choice.Reason = models.ChoiceFallback
+	case choice.Tied > 1:
+		choice.Reason = models.ChoiceRoundRobin
+	}
+	return choice
+}
+
+// rankTokens returns the eligible tokens of the request's token group, best
+// first under the named strategy, with their scores and the group. Tokens
+// below the minimum credits that are due a balance check are re-read first,
+// so a token that was topped up is not skipped.
+func (lb *LoadBalancer) rankTokens(forImage, forVideo bool, model, strategy string, keyGroup int64) ([]*models.Token, map[int64]float64, int64, error) {
+	group, err := lb.TokenGroupFor(keyGroup, model)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	ranked, scores, low, err := lb.rankGroup(forImage, forVideo, strategy, group)
+	if err != nil || len(low) == 0 {
+		return ranked, scores, group, err
+	}
+	// The checks are marked as done, so the second pass does not repeat them
+	if lb.refreshLowCredits(low, minCredits(forImage, forVideo)) {
+		ranked, scores, _, err = lb.rankGroup(forImage, forVideo, strategy, group)
+	}
+	return ranked, scores, group, err
+}
+
+// minCredits is the balance a token needs for the generation type
+func minCredits(forImage, forVideo bool) int {
+	if forImage {
+		return config.Get().Generation.MinImageCredits
+	} else if forVideo {
+		return config.Get().Generation.MinVideoCredits
+	}
+	return 0
+}
+
+// rankGroup ranks the eligible tokens of group. It also returns the tokens
+// skipped for low credits whose balance is due a re-read.
+func (lb *LoadBalancer) rankGroup(forImage, forVideo bool, strategy string, group int64) ([]*models.Token, map[int64]float64, []int64, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
 	tokens, err := lb.tokenManager.GetActiveTokens()
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	var bestToken *models.Token
-	var bestScore float64 = -1
+	// Today's counts are only loaded when the group or a candidate has a
+	// daily limit
+	var usage map[int64]models.DailyUsage
+	todayUsage := func() map[int64]models.DailyUsage {
+		if usage == nil {
+			if usage, err = lb.tokenManager.GetDailyUsage(); err != nil {
+				balancerLog.Error("Failed to load daily usage, quotas not enforced", "error", err)
+				usage = map[int64]models.DailyUsage{}
+			}
+		}
+		return usage
+	}
+	overQuota := func(token *models.Token) bool {
+		if (!forImage || token.DailyImageLimit <= 0) && (!forVideo || token.DailyVideoLimit <= 0) {
+			return false
+		}
+		today := todayUsage()[token.ID]
+		return (forImage && token.DailyImageLimit > 0 && today.Images >= token.DailyImageLimit) ||
+			(forVideo && token.DailyVideoLimit > 0 && today.Videos >= token.DailyVideoLimit)
+	}
+	if group != 0 && lb.groupOverQuota(group, forImage, forVideo, todayUsage) {
+		return nil, nil, nil, nil
+	}
+
+	minCredits := minCredits(forImage, forVideo)
+	var ranked []*models.Token
+	var low []int64
+	scores := make(map[int64]float64)
 
 	now := time.Now().UTC()
 
 	for _, token := range tokens {
+		if token.GroupID != group {
+			continue
+		}
+
 		// Check if token supports the generation type
 		if forImage && !token.ImageEnabled {
 			continue
@@ -51,34 +234,152 @@ func (lb *LoadBalancer) SelectToken(forImage, forVideo bool, model string) (*mod
 			continue
 		}
 
-		// Check concurrency limits
-		if forImage && token.ImageConcurrency > 0 {
-			if !lb.concurrencyManager.CanAcquireImage(token.ID) {
-				continue
-			}
+		// Skip tokens that used up today's quota
+		if overQuota(token) {
+			continue
 		}
-		if forVideo && token.VideoConcurrency > 0 {
-			if !lb.concurrencyManager.CanAcquireVideo(token.ID) {
-				continue
+
+		// Skip tokens below the minimum, at most once per
+		// creditRefreshInterval without re-reading their balance
+		if token.Credits < minCredits {
+			if last, ok := lb.creditChecks[token.ID]; !ok || now.Sub(last) >= creditRefreshInterval {
+				lb.creditChecks[token.ID] = now
+				low = append(low, token.ID)
 			}
+			continue
 		}
 
-		// Calculate score (prefer tokens with more credits and less recent usage)
-		score := float64(token.Credits)
+		// Check concurrency limits, the token's and its group's
+		if forImage && !lb.concurrencyManager.CanAcquireImage(token.ID) {
+			continue
+		}
+		if forVideo && !lb.concurrencyManager.CanAcquireVideo(token.ID) {
+			continue
+		}
 
-		// Boost score for less recently used tokens
-		if token.LastUsedAt != nil {
-			timeSinceUse := now.Sub(*token.LastUsedAt)
-			score += timeSinceUse.Seconds() / 60 // Add 1 point per minute since last use
+		if strategy == StrategyLeastUsed {
+			scores[token.ID] = -float64(token.UseCount)
 		} else {
-			score += 1000 // Never used, high priority
+			// Whole points, so tokens a few seconds apart count as equal
+			scores[token.ID] = math.Round(tokenScore(token, now))
 		}
+		ranked = append(ranked, token)
+	}
 
-		if score > bestScore {
-			bestScore = score
-			bestToken = token
+	sort.Slice(ranked, func(i, j int) bool {
+		if si, sj := scores[ranked[i].ID], scores[ranked[j].ID]; si != sj {
+			return si > sj
 		}
+		return ranked[i].ID < ranked[j].ID
+	})
+	lb.rotateTies(ranked, scores, group)
+	return ranked, scores, low, nil
+}
+
+// groupOverQuota reports whether the group's tokens together generated its
+// daily limit today. Tokens banned since still count.
+func (lb *LoadBalancer) groupOverQuota(groupID int64, forImage, forVideo bool, todayUsage func() map[int64]models.DailyUsage) bool {
+	groups, err := lb.tokenManager.GetTokenGroups()
+	if err != nil {
+		balancerLog.Error("Failed to load token groups, group quotas not enforced", "error", err)
+		return false
+	}
+	var group *models.TokenGroup
+	for _, g := range groups {
+		if g.ID == groupID {
+			group = g
+		}
+	}
+	if group == nil || (!forImage || group.DailyImageLimit <= 0) && (!forVideo || group.DailyVideoLimit <= 0) {
+		return false
+	}
+
+	var total models.DailyUsage
+	for _, today := range todayUsage() {
+		if today.GroupID == groupID {
+			total.Images += today.Images
+			total.Videos += today.Videos
+		}
+	}
+	over := (forImage && group.DailyImageLimit > 0 && total.Images >= group.DailyImageLimit) ||
+		(forVideo && group.DailyVideoLimit > 0 && total.Videos >= group.DailyVideoLimit)
+	if over {
+		balancerLog.Debug("Token group used up today's quota", "group_id", groupID, "images", total.Images, "videos", total.Videos)
+	}
+	return over
+}
+
+// rotateTies takes equally scored tokens in turn: within each run of equal
+// scores, the tokens after the one AcquireToken last leased in the group come
+// first, in ID order, so identical tokens share the traffic. Called with
+// lb.mu held and ranked sorted by score, then ID.
+func (lb *LoadBalancer) rotateTies(ranked []*models.Token, scores map[int64]float64, group int64) {
+	last := lb.lastPicked[group]
+	for start := 0; start < len(ranked); {
+		end := start + 1
+		for end < len(ranked) && scores[ranked[end].ID] == scores[ranked[start].ID] {
+			end++
+		}
+		run := ranked[start:end]
+		next := sort.Search(len(run), func(i int) bool { return run[i].ID > last })
+		if next < len(run) {
+			rotated := append(append([]*models.Token{}, run[next:]...), run[:next]...)
+			copy(run, rotated)
+		}
+		start = end
+	}
+}
+
+// refreshLowCredits re-reads the balances of tokens found below minCredits
+// and reports whether one of them is back above it. It waits at most
+// creditRefreshTimeout and is called without lb.mu held, so a slow Flow call
+// holds up only this selection; late answers are stored for the next one.
+func (lb *LoadBalancer) refreshLowCredits(tokenIDs []int64, minCredits int) bool {
+	results := make(chan bool, len(tokenIDs))
+	for _, tokenID := range tokenIDs {
+		go func(tokenID int64) {
+			credits, err := lb.tokenManager.RefreshCredits(tokenID)
+			if err != nil {
+				balancerLog.Warn("Failed to refresh credits", "token_id", tokenID, "error", err)
+				results <- false
+				return
+			}
+			if credits < minCredits {
+				balancerLog.Info("Skipping token below minimum credits", "token_id", tokenID, "credits", credits, "minimum", minCredits)
+				results <- false
+				return
+			}
+			lb.mu.Lock()
+			delete(lb.creditChecks, tokenID)
+			lb.mu.Unlock()
+			results <- true
+		}(tokenID)
 	}
 
-	return bestToken, nil
+	timeout := time.NewTimer(creditRefreshTimeout)
+	defer timeout.Stop()
+	recovered := false
+	for range tokenIDs {
+		select {
+		case ok := <-results:
+			recovered = recovered || ok
+		case <-timeout.C:
+			return recovered
+		}
+	}
+	return recovered
+}
+
+// tokenScore prefers tokens with more credits and less recent usage
+func tokenScore(token *models.Token, now time.Time) float64 {
+	score := float64(token.Credits)
+
+	// Boost score for less recently used tokens
+	if token.LastUsedAt != nil {
+		timeSinceUse := now.Sub(*token.LastUsedAt)
+		score += timeSinceUse.Seconds() / 60 // Add 1 point per minute since last use
+	} else {
+		score += 1000 // Never used, high priority
+	}
+	return score
 }
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"flow2api/internal/config"
+)
+
+// ffprobeTimeout bounds the optional ffprobe check of a downloaded file
+const ffprobeTimeout = 30 * time.Second
+
+// MediaVerifyError reports a downloaded result that is not the media it
+// claims to be, such as an HTML error page or a truncated transfer
+type MediaVerifyError struct {
+	MediaType string
+	Reason    string
+}
+
+func (e *MediaVerifyError) Error() string {
+	return fmt.Sprintf("downloaded %s failed verification: %s", e.MediaType, e.Reason)
+}
+
+// mediaFormat is a file type recognized by its leading bytes
+type mediaFormat struct {
+	ext         string
+	contentType string
+}
+
+// sniffMedia identifies the media format from the start of a file
+func sniffMedia(head []byte, mediaType string) (mediaFormat, bool) {
+	if mediaType == "video" {
+		// ISO base media files (MP4, MOV) open with a box named ftyp
+		if len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")) {
+			return mediaFormat{".mp4", "video/mp4"}, true
+		}
+		return mediaFormat{}, false
+	}
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return mediaFormat{".jpg", "image/jpeg"}, true
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return mediaFormat{".png", "image/png"}, true
+	case len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WEBP")):
+		return mediaFormat{".webp", "image/webp"}, true
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return mediaFormat{".gif", "image/gif"}, true
+	}
+	return mediaFormat{}, false
+}
+
+// verifyMedia checks a downloaded file before it is cached: it must be
+// non-empty, match the announced length and start with the magic bytes of
+// its media type. With cache.ffprobe set, ffprobe must also read it.
+// It returns the detected format.
+func verifyMedia(f *os.File, size, expected int64, mediaType string) (mediaFormat, error) {
+	if size == 0 {
+		return mediaFormat{}, &MediaVerifyError{mediaType, "file is empty"}
+	}
+	if expected > 0 && size != expected {
+		return mediaFormat{}, &MediaVerifyError{mediaType, fmt.Sprintf("got %d of %d bytes", size, expected)}
+	}
+
+	head := make([]byte, 16)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return mediaFormat{}, err
+	}
+	format, ok := sniffMedia(head[:n], mediaType)
+	if !ok {
+		return mediaFormat{}, &MediaVerifyError{mediaType, fmt.Sprintf("unrecognized content starting with %q", head[:n])}
+	}
+
+	if ffprobe := config.Get().Cache.FFprobe; ffprobe != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), ffprobeTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, ffprobe, "-v", "error", "-show_format", f.Name()).CombinedOutput()
+		if err != nil {
+			reason := string(bytes.TrimSpace(out))
+			if reason == "" {
+				reason = err.Error()
+			}
+			return mediaFormat{}, &MediaVerifyError{mediaType, "ffprobe: " + truncate(reason, 200)}
+		}
+	}
+	return format, nil
+}
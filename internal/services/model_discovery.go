@@ -0,0 +1,251 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"flow2api/internal/client"
+	"flow2api/internal/database"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+)
+
+var discoveryLog = logging.Component("model_discovery")
+
+// ModelDiscovery periodically reconciles upstream model keys with the model registry
+type ModelDiscovery struct {
+	db           *database.Database
+	flowClient   *client.FlowClient
+	tokenManager TokenStore
+}
+
+// NewModelDiscovery creates a new model discovery service
+func NewModelDiscovery(db *database.Database, fc *client.FlowClient, tm TokenStore) *ModelDiscovery {
+	return &ModelDiscovery{
+		db:           db,
+		flowClient:   fc,
+		tokenManager: tm,
+	}
+}
+
+// Start runs discovery on the given interval until the process exits
+func (md *ModelDiscovery) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := md.Discover(); err != nil {
+				discoveryLog.Error("Model discovery failed", "error", err)
+			}
+		}
+	}()
+}
+
+// Discover queries Flow with an active token and records new upstream models
+func (md *ModelDiscovery) Discover() ([]*models.UpstreamModel, error) {
+	tokens, err := md.tokenManager.GetActiveTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, token := range tokens {
+		if valid, err := md.tokenManager.IsATValid(token.ID); !valid || err != nil {
+			continue
+		}
+		// Reload for the refreshed AT; the token may be gone by now
+		token, err := md.tokenManager.GetToken(token.ID)
+		if err != nil || token == nil {
+			continue
+		}
+
+		discovered, err := client.RetryTransient(func() ([]client.DiscoveredModel, error) {
+			return md.flowClient.ListAvailableModels(token.AT)
+		})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		newCount := 0
+		for _, m := range discovered {
+			status := "known"
+			if !models.IsKnownUpstreamModel(m.Key) {
+				status = "new"
+				newCount++
+			}
+			if err := md.db.UpsertUpstreamModel(&models.UpstreamModel{
+				ModelKey:    m.Key,
+				ModelType:   m.Type,
+				DisplayName: m.DisplayName,
+				Status:      status,
+			}); err != nil {
+				return nil, err
+			}
+		}
+
+		discoveryLog.Info("Discovered upstream models", "count", len(discovered), "unregistered", newCount, "token_id", token.ID)
+		return md.db.GetUpstreamModels()
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("no active token available for model discovery")
+}
+
+// EnableModel registers landscape and portrait variants of a discovered model
+func (md *ModelDiscovery) EnableModel(modelKey, videoType string) ([]string, error) {
+	upstream, err := md.findUpstreamModel(modelKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if upstream.ModelType == "video" {
+		switch videoType {
+		case "t2v", "i2v", "r2v":
+		default:
+			return nil, fmt.Errorf("video_type must be one of t2v, i2v, r2v")
+		}
+	} else {
+		videoType = ""
+	}
+
+	if err := md.db.UpdateUpstreamModelStatus(modelKey, "enabled", videoType); err != nil {
+		return nil, err
+	}
+	upstream.VideoType = videoType
+
+	return registerUpstreamModel(upstream), nil
+}
+
+// IgnoreModel hides a discovered model from the new-model list
+func (md *ModelDiscovery) IgnoreModel(modelKey string) error {
+	return md.db.UpdateUpstreamModelStatus(modelKey, "ignored", "")
+}
+
+// LoadModelRegistry seeds the models table with the built-in models, makes
+// its enabled rows the model registry and loads the model aliases
+func LoadModelRegistry(db *database.Database) error {
+	if err := db.SeedModels(models.BuiltinModels()); err != nil {
+		return err
+	}
+	rows, err := db.GetRegistryModels()
+	if err != nil {
+		return err
+	}
+
+	registry := make(map[string]models.ModelConfig, len(rows))
+	for _, row := range rows {
+		if !row.Enabled {
+			continue
+		}
+		if err := row.Validate(); err != nil {
+			discoveryLog.Warn("Skipping invalid model", "model", row.Name, "error", err)
+			continue
+		}
+		registry[row.Name] = row.ModelConfig
+	}
+	models.ReplaceModels(registry)
+
+	aliases, err := db.GetModelAliases()
+	if err != nil {
+		return err
+	}
+	aliasMap := make(map[string]string, len(aliases))
+	for _, alias := range aliases {
+		aliasMap[alias.Alias] = alias.Model
+	}
+	defaultModel, err := db.GetDefaultModel()
+	if err != nil {
+		return err
+	}
+	models.SetAliases(aliasMap, defaultModel)
+	return nil
+}
+
+// LoadModels rebuilds the model registry from the models table and the
+// enabled upstream models
+func (md *ModelDiscovery) LoadModels() error {
+	if err := LoadModelRegistry(md.db); err != nil {
+		return err
+	}
+	return md.LoadEnabledModels()
+}
+
+// LoadEnabledModels registers all previously enabled upstream models
+func (md *ModelDiscovery) LoadEnabledModels() error {
+	upstreamModels, err := md.db.GetUpstreamModels()
+	if err != nil {
+		return err
+	}
+
+	for _, upstream := range upstreamModels {
+		if upstream.Status == "enabled" {
+			registerUpstreamModel(upstream)
+		}
+	}
+	return nil
+}
+
+func (md *ModelDiscovery) findUpstreamModel(modelKey string) (*models.UpstreamModel, error) {
+	upstreamModels, err := md.db.GetUpstreamModels()
+	if err != nil {
+		return nil, err
+	}
+	for _, upstream := range upstreamModels {
+		if upstream.ModelKey == modelKey {
+			return upstream, nil
+		}
+	}
+	return nil, fmt.Errorf("upstream model not found: %s", modelKey)
+}
+
+// registerUpstreamModel adds registry entries following the built-in naming scheme
+func registerUpstreamModel(upstream *models.UpstreamModel) []string {
+	var names []string
+
+	if upstream.ModelType == "image" {
+		base := strings.ToLower(strings.ReplaceAll(upstream.ModelKey, "_", "-"))
+		supportsImages, maxImages := models.ImageInputLimits(upstream.ModelKey)
+		for suffix, aspectRatio := range map[string]string{
+			"landscape": "IMAGE_ASPECT_RATIO_LANDSCAPE",
+			"portrait":  "IMAGE_ASPECT_RATIO_PORTRAIT",
+		} {
+			name := base + "-" + suffix
+			models.RegisterModel(name, models.ModelConfig{
+				Type: "image", ModelName: upstream.ModelKey, AspectRatio: aspectRatio,
+				SupportsImages: supportsImages, MaxImages: maxImages,
+			})
+			names = append(names, name)
+		}
+		return names
+	}
+
+	supportsImages := upstream.VideoType != "t2v"
+	minImages, maxImages := 0, 0
+	switch upstream.VideoType {
+	case "i2v":
+		minImages, maxImages = 1, 2
+	case "r2v":
+		maxImages = -1
+	}
+
+	for suffix, aspectRatio := range map[string]string{
+		"landscape": "VIDEO_ASPECT_RATIO_LANDSCAPE",
+		"portrait":  "VIDEO_ASPECT_RATIO_PORTRAIT",
+	} {
+		name := upstream.ModelKey + "_" + suffix
+		models.RegisterModel(name, models.ModelConfig{
+			Type: "video", VideoType: upstream.VideoType, ModelKey: upstream.ModelKey,
+			AspectRatio: aspectRatio, SupportsImages: supportsImages, MinImages: minImages, MaxImages: maxImages,
+		})
+		names = append(names, name)
+	}
+	return names
+}
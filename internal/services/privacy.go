@@ -0,0 +1,88 @@
+package services
+
+import (
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/models"
+)
+
+// PrivacyPolicy decides what is retained about a request's prompts and media
+type PrivacyPolicy struct {
+	Mode           string
+	TruncateLength int
+	SkipCache      bool
+}
+
+// privacyPolicy applies the request's per-key overrides to the global policy
+func privacyPolicy(req *GenerationRequest) PrivacyPolicy {
+	cfg := config.Get().Privacy
+	policy := PrivacyPolicy{Mode: cfg.Mode, TruncateLength: cfg.TruncateLength, SkipCache: cfg.SkipCache}
+	if req.PrivacyMode != "" {
+		policy.Mode = req.PrivacyMode
+	}
+	policy.SkipCache = policy.SkipCache || req.SkipCache
+	return policy
+}
+
+// Redact returns the form of text that may be stored or logged
+func (p PrivacyPolicy) Redact(text string) string {
+	return models.RedactPrompt(p.Mode, p.TruncateLength, text)
+}
+
+// storedTask returns the copy of task written to the database, with its
+// prompts redacted; the original keeps them for the upstream request
+func (p PrivacyPolicy) storedTask(task *models.Task) *models.Task {
+	if p.Mode == "" || p.Mode == models.PrivacyOff {
+		return task
+	}
+	stored := *task
+	stored.Prompt = p.Redact(task.Prompt)
+	if task.Params != nil {
+		params := *task.Params
+		params.NegativePrompt = p.Redact(params.NegativePrompt)
+		stored.Params = &params
+	}
+	return &stored
+}
+
+// promptRetentionBatch is how many tasks are read per query when redacting
+// old prompts
+const promptRetentionBatch = 500
+
+// RedactOldPrompts redacts the prompts of tasks older than
+// privacy.prompt_retention_days with privacy.retention_mode, keeping their
+// counters and URLs, and returns how many tasks it redacted
+func (cj *CacheJanitor) RedactOldPrompts() (int, error) {
+	cfg := config.Get().Privacy
+	if cfg.PromptRetentionDays <= 0 {
+		return 0, nil
+	}
+	policy := PrivacyPolicy{Mode: cfg.RetentionMode, TruncateLength: cfg.TruncateLength}
+	age := time.Duration(cfg.PromptRetentionDays) * 24 * time.Hour
+
+	redacted := 0
+	for {
+		tasks, err := cj.db.GetUnredactedTasks(age, promptRetentionBatch)
+		if err != nil {
+			return redacted, err
+		}
+		for _, task := range tasks {
+			// A task stored under the same mode only needs marking
+			stored := task
+			if task.Params == nil || task.Params.Privacy != policy.Mode {
+				stored = policy.storedTask(task)
+				if stored.Params != nil {
+					stored.Params.Privacy = policy.Mode
+				}
+			}
+			if err := cj.db.RedactTaskPrompts(task.TaskID, stored.Prompt, stored.Params); err != nil {
+				return redacted, err
+			}
+			redacted++
+		}
+		if len(tasks) < promptRetentionBatch {
+			return redacted, nil
+		}
+	}
+}
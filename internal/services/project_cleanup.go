@@ -0,0 +1,106 @@
+package services
+
+import (
+	"strings"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+)
+
+var projectLog = logging.Component("project")
+
+// OrphanProject is an upstream project created by flow2api that no token uses anymore
+type OrphanProject struct {
+	TokenID   int64  `json:"token_id"`
+	Email     string `json:"email"`
+	ProjectID string `json:"project_id"`
+	Title     string `json:"title"`
+	Deleted   bool   `json:"deleted"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ProjectCleanupResult summarizes a cleanup run
+type ProjectCleanupResult struct {
+	DryRun   bool             `json:"dry_run"`
+	Accounts int              `json:"accounts"`
+	Orphans  []*OrphanProject `json:"orphans"`
+	Errors   []string         `json:"errors,omitempty"`
+}
+
+// CleanupOrphanProjects lists projects on every account and deletes the ones flow2api
+// created that are no longer any token's current project. A project counts as
+// flow2api's when it was recorded locally or its title starts with the fixed prefix
+// of the project name template. With dryRun nothing is deleted.
+func (tm *TokenManager) CleanupOrphanProjects(dryRun bool) (*ProjectCleanupResult, error) {
+	tokens, err := tm.db.GetAllTokens()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ProjectCleanupResult{DryRun: dryRun, Orphans: []*OrphanProject{}}
+	prefix := projectNamePrefix(config.Get().Flow.ProjectNameTemplate)
+
+	// Several tokens may belong to the same account; every current project stays
+	inUse := make(map[string]bool)
+	for _, token := range tokens {
+		if token.CurrentProjectID != "" {
+			inUse[token.CurrentProjectID] = true
+		}
+	}
+
+	seenAccounts := make(map[string]bool)
+	for _, token := range tokens {
+		if token.ST == "" || seenAccounts[token.Email] {
+			continue
+		}
+		seenAccounts[token.Email] = true
+		result.Accounts++
+
+		known := make(map[string]bool)
+		if ids, err := tm.db.GetProjectIDsByEmail(token.Email); err == nil {
+			for _, id := range ids {
+				known[id] = true
+			}
+		}
+
+		projects, err := tm.flowClient.ListProjects(token.ST)
+		if err != nil {
+			projectLog.Warn("Failed to list projects", "token_id", token.ID, "email", token.Email, "error", err)
+			result.Errors = append(result.Errors, token.Email+": "+err.Error())
+			continue
+		}
+
+		for _, project := range projects {
+			if inUse[project.ID] {
+				continue
+			}
+			if !known[project.ID] && (prefix == "" || !strings.HasPrefix(project.Title, prefix)) {
+				continue
+			}
+
+			orphan := &OrphanProject{TokenID: token.ID, Email: token.Email, ProjectID: project.ID, Title: project.Title}
+			result.Orphans = append(result.Orphans, orphan)
+			if dryRun {
+				continue
+			}
+
+			if err := tm.flowClient.DeleteProject(token.ST, project.ID); err != nil {
+				orphan.Error = err.Error()
+				continue
+			}
+			orphan.Deleted = true
+			tm.db.DeactivateProject(project.ID)
+			projectLog.Info("Deleted orphaned project", "project_id", project.ID, "title", project.Title, "token_id", token.ID, "email", token.Email)
+		}
+	}
+
+	return result, nil
+}
+
+// projectNamePrefix returns the literal text before the first placeholder of a template
+func projectNamePrefix(template string) string {
+	if i := strings.Index(template, "{"); i >= 0 {
+		return template[:i]
+	}
+	return template
+}
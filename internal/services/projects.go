@@ -0,0 +1,222 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/models"
+)
+
+// ProjectInfo describes a project of a token's account
+type ProjectInfo struct {
+	ProjectID       string     `json:"project_id"`
+	Title           string     `json:"title"`
+	Current         bool       `json:"current"`            // the token's current project
+	Managed         bool       `json:"managed"`            // created by flow2api for this token
+	Active          bool       `json:"active"`             // not deleted by flow2api
+	Upstream        *bool      `json:"upstream,omitempty"` // listed on the account; set when upstream was queried
+	GenerationCount int        `json:"generation_count"`
+	CreatedAt       *time.Time `json:"created_at,omitempty"`
+}
+
+// ListProjects returns the projects recorded for a token. With upstream, the
+// account's projects are listed on Flow as well, so projects created outside
+// flow2api and records of projects deleted upstream show up.
+func (tm *TokenManager) ListProjects(id int64, upstream bool) ([]*ProjectInfo, error) {
+	token, err := tm.db.GetToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, fmt.Errorf("token not found")
+	}
+
+	records, err := tm.db.GetProjectsByToken(id)
+	if err != nil {
+		return nil, err
+	}
+	projects := make([]*ProjectInfo, 0, len(records))
+	byID := make(map[string]*ProjectInfo, len(records))
+	for _, record := range records {
+		info := &ProjectInfo{
+			ProjectID: record.ProjectID,
+			Title:     record.ProjectName,
+			Current:   record.ProjectID == token.CurrentProjectID,
+			Managed:   true,
+			Active:    record.IsActive,
+
+			GenerationCount: record.GenerationCount,
+			CreatedAt:       record.CreatedAt,
+		}
+		projects = append(projects, info)
+		byID[record.ProjectID] = info
+	}
+	if !upstream {
+		return projects, nil
+	}
+
+	listed, err := tm.flowClient.ListProjects(token.ST)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list upstream projects: %w", err)
+	}
+	yes, no := true, false
+	for _, info := range projects {
+		info.Upstream = &no
+	}
+	for _, p := range listed {
+		if info, ok := byID[p.ID]; ok {
+			info.Upstream = &yes
+			info.Title = p.Title
+			continue
+		}
+		projects = append(projects, &ProjectInfo{
+			ProjectID: p.ID,
+			Title:     p.Title,
+			Current:   p.ID == token.CurrentProjectID,
+			Active:    true,
+			Upstream:  &yes,
+		})
+	}
+	return projects, nil
+}
+
+// CreateProject creates a project on the token's account, optionally making
+// it the token's current project
+func (tm *TokenManager) CreateProject(id int64, makeCurrent bool) (*models.Project, error) {
+	token, err := tm.db.GetToken(id)
+	if err != nil || token == nil {
+		return nil, fmt.Errorf("token not found")
+	}
+
+	defer tm.lockProjects(id)()
+	return tm.createProject(token, makeCurrent)
+}
+
+// RotateProject moves the token to a new project. The previous project is
+// deleted upstream when deleteOld is set; generations still running in it
+// may then fail, so by default it is left for orphan cleanup.
+func (tm *TokenManager) RotateProject(id int64, deleteOld bool) (*models.Project, error) {
+	token, err := tm.db.GetToken(id)
+	if err != nil || token == nil {
+		return nil, fmt.Errorf("token not found")
+	}
+
+	defer tm.lockProjects(id)()
+
+	previous := token.CurrentProjectID
+	project, err := tm.createProject(token, true)
+	if err != nil {
+		return nil, err
+	}
+	tm.events.Publish(EventTokenUpdated, map[string]interface{}{
+		"token_id": id, "change": "project_rotated", "project_id": project.ProjectID, "previous_project_id": previous,
+	})
+
+	if deleteOld && previous != "" {
+		if err := tm.deleteProject(token, previous); err != nil {
+			return project, fmt.Errorf("rotated, but failed to delete previous project: %w", err)
+		}
+	}
+	return project, nil
+}
+
+// DeleteProject deletes one of the account's projects. The token's current
+// project cannot be deleted; rotate first.
+func (tm *TokenManager) DeleteProject(id int64, projectID string) error {
+	token, err := tm.db.GetToken(id)
+	if err != nil || token == nil {
+		return fmt.Errorf("token not found")
+	}
+
+	defer tm.lockProjects(id)()
+
+	if projectID == token.CurrentProjectID {
+		return fmt.Errorf("project %s is the token's current project; rotate it first", projectID)
+	}
+	return tm.deleteProject(token, projectID)
+}
+
+// lockProjects serializes project changes of one token, so calls upstream for
+// one token never hold up another's; it returns the unlock
+func (tm *TokenManager) lockProjects(id int64) func() {
+	lock, _ := tm.projectLocks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// createProject creates and records a project; the token's project lock
+// must be held
+func (tm *TokenManager) createProject(token *models.Token, makeCurrent bool) (*models.Project, error) {
+	projectName := tm.newProjectName(token.Email)
+	projectID, err := tm.flowClient.CreateProject(token.ST, projectName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create project: %w", err)
+	}
+
+	projectLog.Info("Created project", "token_id", token.ID, "project_id", projectID, "name", projectName, "current", makeCurrent)
+
+	if makeCurrent {
+		tm.db.UpdateToken(token.ID, map[string]interface{}{
+			"current_project_id":   projectID,
+			"current_project_name": projectName,
+		})
+	}
+
+	project := &models.Project{
+		ProjectID:   projectID,
+		TokenID:     token.ID,
+		ProjectName: projectName,
+		ToolName:    "PINHOLE",
+		IsActive:    true,
+	}
+	project.ID, _ = tm.db.AddProject(project)
+	return project, nil
+}
+
+// deleteProject deletes a project upstream and marks its record inactive
+func (tm *TokenManager) deleteProject(token *models.Token, projectID string) error {
+	if err := tm.flowClient.DeleteProject(token.ST, projectID); err != nil {
+		return fmt.Errorf("failed to delete project: %w", err)
+	}
+	tm.db.DeactivateProject(projectID)
+	projectLog.Info("Deleted project", "token_id", token.ID, "project_id", projectID)
+	return nil
+}
+
+// countProjectGeneration counts a generation against the token's current
+// project and rotates the token to a new one once flow.project_rotate_every
+// is reached. Rotation runs in the background and keeps the old project.
+func (tm *TokenManager) countProjectGeneration(id int64) {
+	token, err := tm.db.GetToken(id)
+	if err != nil || token == nil || token.CurrentProjectID == "" {
+		return
+	}
+	count, err := tm.db.IncrementProjectGenerations(token.CurrentProjectID)
+	if err != nil {
+		projectLog.Warn("Failed to count project generation", "token_id", id, "project_id", token.CurrentProjectID, "error", err)
+		return
+	}
+
+	every := config.Get().Flow.ProjectRotateEvery
+	if every <= 0 || count < every {
+		return
+	}
+	go func() {
+		defer tm.lockProjects(id)()
+
+		// Another completion may have rotated the token already
+		current, err := tm.db.GetToken(id)
+		if err != nil || current == nil || current.CurrentProjectID != token.CurrentProjectID {
+			return
+		}
+		project, err := tm.createProject(current, true)
+		if err != nil {
+			projectLog.Warn("Project rotation failed", "token_id", id, "project_id", token.CurrentProjectID, "error", err)
+			return
+		}
+		projectLog.Info("Rotated project", "token_id", id, "previous_project_id", token.CurrentProjectID,
+			"project_id", project.ProjectID, "generations", count)
+	}()
+}
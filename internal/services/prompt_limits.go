@@ -0,0 +1,63 @@
+package services
+
+import (
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"flow2api/internal/config"
+	"flow2api/internal/models"
+)
+
+// PromptLimit returns the longest prompt, in characters, the model accepts;
+// 0 means no limit. An exact model ID in generation.prompt_limits wins over
+// globs, and the longest matching glob over shorter ones.
+func PromptLimit(model string, modelConfig models.ModelConfig) int {
+	cfg := config.Get().Generation
+	if limit, ok := cfg.PromptLimits[model]; ok {
+		return limit
+	}
+	best, limit := "", -1
+	for pattern, l := range cfg.PromptLimits {
+		if ok, _ := path.Match(pattern, model); ok && len(pattern) > len(best) {
+			best, limit = pattern, l
+		}
+	}
+	if limit >= 0 {
+		return limit
+	}
+	if modelConfig.Type == "video" {
+		return cfg.MaxVideoPrompt
+	}
+	return cfg.MaxImagePrompt
+}
+
+// FitPrompt checks the prompt against the model's limit before any captcha is
+// spent on it. Over the limit, the prompt is cut at a word boundary when
+// generation.prompt_overflow is "truncate", returning its original length,
+// and rejected with a PromptTooLongError otherwise.
+func FitPrompt(model string, modelConfig models.ModelConfig, prompt string) (string, int, error) {
+	limit := PromptLimit(model, modelConfig)
+	length := utf8.RuneCountInString(prompt)
+	if limit <= 0 || length <= limit {
+		return prompt, 0, nil
+	}
+	if config.Get().Generation.PromptOverflow != "truncate" {
+		return prompt, 0, &models.PromptTooLongError{Model: model, Length: length, Limit: limit}
+	}
+	return truncatePrompt(prompt, limit), length, nil
+}
+
+// truncatePrompt keeps at most limit characters, backing up to the last
+// space when one falls in the final fifth so words are not split
+func truncatePrompt(prompt string, limit int) string {
+	runes := []rune(prompt)[:limit]
+	for i := len(runes) - 1; i >= limit*4/5; i-- {
+		if unicode.IsSpace(runes[i]) {
+			runes = runes[:i]
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(runes), unicode.IsSpace)
+}
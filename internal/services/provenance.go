@@ -0,0 +1,44 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/imageproc"
+	"flow2api/internal/models"
+)
+
+// provenanceOf describes the image a task generated
+func provenanceOf(cfg *config.Config, task *models.Task) imageproc.Provenance {
+	p := imageproc.Provenance{
+		Model:    task.Model,
+		TaskID:   task.TaskID,
+		Instance: cfg.Provenance.Instance,
+		Created:  time.Now(),
+		Manifest: cfg.Provenance.Manifest,
+	}
+	if task.Prompt != "" {
+		sum := sha256.Sum256([]byte(task.Prompt))
+		p.PromptSHA256 = hex.EncodeToString(sum[:])
+	}
+	if p.Instance == "" {
+		p.Instance, _ = os.Hostname()
+	}
+	return p
+}
+
+// embedProvenanceFile writes a task's provenance into the image at path
+func embedProvenanceFile(path string, cfg *config.Config, task *models.Task) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	embedded, err := imageproc.EmbedProvenance(data, provenanceOf(cfg, task))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, embedded, 0600)
+}
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrPrivateAddress rejects outbound requests that resolve inside the network
+var ErrPrivateAddress = errors.New("address is not public")
+
+// IsPublicIP reports whether ip is outside loopback, private and link-local
+// ranges, cloud metadata addresses included
+func IsPublicIP(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// PublicOnly is a net.Dialer Control that refuses connections to non-public
+// addresses. It runs after DNS resolution and on every redirect, so a public
+// name cannot lead the server into the local network.
+func PublicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !IsPublicIP(net.ParseIP(host)) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// CheckPublicHost rejects a host with any non-public address. Behind a proxy
+// the connection goes to the proxy, so targets are resolved and checked here
+// instead.
+func CheckPublicHost(host string) error {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !IsPublicIP(ip) {
+			return ErrPrivateAddress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"flow2api/internal/database"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+)
+
+// tokenBucket refills at rate tokens per second up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait is how long until one token is available
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	if b.rate <= 0 {
+		return time.Minute
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// RateLimiter applies a global and per-model token bucket to generation requests
+type RateLimiter struct {
+	db      *database.Database
+	buckets map[string]*tokenBucket // keyed by base model name or models.RateLimitGlobal
+	mu      sync.Mutex
+}
+
+// NewRateLimiter creates a rate limiter and loads the stored limits
+func NewRateLimiter(db *database.Database) *RateLimiter {
+	rl := &RateLimiter{
+		db:      db,
+		buckets: make(map[string]*tokenBucket),
+	}
+	if err := rl.Reload(); err != nil {
+		logging.Component("rate_limit").Error("Failed to load limits", "error", err)
+	}
+	return rl
+}
+
+// Reload refreshes the limits from the database, keeping the fill level of unchanged buckets
+func (rl *RateLimiter) Reload() error {
+	limits, err := rl.db.GetRateLimits()
+	if err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	buckets := make(map[string]*tokenBucket, len(limits))
+	for _, limit := range limits {
+		rate := limit.RequestsPerMinute / 60
+		burst := float64(max(limit.Burst, 1))
+		if old, ok := rl.buckets[limit.Model]; ok && old.rate == rate && old.burst == burst {
+			buckets[limit.Model] = old
+			continue
+		}
+		buckets[limit.Model] = &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+	}
+	rl.buckets = buckets
+	return nil
+}
+
+// Allow takes one request from the global and model buckets. When either is
+// empty nothing is taken and the time until a retry can succeed is returned.
+func (rl *RateLimiter) Allow(model string) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	var buckets []*tokenBucket
+	for _, key := range []string{models.RateLimitGlobal, models.BaseModelName(model)} {
+		if b, ok := rl.buckets[key]; ok {
+			b.refill(now)
+			buckets = append(buckets, b)
+		}
+	}
+
+	var retryAfter time.Duration
+	for _, b := range buckets {
+		retryAfter = max(retryAfter, b.wait())
+	}
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// errGenerationPanic is what clients see when a generation panicked
+var errGenerationPanic = fmt.Errorf("internal error during generation")
+
+// recoverGeneration turns a panic into a failed generation: the stack is
+// logged, the task (when one was recorded) is marked failed, the client gets
+// an error chunk and the panic is counted. Concurrency slots are freed by the
+// deferred releases the panic unwound through; the slot reconciler catches
+// any that were not.
+func (gh *GenerationHandler) recoverGeneration(r interface{}, requestID, taskID string, chunkChan chan<- string) error {
+	gh.panics.Add(1)
+	generationLog.Error("Generation panicked", "request_id", requestID, "task_id", taskID,
+		"panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+
+	if taskID != "" {
+		gh.db.UpdateTask(taskID, map[string]interface{}{
+			"status":        "failed",
+			"error_message": errGenerationPanic.Error(),
+			"completed_at":  time.Now(),
+		})
+	}
+	if chunkChan != nil {
+		chunkChan <- gh.createStreamChunk(fmt.Sprintf("❌ %s\n", errGenerationPanic), "", false)
+		chunkChan <- gh.createErrorResponse(errGenerationPanic.Error())
+	}
+	return errGenerationPanic
+}
@@ -0,0 +1,227 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+
+	"github.com/google/uuid"
+)
+
+var uploadLog = logging.Component("uploads")
+
+// Resumable upload errors
+var (
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrUploadOffset     = errors.New("chunk does not start at the upload offset")
+	ErrUploadTooLarge   = errors.New("chunk goes past the declared upload size")
+	ErrUploadIncomplete = errors.New("upload is not complete")
+	ErrUploadOverLimit  = errors.New("upload is larger than a reference image may be")
+)
+
+// Upload is a file sent in chunks. Offset is how many bytes arrived; a client
+// whose connection dropped asks for it and continues from there.
+type Upload struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename,omitempty"`
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	Complete  bool      `json:"complete"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	keyID   string
+	expires atomic.Int64 // unix nanoseconds; each chunk pushes it back
+	mu      sync.Mutex   // one chunk at a time
+}
+
+func (u *Upload) expired(now time.Time) bool {
+	return now.UnixNano() > u.expires.Load()
+}
+
+// UploadStore keeps resumable uploads on disk until they expire. Uploads are
+// only known to the process that received them; one left over from before a
+// restart is removed and has to be sent again.
+type UploadStore struct {
+	dir     string
+	mu      sync.Mutex
+	uploads map[string]*Upload
+}
+
+// NewUploadStore creates a store keeping its files in dir
+func NewUploadStore(dir string) *UploadStore {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		uploadLog.Error("Failed to create upload directory", "dir", dir, "error", err)
+	}
+	// Only files named like upload IDs are ours to remove
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if _, err := uuid.Parse(entry.Name()); err == nil && !entry.IsDir() {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return &UploadStore{dir: dir, uploads: make(map[string]*Upload)}
+}
+
+// MaxUploadBytes is the largest upload accepted. Uploads are reference
+// images, so nothing larger than a reference image can be used.
+func MaxUploadBytes() int64 {
+	cfg := config.Get()
+	return int64(min(cfg.Uploads.MaxSize, cfg.Generation.MaxReferenceImageMB)) << 20
+}
+
+func uploadTTL() time.Duration {
+	return time.Duration(config.Get().Uploads.Expire) * time.Minute
+}
+
+func (s *UploadStore) path(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// Create starts an upload of size bytes for the API key keyID
+func (s *UploadStore) Create(keyID, filename string, size int64) (*Upload, error) {
+	s.Sweep()
+
+	u := &Upload{
+		ID:        uuid.New().String(),
+		Size:      size,
+		CreatedAt: time.Now().UTC(),
+		keyID:     keyID,
+	}
+	if filename != "" {
+		u.Filename = filepath.Base(filename)
+	}
+	u.expires.Store(u.CreatedAt.Add(uploadTTL()).UnixNano())
+	f, err := os.OpenFile(s.path(u.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	s.mu.Lock()
+	s.uploads[u.ID] = u
+	s.mu.Unlock()
+	return u.snapshot(), nil
+}
+
+// snapshot copies the exported fields, for callers outside the chunk lock
+func (u *Upload) snapshot() *Upload {
+	return &Upload{
+		ID: u.ID, Filename: u.Filename, Size: u.Size, Offset: u.Offset, Complete: u.Offset == u.Size,
+		CreatedAt: u.CreatedAt, ExpiresAt: time.Unix(0, u.expires.Load()).UTC(),
+	}
+}
+
+// lookup returns the upload id of keyID; uploads of other keys are not found
+func (s *UploadStore) lookup(id, keyID string) (*Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[id]
+	if !ok || u.keyID != keyID || u.expired(time.Now()) {
+		return nil, ErrUploadNotFound
+	}
+	return u, nil
+}
+
+// Get reports the progress of an upload
+func (s *UploadStore) Get(id, keyID string) (*Upload, error) {
+	u, err := s.lookup(id, keyID)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.snapshot(), nil
+}
+
+// Append writes chunk at offset, which must be where the upload stands. On
+// ErrUploadOffset the returned upload tells where to continue.
+func (s *UploadStore) Append(id, keyID string, offset int64, chunk []byte) (*Upload, error) {
+	u, err := s.lookup(id, keyID)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if offset != u.Offset {
+		return u.snapshot(), ErrUploadOffset
+	}
+	if offset+int64(len(chunk)) > u.Size {
+		return u.snapshot(), ErrUploadTooLarge
+	}
+
+	f, err := os.OpenFile(s.path(id), os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteAt(chunk, offset)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.Offset += int64(len(chunk))
+	u.expires.Store(time.Now().Add(uploadTTL()).UnixNano())
+	return u.snapshot(), nil
+}
+
+// Data returns the content of a complete upload of keyID, for the generation
+// requests that name it
+func (s *UploadStore) Data(id, keyID string) ([]byte, error) {
+	u, err := s.lookup(id, keyID)
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.Offset != u.Size {
+		return nil, ErrUploadIncomplete
+	}
+	// The limit may have been lowered since the upload started
+	if u.Size > MaxUploadBytes() {
+		return nil, ErrUploadOverLimit
+	}
+	return os.ReadFile(s.path(id))
+}
+
+// Delete removes an upload
+func (s *UploadStore) Delete(id, keyID string) error {
+	if _, err := s.lookup(id, keyID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.uploads, id)
+	s.mu.Unlock()
+	return os.Remove(s.path(id))
+}
+
+// Sweep removes expired uploads
+func (s *UploadStore) Sweep() {
+	now := time.Now()
+	s.mu.Lock()
+	var expired []string
+	for id, u := range s.uploads {
+		if u.expired(now) {
+			expired = append(expired, id)
+			delete(s.uploads, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range expired {
+		if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+			uploadLog.Warn("Failed to remove expired upload", "upload_id", id, "error", err)
+		}
+	}
+	if len(expired) > 0 {
+		uploadLog.Info("Removed expired uploads", "count", len(expired))
+	}
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var selfTestLog = logging.Component("selftest")
+
+var (
+	ErrSelfTestDisabled = errors.New("self-test is not enabled")
+	ErrSelfTestRunning  = errors.New("a self-test is already running")
+)
+
+// SelfTestStep is one stage of a self-test
+type SelfTestStep struct {
+	Name       string `json:"name"`
+	OK         bool   `json:"ok"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SelfTestResult is the outcome of an end-to-end generation self-test
+type SelfTestResult struct {
+	OK         bool           `json:"ok"`
+	TokenID    int64          `json:"token_id"`
+	Model      string         `json:"model"`
+	StartedAt  time.Time      `json:"started_at"`
+	DurationMs int64          `json:"duration_ms"`
+	Steps      []SelfTestStep `json:"steps"`
+	ResultURL  string         `json:"result_url,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// RunSelfTest generates an image from an uploaded reference image on the
+// self-test token and caches it, recording each step: token (session, slot
+// and project), upload, generate (which solves a captcha) and cache, when
+// caching is enabled. No task or request log entry is written.
+func (gh *GenerationHandler) RunSelfTest() (*SelfTestResult, error) {
+	cfg := config.Get()
+	if !cfg.SelfTest.Enabled {
+		return nil, ErrSelfTestDisabled
+	}
+	if !gh.selfTestMu.TryLock() {
+		return nil, ErrSelfTestRunning
+	}
+	defer gh.selfTestMu.Unlock()
+
+	result := &SelfTestResult{TokenID: cfg.SelfTest.TokenID, Model: cfg.SelfTest.Model, StartedAt: time.Now()}
+	err := gh.selfTest(cfg, result)
+	result.OK = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.DurationMs = time.Since(result.StartedAt).Milliseconds()
+	gh.lastSelfTest.Store(result)
+
+	if err != nil {
+		selfTestLog.Warn("Self-test failed", "token_id", result.TokenID, "error", err)
+	} else {
+		selfTestLog.Info("Self-test passed", "token_id", result.TokenID, "duration_ms", result.DurationMs)
+	}
+	return result, nil
+}
+
+// StartSelfTests runs a self-test now and then every interval, until the
+// process exits, so the health check stays current without a caller
+func (gh *GenerationHandler) StartSelfTests(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			// Disabled by a reload, or already started from the admin API
+			if _, err := gh.RunSelfTest(); err != nil && !errors.Is(err, ErrSelfTestDisabled) && !errors.Is(err, ErrSelfTestRunning) {
+				selfTestLog.Error("Scheduled self-test failed to run", "error", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// LastSelfTest returns the result of the last self-test, nil before the first
+func (gh *GenerationHandler) LastSelfTest() *SelfTestResult {
+	return gh.lastSelfTest.Load()
+}
+
+func (gh *GenerationHandler) selfTest(cfg *config.Config, result *SelfTestResult) error {
+	step := func(name string, fn func() error) error {
+		start := time.Now()
+		err := fn()
+		s := SelfTestStep{Name: name, OK: err == nil, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		result.Steps = append(result.Steps, s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	}
+
+	_, modelConfig, err := models.ResolveModel(cfg.SelfTest.Model, "")
+	if err != nil {
+		return err
+	}
+	if modelConfig.Type != "image" {
+		return fmt.Errorf("model %s is not an image model", cfg.SelfTest.Model)
+	}
+
+	owner := "selftest-" + uuid.New().String()
+	var token *models.Token
+	var projectID string
+	err = step("token", func() error {
+		if token, _ = gh.tokenManager.GetToken(cfg.SelfTest.TokenID); token == nil {
+			return fmt.Errorf("token %d not found", cfg.SelfTest.TokenID)
+		}
+		if valid, err := gh.tokenManager.IsATValid(token.ID); err != nil || !valid {
+			return fmt.Errorf("token %d has no valid access token", token.ID)
+		}
+		token, _ = gh.tokenManager.GetToken(token.ID)
+		if !gh.concurrencyManager.AcquireImage(token.ID, owner, slotTTL(false)) {
+			return fmt.Errorf("image concurrency limit reached")
+		}
+		id, err := gh.tokenManager.EnsureProjectExists(token.ID)
+		projectID = id
+		return err
+	})
+	if token != nil {
+		defer gh.concurrencyManager.ReleaseImage(token.ID, owner)
+	}
+	if err != nil {
+		return err
+	}
+
+	var mediaID string
+	if err := step("upload", func() (err error) {
+		mediaID, err = gh.uploadImage(context.Background(), token.AT, selfTestImage(), modelConfig.AspectRatio)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	var imageURL string
+	if err := step("generate", func() error {
+		inputs := []map[string]interface{}{{"name": mediaID, "imageInputType": "IMAGE_INPUT_TYPE_REFERENCE"}}
+		generated, err := gh.flowClient.GenerateImage(token.AT, projectID, cfg.SelfTest.Prompt, "", modelConfig.ModelName, modelConfig.AspectRatio, inputs, 1, 1)
+		if err != nil {
+			return err
+		}
+		gh.tokenManager.RecordUsage(token.ID, false)
+		media, _ := generated["media"].([]interface{})
+		for _, item := range media {
+			mediaItem, _ := item.(map[string]interface{})
+			img, _ := mediaItem["image"].(map[string]interface{})
+			genImage, _ := img["generatedImage"].(map[string]interface{})
+			if imageURL, _ = genImage["fifeUrl"].(string); imageURL != "" {
+				return nil
+			}
+		}
+		return fmt.Errorf("empty generation result")
+	}); err != nil {
+		return err
+	}
+	result.ResultURL = imageURL
+
+	if !cfg.Cache.Enabled {
+		return nil
+	}
+	return step("cache", func() error {
+		task := &models.Task{TaskID: owner, TokenID: token.ID, Model: cfg.SelfTest.Model, Prompt: cfg.SelfTest.Prompt,
+			Params: &models.TaskParams{Type: "image"}}
+		cached, err := gh.cacheFile(context.Background(), imageURL, "image", task, nil)
+		if err != nil {
+			return err
+		}
+		result.ResultURL = cached
+		return nil
+	})
+}
+
+// selfTestImage is the reference image of self-tests, a small gradient
+func selfTestImage() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
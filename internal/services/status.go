@@ -0,0 +1,184 @@
+package services
+
+import (
+	"sort"
+	"time"
+
+	"flow2api/internal/models"
+)
+
+// StatusWindow is the period over which completion statistics are reported
+const StatusWindow = time.Hour
+
+// ServiceStatus is a snapshot of capacity and load for external schedulers
+type ServiceStatus struct {
+	ActiveTokens int                   `json:"active_tokens"`
+	Load         PoolLoad              `json:"load"`
+	QueueDepth   int                   `json:"queue_depth"`        // tasks currently processing
+	Queues       map[string]QueueStats `json:"queues,omitempty"`   // worker pool by generation type
+	Draining     bool                  `json:"draining,omitempty"` // shutting down; new generations are rejected
+	Panics       int64                 `json:"panics"`             // generations that panicked since startup
+	WindowSec    int                   `json:"window_seconds"`
+	Models       []*ModelStatus        `json:"models"`
+}
+
+// ModelStatus describes availability and recent performance of one model
+type ModelStatus struct {
+	ID                   string   `json:"id"`
+	Type                 string   `json:"type"`
+	Available            bool     `json:"available"`
+	AspectRatios         []string `json:"aspect_ratios"`
+	Processing           int      `json:"processing"`
+	Completed            int      `json:"completed"`
+	Failed               int      `json:"failed"`
+	AvgCompletionSeconds float64  `json:"avg_completion_seconds"`
+}
+
+// Public status health levels
+const (
+	HealthOperational = "operational"
+	HealthDegraded    = "degraded" // draining or a low success rate
+	HealthDown        = "down"     // no model can be served
+)
+
+// A success rate below degradedSuccessRate marks the service degraded once
+// at least minStatusSamples tasks finished in the window
+const (
+	degradedSuccessRate = 0.8
+	minStatusSamples    = 5
+)
+
+// PublicStatus is the summary shown on the public status page. It leaves out
+// token counts, pool load and queue details.
+type PublicStatus struct {
+	Status       string               `json:"status"`
+	Announcement string               `json:"announcement,omitempty"`
+	Draining     bool                 `json:"draining,omitempty"`
+	SuccessRate  *float64             `json:"success_rate"` // null when no task finished in the window
+	WindowSec    int                  `json:"window_seconds"`
+	UpdatedAt    time.Time            `json:"updated_at"`
+	Models       []*PublicModelStatus `json:"models"`
+}
+
+// PublicModelStatus is one model's line on the public status page
+type PublicModelStatus struct {
+	ID                   string   `json:"id"`
+	Type                 string   `json:"type"`
+	Available            bool     `json:"available"`
+	Completed            int      `json:"completed"`
+	Failed               int      `json:"failed"`
+	SuccessRate          *float64 `json:"success_rate"`
+	AvgCompletionSeconds float64  `json:"avg_completion_seconds"`
+}
+
+// Public summarizes the status for the public status page
+func (s *ServiceStatus) Public() *PublicStatus {
+	public := &PublicStatus{
+		Status:    HealthOperational,
+		Draining:  s.Draining,
+		WindowSec: s.WindowSec,
+		UpdatedAt: time.Now().UTC(),
+		Models:    make([]*PublicModelStatus, 0, len(s.Models)),
+	}
+
+	var completed, failed, available int
+	for _, m := range s.Models {
+		public.Models = append(public.Models, &PublicModelStatus{
+			ID:                   m.ID,
+			Type:                 m.Type,
+			Available:            m.Available,
+			Completed:            m.Completed,
+			Failed:               m.Failed,
+			SuccessRate:          successRate(m.Completed, m.Failed),
+			AvgCompletionSeconds: m.AvgCompletionSeconds,
+		})
+		completed += m.Completed
+		failed += m.Failed
+		if m.Available {
+			available++
+		}
+	}
+	public.SuccessRate = successRate(completed, failed)
+
+	switch {
+	case available == 0:
+		public.Status = HealthDown
+	case s.Draining:
+		public.Status = HealthDegraded
+	case completed+failed >= minStatusSamples && *public.SuccessRate < degradedSuccessRate:
+		public.Status = HealthDegraded
+	}
+	return public
+}
+
+// successRate is the share of finished tasks that completed, nil when none finished
+func successRate(completed, failed int) *float64 {
+	if completed+failed == 0 {
+		return nil
+	}
+	rate := float64(completed) / float64(completed+failed)
+	return &rate
+}
+
+// Status reports which models can be served, the current pool load and recent completion times
+func (gh *GenerationHandler) Status() (*ServiceStatus, error) {
+	tokens, err := gh.tokenManager.GetActiveTokens()
+	if err != nil {
+		return nil, err
+	}
+	taskStats, err := gh.db.GetTaskStatsSince(StatusWindow)
+	if err != nil {
+		return nil, err
+	}
+
+	var hasImage, hasVideo bool
+	for _, token := range tokens {
+		hasImage = hasImage || token.ImageEnabled
+		hasVideo = hasVideo || token.VideoEnabled
+	}
+
+	status := &ServiceStatus{
+		ActiveTokens: len(tokens),
+		Load:         gh.concurrencyManager.Load(tokens),
+		WindowSec:    int(StatusWindow.Seconds()),
+		Panics:       gh.panics.Load(),
+	}
+
+	byID := make(map[string]*ModelStatus)
+	for name, cfg := range models.ListModelConfigs() {
+		id := models.BaseModelName(name)
+		if byID[id] != nil {
+			continue
+		}
+		byID[id] = &ModelStatus{
+			ID:           id,
+			Type:         cfg.Type,
+			Available:    (cfg.Type == "image" && hasImage) || (cfg.Type == "video" && hasVideo),
+			AspectRatios: models.SupportedAspectRatios(cfg.Type),
+		}
+	}
+
+	// Tasks are recorded under their resolved variant; fold them into the base model
+	completionTotals := make(map[string]float64)
+	for _, s := range taskStats {
+		status.QueueDepth += s.Processing
+		ms := byID[models.BaseModelName(s.Model)]
+		if ms == nil {
+			continue
+		}
+		ms.Processing += s.Processing
+		ms.Failed += s.Failed
+		ms.Completed += s.Completed
+		completionTotals[ms.ID] += s.AvgCompletionSeconds * float64(s.Completed)
+	}
+
+	for id, ms := range byID {
+		if ms.Completed > 0 {
+			ms.AvgCompletionSeconds = completionTotals[id] / float64(ms.Completed)
+		}
+		status.Models = append(status.Models, ms)
+	}
+	sort.Slice(status.Models, func(i, j int) bool { return status.Models[i].ID < status.Models[j].ID })
+
+	return status, nil
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"flow2api/internal/client"
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+)
+
+var watchdogLog = logging.Component("watchdog")
+
+// StartTaskWatchdog checks every interval for tasks stuck in processing
+// longer than generation.stuck_task_timeout, until the process exits
+func (gh *GenerationHandler) StartTaskWatchdog(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			timeout := config.Get().Generation.StuckTaskTimeout
+			if timeout <= 0 {
+				continue
+			}
+			if err := gh.RecoverStuckTasks(time.Duration(timeout) * time.Second); err != nil {
+				watchdogLog.Error("Stuck task check failed", "error", err)
+			}
+		}
+	}()
+}
+
+// RecoverStuckTasks settles the tasks that have been processing without an
+// update for age and that no generation in this process still owns: videos
+// Flow has finished are completed, everything else is failed, and their slots
+// are released
+func (gh *GenerationHandler) RecoverStuckTasks(age time.Duration) error {
+	tasks, err := gh.db.GetStaleTasks(age)
+	if err != nil {
+		return err
+	}
+	owned := gh.inFlightTasks()
+	for _, task := range tasks {
+		if owned[task.TaskID] {
+			continue
+		}
+		gh.recoverStuckTask(task, age)
+	}
+	return nil
+}
+
+// inFlightTasks returns the IDs of the tasks a running generation or
+// background poll is working on
+func (gh *GenerationHandler) inFlightTasks() map[string]bool {
+	owned := make(map[string]bool)
+	gh.inFlight.Range(func(key, _ interface{}) bool {
+		if taskID, _, _ := key.(*RequestTrace).current(); taskID != "" {
+			owned[taskID] = true
+		}
+		return true
+	})
+	return owned
+}
+
+func (gh *GenerationHandler) recoverStuckTask(task *models.Task, age time.Duration) {
+	logger := watchdogLog.With("task_id", task.TaskID, "model", task.Model, "token_id", task.TokenID)
+	video := task.Params != nil && task.Params.Type == "video"
+	defer gh.releaseSlot(task.TokenID, task.TaskID, video)
+
+	startTime := time.Now()
+	if task.CreatedAt != nil {
+		startTime = *task.CreatedAt
+	}
+
+	// One last look upstream, in case only the worker polling it was lost
+	status, err := gh.checkStuckVideo(task, logger)
+	if err == nil && status == "completed" {
+		token, _ := gh.tokenManager.GetToken(task.TokenID)
+		if token == nil {
+			token = &models.Token{ID: task.TokenID}
+		}
+		hookEvent := &HookEvent{
+			TaskID: task.TaskID, Model: task.Model, Type: task.Params.Type, Prompt: task.Prompt,
+			KeyID: task.Params.KeyID, TokenID: task.TokenID,
+		}
+		logger.Warn("Stuck task had finished upstream, completing it")
+		gh.finishTask(task, token, hookEvent, startTime, logger, nil)
+		return
+	}
+
+	errMsg := fmt.Sprintf("Task stuck in processing with no update for %s", age)
+	if err != nil {
+		errMsg += fmt.Sprintf("; last status check failed: %v", err)
+	} else if status != "" {
+		errMsg += fmt.Sprintf("; upstream status %s", status)
+	}
+	gh.db.UpdateTask(task.TaskID, map[string]interface{}{
+		"status":        "failed",
+		"error_message": errMsg,
+		"completed_at":  time.Now(),
+	})
+	gh.events.Publish(EventGenerationFailed, map[string]interface{}{
+		"task_id": task.TaskID, "model": task.Model, "token_id": task.TokenID, "error": errMsg,
+	})
+	gh.callbacks.Notify(task.TaskID)
+	logger.Warn("Failed stuck task", "error", errMsg, "age", time.Since(startTime).Round(time.Second))
+}
+
+// checkStuckVideo checks a video task's operation once. It returns
+// "completed" when the video was finished and stored on the task, otherwise
+// the upstream status; tasks without an operation return "".
+func (gh *GenerationHandler) checkStuckVideo(task *models.Task, logger *slog.Logger) (string, error) {
+	if task.OperationName == "" || task.Params == nil {
+		return "", nil
+	}
+	if valid, err := gh.tokenManager.IsATValid(task.TokenID); err != nil || !valid {
+		return "", fmt.Errorf("token %d has no valid access token", task.TokenID)
+	}
+	token, err := gh.tokenManager.GetToken(task.TokenID)
+	if err != nil || token == nil {
+		return "", fmt.Errorf("token %d not found", task.TokenID)
+	}
+
+	operations := []map[string]interface{}{{
+		"operation": map[string]interface{}{"name": task.OperationName},
+		"sceneId":   task.SceneID,
+		"status":    "MEDIA_GENERATION_STATUS_PENDING",
+	}}
+	result, err := client.RetryTransient(func() (map[string]interface{}, error) {
+		return gh.flowClient.CheckVideoStatus(token.AT, operations)
+	})
+	if err != nil {
+		return "", err
+	}
+	checked, _ := result["operations"].([]interface{})
+	if len(checked) == 0 {
+		return "", fmt.Errorf("no operations in status response")
+	}
+	op, _ := checked[0].(map[string]interface{})
+	status, _ := op["status"].(string)
+	if status != "MEDIA_GENERATION_STATUS_SUCCESSFUL" {
+		return status, nil
+	}
+
+	// Nobody reads the progress any more
+	discard := make(chan string)
+	go func() {
+		for range discard {
+		}
+	}()
+	defer close(discard)
+
+	if err := gh.completeVideo(context.Background(), task, op, newRequestTrace(task.Model, false, logger), discard); err != nil {
+		return status, err
+	}
+	return "completed", nil
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"time"
+	_ "time/tzdata" // quota reset timezones work without system zoneinfo
+
+	"flow2api/internal/models"
+)
+
+// StartAutoUnban lifts expired token bans every unban_check_minutes of the
+// ban config, and at each daily quota reset, until the process exits.
+// ReloadAutoUnban applies a changed config right away.
+func (tm *TokenManager) StartAutoUnban() {
+	go func() {
+		for {
+			cfg := tm.banConfig()
+			wait := time.Duration(cfg.UnbanCheckMinutes) * time.Minute
+			if untilReset := time.Until(nextQuotaReset(time.Now(), cfg)); untilReset < wait {
+				wait = untilReset
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-tm.unbanWake:
+				timer.Stop()
+			}
+			if err := tm.AutoUnbanTokens(); err != nil {
+				tokenLog.Error("Auto-unban failed", "error", err)
+			}
+		}
+	}()
+}
+
+// ReloadAutoUnban applies a changed ban config right away
+func (tm *TokenManager) ReloadAutoUnban() {
+	select {
+	case tm.unbanWake <- struct{}{}:
+	default:
+	}
+}
+
+// banConfig returns the ban config, or the defaults when it cannot be read
+func (tm *TokenManager) banConfig() *models.BanConfig {
+	cfg, err := tm.db.GetBanConfig()
+	if err != nil {
+		tokenLog.Error("Failed to load ban config", "error", err)
+		return &models.BanConfig{RateLimitBan: true, RateLimitBanMinutes: 720, ErrorBan: true, UnbanCheckMinutes: 60,
+			QuotaResetTimezone: "America/Los_Angeles"}
+	}
+	return cfg
+}
+
+// nextQuotaReset returns the first time after t the daily quota resets
+func nextQuotaReset(t time.Time, cfg *models.BanConfig) time.Time {
+	loc, err := time.LoadLocation(cfg.QuotaResetTimezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	reset := time.Date(t.Year(), t.Month(), t.Day(), cfg.QuotaResetHour, 0, 0, 0, loc)
+	if !reset.After(t) {
+		reset = time.Date(t.Year(), t.Month(), t.Day()+1, cfg.QuotaResetHour, 0, 0, 0, loc)
+	}
+	return reset
+}
+
+// liftQuotaBan enables a token banned for its quota once fresh credits show
+// the quota is back; until then it stays banned and is checked again with
+// the other bans
+func (tm *TokenManager) liftQuotaBan(token *models.Token) {
+	credits, err := tm.RefreshCredits(token.ID)
+	if err != nil || credits <= 0 {
+		tokenLog.Info("Quota not back yet, keeping token banned", "token_id", token.ID, "credits", credits, "error", err)
+		return
+	}
+	tm.unbanToken(token)
+}
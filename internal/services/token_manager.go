@@ -1,28 +1,54 @@
 package services
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"flow2api/internal/client"
+	"flow2api/internal/config"
 	"flow2api/internal/database"
+	"flow2api/internal/logging"
 	"flow2api/internal/models"
 )
 
+var tokenLog = logging.Component("token")
+
+// ErrTokenConflict is returned by EditToken when the token was edited since
+// the caller read it
+var ErrTokenConflict = errors.New("token was changed by another session")
+
 // TokenManager handles token lifecycle
 type TokenManager struct {
-	db         *database.Database
-	flowClient *client.FlowClient
-	mu         sync.Mutex
+	db           *database.Database
+	flowClient   *client.FlowClient
+	events       *EventBus
+	atLocks      sync.Map   // token ID -> *sync.Mutex, one AT refresh per token at a time
+	rejectedAt   sync.Map   // token ID -> time.Time its AT was last refreshed after the upstream rejected it
+	projectLocks sync.Map   // token ID -> *sync.Mutex, one project creation or rotation per token at a time
+	proxied      sync.Map   // proxy URL -> *client.FlowClient used to add tokens through it
+	addMu        sync.Mutex // paces the upstream calls of new tokens
+	lastAdd      time.Time
+	addCount     int
+
+	scheduledRefresh atomic.Bool   // ATs are refreshed ahead of expiry by StartATRefresh
+	refreshWake      chan struct{} // a changed token refresh config
+	unbanWake        chan struct{} // a changed ban config
 }
 
 // NewTokenManager creates a new token manager
-func NewTokenManager(db *database.Database, flowClient *client.FlowClient) *TokenManager {
+func NewTokenManager(db *database.Database, flowClient *client.FlowClient, events *EventBus) *TokenManager {
 	return &TokenManager{
 		db:         db,
 		flowClient: flowClient,
+		events:     events,
+
+		refreshWake: make(chan struct{}, 1),
+		unbanWake:   make(chan struct{}, 1),
 	}
 }
 
@@ -36,6 +62,16 @@ func (tm *TokenManager) GetActiveTokens() ([]*models.Token, error) {
 	return tm.db.GetActiveTokens()
 }
 
+// GetTokenGroups returns all token groups
+func (tm *TokenManager) GetTokenGroups() ([]*models.TokenGroup, error) {
+	return tm.db.GetTokenGroups()
+}
+
+// GetDailyUsage returns today's generation counts per token
+func (tm *TokenManager) GetDailyUsage() (map[int64]models.DailyUsage, error) {
+	return tm.db.GetDailyUsage()
+}
+
 // GetToken returns a token by ID
 func (tm *TokenManager) GetToken(id int64) (*models.Token, error) {
 	return tm.db.GetToken(id)
@@ -43,33 +79,67 @@ func (tm *TokenManager) GetToken(id int64) (*models.Token, error) {
 
 // DeleteToken deletes a token
 func (tm *TokenManager) DeleteToken(id int64) error {
-	return tm.db.DeleteToken(id)
+	if err := tm.db.DeleteToken(id); err != nil {
+		return err
+	}
+	tm.publishTokenUpdate(id, "deleted")
+	return nil
 }
 
 // EnableToken enables a token and resets error count
 func (tm *TokenManager) EnableToken(id int64) error {
-	if err := tm.db.UpdateToken(id, map[string]interface{}{"is_active": true}); err != nil {
+	if err := tm.db.UpdateToken(id, map[string]interface{}{"is_active": true, "ban_reason": nil, "banned_at": nil}); err != nil {
 		return err
 	}
+	tm.publishTokenUpdate(id, "enabled")
 	return tm.db.ResetErrorCount(id)
 }
 
 // DisableToken disables a token
 func (tm *TokenManager) DisableToken(id int64) error {
-	return tm.db.UpdateToken(id, map[string]interface{}{"is_active": false})
+	if err := tm.db.UpdateToken(id, map[string]interface{}{"is_active": false}); err != nil {
+		return err
+	}
+	tm.publishTokenUpdate(id, "disabled")
+	return nil
+}
+
+func (tm *TokenManager) publishTokenUpdate(id int64, change string) {
+	tm.events.Publish(EventTokenUpdated, map[string]interface{}{"token_id": id, "change": change})
 }
 
 // AddToken adds a new token
 func (tm *TokenManager) AddToken(st, projectID, projectName, remark string, imageEnabled, videoEnabled bool, imageConcurrency, videoConcurrency int) (*models.Token, error) {
+	return tm.AddTokenViaProxy("", st, projectID, projectName, remark, imageEnabled, videoEnabled, imageConcurrency, videoConcurrency)
+}
+
+// AddTokenViaProxy adds a new token like AddToken, but makes the ST
+// conversion, credits and project calls through proxyURL. Without one the
+// token_import.proxies take turns, then the usual proxy is used; generation
+// always goes through the usual proxy.
+func (tm *TokenManager) AddTokenViaProxy(proxyURL, st, projectID, projectName, remark string, imageEnabled, videoEnabled bool, imageConcurrency, videoConcurrency int) (*models.Token, error) {
 	// Check if ST already exists
 	existing, _ := tm.db.GetTokenByST(st)
 	if existing != nil {
 		return nil, fmt.Errorf("Token already exists (email: %s)", existing.Email)
 	}
 
+	turn := tm.paceAdd()
+	fc := tm.flowClient
+	if proxies := config.Get().TokenImport.Proxies; proxyURL == "" && len(proxies) > 0 {
+		proxyURL = proxies[turn%len(proxies)]
+	}
+	if proxyURL != "" {
+		proxied, ok := tm.proxied.Load(proxyURL)
+		if !ok {
+			proxied, _ = tm.proxied.LoadOrStore(proxyURL, client.NewFlowClient(proxyURL))
+		}
+		fc = proxied.(*client.FlowClient)
+	}
+
 	// Convert ST to AT
-	log.Println("[AddToken] Converting ST to AT...")
-	result, err := tm.flowClient.STToAT(st)
+	tokenLog.Debug("Converting ST to AT")
+	result, err := fc.STToAT(st)
 	if err != nil {
 		return nil, fmt.Errorf("ST to AT failed: %w", err)
 	}
@@ -95,7 +165,7 @@ func (tm *TokenManager) AddToken(st, projectID, projectName, remark string, imag
 	// Get credits
 	credits := 0
 	userPaygateTier := ""
-	if creditsResult, err := tm.flowClient.GetCredits(at); err == nil {
+	if creditsResult, err := fc.GetCredits(at); err == nil {
 		if c, ok := creditsResult["credits"].(float64); ok {
 			credits = int(c)
 		}
@@ -107,16 +177,16 @@ func (tm *TokenManager) AddToken(st, projectID, projectName, remark string, imag
 	// Handle project
 	if projectID == "" {
 		if projectName == "" {
-			projectName = time.Now().Format("Jan 02 - 15:04")
+			projectName = tm.newProjectName(email)
 		}
 		var err error
-		projectID, err = tm.flowClient.CreateProject(st, projectName)
+		projectID, err = fc.CreateProject(st, projectName)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create project: %w", err)
 		}
-		log.Printf("[AddToken] Created project: %s (ID: %s)", projectName, projectID)
+		projectLog.Info("Created project", "project_id", projectID, "name", projectName)
 	} else if projectName == "" {
-		projectName = time.Now().Format("Jan 02 - 15:04")
+		projectName = tm.newProjectName(email)
 	}
 
 	// Create token
@@ -154,31 +224,63 @@ func (tm *TokenManager) AddToken(st, projectID, projectName, remark string, imag
 	}
 	tm.db.AddProject(project)
 
-	log.Printf("[AddToken] Token added (ID: %d, Email: %s)", tokenID, email)
+	tokenLog.Info("Token added", "token_id", tokenID, "email", email)
+	tm.publishTokenUpdate(tokenID, "added")
 	return token, nil
 }
 
+// paceAdd waits until token_import.interval has passed since the previous
+// new token started, and returns how many new tokens started before this one
+func (tm *TokenManager) paceAdd() int {
+	interval := time.Duration(config.Get().TokenImport.Interval) * time.Millisecond
+
+	tm.addMu.Lock()
+	defer tm.addMu.Unlock()
+	if wait := time.Until(tm.lastAdd.Add(interval)); wait > 0 {
+		time.Sleep(wait)
+	}
+	tm.lastAdd = time.Now()
+	tm.addCount++
+	return tm.addCount - 1
+}
+
 // UpdateToken updates a token
 func (tm *TokenManager) UpdateToken(id int64, updates map[string]interface{}) error {
+	_, err := tm.EditToken(id, -1, updates)
+	return err
+}
+
+// EditToken updates a token only while it is still at the expected version,
+// so concurrent admin edits cannot overwrite each other; a negative version
+// skips the check. It returns the token's new version.
+func (tm *TokenManager) EditToken(id, version int64, updates map[string]interface{}) (int64, error) {
 	// Check if token is banned for 429, clear ban if not expired
 	token, err := tm.db.GetToken(id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if token != nil && token.BanReason == "429_rate_limit" {
+	if token != nil && token.BanReason == models.BanReasonRateLimit {
 		isExpired := false
 		if token.ATExpires != nil {
 			isExpired = token.ATExpires.Before(time.Now().UTC())
 		}
 		if !isExpired {
-			log.Printf("[UpdateToken] Token %d edited, clearing 429 ban", id)
+			tokenLog.Info("Token edited, clearing 429 ban", "token_id", id)
 			updates["ban_reason"] = nil
 			updates["banned_at"] = nil
 		}
 	}
 
-	return tm.db.UpdateToken(id, updates)
+	newVersion, applied, err := tm.db.EditToken(id, version, updates)
+	if err != nil {
+		return 0, err
+	}
+	if !applied {
+		return 0, ErrTokenConflict
+	}
+	tm.publishTokenUpdate(id, "updated")
+	return newVersion, nil
 }
 
 // IsATValid checks if AT is valid, refreshes if needed
@@ -189,19 +291,24 @@ func (tm *TokenManager) IsATValid(id int64) (bool, error) {
 	}
 
 	if token.AT == "" {
-		log.Printf("[AT_CHECK] Token %d: AT missing, refreshing", id)
+		tokenLog.Info("AT missing, refreshing", "token_id", id)
 		return tm.refreshATInternal(id)
 	}
 
 	if token.ATExpires == nil {
-		log.Printf("[AT_CHECK] Token %d: AT expires unknown, refreshing", id)
+		tokenLog.Info("AT expiry unknown, refreshing", "token_id", id)
 		return tm.refreshATInternal(id)
 	}
 
-	// Check if expiring within 1 hour
+	// Refresh one expiring within the hour, or, while the scheduler refreshes
+	// them ahead, only one it did not get to in time
+	margin := time.Hour
+	if tm.scheduledRefresh.Load() {
+		margin = lazyRefreshMargin
+	}
 	timeUntilExpiry := time.Until(*token.ATExpires)
-	if timeUntilExpiry < time.Hour {
-		log.Printf("[AT_CHECK] Token %d: AT expiring in %.0fs, refreshing", id, timeUntilExpiry.Seconds())
+	if timeUntilExpiry < margin {
+		tokenLog.Info("AT expiring, refreshing", "token_id", id, "expires_in", timeUntilExpiry.Round(time.Second))
 		return tm.refreshATInternal(id)
 	}
 
@@ -217,21 +324,98 @@ func (tm *TokenManager) RefreshAT(id int64) (*models.Token, error) {
 	return tm.db.GetToken(id)
 }
 
+// ATRefreshResult is the outcome of refreshing one token's AT
+type ATRefreshResult struct {
+	ID        int64      `json:"id"`
+	Email     string     `json:"email"`
+	Success   bool       `json:"success"`
+	Error     string     `json:"error,omitempty"`
+	ATExpires *time.Time `json:"at_expires,omitempty"`
+}
+
+// ATRefreshSummary reports a fleet-wide AT refresh
+type ATRefreshSummary struct {
+	Total      int                `json:"total"`
+	Succeeded  int                `json:"succeeded"`
+	Failed     int                `json:"failed"`
+	DurationMs int64              `json:"duration_ms"`
+	Results    []*ATRefreshResult `json:"results"`
+}
+
+// RefreshAllAT refreshes the AT of every given token, running up to
+// parallelism refreshes at once and starting one every pace. Tokens whose
+// refresh fails are disabled, as with a single refresh.
+func (tm *TokenManager) RefreshAllAT(tokens []*models.Token, parallelism int, pace time.Duration) *ATRefreshSummary {
+	start := time.Now()
+	summary := &ATRefreshSummary{Total: len(tokens), Results: make([]*ATRefreshResult, len(tokens))}
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range tokens {
+			if i > 0 && pace > 0 {
+				time.Sleep(pace)
+			}
+			jobs <- i
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				token := tokens[i]
+				result := &ATRefreshResult{ID: token.ID, Email: token.Email}
+				refreshed, err := tm.RefreshAT(token.ID)
+				switch {
+				case err != nil:
+					result.Error = err.Error()
+				case refreshed == nil:
+					result.Error = "token not found"
+				default:
+					result.Success = true
+					result.ATExpires = refreshed.ATExpires
+				}
+				summary.Results[i] = result
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range summary.Results {
+		if result.Success {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+	}
+	summary.DurationMs = time.Since(start).Milliseconds()
+	tokenLog.Info("Fleet AT refresh finished", "total", summary.Total, "succeeded", summary.Succeeded,
+		"failed", summary.Failed, "duration", time.Since(start).Round(time.Millisecond))
+	return summary
+}
+
 // refreshATInternal refreshes the access token (internal)
 func (tm *TokenManager) refreshATInternal(id int64) (bool, error) {
-	tm.mu.Lock()
-	defer tm.mu.Unlock()
+	lock, _ := tm.atLocks.LoadOrStore(id, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
 
 	token, err := tm.db.GetToken(id)
 	if err != nil || token == nil {
 		return false, err
 	}
 
-	log.Printf("[AT_REFRESH] Token %d: Starting refresh...", id)
+	tokenLog.Debug("Refreshing AT", "token_id", id)
 
 	result, err := tm.flowClient.STToAT(token.ST)
 	if err != nil {
-		log.Printf("[AT_REFRESH] Token %d: Failed - %v", id, err)
+		tokenLog.Error("AT refresh failed, disabling token", "token_id", id, "error", err)
 		tm.DisableToken(id)
 		return false, err
 	}
@@ -257,7 +441,7 @@ func (tm *TokenManager) refreshATInternal(id int64) (bool, error) {
 		return false, err
 	}
 
-	log.Printf("[AT_REFRESH] Token %d: Success", id)
+	tokenLog.Info("AT refreshed", "token_id", id)
 
 	// Also refresh credits
 	if creditsResult, err := tm.flowClient.GetCredits(newAT); err == nil {
@@ -280,29 +464,79 @@ func (tm *TokenManager) EnsureProjectExists(id int64) (string, error) {
 		return token.CurrentProjectID, nil
 	}
 
-	projectName := time.Now().Format("Jan 02 - 15:04")
-	projectID, err := tm.flowClient.CreateProject(token.ST, projectName)
+	// Concurrent generations on a new token must not each create a project
+	defer tm.lockProjects(id)()
+	if token, err = tm.db.GetToken(id); err != nil || token == nil {
+		return "", fmt.Errorf("token not found")
+	}
+	if token.CurrentProjectID != "" {
+		return token.CurrentProjectID, nil
+	}
+
+	project, err := tm.createProject(token, true)
 	if err != nil {
-		return "", fmt.Errorf("failed to create project: %w", err)
+		return "", err
 	}
+	return project.ProjectID, nil
+}
 
-	log.Printf("[PROJECT] Created project for token %d: %s", id, projectName)
+// maxProjectNameLength keeps generated titles readable in the Flow UI
+const maxProjectNameLength = 100
 
-	tm.db.UpdateToken(id, map[string]interface{}{
-		"current_project_id":   projectID,
-		"current_project_name": projectName,
-	})
+// newProjectName renders the configured project name template for an account.
+// {seq} counts up past names already recorded for the account; templates
+// without {seq} get a numeric suffix on collision.
+func (tm *TokenManager) newProjectName(email string) string {
+	template := config.Get().Flow.ProjectNameTemplate
+	if template == "" {
+		return time.Now().Format("Jan 02 - 15:04")
+	}
 
-	project := &models.Project{
-		ProjectID:   projectID,
-		TokenID:     id,
-		ProjectName: projectName,
-		ToolName:    "PINHOLE",
-		IsActive:    true,
+	existing := make(map[string]bool)
+	if names, err := tm.db.GetProjectNamesByEmail(email); err == nil {
+		for _, name := range names {
+			existing[name] = true
+		}
 	}
-	tm.db.AddProject(project)
 
-	return projectID, nil
+	now := time.Now()
+	hasSeq := strings.Contains(template, "{seq}")
+	for seq := len(existing) + 1; ; seq++ {
+		name := renderProjectName(template, email, seq, now)
+		if !hasSeq && existing[name] {
+			name = renderProjectName(template+"-{seq}", email, seq, now)
+		}
+		if !existing[name] {
+			return name
+		}
+	}
+}
+
+func renderProjectName(template, email string, seq int, now time.Time) string {
+	user := email
+	if i := strings.Index(email, "@"); i >= 0 {
+		user = email[:i]
+	}
+
+	parts := strings.Split(strings.NewReplacer(
+		"{email}", email,
+		"{user}", user,
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("15:04"),
+	).Replace(template), "{seq}")
+
+	// Shorten the text around the sequence number, never the number itself,
+	// or names that differ only in it would collide
+	seqText := strconv.Itoa(seq)
+	room := max(maxProjectNameLength-(len(parts)-1)*len(seqText), 0)
+	for i, part := range parts {
+		if len(part) > room {
+			part = part[:room]
+		}
+		room -= len(part)
+		parts[i] = part
+	}
+	return strings.Join(parts, seqText)
 }
 
 // RecordUsage records token usage
@@ -310,6 +544,7 @@ func (tm *TokenManager) RecordUsage(id int64, isVideo bool) error {
 	tm.db.UpdateToken(id, map[string]interface{}{
 		"last_used_at": time.Now(),
 	})
+	tm.countProjectGeneration(id)
 
 	statType := "image"
 	if isVideo {
@@ -335,10 +570,10 @@ func (tm *TokenManager) RecordError(id int64) error {
 		return err
 	}
 
-	if stats != nil && stats.ConsecutiveErrorCount >= adminConfig.ErrorBanThreshold {
-		log.Printf("[TOKEN_BAN] Token %d consecutive errors (%d) reached threshold (%d), disabling",
-			id, stats.ConsecutiveErrorCount, adminConfig.ErrorBanThreshold)
-		return tm.DisableToken(id)
+	if stats != nil && stats.ConsecutiveErrorCount >= adminConfig.ErrorBanThreshold && tm.banConfig().ErrorBan {
+		tokenLog.Warn("Consecutive error threshold reached, banning token", "token_id", id,
+			"errors", stats.ConsecutiveErrorCount, "threshold", adminConfig.ErrorBanThreshold)
+		return tm.banToken(id, models.BanReasonErrors, map[string]interface{}{"consecutive_errors": stats.ConsecutiveErrorCount})
 	}
 
 	return nil
@@ -349,52 +584,124 @@ func (tm *TokenManager) RecordSuccess(id int64) error {
 	return tm.db.ResetErrorCount(id)
 }
 
-// BanTokenFor429 bans token due to 429 error
+// BanTokenFor429 bans token due to 429 error; with rate_limit_ban off the
+// 429 counts as an error instead
 func (tm *TokenManager) BanTokenFor429(id int64) error {
-	log.Printf("[429_BAN] Banning Token %d (reason: 429 Rate Limit)", id)
-	return tm.db.UpdateToken(id, map[string]interface{}{
+	if !tm.banConfig().RateLimitBan {
+		return tm.RecordError(id)
+	}
+	tokenLog.Warn("Banning token after 429", "token_id", id)
+	return tm.banToken(id, models.BanReasonRateLimit, nil)
+}
+
+// BanTokenForQuota bans a token whose daily quota is used up until the
+// quota resets
+func (tm *TokenManager) BanTokenForQuota(id int64) error {
+	tokenLog.Warn("Banning token until its quota resets", "token_id", id)
+	return tm.banToken(id, models.BanReasonQuota, nil)
+}
+
+// rejectedATWindow is how long after refreshing a rejected AT another
+// rejection is blamed on the session rather than the AT
+const rejectedATWindow = 10 * time.Minute
+
+// RefreshRejectedAT refreshes the AT of a token the upstream rejected with a
+// 401 or 403, and reports whether it got a new one. The AT may have been
+// revoked before it expired; a token rejected again within rejectedATWindow
+// is not refreshed, so a dead session still gets banned.
+func (tm *TokenManager) RefreshRejectedAT(id int64) bool {
+	now := time.Now()
+	if last, ok := tm.rejectedAt.Load(id); ok && now.Sub(last.(time.Time)) < rejectedATWindow {
+		return false
+	}
+	tm.rejectedAt.Store(id, now)
+	refreshed, err := tm.refreshATInternal(id)
+	return err == nil && refreshed
+}
+
+// DeactivateForRelogin disables a token whose session the upstream rejected;
+// it stays disabled until an admin enables it, after logging it in again
+func (tm *TokenManager) DeactivateForRelogin(id int64) error {
+	tokenLog.Warn("Upstream rejected token session, re-login required", "token_id", id)
+	return tm.banToken(id, models.BanReasonRelogin, nil)
+}
+
+// banToken disables a token for reason; AutoUnbanTokens lifts the ban once
+// the reason's ban duration passed
+func (tm *TokenManager) banToken(id int64, reason string, details map[string]interface{}) error {
+	if err := tm.db.UpdateToken(id, map[string]interface{}{
 		"is_active":  false,
-		"ban_reason": "429_rate_limit",
+		"ban_reason": reason,
 		"banned_at":  time.Now().UTC(),
-	})
+	}); err != nil {
+		return err
+	}
+	event := map[string]interface{}{"token_id": id, "reason": reason}
+	for k, v := range details {
+		event[k] = v
+	}
+	tm.events.Publish(EventTokenBanned, event)
+	return nil
 }
 
-// AutoUnban429Tokens automatically unbans 429-banned tokens after 12 hours
-func (tm *TokenManager) AutoUnban429Tokens() error {
+// AutoUnbanTokens enables banned tokens whose ban duration passed, and ones
+// banned for their quota once it reset and came back
+func (tm *TokenManager) AutoUnbanTokens() error {
 	tokens, err := tm.db.GetAllTokens()
 	if err != nil {
 		return err
 	}
 
+	cfg := tm.banConfig()
+	durations := map[string]time.Duration{
+		models.BanReasonRateLimit: time.Duration(cfg.RateLimitBanMinutes) * time.Minute,
+		models.BanReasonErrors:    time.Duration(cfg.ErrorBanMinutes) * time.Minute,
+	}
 	now := time.Now().UTC()
 
 	for _, token := range tokens {
-		if token.BanReason != "429_rate_limit" || token.IsActive || token.BannedAt == nil {
+		if token.IsActive || token.BannedAt == nil {
+			continue
+		}
+		// Fresh credits decide; getting them refreshes the AT, so an expired
+		// one does not keep the token banned
+		if token.BanReason == models.BanReasonQuota {
+			if !now.Before(nextQuotaReset(*token.BannedAt, cfg)) {
+				tm.liftQuotaBan(token)
+			}
+			continue
+		}
+		duration := durations[token.BanReason]
+		if duration <= 0 {
 			continue
 		}
 
 		// Check if token is expired
 		if token.ATExpires != nil && token.ATExpires.Before(now) {
-			log.Printf("[AUTO_UNBAN] Token %d expired, skipping", token.ID)
+			tokenLog.Debug("Banned token expired, not unbanning", "token_id", token.ID)
 			continue
 		}
 
-		// Check if 12 hours have passed
-		timeSinceBan := now.Sub(*token.BannedAt)
-		if timeSinceBan >= 12*time.Hour {
-			log.Printf("[AUTO_UNBAN] Unbanning Token %d (banned %.1f hours ago)", token.ID, timeSinceBan.Hours())
-			tm.db.UpdateToken(token.ID, map[string]interface{}{
-				"is_active":  true,
-				"ban_reason": nil,
-				"banned_at":  nil,
-			})
-			tm.db.ResetErrorCount(token.ID)
+		if now.Sub(*token.BannedAt) >= duration {
+			tm.unbanToken(token)
 		}
 	}
 
 	return nil
 }
 
+// unbanToken lifts a token's ban
+func (tm *TokenManager) unbanToken(token *models.Token) {
+	tokenLog.Info("Unbanning token", "token_id", token.ID, "reason", token.BanReason, "banned_for", time.Since(*token.BannedAt).Round(time.Minute))
+	tm.db.UpdateToken(token.ID, map[string]interface{}{
+		"is_active":  true,
+		"ban_reason": nil,
+		"banned_at":  nil,
+	})
+	tm.db.ResetErrorCount(token.ID)
+	tm.publishTokenUpdate(token.ID, "unbanned")
+}
+
 // RefreshCredits refreshes token credits
 func (tm *TokenManager) RefreshCredits(id int64) (int, error) {
 	token, err := tm.db.GetToken(id)
@@ -423,6 +730,11 @@ func (tm *TokenManager) RefreshCredits(id int64) (int, error) {
 	return credits, nil
 }
 
+// GetTokensWithStats returns all tokens together with their statistics
+func (tm *TokenManager) GetTokensWithStats() ([]*models.TokenWithStats, error) {
+	return tm.db.GetTokensWithStats()
+}
+
 // GetTokenStats returns token statistics
 func (tm *TokenManager) GetTokenStats(id int64) (*models.TokenStats, error) {
 	return tm.db.GetTokenStats(id)
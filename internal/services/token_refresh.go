@@ -0,0 +1,85 @@
+package services
+
+import (
+	"time"
+
+	"flow2api/internal/models"
+)
+
+const (
+	// lazyRefreshMargin is how close to expiry a request still refreshes an
+	// AT itself while scheduled refresh is on
+	lazyRefreshMargin = 5 * time.Minute
+
+	// Scheduled refreshes go easy on the upstream; no request waits on them
+	scheduledRefreshParallelism = 2
+	scheduledRefreshPace        = 500 * time.Millisecond
+)
+
+// StartATRefresh refreshes ATs ahead of expiry as the token refresh config
+// says, until the process exits. The config is read again every run and
+// when ReloadATRefresh is called.
+func (tm *TokenManager) StartATRefresh() {
+	go func() {
+		for {
+			cfg := tm.refreshConfig()
+			tm.scheduledRefresh.Store(cfg.Enabled)
+			if cfg.Enabled {
+				tm.refreshExpiring(time.Duration(cfg.BeforeExpiryMinutes) * time.Minute)
+			}
+
+			timer := time.NewTimer(time.Duration(cfg.IntervalMinutes) * time.Minute)
+			select {
+			case <-timer.C:
+			case <-tm.refreshWake:
+				timer.Stop()
+			}
+		}
+	}()
+}
+
+// ReloadATRefresh applies a changed token refresh config right away
+func (tm *TokenManager) ReloadATRefresh() {
+	select {
+	case tm.refreshWake <- struct{}{}:
+	default:
+	}
+}
+
+// refreshConfig returns the token refresh config, or the defaults when it
+// cannot be read
+func (tm *TokenManager) refreshConfig() *models.TokenRefreshConfig {
+	cfg, err := tm.db.GetTokenRefreshConfig()
+	if err != nil {
+		tokenLog.Error("Failed to load token refresh config", "error", err)
+		return &models.TokenRefreshConfig{Enabled: true, IntervalMinutes: 10, BeforeExpiryMinutes: 60}
+	}
+	return cfg
+}
+
+// refreshExpiring refreshes the ATs of active tokens that are missing or
+// expire within before
+func (tm *TokenManager) refreshExpiring(before time.Duration) {
+	tokens, err := tm.db.GetActiveTokens()
+	if err != nil {
+		tokenLog.Error("Scheduled AT refresh failed", "error", err)
+		return
+	}
+
+	deadline := time.Now().Add(before)
+	var due []*models.Token
+	for _, token := range tokens {
+		if token.ST == "" {
+			continue
+		}
+		if token.AT == "" || token.ATExpires == nil || token.ATExpires.Before(deadline) {
+			due = append(due, token)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	tokenLog.Info("Refreshing ATs ahead of expiry", "count", len(due), "before_expiry", before)
+	tm.RefreshAllAT(due, scheduledRefreshParallelism, scheduledRefreshPace)
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238), the defaults every authenticator app supports
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // steps accepted either side of now, for clock drift
+
+	// RecoveryCodeCount is how many recovery codes enrollment hands out
+	RecoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new base32 shared secret
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth:// URI an authenticator app enrolls from,
+// usually shown as a QR code
+func TOTPURI(secret, account, issuer string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// VerifyTOTP checks code against secret around now and returns the time step
+// it matched. Steps up to lastStep were used before and are refused, so a
+// code cannot be replayed.
+func VerifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpCode(key []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// GenerateRecoveryCodes returns RecoveryCodeCount one-time codes like
+// 3f9a-c2e1-77b0 and the hashes to store in their place
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		raw := make([]byte, 6)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		s := hex.EncodeToString(raw)
+		code := s[0:4] + "-" + s[4:8] + "-" + s[8:12]
+		salt := make([]byte, recoverySaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hex.EncodeToString(salt)+":"+hashRecoveryCode(salt, code))
+	}
+	return codes, hashes, nil
+}
+
+// recoverySaltSize is the length of the random salt stored with each
+// recovery code hash, so equal codes never hash alike and no table of
+// precomputed hashes applies
+const recoverySaltSize = 16
+
+// UseRecoveryCode looks code up among the stored "salt:hash" entries and
+// returns the hashes left once it is spent
+func UseRecoveryCode(hashes []string, code string) ([]string, bool) {
+	for i, stored := range hashes {
+		s, hash, ok := strings.Cut(stored, ":")
+		if !ok {
+			continue
+		}
+		salt, err := hex.DecodeString(s)
+		if err != nil || len(salt) == 0 {
+			continue
+		}
+		if hmac.Equal([]byte(hash), []byte(hashRecoveryCode(salt, code))) {
+			return append(append([]string{}, hashes[:i]...), hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
+
+// hashRecoveryCode ignores case, spaces and dashes, so codes can be typed loosely
+func hashRecoveryCode(salt []byte, code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	sum := sha256.Sum256(append(append([]byte{}, salt...), normalized...))
+	return hex.EncodeToString(sum[:])
+}
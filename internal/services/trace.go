@@ -0,0 +1,133 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"flow2api/internal/client"
+	"flow2api/internal/config"
+	"flow2api/internal/models"
+)
+
+// TraceHeader forces trace capture for a single request regardless of duration
+const TraceHeader = "X-Flow2API-Trace"
+
+// RequestTrace records phase timings of one generation for slow-request postmortems
+type RequestTrace struct {
+	TaskID          string       `json:"task_id,omitempty"`
+	Model           string       `json:"model"`
+	TokenID         int64        `json:"token_id,omitempty"`
+	CaptchaProvider string       `json:"captcha_provider"`
+	PollCount       int          `json:"poll_count"`
+	Phases          []TracePhase `json:"phases"`
+	Error           string       `json:"error,omitempty"`
+
+	choice     *models.TokenChoice
+	forced     bool
+	start      time.Time
+	phase      string
+	phaseStart time.Time
+	mu         sync.Mutex   // guards TaskID, TokenID, choice and phase, which state dumps read
+	logger     *slog.Logger // carries the request, model, token and task IDs known so far
+}
+
+// TracePhase is the time spent in one step of a generation
+type TracePhase struct {
+	Name       string `json:"name"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+func newRequestTrace(model string, forced bool, logger *slog.Logger) *RequestTrace {
+	now := time.Now()
+	return &RequestTrace{
+		Model:           model,
+		CaptchaProvider: config.Get().Captcha.CaptchaMethod,
+		Phases:          []TracePhase{},
+		forced:          forced,
+		logger:          logger,
+		start:           now,
+		phaseStart:      now,
+	}
+}
+
+// Mark ends the current phase and starts the named one
+func (t *RequestTrace) Mark(phase string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if t.phase != "" {
+		t.Phases = append(t.Phases, TracePhase{Name: t.phase, DurationMs: now.Sub(t.phaseStart).Milliseconds()})
+	}
+	t.phase = phase
+	t.phaseStart = now
+}
+
+func (t *RequestTrace) setTask(taskID string) {
+	t.mu.Lock()
+	t.TaskID = taskID
+	t.logger = t.logger.With("task_id", taskID)
+	t.mu.Unlock()
+}
+
+func (t *RequestTrace) setToken(tokenID int64, choice *models.TokenChoice) {
+	t.mu.Lock()
+	t.TokenID = tokenID
+	t.choice = choice
+	t.logger = t.logger.With("token_id", tokenID)
+	t.mu.Unlock()
+}
+
+// current reports the task, token and phase of a running generation
+func (t *RequestTrace) current() (taskID string, tokenID int64, phase string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.TaskID, t.TokenID, t.phase
+}
+
+func (t *RequestTrace) finish() time.Duration {
+	t.Mark("")
+	return time.Since(t.start)
+}
+
+// recordRequest writes the request log entry, attaching the trace when the
+// request was slow, tracing was requested, or debug logging is on
+func (gh *GenerationHandler) recordRequest(trace *RequestTrace, generationType string, genErr error) {
+	elapsed := trace.finish()
+
+	statusCode := 200
+	if genErr != nil {
+		trace.Error = genErr.Error()
+		statusCode = 500
+		var upstream *client.UpstreamError
+		if errors.As(genErr, &upstream) {
+			statusCode = upstream.StatusCode
+		}
+	}
+
+	entry := &models.RequestLog{
+		TaskID:     trace.TaskID,
+		TokenID:    trace.TokenID,
+		Operation:  "generate_" + generationType,
+		StatusCode: statusCode,
+		Duration:   elapsed.Seconds(),
+		Selection:  trace.choice,
+	}
+
+	cfg := config.Get()
+	threshold := time.Duration(cfg.Debug.SlowRequestThreshold) * time.Second
+	slow := threshold > 0 && elapsed >= threshold
+	if slow || trace.forced || cfg.Debug.Enabled {
+		data, _ := json.Marshal(trace)
+		entry.Trace = data
+	}
+	if slow {
+		trace.logger.Warn("Slow request", "duration", elapsed.Round(time.Millisecond), "trace", string(entry.Trace))
+	}
+
+	if err := gh.db.AddRequestLog(entry); err != nil {
+		trace.logger.Error("Failed to record request log", "error", err)
+	}
+}
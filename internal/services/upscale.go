@@ -0,0 +1,211 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/imageproc"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+	"flow2api/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+var upscaleLog = logging.Component("upscale")
+
+// UpscaleModel is the model name upscale tasks are recorded under, and the
+// one API key allowlists must permit
+const UpscaleModel = "flow-upscale"
+
+// Upscale target resolutions accepted by Flow
+var upscaleResolutions = map[string]string{
+	"2k": "UPSAMPLE_IMAGE_RESOLUTION_2K",
+	"4k": "UPSAMPLE_IMAGE_RESOLUTION_4K",
+}
+
+// UpscaleRequest represents an image upscale request from the API layer
+type UpscaleRequest struct {
+	RequestID    string // HTTP request ID, for log correlation
+	Image        []byte // uploaded before upscaling when set
+	MediaID      string // upstream mediaGenerationId of a prior result
+	TaskID       string // prior generation task whose result should be upscaled
+	Resolution   string // 2k or 4k
+	AspectRatio  string // normalized aspect ratio of an uploaded image
+	KeyID        string
+	TokenGroupID int64 // token group bound to the calling key
+}
+
+// UpscaleResult is the outcome of an upscale request
+type UpscaleResult struct {
+	TaskID string
+	URL    string
+	Image  []byte
+}
+
+// HandleUpscale upsamples an image through Flow and stores the result
+func (gh *GenerationHandler) HandleUpscale(req *UpscaleRequest) (res *UpscaleResult, err error) {
+	taskID := uuid.New().String()
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, gh.recoverGeneration(r, req.RequestID, taskID, nil)
+		}
+	}()
+	if req.Resolution == "" {
+		req.Resolution = "4k"
+	}
+	resolution, ok := upscaleResolutions[req.Resolution]
+	if !ok {
+		return nil, fmt.Errorf("unsupported resolution: %s", req.Resolution)
+	}
+
+	mediaID := req.MediaID
+	var token *models.Token
+
+	// A prior task pins both the media and the account that owns it
+	if req.TaskID != "" {
+		prior, err := gh.db.GetTask(req.TaskID)
+		if err != nil {
+			return nil, err
+		}
+		if prior == nil || prior.MediaID == "" {
+			return nil, fmt.Errorf("task %s has no upscalable image", req.TaskID)
+		}
+		mediaID = prior.MediaID
+		token, err = gh.tokenManager.GetToken(prior.TokenID)
+		if err != nil || token == nil || !token.IsActive {
+			return nil, fmt.Errorf("token for task %s is no longer available", req.TaskID)
+		}
+	}
+
+	if mediaID == "" && len(req.Image) == 0 {
+		return nil, fmt.Errorf("image, media_id or task_id is required")
+	}
+
+	// Lease the slot before the AT and project checks, in the same step as
+	// selection when the token is not fixed by the prior task
+	if token == nil {
+		var err error
+		token, _, err = gh.loadBalancer.AcquireToken(true, false, "", StrategyScore, req.TokenGroupID, taskID, slotTTL(false))
+		if err != nil || token == nil {
+			return nil, fmt.Errorf(gh.getNoTokenErrorMessage("image"))
+		}
+	} else if !gh.concurrencyManager.AcquireImage(token.ID, taskID, slotTTL(false)) {
+		return nil, fmt.Errorf("Image concurrency limit reached")
+	}
+	defer gh.concurrencyManager.ReleaseImage(token.ID, taskID)
+
+	if valid, err := gh.tokenManager.IsATValid(token.ID); !valid || err != nil {
+		return nil, fmt.Errorf("Token AT invalid or refresh failed")
+	}
+	token, _ = gh.tokenManager.GetToken(token.ID)
+
+	projectID, err := gh.tokenManager.EnsureProjectExists(token.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure project: %w", err)
+	}
+
+	task := &models.Task{
+		TaskID:  taskID,
+		TokenID: token.ID,
+		Model:   UpscaleModel,
+		Prompt:  "",
+		Status:  "processing",
+		Params: &models.TaskParams{
+			Model:       UpscaleModel,
+			Type:        "upscale",
+			AspectRatio: resolution,
+			ImageCount:  1, // one image is upscaled
+			KeyID:       req.KeyID,
+		},
+	}
+	logger := upscaleLog.With("request_id", req.RequestID, "task_id", task.TaskID, "token_id", token.ID)
+	if _, err := gh.db.CreateTask(task); err != nil {
+		logger.Error("Failed to record task", "error", err)
+	}
+
+	uploadAspect, ok := models.FlowAspectRatio("image", req.AspectRatio)
+	if !ok {
+		uploadAspect = "IMAGE_ASPECT_RATIO_LANDSCAPE"
+	}
+
+	logger.Info("Upscale started", "media_id", mediaID, "resolution", resolution)
+	result, err := gh.upscale(task, token, projectID, mediaID, req.Image, uploadAspect, resolution)
+	if err != nil {
+		logger.Error("Upscale failed", "error", err)
+		gh.db.UpdateTask(task.TaskID, map[string]interface{}{
+			"status":        "failed",
+			"error_message": err.Error(),
+			"completed_at":  time.Now(),
+		})
+		gh.blameToken(token.ID, err, logger)
+		return nil, err
+	}
+	result.TaskID = task.TaskID
+
+	gh.db.UpdateTask(task.TaskID, map[string]interface{}{
+		"status":       "completed",
+		"progress":     100,
+		"result_urls":  []string{result.URL},
+		"completed_at": time.Now(),
+	})
+	gh.tokenManager.RecordUsage(token.ID, false)
+	gh.tokenManager.RecordSuccess(token.ID)
+
+	result.URL = storage.SignURL(result.URL)
+	return result, nil
+}
+
+func (gh *GenerationHandler) upscale(task *models.Task, token *models.Token, projectID, mediaID string, image []byte, aspectRatio, resolution string) (*UpscaleResult, error) {
+	if mediaID == "" {
+		// Upright and without metadata, but at full size
+		if prepared, err := imageproc.Prepare(image, imageproc.PrepareOptions{}); err == nil {
+			image = prepared
+		}
+		uploaded, err := gh.uploadImage(context.Background(), token.AT, image, aspectRatio)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload image: %w", err)
+		}
+		mediaID = uploaded
+	}
+
+	// Not retried: an upscale is charged like a generation
+	result, err := gh.flowClient.UpscaleImage(token.AT, projectID, mediaID, resolution)
+	if err != nil {
+		return nil, fmt.Errorf("upscale failed: %w", err)
+	}
+
+	encoded, _ := result["encodedImage"].(string)
+	if encoded == "" {
+		return nil, fmt.Errorf("empty upscale result")
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upscale result: %w", err)
+	}
+
+	cfg := config.Get()
+	if stampsMedia(cfg, "image") {
+		if data, err = watermarkImage(data, cfg.Watermark); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrWatermark, err)
+		}
+	}
+	if cfg.Provenance.Enabled {
+		if embedded, err := imageproc.EmbedProvenance(data, provenanceOf(cfg, task)); err == nil {
+			data = embedded
+		} else {
+			upscaleLog.Warn("Failed to embed provenance", "task_id", task.TaskID, "error", err)
+		}
+	}
+
+	url, err := gh.saveMedia(bytes.NewReader(data), int64(len(data)), ".jpg", "image/jpeg", "image")
+	if err != nil {
+		return nil, fmt.Errorf("failed to store upscaled image: %w", err)
+	}
+
+	return &UpscaleResult{URL: url, Image: data}, nil
+}
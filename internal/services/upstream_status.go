@@ -0,0 +1,110 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"flow2api/internal/models"
+)
+
+// maxUpstreamString is the longest string kept from an upstream payload;
+// longer ones are usually inline media
+const maxUpstreamString = 512
+
+// sensitiveUpstreamKeys mark fields whose values are masked when stored
+var sensitiveUpstreamKeys = []string{"token", "secret", "credential", "signature", "cookie", "authorization"}
+
+// sanitizeUpstream copies an upstream payload for storage: URLs lose their
+// signed query strings, credential-like fields are masked, prompts are
+// omitted and long strings are cut
+func sanitizeUpstream(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			lower := strings.ToLower(k)
+			switch {
+			case strings.Contains(lower, "prompt"):
+				out[k] = "[omitted]"
+			case containsAny(lower, sensitiveUpstreamKeys):
+				out[k] = "[redacted]"
+			default:
+				out[k] = sanitizeUpstream(item)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = sanitizeUpstream(item)
+		}
+		return out
+	case string:
+		if strings.HasPrefix(val, "http://") || strings.HasPrefix(val, "https://") {
+			if i := strings.IndexAny(val, "?#"); i >= 0 {
+				val = val[:i]
+			}
+		}
+		if len(val) > maxUpstreamString {
+			return fmt.Sprintf("%s... (%d bytes)", strings.ToValidUTF8(val[:maxUpstreamString], ""), len(val))
+		}
+		return val
+	}
+	return v
+}
+
+func containsAny(s string, subs []string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamSaveInterval is how often an unchanged status is written anyway,
+// so the task's updated_at shows the stuck task watchdog it is still polled
+const upstreamSaveInterval = time.Minute
+
+// upstreamTracker keeps the last status check of a video task. It is written
+// to the task when the status changes rather than on every poll.
+type upstreamTracker struct {
+	gh      *GenerationHandler
+	taskID  string
+	status  models.UpstreamStatus
+	savedAt time.Time
+}
+
+// record notes a status check; err is set when the check itself failed
+func (t *upstreamTracker) record(attempt int, status string, err error, payload map[string]interface{}) {
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	changed := t.status.Attempt == 0 || status != t.status.Status || errMsg != t.status.Error
+	if changed {
+		t.status.SinceAttempt = attempt
+	}
+	t.status.Status = status
+	t.status.Error = errMsg
+	t.status.Attempt = attempt
+	t.status.CheckedAt = time.Now().UTC()
+	t.status.Payload = nil
+	if payload != nil {
+		t.status.Payload, _ = sanitizeUpstream(payload).(map[string]interface{})
+	}
+	if changed || time.Since(t.savedAt) >= upstreamSaveInterval {
+		t.save()
+	}
+}
+
+// save writes the last check to the task
+func (t *upstreamTracker) save() {
+	if t.status.Attempt == 0 {
+		return
+	}
+	status := t.status
+	t.savedAt = time.Now()
+	t.gh.db.UpdateTask(t.taskID, map[string]interface{}{"upstream_status": &status})
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+	"os/exec"
+	"time"
+
+	"flow2api/internal/config"
+	"flow2api/internal/imageproc"
+)
+
+// ffmpegTimeout bounds stamping one video
+const ffmpegTimeout = 5 * time.Minute
+
+// videoTextWidth is about how wide text marks are rendered for videos;
+// ffmpeg scales them to the video
+const videoTextWidth = 1024
+
+// ErrWatermark marks a result that could not be stamped. It is not served
+// unlabeled, and the token that generated it is not to blame.
+var ErrWatermark = errors.New("watermark failed")
+
+// stampsMedia reports whether results of mediaType are watermarked
+func stampsMedia(cfg *config.Config, mediaType string) bool {
+	w := cfg.Watermark
+	return w.Enabled && (mediaType == "image" && w.Images || mediaType == "video" && w.Videos)
+}
+
+// watermarkMark returns the logo, or the text rendered about textWidth wide
+func watermarkMark(w config.WatermarkConfig, textWidth int) (image.Image, error) {
+	if w.Logo == "" {
+		base := imageproc.TextMark(w.Text, 1)
+		return imageproc.TextMark(w.Text, textWidth/base.Bounds().Dx()), nil
+	}
+	f, err := os.Open(w.Logo)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	logo, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("logo %s: %w", w.Logo, err)
+	}
+	return logo, nil
+}
+
+// watermarkImage stamps an image; PNG stays PNG, other formats become JPEG
+func watermarkImage(data []byte, w config.WatermarkConfig) ([]byte, error) {
+	mark, err := watermarkMark(w, 0)
+	if err != nil {
+		return nil, err
+	}
+	return imageproc.Watermark(data, mark, imageproc.WatermarkOptions{Position: w.Position, Opacity: w.Opacity, Scale: w.Scale})
+}
+
+// watermarkFile stamps the downloaded result at path in place and returns
+// its format afterwards
+func watermarkFile(path string, format mediaFormat, mediaType string, w config.WatermarkConfig) (mediaFormat, error) {
+	if mediaType == "video" {
+		return format, watermarkVideo(path, w)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return format, err
+	}
+	stamped, err := watermarkImage(data, w)
+	if err != nil {
+		return format, err
+	}
+	if format.ext != ".png" {
+		format = mediaFormat{".jpg", "image/jpeg"}
+	}
+	return format, os.WriteFile(path, stamped, 0600)
+}
+
+// watermarkVideo overlays the mark on a video with ffmpeg; the audio is
+// copied as it is
+func watermarkVideo(path string, w config.WatermarkConfig) error {
+	mark, err := watermarkMark(w, videoTextWidth)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, mark); err != nil {
+		return err
+	}
+	markPath, outPath := path+".mark.png", path+".stamped.mp4"
+	defer os.Remove(markPath)
+	defer os.Remove(outPath)
+	if err := os.WriteFile(markPath, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+
+	filter := fmt.Sprintf("[1:v][0:v]scale2ref=w='main_w*%g':h='ow/a'[mark][base];"+
+		"[mark]format=rgba,colorchannelmixer=aa=%g[faded];[base][faded]overlay=%s[out]",
+		w.Scale, w.Opacity, overlayPosition(w.Position))
+
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, w.FFmpeg, "-v", "error", "-y", "-i", path, "-i", markPath,
+		"-filter_complex", filter, "-map", "[out]", "-map", "0:a?", "-c:a", "copy",
+		"-pix_fmt", "yuv420p", "-movflags", "+faststart", outPath).CombinedOutput()
+	if err != nil {
+		reason := string(bytes.TrimSpace(out))
+		if reason == "" {
+			reason = err.Error()
+		}
+		return fmt.Errorf("ffmpeg: %s", truncate(reason, 200))
+	}
+	return os.Rename(outPath, path)
+}
+
+// overlayPosition is the ffmpeg overlay placement matching imageproc.Placement
+func overlayPosition(position string) string {
+	const margin = "min(W,H)/50"
+	left, top := margin, margin
+	right, bottom := "W-w-"+margin, "H-h-"+margin
+	switch position {
+	case "top-left":
+		return fmt.Sprintf("x='%s':y='%s'", left, top)
+	case "top-right":
+		return fmt.Sprintf("x='%s':y='%s'", right, top)
+	case "bottom-left":
+		return fmt.Sprintf("x='%s':y='%s'", left, bottom)
+	case "center":
+		return "x='(W-w)/2':y='(H-h)/2'"
+	}
+	return fmt.Sprintf("x='%s':y='%s'", right, bottom)
+}
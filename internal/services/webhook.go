@@ -0,0 +1,89 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"flow2api/internal/config"
+)
+
+// Webhook request headers. The signature is
+//
+//	sha256=hex(HMAC-SHA256(secret, timestamp + "." + nonce + "." + body))
+const (
+	WebhookTimestampHeader = "X-Flow2API-Timestamp"
+	WebhookNonceHeader     = "X-Flow2API-Nonce"
+	WebhookSignatureHeader = "X-Flow2API-Signature"
+)
+
+// signWebhook computes the signature header value for a webhook body
+func signWebhook(secret, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookVerifier checks signed inbound webhook requests and rejects replays
+type WebhookVerifier struct {
+	nonces map[string]time.Time // nonce -> expiry
+	mu     sync.Mutex
+}
+
+// NewWebhookVerifier creates a new webhook verifier
+func NewWebhookVerifier() *WebhookVerifier {
+	return &WebhookVerifier{nonces: make(map[string]time.Time)}
+}
+
+// Verify checks the timestamp window, the signature and that the nonce has not
+// been used within the window
+func (wv *WebhookVerifier) Verify(timestamp, nonce, signature string, body []byte) error {
+	cfg := config.Get()
+	if !cfg.Webhook.Enabled || cfg.Webhook.Secret == "" {
+		return fmt.Errorf("webhooks are disabled")
+	}
+	if timestamp == "" || nonce == "" || signature == "" {
+		return fmt.Errorf("missing signature headers")
+	}
+	if len(nonce) > 128 {
+		return fmt.Errorf("nonce too long")
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	tolerance := time.Duration(cfg.Webhook.Tolerance) * time.Second
+	now := time.Now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > tolerance || skew < -tolerance {
+		return fmt.Errorf("timestamp outside the allowed window")
+	}
+
+	expected := signWebhook(cfg.Webhook.Secret, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	// Only signed requests reach the nonce store, so it cannot be flooded by forgeries
+	wv.mu.Lock()
+	defer wv.mu.Unlock()
+
+	for n, expiry := range wv.nonces {
+		if now.After(expiry) {
+			delete(wv.nonces, n)
+		}
+	}
+	if _, seen := wv.nonces[nonce]; seen {
+		return fmt.Errorf("nonce already used")
+	}
+	// A nonce can be replayed only while its timestamp is valid
+	wv.nonces[nonce] = time.Unix(unix, 0).Add(tolerance)
+
+	return nil
+}
@@ -0,0 +1,329 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"flow2api/internal/config"
+	"flow2api/internal/logging"
+	"flow2api/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// ErrQueueFull is returned when a generation queue cannot take more jobs
+var ErrQueueFull = errors.New("generation queue is full, retry later")
+
+// ErrDraining is returned for new jobs once the pool drains for shutdown
+var ErrDraining = errors.New("server is shutting down, retry on another instance")
+
+// PriorityHeader set to "batch" queues a request as batch work
+const PriorityHeader = "X-Flow2API-Priority"
+
+// QueueStats describes one generation queue. Batch requests share the
+// workers minus InteractiveReserved; interactive ones may use all of them.
+type QueueStats struct {
+	Workers             int `json:"workers"`
+	Busy                int `json:"busy"`
+	Queued              int `json:"queued"`
+	InteractiveReserved int `json:"interactive_reserved"`
+	BatchBusy           int `json:"batch_busy"`
+	BatchQueued         int `json:"batch_queued"`
+}
+
+type generationJob struct {
+	req       *GenerationRequest
+	chunkChan chan<- string
+}
+
+// lane holds waiting jobs per API key and hands them out round-robin so one
+// busy key cannot starve the others
+type lane struct {
+	pending map[string][]*generationJob
+	keys    []string // keys with pending jobs, in round-robin order
+	next    int
+	size    int
+}
+
+func newLane() *lane {
+	return &lane{pending: make(map[string][]*generationJob)}
+}
+
+func (l *lane) push(job *generationJob) {
+	key := job.req.KeyID
+	if len(l.pending[key]) == 0 {
+		l.keys = append(l.keys, key)
+	}
+	l.pending[key] = append(l.pending[key], job)
+	l.size++
+}
+
+// pop takes the next key's oldest job; the lane must not be empty
+func (l *lane) pop() *generationJob {
+	if l.next >= len(l.keys) {
+		l.next = 0
+	}
+	key := l.keys[l.next]
+	job := l.pending[key][0]
+	l.pending[key] = l.pending[key][1:]
+	if len(l.pending[key]) == 0 {
+		delete(l.pending, key)
+		l.keys = append(l.keys[:l.next], l.keys[l.next+1:]...)
+	} else {
+		l.next++
+	}
+	l.size--
+	return job
+}
+
+// jobQueue feeds one generation type's workers from an interactive and a
+// batch lane. Interactive jobs go first; batch jobs only start while fewer
+// than batchSlots of them are running.
+type jobQueue struct {
+	mu          sync.Mutex
+	cond        *sync.Cond
+	interactive *lane
+	batch       *lane
+	limit       int
+	workers     int
+	busy        int
+	batchBusy   int
+}
+
+func newJobQueue(workers, limit int) *jobQueue {
+	q := &jobQueue{
+		interactive: newLane(),
+		batch:       newLane(),
+		limit:       limit,
+		workers:     workers,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// reserved is how many workers batch jobs may not use; at least one worker
+// is always left to them
+func (q *jobQueue) reserved() int {
+	n := int(math.Ceil(float64(q.workers) * config.Get().Generation.InteractiveReserve))
+	return min(max(n, 0), q.workers-1)
+}
+
+func (q *jobQueue) batchSlots() int {
+	return q.workers - q.reserved()
+}
+
+// push queues a job. queued is called with the job's queue position when it
+// cannot start right away; it runs under the lock so the job cannot start, and
+// close its channel, before the caller is notified.
+func (q *jobQueue) push(job *generationJob, queued func(position int)) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.interactive.size+q.batch.size >= q.limit {
+		return ErrQueueFull
+	}
+	if job.req.Batch {
+		q.batch.push(job)
+		if q.busy+q.interactive.size+q.batch.size > q.workers || q.batchBusy+q.batch.size > q.batchSlots() {
+			queued(q.interactive.size + q.batch.size)
+		}
+	} else {
+		q.interactive.push(job)
+		if q.busy+q.interactive.size > q.workers {
+			queued(q.interactive.size)
+		}
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// pop blocks until a job may start and takes it, preferring interactive jobs
+func (q *jobQueue) pop() *generationJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.interactive.size > 0 {
+			q.busy++
+			return q.interactive.pop()
+		}
+		if q.batch.size > 0 && q.batchBusy < q.batchSlots() {
+			q.busy++
+			q.batchBusy++
+			return q.batch.pop()
+		}
+		q.cond.Wait()
+	}
+}
+
+func (q *jobQueue) done(job *generationJob) {
+	q.mu.Lock()
+	q.busy--
+	if job.req.Batch {
+		q.batchBusy--
+		// A waiting batch job may start now
+		q.cond.Broadcast()
+	}
+	q.mu.Unlock()
+}
+
+func (q *jobQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Workers:             q.workers,
+		Busy:                q.busy,
+		Queued:              q.interactive.size + q.batch.size,
+		InteractiveReserved: q.reserved(),
+		BatchBusy:           q.batchBusy,
+		BatchQueued:         q.batch.size,
+	}
+}
+
+// WorkerPool runs generations on a fixed number of workers per generation type
+type WorkerPool struct {
+	gh     *GenerationHandler
+	queues map[string]*jobQueue
+
+	pending   map[string]string // task ID -> key ID of the tasks accepted but not yet finished
+	pendingMu sync.Mutex
+
+	draining atomic.Bool
+}
+
+// NewWorkerPool creates a worker pool and starts its workers
+func NewWorkerPool(gh *GenerationHandler, imageWorkers, videoWorkers, queueSize int) *WorkerPool {
+	wp := &WorkerPool{
+		gh: gh,
+		queues: map[string]*jobQueue{
+			"image": newJobQueue(max(imageWorkers, 1), max(queueSize, 1)),
+			"video": newJobQueue(max(videoWorkers, 1), max(queueSize, 1)),
+		},
+		pending: make(map[string]string),
+	}
+	gh.queuePreview = wp.queuePreview
+	for _, q := range wp.queues {
+		for i := 0; i < q.workers; i++ {
+			go wp.work(q)
+		}
+	}
+	return wp
+}
+
+func (wp *WorkerPool) work(q *jobQueue) {
+	for {
+		job := q.pop()
+		err := wp.gh.HandleGeneration(job.req, job.chunkChan)
+		q.done(job)
+		// A queued preview finishes the task under the same ID
+		if !errors.Is(err, errPreviewQueued) {
+			wp.setPending(job.req, false)
+		}
+	}
+}
+
+// queuePreview moves the image preview of a video request that found no
+// video token to the image queue, so it does not hold a video worker
+func (wp *WorkerPool) queuePreview(req *GenerationRequest, chunkChan chan<- string) error {
+	return wp.queues["image"].push(&generationJob{req: req, chunkChan: chunkChan}, func(position int) {
+		chunkChan <- wp.gh.createStreamChunk(fmt.Sprintf("⏳ Queued at position %d, waiting for a free worker\n", position), "", false)
+	})
+}
+
+// Submit queues a generation; chunkChan is closed when it finishes. On error
+// the job was not accepted and chunkChan is left untouched.
+func (wp *WorkerPool) Submit(req *GenerationRequest, chunkChan chan<- string) error {
+	// Availability checks do not generate and should not wait behind real work
+	if !req.Stream {
+		go wp.gh.HandleGeneration(req, chunkChan)
+		return nil
+	}
+
+	if wp.draining.Load() {
+		return ErrDraining
+	}
+
+	generationType := "image"
+	if _, modelConfig, err := models.ResolveModel(req.Model, req.AspectRatio); err == nil {
+		generationType = modelConfig.Type
+	}
+	q := wp.queues[generationType]
+
+	wp.setPending(req, true)
+	err := q.push(&generationJob{req: req, chunkChan: chunkChan}, func(position int) {
+		chunkChan <- wp.gh.createStreamChunk(fmt.Sprintf("⏳ Queued at position %d, waiting for a free worker\n", position), "", false)
+	})
+	if err != nil {
+		wp.setPending(req, false)
+		logging.Component("queue").Warn("Request rejected", "request_id", req.RequestID, "type", generationType, "key_id", req.KeyID, "error", err)
+	}
+	return err
+}
+
+func (wp *WorkerPool) setPending(req *GenerationRequest, pending bool) {
+	if req.TaskID == "" {
+		return
+	}
+	wp.pendingMu.Lock()
+	defer wp.pendingMu.Unlock()
+	if pending {
+		wp.pending[req.TaskID] = req.KeyID
+	} else {
+		delete(wp.pending, req.TaskID)
+	}
+}
+
+// Pending reports whether a task was accepted and has not finished, and the
+// key that submitted it; queued tasks have no database record yet
+func (wp *WorkerPool) Pending(taskID string) (keyID string, ok bool) {
+	wp.pendingMu.Lock()
+	defer wp.pendingMu.Unlock()
+	keyID, ok = wp.pending[taskID]
+	return keyID, ok
+}
+
+// Generate runs a generation through the pool and returns the stored result URLs
+func (wp *WorkerPool) Generate(req *GenerationRequest) (*GenerationResult, error) {
+	if req.TaskID == "" {
+		req.TaskID = uuid.New().String()
+	}
+	req.Stream = true
+
+	chunkChan := make(chan string, 100)
+	if err := wp.Submit(req, chunkChan); err != nil {
+		return nil, err
+	}
+	return wp.gh.collectResult(req, chunkChan)
+}
+
+// Drain stops the pool from accepting generations; queued and running ones
+// still complete
+func (wp *WorkerPool) Drain() {
+	wp.draining.Store(true)
+}
+
+// Draining reports whether Drain was called
+func (wp *WorkerPool) Draining() bool {
+	return wp.draining.Load()
+}
+
+// Load returns the number of running and queued generations across all queues
+func (wp *WorkerPool) Load() (running, queued int) {
+	for _, s := range wp.Stats() {
+		running += s.Busy
+		queued += s.Queued
+	}
+	return running, queued
+}
+
+// Stats returns per-type queue statistics
+func (wp *WorkerPool) Stats() map[string]QueueStats {
+	stats := make(map[string]QueueStats, len(wp.queues))
+	for generationType, q := range wp.queues {
+		stats[generationType] = q.stats()
+	}
+	return stats
+}
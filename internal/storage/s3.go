@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"flow2api/internal/config"
+)
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Backend uploads files to an S3-compatible bucket (AWS S3, Cloudflare R2, MinIO)
+type S3Backend struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	publicURL string
+	prefix    string
+	pathStyle bool
+	client    *http.Client
+}
+
+// NewS3Backend creates a new S3-compatible backend
+func NewS3Backend(cfg config.S3Config) (*S3Backend, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 endpoint and bucket are required")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("s3 access key and secret key are required")
+	}
+
+	endpoint, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", cfg.Endpoint)
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &S3Backend{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    cfg.Bucket,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		publicURL: strings.TrimRight(cfg.PublicURL, "/"),
+		prefix:    strings.Trim(cfg.Prefix, "/"),
+		pathStyle: cfg.PathStyle,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+func (b *S3Backend) Name() string {
+	return "s3"
+}
+
+func (b *S3Backend) Save(key string, r io.Reader, size int64, contentType string) (string, error) {
+	objectKey := b.objectKey(key)
+
+	req, err := http.NewRequest("PUT", b.objectURL(objectKey), r)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if err := b.do(req); err != nil {
+		return "", err
+	}
+
+	if b.publicURL != "" {
+		return b.publicURL + "/" + escapePath(objectKey), nil
+	}
+	return b.objectURL(objectKey), nil
+}
+
+func (b *S3Backend) ObjectKey(key string) string {
+	return b.objectKey(key)
+}
+
+func (b *S3Backend) Delete(objectKey string) error {
+	req, err := http.NewRequest("DELETE", b.objectURL(objectKey), nil)
+	if err != nil {
+		return err
+	}
+	return b.do(req)
+}
+
+func (b *S3Backend) do(req *http.Request) error {
+	b.sign(req, time.Now().UTC())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 %s failed: HTTP %d: %s", req.Method, resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+func (b *S3Backend) objectKey(key string) string {
+	if b.prefix == "" {
+		return key
+	}
+	return b.prefix + "/" + key
+}
+
+func (b *S3Backend) objectURL(objectKey string) string {
+	if b.pathStyle {
+		return fmt.Sprintf("%s://%s/%s/%s", b.endpoint.Scheme, b.endpoint.Host, b.bucket, escapePath(objectKey))
+	}
+	return fmt.Sprintf("%s://%s.%s/%s", b.endpoint.Scheme, b.bucket, b.endpoint.Host, escapePath(objectKey))
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request
+func (b *S3Backend) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		req.URL.Host, unsignedPayload, amzDate)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, b.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.accessKey, scope, signedHeaders, b.signature(dateStamp, stringToSign)))
+}
+
+// signature signs stringToSign with the key derived for the day
+func (b *S3Backend) signature(dateStamp, stringToSign string) string {
+	signingKey := hmacSHA256([]byte("AWS4"+b.secretKey), dateStamp)
+	signingKey = hmacSHA256(signingKey, b.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+// Presign returns a GET URL for an object of this bucket that is valid for
+// ttl without credentials (query-string Signature Version 4). URLs outside
+// the bucket, including public_url links, are returned unchanged.
+func (b *S3Backend) Presign(rawURL string, ttl time.Duration, now time.Time) (string, error) {
+	if !strings.HasPrefix(rawURL, b.objectURL("")) {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", dateStamp, b.region)
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", b.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	// S3 wants %20 rather than + in the canonical query
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + b.signature(dateStamp, stringToSign)
+	return u.String(), nil
+}
+
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"flow2api/internal/config"
+	"flow2api/internal/models"
+)
+
+// Backend stores cached media and returns the URL clients should use to fetch it.
+// ObjectKey is where Save puts key; Delete takes that object key, so files
+// are found after the settings that named them change.
+type Backend interface {
+	Name() string
+	Save(key string, r io.Reader, size int64, contentType string) (string, error)
+	ObjectKey(key string) string
+	Delete(objectKey string) error
+}
+
+// New creates the backend selected by the cache configuration
+func New(cacheDir string, cfg *config.Config) (Backend, error) {
+	switch cfg.Cache.Backend {
+	case "", "local":
+		return NewLocalBackend(cacheDir, cfg), nil
+	case "s3":
+		return NewS3Backend(cfg.Cache.S3)
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", cfg.Cache.Backend)
+	}
+}
+
+// LocalBackend writes files to the cache directory served under /tmp
+type LocalBackend struct {
+	dir string
+	cfg *config.Config
+}
+
+// NewLocalBackend creates a new local file backend
+func NewLocalBackend(dir string, cfg *config.Config) *LocalBackend {
+	os.MkdirAll(dir, 0755)
+	return &LocalBackend{dir: dir, cfg: cfg}
+}
+
+func (b *LocalBackend) Name() string {
+	return "local"
+}
+
+func (b *LocalBackend) Save(key string, r io.Reader, size int64, contentType string) (string, error) {
+	file, err := os.Create(filepath.Join(b.dir, filepath.Base(key)))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return "", err
+	}
+
+	baseURL := strings.TrimRight(b.cfg.Cache.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("http://localhost:%d", b.cfg.Server.Port)
+	}
+	return fmt.Sprintf("%s/tmp/%s", baseURL, filepath.Base(key)), nil
+}
+
+func (b *LocalBackend) ObjectKey(key string) string {
+	return filepath.Base(key)
+}
+
+func (b *LocalBackend) Delete(objectKey string) error {
+	err := os.Remove(filepath.Join(b.dir, filepath.Base(objectKey)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// S3ConfigFromDB converts the stored cache configuration into S3 settings
+func S3ConfigFromDB(c *models.CacheConfigDB) config.S3Config {
+	return config.S3Config{
+		Endpoint:  c.S3Endpoint,
+		Region:    c.S3Region,
+		Bucket:    c.S3Bucket,
+		AccessKey: c.S3AccessKey,
+		SecretKey: c.S3SecretKey,
+		PublicURL: c.S3PublicURL,
+		Prefix:    c.S3Prefix,
+		PathStyle: c.S3PathStyle,
+	}
+}
@@ -0,0 +1,233 @@
+// Package flow2api embeds the Flow2API generation service in other Go
+// programs. An Engine runs generations through the same worker pool, token
+// selection and caching as the server; token storage, balancing,
+// concurrency limits and result URL signing can be replaced through Options,
+// and hooks registered with RegisterHook run at each stage of a request.
+//
+//	cfg, err := flow2api.LoadConfig("config/setting.toml")
+//	...
+//	engine, err := flow2api.New(cfg, flow2api.Options{Balancer: myBalancer})
+//	...
+//	defer engine.Close()
+//	result, err := engine.Generate(&flow2api.GenerationRequest{Model: "gemini-2.5-flash-image", Prompt: "a lighthouse"})
+//
+// The engine reads setting.toml and the FLOW2API_* environment only; settings
+// saved in the admin panel apply to the server binary.
+package flow2api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"flow2api/internal/browser"
+	"flow2api/internal/client"
+	"flow2api/internal/config"
+	"flow2api/internal/database"
+	"flow2api/internal/models"
+	"flow2api/internal/services"
+	"flow2api/internal/storage"
+)
+
+// Types used by the service interfaces
+type (
+	Config            = config.Config
+	Token             = models.Token
+	TokenGroup        = models.TokenGroup
+	DailyUsage        = models.DailyUsage
+	PoolLoad          = services.PoolLoad
+	GenerationRequest = services.GenerationRequest
+	GenerationResult  = services.GenerationResult
+	UpscaleRequest    = services.UpscaleRequest
+	UpscaleResult     = services.UpscaleResult
+	Estimate          = services.Estimate
+	ServiceStatus     = services.ServiceStatus
+)
+
+// Request lifecycle hooks
+type (
+	Hook          = services.Hook
+	HookEvent     = services.HookEvent
+	HookRejection = services.HookRejection
+)
+
+// Hook stages
+const (
+	HookPreSelect    = services.HookPreSelect
+	HookPreSubmit    = services.HookPreSubmit
+	HookPostComplete = services.HookPostComplete
+	HookOnError      = services.HookOnError
+)
+
+// Service interfaces; see the services package for their contracts
+type (
+	// TokenManager provides tokens and records their use
+	TokenManager = services.TokenStore
+	// LoadBalancer picks the token for each generation
+	LoadBalancer = services.Balancer
+	// ConcurrencyManager bounds concurrent generations per token
+	ConcurrencyManager = services.Limiter
+	// GenerationHandler runs generations
+	GenerationHandler = services.Generator
+	// URLSigner rewrites result URLs each time they are handed out, e.g. to
+	// presign private bucket objects or add CDN auth tokens
+	URLSigner = storage.Signer
+)
+
+// SignerFunc adapts a function to URLSigner
+type SignerFunc = storage.SignerFunc
+
+// Balancing strategies understood by the default LoadBalancer
+const (
+	StrategyScore     = services.StrategyScore
+	StrategyLeastUsed = services.StrategyLeastUsed
+)
+
+// LoadConfig reads a setting.toml (config/setting.toml when path is empty),
+// applies FLOW2API_* environment overrides and validates the result
+func LoadConfig(path string) (*Config, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(browser.ValidateBrowserProxyURL); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Options replaces default services; nil fields use the built-in,
+// database-backed implementations, and cache.signing for URLSigner
+type Options struct {
+	Tokens      TokenManager
+	Balancer    LoadBalancer
+	Concurrency ConcurrencyManager
+	URLSigner   URLSigner
+}
+
+// Engine is an embedded generation service
+type Engine struct {
+	Tokens      TokenManager
+	Balancer    LoadBalancer
+	Concurrency ConcurrencyManager
+	Generator   GenerationHandler
+
+	hooks   *services.HookRegistry
+	pool    *services.WorkerPool
+	db      *database.Database
+	closers []func() error
+	stop    context.CancelFunc // ends the engine's background goroutines
+}
+
+// New opens the database at cfg.Database.Path, starts the captcha service the
+// configuration selects and wires the generation pipeline
+func New(cfg *Config, opts Options) (*Engine, error) {
+	db := database.GetInstance()
+	if err := db.Init(cfg.Database.Path); err != nil {
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	e := &Engine{db: db, stop: stop}
+	if err := services.LoadModelRegistry(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load the model registry: %w", err)
+	}
+
+	switch cfg.Captcha.CaptchaMethod {
+	case "browser":
+		captchaService := browser.GetCaptchaService()
+		if err := captchaService.Initialize(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to initialize browser captcha: %w", err)
+		}
+		e.closers = append(e.closers, captchaService.Close)
+	case "personal":
+		personalService := browser.GetPersonalCaptchaService()
+		if err := personalService.Initialize(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to initialize personal captcha: %w", err)
+		}
+		e.closers = append(e.closers, personalService.Close)
+	}
+
+	if opts.URLSigner != nil {
+		storage.SetSigner(opts.URLSigner)
+	}
+	flowClient := client.NewFlowClient(cfg.Proxy.URL)
+	events := services.NewEventBus()
+
+	e.Tokens = opts.Tokens
+	if e.Tokens == nil {
+		e.Tokens = services.NewTokenManager(db, flowClient, events)
+	}
+	e.Concurrency = opts.Concurrency
+	if e.Concurrency == nil {
+		concurrencyManager := services.NewConcurrencyManager()
+		tokens, err := e.Tokens.GetActiveTokens()
+		if err != nil {
+			e.Close()
+			return nil, fmt.Errorf("failed to load tokens: %w", err)
+		}
+		concurrencyManager.Initialize(tokens)
+		concurrencyManager.WatchTokens(ctx, e.Tokens, events)
+		e.Concurrency = concurrencyManager
+	}
+	e.Balancer = opts.Balancer
+	if e.Balancer == nil {
+		e.Balancer = services.NewLoadBalancer(e.Tokens, e.Concurrency)
+	}
+
+	generationHandler := services.NewGenerationHandler(flowClient, e.Tokens, e.Balancer, db, e.Concurrency, services.NewCanaryRouter(db), events)
+	if concurrencyManager, ok := e.Concurrency.(*services.ConcurrencyManager); ok {
+		concurrencyManager.StartReconciler(time.Minute, generationHandler.TaskFinished)
+	}
+	generationHandler.StartTaskWatchdog(time.Minute)
+	e.Generator = generationHandler
+	e.hooks = generationHandler.Hooks()
+	services.RegisterHTTPHooks(e.hooks, cfg.Hooks)
+	e.pool = services.NewWorkerPool(generationHandler, cfg.Generation.ImageWorkers, cfg.Generation.VideoWorkers, cfg.Generation.QueueSize)
+	return e, nil
+}
+
+// RegisterHook adds a hook called at stage (one of the Hook* constants).
+// Pre-stage hooks run in order and reject the request by returning an error;
+// pre-select hooks may also change the event's TokenGroupID and Strategy.
+// Post-stage hooks run in the background.
+func (e *Engine) RegisterHook(stage, name string, hook Hook) {
+	e.hooks.Register(stage, name, hook)
+}
+
+// Generate runs a generation to completion and returns its result URLs
+func (e *Engine) Generate(req *GenerationRequest) (*GenerationResult, error) {
+	return e.pool.Generate(req)
+}
+
+// Stream queues a generation and returns its chunks as OpenAI-style SSE
+// "data:" lines; the channel is closed when the generation finishes
+func (e *Engine) Stream(req *GenerationRequest) (<-chan string, error) {
+	req.Stream = true
+	chunkChan := make(chan string, 100)
+	if err := e.pool.Submit(req, chunkChan); err != nil {
+		return nil, err
+	}
+	return chunkChan, nil
+}
+
+// Close stops accepting generations and watching tokens, and releases the
+// captcha service and the database. Generations still running are abandoned.
+func (e *Engine) Close() error {
+	e.stop()
+	if e.pool != nil {
+		e.pool.Drain()
+	}
+	var firstErr error
+	for _, closeFn := range e.closers {
+		if err := closeFn(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := e.db.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}